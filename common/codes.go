@@ -175,4 +175,31 @@ var SQLcmds = map[int]string{
 	COM_SET_OPTION: "COM_SET_OPTION",
 	COM_STMT_FETCH: "COM_STMT_FETCH",
 	COM_RESET_CONNECTION: "COM_RESET_CONNECTION",
-	COM_DAEMON: "COM_DAEMON" } // 30
\ No newline at end of file
+	COM_DAEMON: "COM_DAEMON" } // 30
+
+/* ---- ERROR CODES. -----------------------------------------------------------
+* Error codes sent in ERR packets for errors detected by Hera itself, as opposed
+* to the errors coming from the database.
+*    https://dev.mysql.com/doc/refman/8.0/en/server-error-reference.html
+*    https://dev.mysql.com/doc/refman/8.0/en/client-error-reference.html
+ */
+const (
+	ER_HANDSHAKE_ERROR int = 1043
+	ER_BAD_DB_ERROR int = 1049
+	ER_EMPTY_QUERY int = 1065
+	ER_NO_SUCH_THREAD int = 1094
+	ER_KILL_DENIED_ERROR int = 1095
+	ER_UNKNOWN_ERROR int = 1105
+	ER_NOT_ALLOWED_COMMAND int = 1148
+	ER_NET_PACKET_TOO_LARGE int = 1153
+	ER_NOT_SUPPORTED_YET int = 1235
+	ER_UNKNOWN_STMT_HANDLER int = 1243
+	ER_SP_BADSELECT int = 1312
+	ER_QUERY_INTERRUPTED int = 1317
+	ER_STMT_HAS_NO_OPEN_CURSOR int = 1421
+	ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION int = 1792
+	ER_MALFORMED_PACKET int = 1835
+	CR_COMMANDS_OUT_OF_SYNC int = 2014
+	// the client error of an SSL request to a server without SSL, MySQL has no server code for it
+	ER_SERVER_NO_SSL int = 2026
+)
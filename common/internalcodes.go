@@ -23,6 +23,11 @@ const (
 	CmdEOR        = 502 // end of response
 )
 
+// ControlMsgCapabilities starts the payload of the CmdControlMsg the proxy sends to a worker before it
+// forwards the first MySQL command of a session. It is followed by the capability flags negotiated with
+// the client, in decimal, e.g. "capabilities=512". The worker doesn't respond.
+const ControlMsgCapabilities = "capabilities="
+
 // EOR codes
 const (
 	EORFree                     = 0
@@ -31,8 +36,9 @@ const (
 	EORInCursorInTransaction    = 3 /* not in transaction but not free because the cursor is open for ex */
 	EORMoreIncomingRequests     = 4 /* worker would be free, but it is not because there are more requests on the incomming buffer because
 	they were pipelined by the client */
-	EORBusyOther = 5 /* not used yet */
-	EORRestart   = 6
+	EORBusyOther                 = 5 /* not used yet */
+	EORRestart                   = 6
+	EORInSessionNotInTransaction = 7 /* not in transaction but not free because the session state, like the schema, is the client's */
 )
 
 // Reasons for stranded child
@@ -0,0 +1,168 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"strings"
+)
+
+// sqlToken is the kind of a segment of a SQL text, as split by scanSQL
+type sqlToken int
+
+const (
+	sqlCode sqlToken = iota
+	// a '...' or "..." string
+	sqlString
+	// a `...` identifier
+	sqlIdentifier
+	// a -- or # comment, up to the end of the line, or a /* */ comment
+	sqlComment
+	// a /*! */ comment, which MySQL executes, or a /*+ */ optimizer hint
+	sqlHint
+)
+
+// scanSQL splits sql into segments following the MySQL lexical rules, or the standard ones where
+// backslashes don't escape in strings, -- doesn't need a space after it and # is not a comment. It calls
+// fn for each segment in order. A string, identifier or comment which is not terminated runs to the end
+// of sql.
+func scanSQL(sql string, mysql bool, fn func(tok sqlToken, text string)) {
+	start := 0
+	emit := func(tok sqlToken, end int) {
+		if end > start {
+			fn(tok, sql[start:end])
+		}
+		start = end
+	}
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			emit(sqlCode, i)
+			end := len(sql)
+			for j := i + 1; j < len(sql); j++ {
+				if sql[j] == '\\' && c != '`' && mysql {
+					j++
+				} else if sql[j] == c {
+					// a doubled quote stands for the quote itself
+					if j+1 < len(sql) && sql[j+1] == c {
+						j++
+						continue
+					}
+					end = j + 1
+					break
+				}
+			}
+			if c == '`' {
+				emit(sqlIdentifier, end)
+			} else {
+				emit(sqlString, end)
+			}
+			i = end
+		case (c == '#' && mysql) || (c == '-' && strings.HasPrefix(sql[i:], "--") && (!mysql || i+2 == len(sql) || isSpace(sql[i+2]))):
+			emit(sqlCode, i)
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i
+			}
+			emit(sqlComment, end)
+			i = end
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			emit(sqlCode, i)
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i + 4
+			}
+			if strings.HasPrefix(sql[i:], "/*!") || strings.HasPrefix(sql[i:], "/*+") {
+				emit(sqlHint, end)
+			} else {
+				emit(sqlComment, end)
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	emit(sqlCode, len(sql))
+}
+
+// StripComments returns sql without its comments. A /* */ comment is replaced with a space so that the
+// tokens around it stay apart, a -- or # comment is removed up to the end of the line. The /*! */
+// comments MySQL executes and the /*+ */ optimizer hints are kept, as are the strings and identifiers
+// looking like comments.
+func StripComments(sql string) string {
+	var sb strings.Builder
+	scanSQL(sql, true, func(tok sqlToken, text string) {
+		if tok != sqlComment {
+			sb.WriteString(text)
+		} else if strings.HasPrefix(text, "/*") {
+			sb.WriteByte(' ')
+		}
+	})
+	return sb.String()
+}
+
+// SplitStatements splits sql into its statements, on the semicolons outside of strings, identifiers and
+// comments. The statements are trimmed and don't have the semicolon, the empty ones are dropped.
+func SplitStatements(sql string) []string {
+	var statements []string
+	var sb strings.Builder
+	add := func() {
+		if stmt := strings.TrimSpace(sb.String()); stmt != "" {
+			statements = append(statements, stmt)
+		}
+		sb.Reset()
+	}
+	scanSQL(sql, true, func(tok sqlToken, text string) {
+		if tok != sqlCode {
+			sb.WriteString(text)
+			return
+		}
+		for {
+			semi := strings.IndexByte(text, ';')
+			if semi < 0 {
+				sb.WriteString(text)
+				return
+			}
+			sb.WriteString(text[:semi])
+			add()
+			text = text[semi+1:]
+		}
+	})
+	add()
+	return statements
+}
+
+// MaskLiterals returns sql with the strings and the comments, other than the executed /*! */ comments
+// and the hints, blanked out with spaces. The result has the same length as sql, so that the matches of
+// a pattern which must only match code, like a bind name, are at the same positions in sql. With mysql
+// false sql is lexed with the standard rules, as for Oracle.
+func MaskLiterals(sql string, mysql bool) string {
+	var sb strings.Builder
+	scanSQL(sql, mysql, func(tok sqlToken, text string) {
+		if tok == sqlString || tok == sqlComment {
+			sb.WriteString(strings.Repeat(" ", len(text)))
+		} else {
+			sb.WriteString(text)
+		}
+	})
+	return sb.String()
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripComments(t *testing.T) {
+	cases := []struct {
+		sql      string
+		stripped string
+	}{
+		{"select a /* :b */ from t", "select a   from t"},
+		{"select a -- :b\nfrom t", "select a \nfrom t"},
+		{"select a # :b\nfrom t", "select a \nfrom t"},
+		{"select a--b from t", "select a--b from t"},
+		{"select ':a /* not */' from t", "select ':a /* not */' from t"},
+		{"select \"-- not\", `#not` from t", "select \"-- not\", `#not` from t"},
+		{"select 'it''s /* x */' from t", "select 'it''s /* x */' from t"},
+		{"select 'a\\' /* x */' from t", "select 'a\\' /* x */' from t"},
+		{"select /*+ BKA(t) */ a /*!50000 , b */ from t", "select /*+ BKA(t) */ a /*!50000 , b */ from t"},
+		{"select a from t /* not terminated", "select a from t  "},
+		{"select a from t --", "select a from t "},
+	}
+	for _, c := range cases {
+		stripped := StripComments(c.sql)
+		if stripped != c.stripped {
+			t.Logf("%q expected %q instead got %q", c.sql, c.stripped, stripped)
+			t.Fail()
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	cases := []struct {
+		sql        string
+		statements []string
+	}{
+		{"select 1; select 2", []string{"select 1", "select 2"}},
+		{"select 1;;\n select 2;\n", []string{"select 1", "select 2"}},
+		{"select ';'; select \";\"", []string{"select ';'", "select \";\""}},
+		{"select `a;b` from t; select 2", []string{"select `a;b` from t", "select 2"}},
+		{"select 1 /* ; */; select 2 -- ;\n", []string{"select 1 /* ; */", "select 2 -- ;"}},
+		{"select 'a\\';' ; select 2", []string{"select 'a\\';'", "select 2"}},
+		{"insert into t values ('it''s;')", []string{"insert into t values ('it''s;')"}},
+		{"  ; ", nil},
+	}
+	for _, c := range cases {
+		statements := SplitStatements(c.sql)
+		if !reflect.DeepEqual(statements, c.statements) {
+			t.Logf("%q expected %q instead got %q", c.sql, c.statements, statements)
+			t.Fail()
+		}
+	}
+}
+
+func TestMaskLiterals(t *testing.T) {
+	cases := []struct {
+		sql    string
+		masked string
+	}{
+		{"select * from t where a = ':a' and b = :b", "select * from t where a =      and b = :b"},
+		{"select * from t /* :b */ where c = :c", "select * from t          where c = :c"},
+		{"select `:a` from t -- :b", "select `:a` from t      "},
+		{"update t set a = \"x\\\":y\" where id = :id", "update t set a =         where id = :id"},
+	}
+	for _, c := range cases {
+		masked := MaskLiterals(c.sql, true)
+		if masked != c.masked {
+			t.Logf("%q expected %q instead got %q", c.sql, c.masked, masked)
+			t.Fail()
+		}
+		if len(masked) != len(c.sql) {
+			t.Log(c.sql, "masked to a different length", len(masked))
+			t.Fail()
+		}
+	}
+}
+
+func TestMaskLiteralsStandard(t *testing.T) {
+	cases := []struct {
+		sql    string
+		masked string
+	}{
+		{"select * from t where a = 'C:\\' and b = :b", "select * from t where a =       and b = :b"},
+		{"select a#b from t where c = :c--:d", "select a#b from t where c = :c    "},
+		{"select \"x:y\" from t where a = 'it''s :a'", "select       from t where a =           "},
+	}
+	for _, c := range cases {
+		masked := MaskLiterals(c.sql, false)
+		if masked != c.masked {
+			t.Logf("%q expected %q instead got %q", c.sql, c.masked, masked)
+			t.Fail()
+		}
+	}
+}
@@ -19,6 +19,7 @@ package common
 
 import (
 	"regexp"
+	"strings"
 )
 
 // SQLParser is the interface grouping SQL parsing functions.
@@ -92,3 +93,78 @@ func (parser *dummyParser) IsRead(sql string) bool {
 func (parser *dummyParser) Parse(sql string) (bool, bool) {
 	return false, false
 }
+
+var (
+	selectPrefix   = regexp.MustCompile("(?i)^\\s*(/\\*.*?\\*/\\s*)*select\\s+((distinct|distinctrow|all)\\s+)?")
+	selectAlias    = regexp.MustCompile("(?is)^(.*?)\\s+(as\\s+)?(`[^`]+`|[a-z_][a-z0-9_$]*|'[^']*'|\"[^\"]*\")$")
+	selectColumn   = regexp.MustCompile("(?i)^((`[^`]+`|[a-z_][a-z0-9_$]*)\\.)*(`[^`]+`|[a-z_][a-z0-9_$]*)$")
+	selectKeywords = map[string]bool{"from": true, "into": true, "where": true, "for": true, "limit": true, "union": true}
+)
+
+// SelectColumns returns the original names of the columns in the select list of a SELECT, in order. For
+// "select a as b, t.c, a + 1 x from t" it returns ["a", "c", ""]: an expression doesn't have an original
+// name. It returns nil if sql is not a SELECT or the select list has a "*", since then the columns are unknown.
+func SelectColumns(sql string) []string {
+	prefix := selectPrefix.FindString(sql)
+	if prefix == "" {
+		return nil
+	}
+	var items []string
+	var quote byte
+	depth := 0
+	start := len(prefix)
+	end := len(sql)
+scan:
+	for i := start; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && c == ',':
+			items = append(items, sql[start:i])
+			start = i + 1
+		case depth == 0 && isSpace(c):
+			// the select list ends with the first keyword of the next clause
+			word := i + 1
+			for word < len(sql) && isSpace(sql[word]) {
+				word++
+			}
+			wordEnd := word
+			for wordEnd < len(sql) && !isSpace(sql[wordEnd]) {
+				wordEnd++
+			}
+			if selectKeywords[strings.ToLower(sql[word:wordEnd])] {
+				end = i
+				break scan
+			}
+		}
+	}
+	items = append(items, sql[start:end])
+
+	columns := make([]string, len(items))
+	for i, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "*" || strings.HasSuffix(item, ".*") {
+			return nil
+		}
+		if m := selectAlias.FindStringSubmatch(item); m != nil {
+			item = m[1]
+		}
+		if m := selectColumn.FindStringSubmatch(item); m != nil {
+			columns[i] = strings.Trim(m[3], "`")
+		}
+	}
+	return columns
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
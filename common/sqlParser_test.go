@@ -75,3 +75,34 @@ func TestDumySQLParser(t *testing.T) {
 	}
 	t.Log("----Done TestSQLParser")
 }
+
+func TestSelectColumns(t *testing.T) {
+	cases := []struct {
+		sql     string
+		columns []string
+	}{
+		{"SELECT a AS b FROM t", []string{"a"}},
+		{"select a as b, t.c, a + 1 x, count(*) n from t where id = 1", []string{"a", "c", "", ""}},
+		{"/* hint */ select distinct `t`.`a` `b`, 'lit' from t", []string{"a", ""}},
+		{"select concat(a, ',', b) as ab, c\nfrom t", []string{"", "c"}},
+		{"select 1", []string{""}},
+		{"select * from t", nil},
+		{"select t.*, a from t", nil},
+		{"update t set a = 1", nil},
+	}
+	for _, c := range cases {
+		columns := SelectColumns(c.sql)
+		if len(columns) != len(c.columns) || (columns == nil) != (c.columns == nil) {
+			t.Log(c.sql, "expected", c.columns, "instead got", columns)
+			t.Fail()
+			continue
+		}
+		for i := range columns {
+			if columns[i] != c.columns[i] {
+				t.Log(c.sql, "expected", c.columns, "instead got", columns)
+				t.Fail()
+				break
+			}
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/paypal/hera
 
-go 1.12
+go 1.18
 
 require (
 	github.com/go-goracle/goracle v2.1.14+incompatible
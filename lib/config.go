@@ -23,6 +23,7 @@ import (
 	"sync/atomic"
 
 	"github.com/paypal/hera/config"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
 	"github.com/paypal/hera/utility/logger"
 )
 
@@ -228,6 +229,8 @@ func InitConfig() error {
 	gAppConfig.TimeSkewThresholdWarnSec = cdb.GetOrDefaultInt("time_skew_threshold_warn", 2)
 	gAppConfig.TimeSkewThresholdErrorSec = cdb.GetOrDefaultInt("time_skew_threshold_error", 15)
 	gAppConfig.StrandedWorkerTimeoutMs = cdb.GetOrDefaultInt("max_stranded_time_interval", 2000)
+	// the largest payload accepted from a MySQL client, the packets larger than this close the connection
+	mysqlpackets.MaxAllowedPacket = cdb.GetOrDefaultInt("max_allowed_packet", mysqlpackets.MAX_PACKET_SIZE)
 	gAppConfig.StateLogInterval = cdb.GetOrDefaultInt("state_log_interval", 1)
 	if gAppConfig.StateLogInterval <= 0 {
 		gAppConfig.StateLogInterval = 1
@@ -19,88 +19,192 @@ package lib
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/paypal/hera/common"
 	"github.com/paypal/hera/utility/encoding"
 	"github.com/paypal/hera/utility/encoding/mysqlpackets"
 	"io"
 	"net"
+	"sort"
 	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/paypal/hera/cal"
 	"github.com/paypal/hera/utility/encoding/netstring"
 	"github.com/paypal/hera/utility/logger"
 )
 
-var connection_id = 0
+// connectionID is the last thread id sent in the handshake. Connections are accepted concurrently,
+// so it is only accessed through nextConnectionID
+var connectionID uint32
 
-// Spawns a goroutine which blocks waiting for a message on conn. When a message is received it writes
-// to the channel and exit. It basically wrapps the net.Conn in a channel
-func wrapNewNetstring(conn net.Conn, isMySQL bool) <-chan *encoding.Packet {
-	ch := make(chan *encoding.Packet, 1)
-	go func() {
-		var ns *encoding.Packet
-		var err error
+// nextConnectionID allocates a unique thread id for a new MySQL connection. Like the MySQL server
+// the ids start at 1.
+func nextConnectionID() int {
+	return int(atomic.AddUint32(&connectionID, 1))
+}
 
-		if isMySQL {
-			ns, err = mysqlpackets.NewInitSQLPacket(conn)
+// serverCapabilities are the capability flags announced in the handshake. The handshake response is read
+// with the flags both Hera and the client support. CLIENT_TRANSACTIONS and CLIENT_LONG_FLAG
+// only change the packets of a client without CLIENT_PROTOCOL_41, which then gets the status flags in the
+// OK packets and the two bytes of flags in the column definitions. With CLIENT_MULTI_RESULTS the workers send
+// the result sets of a CALL. With CLIENT_SESSION_TRACK the OK packet of a change of schema tells the new one.
+const serverCapabilities = uint32(mysqlpackets.CLIENT_PROTOCOL_41 | mysqlpackets.CLIENT_CONNECT_ATTRS |
+	mysqlpackets.CLIENT_TRANSACTIONS | mysqlpackets.CLIENT_LONG_FLAG | mysqlpackets.CLIENT_MULTI_RESULTS |
+	mysqlpackets.CLIENT_SESSION_TRACK)
+
+// Sequence ids of the connection phase. The sequence id of the command phase starts over with each
+// command: the client sends the command with 0 and the responses follow with the next sequence ids
+const (
+	handshakeSqid         = 0 // initial handshake, sent by the server
+	handshakeResponseSqid = 1 // handshake response, sent by the client
+	handshakeOKSqid       = 2 // OK ending the connection phase
+)
 
-		} else {
-			ns, err = netstring.NewInitNetstring(conn)
-		}
-		if err != nil {
-			if err == io.EOF {
-				if logger.GetLogger().V(logger.Debug) {
-					logger.GetLogger().Log(logger.Debug, conn.RemoteAddr(), ": Connection closed (eof) ")
-				}
+// clientReadAhead is the number of messages read from the client that can wait in the channel
+// returned by wrapNewNetstring. When it is full the reader goroutine stops reading from the client
+const clientReadAhead = 8
+
+// Spawns the goroutine reading the messages from conn for the life of the connection, writing them to the
+// returned channel. It basically wrapps the net.Conn in a channel. If the decoder for isMySQL reports
+// encoding.WRONGPACKET, the message is read again with the decoder for the other protocol, which is then
+// used for the next messages. The caller can check ns.IsMySQL to find out which protocol the client speaks.
+// The channel is closed when the goroutine exits, after a read error or when done is closed. To stop a
+// goroutine blocked reading, close done and expire the read with conn.SetReadDeadline.
+func wrapNewNetstring(conn net.Conn, reader *bufio.Reader, isMySQL bool, done <-chan struct{}) <-chan *encoding.Packet {
+	ch := make(chan *encoding.Packet, clientReadAhead)
+	packager := mysqlpackets.NewClientPackager(reader, nil)
+	go func() {
+		defer close(ch)
+		for {
+			var ns *encoding.Packet
+			var err error
+
+			if isMySQL {
+				ns, err = packager.ReadPacket()
 			} else {
+				ns, err = netstring.NewInitNetstring(reader)
+			}
+			if errors.Is(err, encoding.WRONGPACKET) {
+				if logger.GetLogger().V(logger.Info) {
+					logger.GetLogger().Log(logger.Info, conn.RemoteAddr(), ": Connection handler switching protocol, was mysql:", isMySQL)
+				}
+				isMySQL = !isMySQL
+				if isMySQL {
+					ns, err = packager.ReadPacket()
+				} else {
+					ns, err = netstring.NewInitNetstring(reader)
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					if logger.GetLogger().V(logger.Debug) {
+						logger.GetLogger().Log(logger.Debug, conn.RemoteAddr(), ": Connection closed (eof) ")
+					}
+				} else if err == mysqlpackets.ErrPacketTooLarge {
+					if logger.GetLogger().V(logger.Warning) {
+						logger.GetLogger().Log(logger.Warning, conn.RemoteAddr(), ": Closing connection, packet larger than", mysqlpackets.MaxAllowedPacket)
+					}
+					evt := cal.NewCalEvent("MUX", "payload_too_large", cal.TransOK, "")
+					evt.AddDataInt("max", int64(mysqlpackets.MaxAllowedPacket))
+					evt.Completed()
+				} else {
+					if logger.GetLogger().V(logger.Info) {
+						logger.GetLogger().Log(logger.Info, conn.RemoteAddr(), ": Connection handler read error", err.Error())
+					}
+				}
+				return
+			}
+			if ns.IsMySQL && ns.Cmd == mysqlpackets.NO_CMD {
+				// zero-length MySQL packet, i.e. the terminator of a payload which is an exact multiple of
+				// MAX_PACKET_SIZE. There is no command to run, so it is not passed on
 				if logger.GetLogger().V(logger.Info) {
-					logger.GetLogger().Log(logger.Info, conn.RemoteAddr(), ": Connection handler read error", err.Error(), ns.Serialized)
+					logger.GetLogger().Log(logger.Info, conn.RemoteAddr(), ": Connection handler read empty packet, sqid", ns.Sqid)
 				}
+				continue
+			}
+			if ns.IsMySQL && mysqlpackets.TraceEnabled() {
+				logger.GetLogger().Log(logger.Info, conn.RemoteAddr(), ": trace in:", mysqlpackets.Trace(ns))
 			}
-			ch <- nil
-		} else {
 			if ns.Serialized != nil && len(ns.Serialized) > 64*1024 {
 				evt := cal.NewCalEvent("MUX", "large_payload_in", cal.TransOK, "")
 				evt.AddDataInt("len", int64(len(ns.Serialized)))
 				evt.Completed()
 			}
-			ch <- ns
+			select {
+			case ch <- ns:
+			case <-done:
+				return
+			}
 		}
-		close(ch)
 	}()
 
 	return ch
 }
 
-// sendHandshake sends a MySQLProtocol Handshakev10 to the client. Handshakev10 was chosen because
-// go-sql-driver requires CLIENT_PROTOCOL_41 compatibility.
-// https://dev.mysql.com/doc/dev/mysql-server/8.0.12/page_protocol_connection_phase_packets_protocol_handshake_v10.html
 /*=== HANDSHAKE FUNCTIONS ====================================================*/
 
-/* Sends handshake over connection. Only writes Handshakev10 packets. */
-func sendHandshake(conn net.Conn) {
-	scramble := "ham&eggs" // temporary authentication plugin data
-	pos := 0
+// scrambleLength is the length of the auth plugin data of mysql_native_password
+const scrambleLength = 20
+
+// authPluginName is the auth plugin announced with CLIENT_PLUGIN_AUTH, which the scramble is generated for
+const authPluginName = "mysql_native_password"
+
+// newScramble generates the auth plugin data of a handshake. Like the MySQL server the bytes are 7 bit and
+// neither NUL, which terminates the second part, nor '$'.
+func newScramble() []byte {
+	scramble := make([]byte, scrambleLength)
+	if _, err := rand.Read(scramble); err != nil {
+		logger.GetLogger().Log(logger.Warning, "Failed to generate the handshake scramble:", err.Error())
+	}
+	for i := range scramble {
+		scramble[i] &= 0x7f
+		if scramble[i] == 0x00 || scramble[i] == '$' {
+			scramble[i]++
+		}
+	}
+	return scramble
+}
 
-	// The max packet size is overkill.
-	writeBuf := make([]byte, mysqlpackets.MAX_PACKET_SIZE)
+// handshakeConfig is what a Handshakev10 announces to the client
+type handshakeConfig struct {
+	// the thread id of the connection
+	connID int
+	// the auth plugin data, generated with newScramble
+	scramble []byte
+	// the capability flags of the server
+	capabilities uint32
+}
+
+// encodeHandshake returns the payload of a Handshakev10 for cfg. The scramble is split in two: the first 8 bytes
+// and the rest, NUL terminated and padded to 13 bytes, after the reserved filler. With CLIENT_PLUGIN_AUTH
+// auth_plugin_data_len is the length of both parts including the NUL.
+// https://dev.mysql.com/doc/dev/mysql-server/8.0.12/page_protocol_connection_phase_packets_protocol_handshake_v10.html
+func encodeHandshake(cfg handshakeConfig) []byte {
+	scramble, cflags := cfg.scramble, cfg.capabilities
+	part2Len := len(scramble) - 8 + 1 /* NUL */
+	if part2Len < 13 {
+		part2Len = 13
+	}
+	pos := 0
+	writeBuf := make([]byte, 1+len("hera_server")+1+mysqlpackets.INT4+8+1+mysqlpackets.INT2+1+mysqlpackets.INT2+
+		mysqlpackets.INT2+1+10+part2Len+len(authPluginName)+1)
 	// protocol version
 	mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT1, 0xa, &pos)
 
 	// server version
 	mysqlpackets.WriteString(writeBuf, "hera_server", mysqlpackets.NULLSTR, &pos, 0)
 
-	cflags := uint32(mysqlpackets.CLIENT_PROTOCOL_41)
-
 	// thread id
-	mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT4, connection_id, &pos)
-	connection_id++
+	mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT4, cfg.connID, &pos)
 
 	// Write first 8 bytes of plugin provided data (scramble)
-	mysqlpackets.WriteString(writeBuf, scramble, mysqlpackets.FIXEDSTR, &pos, 8)
+	mysqlpackets.WriteString(writeBuf, string(scramble[:8]), mysqlpackets.FIXEDSTR, &pos, 8)
 
 	// filler
 	mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT1, 0x00, &pos)
@@ -118,131 +222,239 @@ func sendHandshake(conn net.Conn) {
 	mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT2, int(cflags) >> 16, &pos)
 
 	if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
-		// authin_plugin_data_len. Temp: 0xaa
-		mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT1, 0xaa, &pos)
+		// auth_plugin_data_len, both parts of the scramble and the NUL
+		mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT1, len(scramble)+1, &pos)
 	} else {
 		// 00
 		mysqlpackets.WriteFixedLenInt(writeBuf, mysqlpackets.INT1, 0x00, &pos)
 	}
-	// reserved
-	mysqlpackets.WriteString(writeBuf, strings.Repeat("0", 10), mysqlpackets.FIXEDSTR, &pos, 10)
+	// reserved, all zeros
+	pos += 10
 
-	// auth-plugin-data-part-2
-	mysqlpackets.WriteString(writeBuf, scramble, mysqlpackets.LENENCSTR, &pos, 13)
+	// auth-plugin-data-part-2, the padding is zeros as well
+	copy(writeBuf[pos:], scramble[8:])
+	pos += part2Len
 
 	if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
-		plugin_name := "temp_auth"
-		mysqlpackets.WriteString(writeBuf, plugin_name, mysqlpackets.NULLSTR, &pos, 0)
-	}
-	handshake := mysqlpackets.NewMySQLPacketFrom(0, writeBuf[0:pos])
-	_, err := conn.Write(handshake.Serialized[1:])
-	logger.GetLogger().Log(logger.Info, ": Writing handshake to MySQL client >>>", handshake.Serialized[1:])
-	if err != nil {
-		logger.GetLogger().Log(logger.Verbose, ": Failed to write handshake to MySQL client >>>", DebugString(handshake.Serialized))
+		mysqlpackets.WriteString(writeBuf, authPluginName, mysqlpackets.NULLSTR, &pos, 0)
 	}
+	return writeBuf[:pos]
 }
 
-/* READS THE HANDSHAKE RESPONSE SENT BY THE CLIENT. */
-func readHandshakeResponse(conn net.Conn) {
-
-	reader := bufio.NewReader(conn)
+// sendHandshake sends a MySQLProtocol Handshakev10 to the client. Handshakev10 was chosen because
+// go-sql-driver requires CLIENT_PROTOCOL_41 compatibility.
+/* Sends handshake over connection. Only writes Handshakev10 packets. Returns the connection id
+* sent to the client and the scramble the client answers the auth challenge with, or the error
+* writing the handshake. */
+func sendHandshake(conn net.Conn) (int, []byte, error) {
+	cfg := handshakeConfig{connID: nextConnectionID(), scramble: newScramble(), capabilities: serverCapabilities}
+	payload := encodeHandshake(cfg)
+	packager := mysqlpackets.NewClientPackager(nil, conn)
+	packager.SetSqid(handshakeSqid)
+	logger.GetLogger().Log(logger.Info, ": Writing handshake to MySQL client >>>", payload)
+	_, err := packager.WritePacket(payload)
+	return cfg.connID, cfg.scramble, err
+}
 
-	// Read in the header and sequence id of the packet.
-	a, err := reader.ReadByte()
-	b, err := reader.ReadByte()
-	d, err := reader.ReadByte()
-	length := uint32(d) << 16 | uint32(b) << 8 | uint32(a)
-
-	// Increase the sequence id by 1 because a packet was just received
-	// from the client.
-	sqid, err := reader.ReadByte()
-	sqid++
-
-	// Read in the payload.
-	packet := make([]byte, length)
-	n, err := io.ReadFull(reader, packet)
-
-	// Check that the length of the payload is correct.
-	if n != int(length) {
-		logger.GetLogger().Log(logger.Verbose,fmt.Sprintf("Expected %d bytes, read %d", length, n))
-	} else if err != nil {
-		logger.GetLogger().Log(logger.Verbose, err.Error())
-	}
+// handshakeResponse is what the mux keeps from the handshake response of a MySQL client
+type handshakeResponse struct {
+	// the connection attributes, if the client sent any
+	attrs map[string]string
+	// the largest packet the client wants to send, its max_allowed_packet. It doesn't change how
+	// the responses are split: the protocol always splits the messages in packets of
+	// mysqlpackets.MAX_PACKET_SIZE, and the client reassembles them whatever its own limit
+	maxPacketSize int
+	// the capability flags both Hera and the client support, forwarded to the workers
+	capabilities uint32
+	// the character set, the credentials, the default schema and the auth plugin sent by the client. The
+	// handshake doesn't verify the credentials
+	charset      int
+	user         string
+	authResponse []byte
+	schema       string
+	authPlugin   string
+}
 
-	pos := 0  // index tracker
-	cflags := uint32(mysqlpackets.CLIENT_PROTOCOL_41)
-	if !mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_PROTOCOL_41) {
-
-		// log : Reading HANDSHAKE_RESPONSE_320
-		// lflags := ReadFixedLenInt(packet, INT2, &pos)
-		// mpsize := ReadFixedLenInt(packet, INT3, &pos)
-		mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT2, &pos)
-		mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT3, &pos)
-
-		// Username (null-terminated string)
-		// user := ReadString(packet, NULLSTR, &pos, 0)
-		mysqlpackets.ReadString(packet, mysqlpackets.NULLSTR, &pos, 0)
-
-		if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_CONNECT_WITH_DB) {
-			// auth_response := ReadString(packet, NULLSTR, &pos, 0)
-			mysqlpackets.ReadString(packet, mysqlpackets.NULLSTR, &pos, 0)
-			// dbname := ReadString(packet, NULLSTR, &pos, 0)
-			mysqlpackets.ReadString(packet, mysqlpackets.NULLSTR, &pos, 0)
-		} else {
-			// auth_response := ReadString(packet, EOFSTR, &pos, int(packetLen) - pos)
-			mysqlpackets.ReadString(packet, mysqlpackets.EOFSTR, &pos, int(length) - pos)
-		}
-	} else {
-		// log : Reading HANDSHAKE_RESPONSE_41
+// errBadHandshake is returned decoding a handshake response shorter than its content requires
+var errBadHandshake = errors.New("Bad handshake")
 
-		// client flags
-		flags := uint32(mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT4, &pos))
-		cflags &= flags
+// errSSLRequest is returned decoding an SSL request, the short handshake response a client with CLIENT_SSL
+// sends before starting the TLS handshake. The handshake never announces CLIENT_SSL: the TLS listener
+// encrypts the connection from the first byte, and the connection can't switch to TLS after the handshake.
+var errSSLRequest = errors.New("Server doesn't support SSL")
 
-		// maximum packet size, 0xFFFFFF max
-		// mpsize := ReadFixedLenInt(packet, INT4, &pos)
-		mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT4, &pos)
+// Sizes of the SSL request, the fixed fields of the handshake response
+const (
+	sslRequest41Size  = mysqlpackets.INT4 + mysqlpackets.INT4 + mysqlpackets.INT1 + 23
+	sslRequest320Size = mysqlpackets.INT2 + mysqlpackets.INT3
+)
 
-		// character set
-		mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT1, &pos)
+// readNullTerminated reads a string<NUL> at pos, without the NUL
+func readNullTerminated(data []byte, pos *int) (string, error) {
+	end := bytes.IndexByte(data[*pos:], 0x00)
+	if end < 0 {
+		return "", errBadHandshake
+	}
+	str := string(data[*pos : *pos+end])
+	*pos += end + 1
+	return str, nil
+}
 
-		// filler string
-		mysqlpackets.ReadString(packet, mysqlpackets.FIXEDSTR, &pos, 23)
+// decodeHandshakeResponse decodes the payload of a HANDSHAKE_RESPONSE_41, or a HANDSHAKE_RESPONSE_320 from a client
+// without CLIENT_PROTOCOL_41. The fields present are the ones of the flags the client sent, the capabilities kept
+// are the ones serverCaps has too.
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse
+func decodeHandshakeResponse(packet []byte, serverCaps uint32) (*handshakeResponse, error) {
+	resp := &handshakeResponse{}
+	pos := 0
+	var err error
+	if len(packet) < mysqlpackets.INT2 {
+		return nil, errBadHandshake
+	}
+	flags := uint32(mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT2, &pos))
+	if !mysqlpackets.Supports(flags, mysqlpackets.CLIENT_PROTOCOL_41) {
+		// HANDSHAKE_RESPONSE_320: capability flags int<2>, max packet size int<3>
+		if len(packet) < mysqlpackets.INT2+mysqlpackets.INT3 {
+			return nil, errBadHandshake
+		}
+		if mysqlpackets.Supports(flags, mysqlpackets.CLIENT_SSL) && len(packet) == sslRequest320Size {
+			return nil, errSSLRequest
+		}
+		resp.capabilities = serverCaps & flags
+		resp.maxPacketSize = mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT3, &pos)
+		if resp.user, err = readNullTerminated(packet, &pos); err != nil {
+			return nil, err
+		}
+		if !mysqlpackets.Supports(flags, mysqlpackets.CLIENT_CONNECT_WITH_DB) {
+			resp.authResponse = packet[pos:]
+			return resp, nil
+		}
+		auth, err := readNullTerminated(packet, &pos)
+		if err != nil {
+			return nil, err
+		}
+		resp.authResponse = []byte(auth)
+		if resp.schema, err = readNullTerminated(packet, &pos); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
 
-		// username
-		// user := ReadString(packet, NULLSTR, &pos, 0)
-		mysqlpackets.ReadString(packet, mysqlpackets.NULLSTR, &pos, 0)
+	// HANDSHAKE_RESPONSE_41: capability flags int<4>, max packet size int<4>, character set int<1>, filler
+	if len(packet) < sslRequest41Size {
+		return nil, errBadHandshake
+	}
+	pos = 0
+	flags = uint32(mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT4, &pos))
+	if mysqlpackets.Supports(flags, mysqlpackets.CLIENT_SSL) && len(packet) == sslRequest41Size {
+		return nil, errSSLRequest
+	}
+	resp.capabilities = serverCaps & flags
+	resp.maxPacketSize = mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT4, &pos)
+	resp.charset = mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT1, &pos)
+	pos += 23
 
-		if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA) {
-			// auth_response := ReadString(packet, LENENCSTR, &pos, 0)
-			mysqlpackets.ReadString(packet, mysqlpackets.LENENCSTR, &pos, 0)
-		} else {
-			// auth_response_length := ReadFixedLenInt(packet, INT1, &pos)
-			n := mysqlpackets.ReadFixedLenInt(packet, mysqlpackets.INT1, &pos)
+	if resp.user, err = readNullTerminated(packet, &pos); err != nil {
+		return nil, err
+	}
 
-			mysqlpackets.ReadString(packet, mysqlpackets.FIXEDSTR, &pos, n)
+	switch {
+	case mysqlpackets.Supports(flags, mysqlpackets.CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA):
+		if resp.authResponse, err = mysqlpackets.ReadLenEncString(packet, &pos); err != nil {
+			return nil, errBadHandshake
+		}
+	case mysqlpackets.Supports(flags, mysqlpackets.CLIENT_RESERVED2 /* CLIENT_SECURE_CONNECTION */):
+		if pos >= len(packet) || int(packet[pos]) > len(packet)-pos-1 {
+			return nil, errBadHandshake
+		}
+		n := int(packet[pos])
+		resp.authResponse = packet[pos+1 : pos+1+n]
+		pos += 1 + n
+	default:
+		auth, err := readNullTerminated(packet, &pos)
+		if err != nil {
+			return nil, err
 		}
+		resp.authResponse = []byte(auth)
+	}
 
-		if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_CONNECT_WITH_DB) {
-			// dbname := ReadString(packet, NULLSTR, &pos, 0)
-			mysqlpackets.ReadString(packet, mysqlpackets.NULLSTR, &pos, 0)
+	if mysqlpackets.Supports(flags, mysqlpackets.CLIENT_CONNECT_WITH_DB) {
+		if resp.schema, err = readNullTerminated(packet, &pos); err != nil {
+			return nil, err
 		}
+	}
 
-		if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
-			// client_plugin_name := ReadString(packet, NULLSTR, &pos, 0)
-			mysqlpackets.ReadString(packet, mysqlpackets.NULLSTR, &pos, 0)
+	if mysqlpackets.Supports(flags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
+		if resp.authPlugin, err = readNullTerminated(packet, &pos); err != nil {
+			return nil, err
 		}
+	}
 
-		if mysqlpackets.Supports(cflags, mysqlpackets.CLIENT_CONNECT_ATTRS) {
-			// key_val_len := ReadLenEncInt(packet, &pos)
-			mysqlpackets.ReadLenEncInt(packet, &pos)
+	if mysqlpackets.Supports(flags, mysqlpackets.CLIENT_CONNECT_ATTRS) && pos < len(packet) {
+		if resp.attrs, err = mysqlpackets.ReadConnectAttrs(packet, &pos); err != nil {
+			return nil, err
 		}
 	}
+	return resp, nil
+}
 
-	OK := mysqlpackets.NewMySQLPacketFrom(int(sqid), mysqlpackets.OKPacket(0, 0, uint32(0), "Welcome to Hera!"))
+// readHandshakeResponse reads the handshake response sent by the client and ends the connection phase, with an
+// OK packet, or an ERR packet if the response can't be decoded.
+func readHandshakeResponse(conn net.Conn) (*handshakeResponse, error) {
+	packet, err := mysqlpackets.NewInitSQLPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	if packet.Sqid != handshakeResponseSqid && logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, fmt.Sprintf("Expected handshake response with sequence id %d, instead got %d", handshakeResponseSqid, packet.Sqid))
+	}
+
+	resp, err := decodeHandshakeResponse(packet.Payload, serverCapabilities)
+	packager := mysqlpackets.NewClientPackager(nil, conn)
+	packager.SetSqid(handshakeOKSqid)
+	if err != nil {
+		// the flags of a response too short to decode are taken for 4.1, the client announced it
+		clientCaps := serverCapabilities
+		if len(packet.Payload) >= mysqlpackets.INT2 {
+			pos := 0
+			clientCaps &= uint32(mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos))
+		}
+		errcode := common.ER_HANDSHAKE_ERROR
+		if err == errSSLRequest {
+			errcode = common.ER_SERVER_NO_SSL
+		}
+		packager.WritePacket(mysqlpackets.ClientERRPacket(errcode, "08S01", err.Error(), clientCaps))
+		return nil, err
+	}
 
 	// Write OK packet to signify handshake response has been processed.
-	conn.Write(OK.Serialized[1:])
+	if _, err = packager.WritePacket(mysqlpackets.HandshakeOKPacket(resp.capabilities, "Welcome to Hera!")); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// logConnectAttrs logs the connection attributes of a MySQL client, like the client info of the netstring
+// clients, so that CAL shows which client library, version and program opened the connection
+func logConnectAttrs(connID int, attrs map[string]string) {
+	name := attrs["program_name"]
+	if name == "" {
+		name = "UNKNOWN"
+	}
+	et := cal.NewCalEvent(cal.EventTypeClientInfo, name, cal.TransOK, "mysql")
+	et.AddDataInt("conn_id", int64(connID))
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		et.AddDataStr(key, attrs[key])
+	}
+	et.Completed()
+	if logger.GetLogger().V(logger.Verbose) {
+		logger.GetLogger().Log(logger.Verbose, "connection", connID, "attributes", attrs)
+	}
 }
 
 
@@ -253,8 +465,9 @@ func readHandshakeResponse(conn net.Conn) {
 // with the coordinator. Then it sits in a loop for the life of the connection
 // reading data from the connection. Once a complete netstring is read, the
 // netstring object (which can contain nested sub-netstrings) is passed on
-// to the coordinator for processing
-func HandleConnection(conn net.Conn) {
+// to the coordinator for processing. Once drain is done, the handler stops reading commands and the coordinator
+// exits after answering the command in flight, recovering its worker.
+func HandleConnection(drain context.Context, conn net.Conn) {
 	//
 	// proxy just took a new connection. increment the idel connection count.
 	//
@@ -267,26 +480,65 @@ func HandleConnection(conn net.Conn) {
 		GetStateLog().PublishStateEvent(StateEvent{eType: ConnStateEvt, shardID: 0, wType: wtypeRW, instID: 0, oldCState: Idle, newCState: Close})
 	}()
 
-	//TODO: create a context with timeout
+	// the idle timeout is tracked by the coordinator, which knows if the client is in a transaction.
+	// the context is cancelled when the connection handler exits
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Right now this is set to true. Set to false if you expect non-MySQL client.
 	// Eventually, Hera should be able to detect MySQLPacket vs OCC protocol.
 	IsMySQL := true
+	connID := -1
+	handshake := &handshakeResponse{}
+
+	// the traffic of the connection is summarized in a CAL event when it closes. The counting connection
+	// is the one used from here on, by the handshake, the reader goroutine and the coordinator
+	cconn := newCountingConn(conn)
+	conn = cconn
+	commands := 0
+	defer func() {
+		logConnSummary(connID, cconn, commands)
+	}()
 
 	// For MySQL clients, the connection expects a handshake packet from the server. We'll send this outside
 	// of the coordinator in order to keep coordinator code limited to the command phase.
 
 	if IsMySQL {
 		logger.GetLogger().Log(logger.Info, "Sending handshake")
-		sendHandshake(conn)
-		logger.GetLogger().Log(logger.Info, "Reading handshake response")
-		readHandshakeResponse(conn)
+		var err error
+		connID, _, err = sendHandshake(conn)
+		if err == nil {
+			logger.GetLogger().Log(logger.Info, "Reading handshake response")
+			handshake, err = readHandshakeResponse(conn)
+		}
+		if err != nil {
+			if logger.GetLogger().V(logger.Info) {
+				logger.GetLogger().Log(logger.Info, conn.RemoteAddr(), ": Closing connection, handshake failed:", err.Error())
+			}
+			evt := cal.NewCalEvent("MUX", "bad_handshake", cal.TransOK, "")
+			evt.AddDataInt("conn_id", int64(connID))
+			evt.Completed()
+			conn.Close()
+			cancel()
+			return
+		}
+		logConnectAttrs(connID, handshake.attrs)
+		if logger.GetLogger().V(logger.Info) {
+			logger.GetLogger().Log(logger.Info, "Client max packet size", handshake.maxPacketSize)
+		}
 	}
 
 	logger.GetLogger().Log(logger.Info, "Created coordinator in connection handler")
 
 	crd := NewCoordinator(ctx, clientchannel, conn)
+	crd.connID = connID
+	crd.draining = drain.Done()
+	crd.user = handshake.user
+	crd.capabilities = handshake.capabilities
+	if connID >= 0 {
+		// KILL CONNECTION closes the connection, which ends the loop below like a COM_QUIT
+		registerConn(connID, handshake.user, func() { conn.Close() })
+		defer unregisterConn(connID)
+	}
 	go crd.Run()
 
 	//
@@ -297,10 +549,13 @@ func HandleConnection(conn net.Conn) {
 	//   detectable event in coordinator such that coordinator can clean up and exit too
 	//
 	addr := conn.RemoteAddr()
+	reader := bufio.NewReader(conn)
+	readerDone := make(chan struct{})
+	nsch := wrapNewNetstring(conn, reader, IsMySQL, readerDone)
 	for {
 		var ns *encoding.Packet
 		select {
-		case ns = <-wrapNewNetstring(conn, true): /* Set this to false if you expect a client with netstring */
+		case ns = <-nsch:
 		case timeout := <-crd.Done():
 			if logger.GetLogger().V(logger.Info) {
 				logger.GetLogger().Log(logger.Info, "Connection handler idle timeout", addr)
@@ -308,7 +563,20 @@ func HandleConnection(conn net.Conn) {
 			evt := cal.NewCalEvent("MUX", "idle_timeout_"+strconv.Itoa(int(timeout)), cal.TransOK, "")
 			evt.Completed()
 
-			conn.Close() // this forces netstring.NewNetstring() conn.Read to exit with err=read tcp 127.0.0.1:8081->127.0.0.1:57968: use of closed network connection
+			// leaving the loop closes clientchannel, like for COM_QUIT, and the coordinator
+			// recovers the worker which rollbacks any open transaction
+			ns = nil
+		case <-drain.Done():
+			if logger.GetLogger().V(logger.Info) {
+				logger.GetLogger().Log(logger.Info, "Connection handler draining", addr)
+			}
+			evt := cal.NewCalEvent("MUX", "conn_drain", cal.TransOK, "")
+			evt.AddDataInt("conn_id", int64(connID))
+			evt.Completed()
+
+			// the coordinator exits by itself after answering the command in flight, wait
+			// for it before closing the connection
+			<-crd.Exited()
 			ns = nil
 		}
 		if ns == nil {
@@ -317,7 +585,6 @@ func HandleConnection(conn net.Conn) {
 		if logger.GetLogger().V(logger.Verbose) {
 			logger.GetLogger().Log(logger.Verbose, addr, ": Connection handler read <<<", DebugString(ns.Serialized))
 		}
-
 		// Don't send COM_QUIT, COM_SLEEP queries into
 		if ns.IsMySQL && ns.Cmd == common.COM_QUIT || ns.IsMySQL && ns.Cmd == common.COM_SLEEP || ns.IsMySQL && ns.Cmd == common.COM_SHUTDOWN {
 			logger.GetLogger().Log(logger.Info, "Client closed connection")
@@ -332,10 +599,17 @@ func HandleConnection(conn net.Conn) {
 		// listening to clientchannel anymore. to avoid blocking, give clientchannel a buffer.
 		//
 		clientchannel <- ns
+		commands++
 	}
 	if logger.GetLogger().V(logger.Info) {
 		logger.GetLogger().Log(logger.Info, "======== Connection handler exits", addr)
 	}
+	// stop the reader goroutine: expire the pending read and wait for the goroutine to exit, so that
+	// nothing reads from conn once it is closed
+	close(readerDone)
+	conn.SetReadDeadline(time.Now())
+	for range nsch {
+	}
 	conn.Close()
 	conn = nil
 	cancel()
@@ -0,0 +1,903 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"github.com/paypal/hera/utility/encoding/netstring"
+)
+
+func TestWrapNewNetstring(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	nsch := wrapNewNetstring(server, bufio.NewReader(server), false, done)
+
+	// one reader goroutine reads all the messages, switching protocol as needed
+	query := mysqlpackets.NewMySQLPacketFrom(0, append([]byte{byte(common.COM_QUERY)}, []byte("select 1")...))
+	go func() {
+		client.Write([]byte("5:502 0,"))
+		client.Write(query.Serialized[encoding.IndicatorSize:])
+		client.Write(query.Serialized[encoding.IndicatorSize:])
+	}()
+	for i, isMySQL := range []bool{false, true, true} {
+		select {
+		case ns := <-nsch:
+			if ns == nil || ns.IsMySQL != isMySQL {
+				t.Fatal("message", i, "expected IsMySQL", isMySQL, "instead got", ns)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message", i, "not read")
+		}
+	}
+
+	// the reader goroutine is blocked reading, it must exit when stopped
+	close(done)
+	server.SetReadDeadline(time.Now())
+	select {
+	case ns, ok := <-nsch:
+		if ok {
+			t.Fatal("Expected the channel to be closed, instead got", ns)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader goroutine did not exit")
+	}
+}
+
+func TestConnectionIDUnique(t *testing.T) {
+	const conns = 50
+	ids := make(chan int, conns)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			sent := make(chan int, 1)
+			go func() {
+				connID, _, _ := sendHandshake(server)
+				sent <- connID
+			}()
+			handshake, err := mysqlpackets.NewInitSQLPacket(client)
+			if err != nil {
+				t.Error("reading handshake:", err.Error())
+				return
+			}
+			pos := 1 // skip the protocol version
+			mysqlpackets.ReadString(handshake.Payload, mysqlpackets.NULLSTR, &pos, 0)
+			id := mysqlpackets.ReadFixedLenInt(handshake.Payload, mysqlpackets.INT4, &pos)
+			if connID := <-sent; connID != id {
+				t.Error("handshake has thread id", id, "but sendHandshake returned", connID)
+			}
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Error("duplicate thread id", id)
+		}
+		seen[id] = true
+	}
+}
+
+// handshakeResponse41 returns the HANDSHAKE_RESPONSE_41 packet of user, without auth response
+func handshakeResponse41(user string) []byte {
+	response := make([]byte, 4+4+1+23+len(user)+1+1)
+	pos := 0
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.CLIENT_PROTOCOL_41, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.MAX_PACKET_SIZE, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0x21, &pos)
+	pos += 23
+	mysqlpackets.WriteString(response, user, mysqlpackets.NULLSTR, &pos, 0)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0, &pos)
+	return mysqlpackets.NewMySQLPacketFrom(handshakeResponseSqid, response).Serialized[encoding.IndicatorSize:]
+}
+
+func TestHandshakeOK(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write(handshakeResponse41("user"))
+	}()
+	go readHandshakeResponse(server)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ok, err := mysqlpackets.NewInitSQLPacket(client)
+	if err != nil {
+		t.Fatal("reading OK:", err.Error())
+	}
+	if ok.Cmd != 0x00 || ok.Sqid != 2 {
+		t.Fatal("Expected OK packet with sequence id 2, instead got", ok.Sqid, ok.Payload)
+	}
+	pos := 3 // header, affected rows, last insert id
+	status := mysqlpackets.ReadFixedLenInt(ok.Payload, mysqlpackets.INT2, &pos)
+	warnings := mysqlpackets.ReadFixedLenInt(ok.Payload, mysqlpackets.INT2, &pos)
+	if status != mysqlpackets.SERVER_STATUS_AUTOCOMMIT || warnings != 0 {
+		t.Log("Expected status", mysqlpackets.SERVER_STATUS_AUTOCOMMIT, "and no warnings, instead got", status, warnings)
+		t.Fail()
+	}
+	if string(ok.Payload[pos:]) != "Welcome to Hera!" {
+		t.Log("Unexpected message", ok.Payload[pos:])
+		t.Fail()
+	}
+}
+
+func TestHandshakeConnectAttrs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	attrs := map[string]string{"_client_name": "Go-MySQL-Driver", "program_name": "checkout"}
+	attrsLen := 0
+	for key, value := range attrs {
+		attrsLen += mysqlpackets.WriteLenEncString(nil, key, nil) + mysqlpackets.WriteLenEncString(nil, value, nil)
+	}
+	// HANDSHAKE_RESPONSE_41 without auth response, followed by the connection attributes
+	response := make([]byte, 4+4+1+23+len("user")+1+1+1+attrsLen)
+	pos := 0
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.CLIENT_PROTOCOL_41|mysqlpackets.CLIENT_CONNECT_ATTRS, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.MAX_PACKET_SIZE, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0x21, &pos)
+	pos += 23
+	mysqlpackets.WriteString(response, "user", mysqlpackets.NULLSTR, &pos, 0)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, attrsLen, &pos)
+	for key, value := range attrs {
+		mysqlpackets.WriteLenEncString(response, key, &pos)
+		mysqlpackets.WriteLenEncString(response, value, &pos)
+	}
+	go func() {
+		client.Write(mysqlpackets.NewMySQLPacketFrom(1, response).Serialized[encoding.IndicatorSize:])
+		mysqlpackets.NewInitSQLPacket(client)
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := readHandshakeResponse(server)
+	if err != nil {
+		t.Fatal("readHandshakeResponse:", err.Error())
+	}
+	if resp.capabilities != uint32(mysqlpackets.CLIENT_PROTOCOL_41|mysqlpackets.CLIENT_CONNECT_ATTRS) {
+		t.Log("Unexpected negotiated capabilities", resp.capabilities)
+		t.Fail()
+	}
+	got := resp.attrs
+	if len(got) != len(attrs) {
+		t.Fatal("Expected attributes", attrs, "instead got", got)
+	}
+	for key, value := range attrs {
+		if got[key] != value {
+			t.Log("Expected", key, "=", value, "instead got", got[key])
+			t.Fail()
+		}
+	}
+}
+
+func TestHandshakeMaxPacketSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// a client with a reduced max_allowed_packet
+	maxPacketSize := 1024 * 1024
+	response := make([]byte, 4+4+1+23+len("user")+1+1)
+	pos := 0
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.CLIENT_PROTOCOL_41, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, maxPacketSize, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0x21, &pos)
+	pos += 23
+	mysqlpackets.WriteString(response, "user", mysqlpackets.NULLSTR, &pos, 0)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0, &pos)
+	go func() {
+		client.Write(mysqlpackets.NewMySQLPacketFrom(1, response).Serialized[encoding.IndicatorSize:])
+		mysqlpackets.NewInitSQLPacket(client)
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := readHandshakeResponse(server)
+	if err != nil {
+		t.Fatal("readHandshakeResponse:", err.Error())
+	}
+	if resp.maxPacketSize != maxPacketSize {
+		t.Log("Expected max packet size", maxPacketSize, "instead got", resp.maxPacketSize)
+		t.Fail()
+	}
+}
+
+func TestHandshakeSequenceIds(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		sendHandshake(server)
+		readHandshakeResponse(server)
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	handshake, err := mysqlpackets.NewInitSQLPacket(client)
+	if err != nil {
+		t.Fatal("reading handshake:", err.Error())
+	}
+	if handshake.Sqid != handshakeSqid {
+		t.Log("Expected handshake with sequence id", handshakeSqid, "instead got", handshake.Sqid)
+		t.Fail()
+	}
+
+	response := make([]byte, 4+4+1+23+len("user")+1+1)
+	pos := 0
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.CLIENT_PROTOCOL_41, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.MAX_PACKET_SIZE, &pos)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0x21, &pos)
+	pos += 23
+	mysqlpackets.WriteString(response, "user", mysqlpackets.NULLSTR, &pos, 0)
+	mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT1, 0, &pos)
+	client.Write(mysqlpackets.NewMySQLPacketFrom(handshake.Sqid+1, response).Serialized[encoding.IndicatorSize:])
+
+	ok, err := mysqlpackets.NewInitSQLPacket(client)
+	if err != nil {
+		t.Fatal("reading OK:", err.Error())
+	}
+	if ok.Sqid != handshakeOKSqid {
+		t.Log("Expected OK with sequence id", handshakeOKSqid, "instead got", ok.Sqid)
+		t.Fail()
+	}
+}
+
+// clientHandshake is a Handshakev10 as decoded by a client
+type clientHandshake struct {
+	connID   int
+	cflags   uint32
+	scramble []byte
+	plugin   string
+}
+
+// decodeHandshake decodes a Handshakev10 the way go-sql-driver does: the second part of the scramble is
+// auth_plugin_data_len - 8 bytes, at least 13, of which the last one is the NUL.
+func decodeHandshake(payload []byte) (*clientHandshake, error) {
+	if len(payload) == 0 || payload[0] != 0x0a {
+		return nil, errors.New("not a Handshakev10")
+	}
+	pos := 1 + bytes.IndexByte(payload[1:], 0x00) + 1
+	if pos+mysqlpackets.INT4+8+1+mysqlpackets.INT2+1+mysqlpackets.INT2+mysqlpackets.INT2+1+10 > len(payload) {
+		return nil, errors.New("short handshake")
+	}
+	hs := &clientHandshake{connID: mysqlpackets.ReadFixedLenInt(payload, mysqlpackets.INT4, &pos)}
+	hs.scramble = append(hs.scramble, payload[pos:pos+8]...)
+	pos += 8
+	if payload[pos] != 0x00 {
+		return nil, errors.New("no filler after the first part of the scramble")
+	}
+	pos++
+	hs.cflags = uint32(mysqlpackets.ReadFixedLenInt(payload, mysqlpackets.INT2, &pos))
+	pos += 1 + mysqlpackets.INT2 // character set, status flags
+	hs.cflags |= uint32(mysqlpackets.ReadFixedLenInt(payload, mysqlpackets.INT2, &pos)) << 16
+	authDataLen := int(payload[pos])
+	pos++
+	if !bytes.Equal(payload[pos:pos+10], make([]byte, 10)) {
+		return nil, errors.New("reserved bytes are not zeros")
+	}
+	pos += 10
+	part2Len := 13
+	if mysqlpackets.Supports(hs.cflags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
+		if authDataLen == 0 {
+			return nil, errors.New("no auth_plugin_data_len with CLIENT_PLUGIN_AUTH")
+		}
+		if authDataLen-8 > part2Len {
+			part2Len = authDataLen - 8
+		}
+	} else if authDataLen != 0 {
+		return nil, errors.New("auth_plugin_data_len without CLIENT_PLUGIN_AUTH")
+	}
+	if pos+part2Len > len(payload) || payload[pos+part2Len-1] != 0x00 {
+		return nil, errors.New("second part of the scramble not NUL terminated")
+	}
+	part2 := payload[pos : pos+part2Len-1]
+	if mysqlpackets.Supports(hs.cflags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
+		part2 = part2[:authDataLen-8-1]
+	} else if end := bytes.IndexByte(part2, 0x00); end >= 0 {
+		part2 = part2[:end]
+	}
+	hs.scramble = append(hs.scramble, part2...)
+	pos += part2Len
+	if mysqlpackets.Supports(hs.cflags, mysqlpackets.CLIENT_PLUGIN_AUTH) {
+		end := bytes.IndexByte(payload[pos:], 0x00)
+		if end < 0 {
+			return nil, errors.New("plugin name not NUL terminated")
+		}
+		hs.plugin = string(payload[pos : pos+end])
+		pos += end + 1
+	}
+	if pos != len(payload) {
+		return nil, errors.New("trailing bytes after the handshake")
+	}
+	return hs, nil
+}
+
+func TestHandshakeScramble(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	type sent struct {
+		connID   int
+		scramble []byte
+	}
+	sentch := make(chan sent, 1)
+	go func() {
+		connID, scramble, _ := sendHandshake(server)
+		sentch <- sent{connID, scramble}
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	handshake, err := mysqlpackets.NewInitSQLPacket(client)
+	if err != nil {
+		t.Fatal("reading handshake:", err.Error())
+	}
+	hs, err := decodeHandshake(handshake.Payload)
+	if err != nil {
+		t.Fatal("decoding the handshake:", err.Error())
+	}
+	expected := <-sentch
+	if hs.connID != expected.connID || hs.cflags != serverCapabilities || !bytes.Equal(hs.scramble, expected.scramble) {
+		t.Log("Expected", expected.connID, serverCapabilities, expected.scramble, "instead got", hs.connID, hs.cflags, hs.scramble)
+		t.Fail()
+	}
+	if len(expected.scramble) != scrambleLength || bytes.IndexByte(expected.scramble, 0x00) >= 0 {
+		t.Log("Unexpected scramble", expected.scramble)
+		t.Fail()
+	}
+
+	// with CLIENT_PLUGIN_AUTH the client relies on auth_plugin_data_len
+	cflags := serverCapabilities | uint32(mysqlpackets.CLIENT_PLUGIN_AUTH|mysqlpackets.CLIENT_RESERVED2)
+	scramble := newScramble()
+	payload := encodeHandshake(handshakeConfig{connID: 7, scramble: scramble, capabilities: cflags})
+	hs, err = decodeHandshake(payload)
+	if err != nil {
+		t.Fatal("decoding the handshake with CLIENT_PLUGIN_AUTH:", err.Error())
+	}
+	if hs.connID != 7 || hs.cflags != cflags || !bytes.Equal(hs.scramble, scramble) || hs.plugin != authPluginName {
+		t.Log("Expected", scramble, authPluginName, "instead got", hs.connID, hs.cflags, hs.scramble, hs.plugin)
+		t.Fail()
+	}
+	if authDataLen := payload[len(payload)-len(authPluginName)-1-13-10-1]; authDataLen != scrambleLength+1 {
+		t.Log("Expected auth_plugin_data_len", scrambleLength+1, "instead got", authDataLen)
+		t.Fail()
+	}
+}
+
+func TestWrapNewNetstringEmptyPacket(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	nsch := wrapNewNetstring(server, bufio.NewReader(server), true, done)
+
+	// the zero-length packet is skipped and the connection stays open
+	query := mysqlpackets.NewMySQLPacketFrom(0, append([]byte{byte(common.COM_QUERY)}, []byte("select 1")...))
+	go func() {
+		client.Write(mysqlpackets.NewMySQLPacketFrom(1, nil).Serialized[encoding.IndicatorSize:])
+		client.Write(query.Serialized[encoding.IndicatorSize:])
+	}()
+	select {
+	case ns := <-nsch:
+		if ns == nil || ns.Cmd != common.COM_QUERY {
+			t.Fatal("Expected the query after the empty packet, instead got", ns)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not read")
+	}
+}
+
+// goSQLDriverHandshakeResponse is the HANDSHAKE_RESPONSE_41 of go-sql-driver v1.4.1 connecting as user with the password
+// secret to the schema sales, answering the handshake with the scramble goSQLDriverScramble
+var goSQLDriverHandshakeResponse = "89a20a00000000002100000000000000000000000000000000000000000000007573657200142493d41c906e" +
+	"2ea19aec8f9abc7e6f8488dd60c973616c6573006d7973716c5f6e61746976655f70617373776f726400"
+var goSQLDriverScramble = "552c22735f6a2d2d3d5b233616016a0225673226"
+
+// nativePassword computes the mysql_native_password auth response:
+// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+func nativePassword(scramble []byte, password string) []byte {
+	hash := sha1.Sum([]byte(password))
+	hashHash := sha1.Sum(hash[:])
+	mix := sha1.Sum(append(append([]byte{}, scramble...), hashHash[:]...))
+	for i := range hash {
+		hash[i] ^= mix[i]
+	}
+	return hash[:]
+}
+
+func TestDecodeHandshakeResponse(t *testing.T) {
+	packet, _ := hex.DecodeString(goSQLDriverHandshakeResponse)
+	resp, err := decodeHandshakeResponse(packet, serverCapabilities)
+	if err != nil {
+		t.Fatal("decoding the go-sql-driver handshake response:", err.Error())
+	}
+	scramble, _ := hex.DecodeString(goSQLDriverScramble)
+	authResponse := nativePassword(scramble, "secret")
+	if resp.capabilities != uint32(mysqlpackets.CLIENT_PROTOCOL_41|mysqlpackets.CLIENT_TRANSACTIONS|mysqlpackets.CLIENT_MULTI_RESULTS) || resp.maxPacketSize != 0 || resp.charset != 0x21 ||
+		resp.user != "user" || !bytes.Equal(resp.authResponse, authResponse) || resp.schema != "sales" ||
+		resp.authPlugin != authPluginName || resp.attrs != nil {
+		t.Log("Unexpected go-sql-driver handshake response", resp)
+		t.Fail()
+	}
+
+	// the connection attributes and the length encoded auth response are decoded with the flags of the client
+	flags := mysqlpackets.CLIENT_PROTOCOL_41 | mysqlpackets.CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA | mysqlpackets.CLIENT_CONNECT_ATTRS
+	packet = make([]byte, 256)
+	pos := 0
+	mysqlpackets.WriteFixedLenInt(packet, mysqlpackets.INT4, flags, &pos)
+	mysqlpackets.WriteFixedLenInt(packet, mysqlpackets.INT4, 1024, &pos)
+	mysqlpackets.WriteFixedLenInt(packet, mysqlpackets.INT1, 0xff, &pos)
+	pos += 23
+	mysqlpackets.WriteString(packet, "app", mysqlpackets.NULLSTR, &pos, 0)
+	mysqlpackets.WriteLenEncString(packet, "auth", &pos)
+	mysqlpackets.WriteFixedLenInt(packet, mysqlpackets.INT1, 1+len("_os")+1+len("linux"), &pos)
+	mysqlpackets.WriteLenEncString(packet, "_os", &pos)
+	mysqlpackets.WriteLenEncString(packet, "linux", &pos)
+	resp, err = decodeHandshakeResponse(packet[:pos], serverCapabilities)
+	if err != nil {
+		t.Fatal("decoding the handshake response:", err.Error())
+	}
+	if resp.capabilities != uint32(mysqlpackets.CLIENT_PROTOCOL_41|mysqlpackets.CLIENT_CONNECT_ATTRS) || resp.maxPacketSize != 1024 || resp.user != "app" ||
+		string(resp.authResponse) != "auth" || resp.attrs["_os"] != "linux" {
+		t.Log("Unexpected handshake response", resp)
+		t.Fail()
+	}
+
+	// HANDSHAKE_RESPONSE_320
+	packet = append([]byte{byte(mysqlpackets.CLIENT_CONNECT_WITH_DB), 0x00, 0x00, 0x00, 0x01}, "old\x00auth\x00sales\x00"...)
+	resp, err = decodeHandshakeResponse(packet, serverCapabilities)
+	if err != nil || resp.capabilities != 0 || resp.maxPacketSize != 1<<16 || resp.user != "old" ||
+		string(resp.authResponse) != "auth" || resp.schema != "sales" {
+		t.Log("Unexpected HANDSHAKE_RESPONSE_320", resp, err)
+		t.Fail()
+	}
+
+	// every truncation of the go-sql-driver response is an error, not a panic
+	packet, _ = hex.DecodeString(goSQLDriverHandshakeResponse)
+	for n := 0; n < len(packet)-1; n++ {
+		if _, err = decodeHandshakeResponse(packet[:n], serverCapabilities); err == nil {
+			t.Log("Expected an error decoding the first", n, "bytes")
+			t.Fail()
+		}
+	}
+}
+
+func TestHandshake320(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// HANDSHAKE_RESPONSE_320 of a client with CLIENT_TRANSACTIONS and CLIENT_LONG_FLAG
+	flags := mysqlpackets.CLIENT_TRANSACTIONS | mysqlpackets.CLIENT_LONG_FLAG
+	response := append([]byte{byte(flags), byte(flags >> 8), 0x00, 0x00, 0x01}, "old\x00"...)
+	go func() {
+		client.Write(mysqlpackets.NewMySQLPacketFrom(1, response).Serialized[encoding.IndicatorSize:])
+	}()
+	respch := make(chan *handshakeResponse, 1)
+	go func() {
+		resp, _ := readHandshakeResponse(server)
+		respch <- resp
+	}()
+
+	// the OK packet has the status flags, without the warnings of 4.1
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ok, err := mysqlpackets.NewInitSQLPacket(client)
+	if err != nil {
+		t.Fatal("reading OK:", err.Error())
+	}
+	expected := append([]byte{0x00, 0, 0, byte(mysqlpackets.SERVER_STATUS_AUTOCOMMIT), 0}, "Welcome to Hera!"...)
+	if !bytes.Equal(ok.Payload, expected) {
+		t.Log("Expected OK", expected, "instead got", ok.Payload)
+		t.Fail()
+	}
+	if resp := <-respch; resp == nil || resp.capabilities != uint32(flags) || resp.user != "old" {
+		t.Log("Expected the capabilities negotiated down to", flags, "instead got", resp)
+		t.Fail()
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		// a HANDSHAKE_RESPONSE_41 without the user
+		response := make([]byte, 4+4+1+23)
+		pos := 0
+		mysqlpackets.WriteFixedLenInt(response, mysqlpackets.INT4, mysqlpackets.CLIENT_PROTOCOL_41, &pos)
+		client.Write(mysqlpackets.NewMySQLPacketFrom(1, response).Serialized[encoding.IndicatorSize:])
+	}()
+	errch := make(chan error, 1)
+	go func() {
+		_, err := readHandshakeResponse(server)
+		errch <- err
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet, err := mysqlpackets.NewInitSQLPacket(client)
+	if err != nil {
+		t.Fatal("reading ERR:", err.Error())
+	}
+	pos := 1
+	if packet.Cmd != 0xff || packet.Sqid != handshakeOKSqid ||
+		mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_HANDSHAKE_ERROR {
+		t.Log("Expected ER_HANDSHAKE_ERROR, instead got", packet.Sqid, packet.Payload)
+		t.Fail()
+	}
+	if err = <-errch; err != errBadHandshake {
+		t.Log("Expected errBadHandshake, instead got", err)
+		t.Fail()
+	}
+}
+
+func TestSSLRequest(t *testing.T) {
+	// SSL requests of a 4.1 and of a 3.20 client
+	request41 := make([]byte, 4+4+1+23)
+	pos := 0
+	mysqlpackets.WriteFixedLenInt(request41, mysqlpackets.INT4, mysqlpackets.CLIENT_PROTOCOL_41|mysqlpackets.CLIENT_SSL, &pos)
+	mysqlpackets.WriteFixedLenInt(request41, mysqlpackets.INT4, 1<<24, &pos)
+	mysqlpackets.WriteFixedLenInt(request41, mysqlpackets.INT1, 0x21, &pos)
+	flags := mysqlpackets.CLIENT_SSL | mysqlpackets.CLIENT_LONG_FLAG
+	request320 := []byte{byte(flags), byte(flags >> 8), 0x00, 0x00, 0x01}
+
+	for _, request := range [][]byte{request41, request320} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(mysqlpackets.NewMySQLPacketFrom(1, request).Serialized[encoding.IndicatorSize:])
+		}()
+		errch := make(chan error, 1)
+		go func() {
+			_, err := readHandshakeResponse(server)
+			errch <- err
+		}()
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		packet, err := mysqlpackets.NewInitSQLPacket(client)
+		if err != nil {
+			t.Fatal("reading ERR:", err.Error())
+		}
+		pos = 1
+		if packet.Cmd != 0xff || packet.Sqid != handshakeOKSqid ||
+			mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_SERVER_NO_SSL {
+			t.Log("Expected ER_SERVER_NO_SSL, instead got", packet.Sqid, packet.Payload)
+			t.Fail()
+		}
+		if err = <-errch; err != errSSLRequest {
+			t.Log("Expected errSSLRequest, instead got", err)
+			t.Fail()
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// a full handshake response with CLIENT_SSL is decoded
+	response := append(request41, "user\x00\x00"...)
+	if resp, err := decodeHandshakeResponse(response, serverCapabilities); err != nil || resp.user != "user" {
+		t.Log("Expected the handshake response of user, instead got", resp, err)
+		t.Fail()
+	}
+}
+
+func TestCountingConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	cconn := newCountingConn(server)
+	defer cconn.Close()
+
+	go func() {
+		client.Write([]byte("hello"))
+		io.ReadFull(client, make([]byte, 3))
+	}()
+	if _, err := io.ReadFull(cconn, make([]byte, 5)); err != nil {
+		t.Fatal("read:", err.Error())
+	}
+	if _, err := cconn.Write([]byte("bye")); err != nil {
+		t.Fatal("write:", err.Error())
+	}
+	if cconn.BytesIn() != 5 || cconn.BytesOut() != 3 {
+		t.Log("Expected 5 bytes in and 3 out, instead got", cconn.BytesIn(), cconn.BytesOut())
+		t.Fail()
+	}
+}
+
+// testCertificate generates a self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("key:", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("certificate:", err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCountingConnTLS(t *testing.T) {
+	client, server := net.Pipe()
+	cconn := newCountingConn(server)
+	tlsServer := tls.Server(cconn, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	defer tlsServer.Close()
+	// closed first, the close notify of the server isn't waited for
+	defer client.Close()
+
+	go func() {
+		tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		tlsClient.Write([]byte("hello"))
+		io.ReadFull(tlsClient, make([]byte, 3))
+	}()
+	tlsServer.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(tlsServer, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("read over TLS:", string(buf), err)
+	}
+	if _, err := tlsServer.Write([]byte("bye")); err != nil {
+		t.Fatal("write over TLS:", err.Error())
+	}
+	// the handshake and the records are counted
+	if cconn.BytesIn() <= 5 || cconn.BytesOut() <= 3 {
+		t.Log("Expected the TLS traffic to be counted, instead got", cconn.BytesIn(), cconn.BytesOut())
+		t.Fail()
+	}
+}
+
+// testDrainWorker plays the worker process on the other end of conn, answering the queries with OK in a
+// transaction. The answer to the update is held until release is closed. The worker is recovered with a
+// SIGHUP to its pid, a sleep standing in for the worker process: once it exits the worker rolls back and
+// sends the EOR free with the request id of the last message, like a real worker.
+func testDrainWorker(conn net.Conn, updating chan<- struct{}, release <-chan struct{}, exited <-chan struct{}) {
+	reader := bufio.NewReader(conn)
+	requests := make(chan *encoding.Packet)
+	go func() {
+		defer close(requests)
+		for {
+			ns, err := netstring.NewNetstringBuffered(reader)
+			if errors.Is(err, encoding.WRONGPACKET) {
+				ns, err = mysqlpackets.NewMySQLPacket(reader)
+			}
+			if err != nil {
+				return
+			}
+			requests <- ns
+		}
+	}()
+	var rqId uint16
+	eor := func(code int, payload []byte) {
+		msg := append([]byte{byte('0' + code), byte(rqId >> 8), byte(rqId)}, payload...)
+		conn.Write(netstring.NewNetstringFrom(common.CmdEOR, msg).Serialized)
+	}
+	for {
+		select {
+		case ns, ok := <-requests:
+			if !ok {
+				return
+			}
+			rqId++
+			if !ns.IsMySQL {
+				// the capabilities of the client
+				continue
+			}
+			if strings.HasPrefix(string(ns.Payload[1:]), "update") {
+				close(updating)
+				<-release
+			}
+			resp := mysqlpackets.OKPacket(1, 0, mysqlpackets.SERVER_STATUS_IN_TRANS, 0, uint32(mysqlpackets.CLIENT_PROTOCOL_41), "")
+			eor(common.EORInTransaction, mysqlpackets.NewMySQLPacketFrom(1, resp).Serialized)
+		case <-exited:
+			eor(common.EORFree, nil)
+			return
+		}
+	}
+}
+
+func TestHandleConnectionDrain(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the worker is recovered with a signal sent by KillParam")
+	}
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("no process to stand in for the worker:", err.Error())
+	}
+	testStateLog(t)
+	appConfig, opsConfig := gAppConfig, gOpsConfig
+	gAppConfig = &Config{StrandedWorkerTimeoutMs: 5000}
+	gOpsConfig = &OpsConfig{idleTimeoutMs: 5000, trIdleTimeoutMs: 5000}
+	defer func() { gAppConfig, gOpsConfig = appConfig, opsConfig }()
+
+	proc := exec.Command(sleep, "30")
+	if err = proc.Start(); err != nil {
+		t.Fatal("starting the worker process:", err.Error())
+	}
+	defer proc.Process.Kill()
+	exited := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(exited)
+	}()
+
+	// a pool with a single free worker
+	proxy, worker := net.Pipe()
+	defer proxy.Close()
+	defer worker.Close()
+	wc := NewWorker(0, wtypeRW, 0, 0, "")
+	wc.workerConn = proxy
+	wc.pid = proc.Process.Pid
+	wc.setState(wsAcpt)
+	go wc.doRead()
+	updating := make(chan struct{})
+	release := make(chan struct{})
+	go testDrainWorker(worker, updating, release, exited)
+	pool := &WorkerPool{Type: wtypeRW, activeQ: NewQueue(), poolCond: sync.NewCond(&sync.Mutex{}), checkoutTickets: make(map[interface{}]string)}
+	pool.aqmanager = &adaptiveQueueManager{wpool: pool, dispatchedWorkers: make(map[*WorkerClient]string)}
+	pool.activeQ.Push(wc)
+	once.Do(func() {})
+	broker := sBrokerInstance
+	sBrokerInstance = &WorkerBroker{workerpools: []map[HeraWorkerType][]*WorkerPool{{wtypeRW: {pool}}}}
+	defer func() { sBrokerInstance = broker }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	drain, stopDrain := context.WithCancel(context.Background())
+	defer stopDrain()
+	handled := make(chan struct{})
+	go func() {
+		HandleConnection(drain, server)
+		close(handled)
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = mysqlpackets.NewInitSQLPacket(client); err != nil {
+		t.Fatal("reading the handshake:", err.Error())
+	}
+	client.Write(handshakeResponse41("user"))
+	if _, err = mysqlpackets.NewInitSQLPacket(client); err != nil {
+		t.Fatal("reading the handshake OK:", err.Error())
+	}
+	query := func(sql string) {
+		client.Write(mysqlpackets.NewMySQLPacketFrom(0, append([]byte{byte(common.COM_QUERY)}, sql...)).Serialized[encoding.IndicatorSize:])
+	}
+	query("begin")
+	if ok, err := mysqlpackets.NewInitSQLPacket(client); err != nil || ok.Cmd != 0x00 {
+		t.Fatal("Expected OK for begin, instead got", ok, err)
+	}
+
+	// the server shuts down while the worker runs the update
+	query("update test set a = 1")
+	<-updating
+	stopDrain()
+	select {
+	case <-handled:
+		t.Fatal("Expected the connection to wait for the update, instead it was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the client gets the answer, then the connection is closed and the worker recovered
+	close(release)
+	if ok, err := mysqlpackets.NewInitSQLPacket(client); err != nil || ok.Cmd != 0x00 || ok.Sqid != 1 {
+		t.Fatal("Expected OK for the update, instead got", ok, err)
+	}
+	if _, err = mysqlpackets.NewInitSQLPacket(client); err == nil {
+		t.Log("Expected the connection closed after the update")
+		t.Fail()
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected HandleConnection to return once drained")
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the worker recovered with SIGHUP")
+	}
+	if status := proc.ProcessState.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGHUP {
+		t.Log("Expected the worker process ended by SIGHUP, instead got", proc.ProcessState)
+		t.Fail()
+	}
+
+	// after its rollback the worker is back in the pool
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pool.poolCond.L.Lock()
+		free := pool.activeQ.Len()
+		pool.poolCond.L.Unlock()
+		if free == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the recovered worker back in the pool, status", wc.Status)
+		}
+	}
+}
+
+func TestHandleConnectionIdleTimeout(t *testing.T) {
+	testStateLog(t)
+	opsConfig := gOpsConfig
+	gOpsConfig = &OpsConfig{idleTimeoutMs: 50, trIdleTimeoutMs: 50}
+	defer func() { gOpsConfig = opsConfig }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	handled := make(chan struct{})
+	go func() {
+		HandleConnection(context.Background(), server)
+		close(handled)
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := mysqlpackets.NewInitSQLPacket(client); err != nil {
+		t.Fatal("reading the handshake:", err.Error())
+	}
+	client.Write(handshakeResponse41("user"))
+	if _, err := mysqlpackets.NewInitSQLPacket(client); err != nil {
+		t.Fatal("reading the handshake OK:", err.Error())
+	}
+
+	// the client sends nothing: HandleConnection returns once the read goroutine exited, then the
+	// connection is closed
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected HandleConnection to return on idle timeout")
+	}
+	if _, err := mysqlpackets.NewInitSQLPacket(client); err != io.EOF {
+		t.Log("Expected the connection closed, instead got", err)
+		t.Fail()
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -33,6 +34,7 @@ import (
 	"github.com/paypal/hera/cal"
 	"github.com/paypal/hera/common"
 	"github.com/paypal/hera/utility"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
 	"github.com/paypal/hera/utility/encoding/netstring"
 	"github.com/paypal/hera/utility/logger"
 )
@@ -46,10 +48,13 @@ type Coordinator struct {
 	clientchannel <-chan *encoding.Packet // channel where client netstring arrives
 	ctx           context.Context
 	done          chan int
+	exited        chan struct{} // closed when Run returns
 	sqlParser     common.SQLParser
 
 	corrID         *encoding.Packet
 	preppendCorrID bool
+	// the capability flags negotiated with a MySQL client, sent to the workers with a control message
+	capabilities uint32
 	// tells if the current request is SELECT
 	isRead bool
 	// for debugging
@@ -68,11 +73,17 @@ type Coordinator struct {
 
 	// if this handles an internal client like rac maintenance config or shard config
 	isInternal bool
+	// the connection id sent to a MySQL client in the handshake, -1 for other clients
+	connID int
+	// the user of the MySQL client, from the handshake or the last COM_CHANGE_USER
+	user string
+	// closed when the server shuts down, the coordinator exits once the command in flight is answered
+	draining <-chan struct{}
 }
 
 // NewCoordinator creates a coordinator, clientchannel is used to read the requests, conn is used to write responses.
 func NewCoordinator(ctx context.Context, clientchannel <-chan *encoding.Packet, conn net.Conn) *Coordinator {
-	coordinator := &Coordinator{clientchannel: clientchannel, conn: conn, ctx: ctx, done: make(chan int, 1), id: conn.RemoteAddr().String(), shard: &shardInfo{sessionShardID: -1}, prevShard: &shardInfo{sessionShardID: -1}}
+	coordinator := &Coordinator{clientchannel: clientchannel, conn: conn, ctx: ctx, done: make(chan int, 1), exited: make(chan struct{}), id: conn.RemoteAddr().String(), shard: &shardInfo{sessionShardID: -1}, prevShard: &shardInfo{sessionShardID: -1}, connID: -1}
 	var err error
 	coordinator.sqlParser, err = common.NewRegexSQLParser()
 	logger.GetLogger().Log(logger.Verbose, "Created coordinator")
@@ -111,6 +122,7 @@ func NewCoordinator(ctx context.Context, clientchannel <-chan *encoding.Packet,
 // ends on an eor free from the worker. at the end of each session, flow control is
 // returned back to Run(), and the next client request is parsed again before dispatching
 func (crd *Coordinator) Run() {
+	defer close(crd.exited)
 	defer crd.conn.Close()
 	idleTimeoutMs := time.Duration(GetIdleTimeoutMs()) * time.Millisecond
 	idleTimer := time.NewTimer(idleTimeoutMs)
@@ -125,7 +137,6 @@ func (crd *Coordinator) Run() {
 		logger.GetLogger().Log(logger.Verbose, "Running coordinator")
 		select {
 		case ns, ok := <-crd.clientchannel:
-			logger.GetLogger().Log(logger.Verbose, "Got msg from client channel", ns.Serialized)
 			if !ok {
 				if logger.GetLogger().V(logger.Debug) {
 					logger.GetLogger().Log(logger.Debug, "Coordinator exiting (closed channel) ...")
@@ -140,6 +151,7 @@ func (crd *Coordinator) Run() {
 				}
 				return
 			}
+			logger.GetLogger().Log(logger.Verbose, "Got msg from client channel", ns.Serialized)
 			logger.GetLogger().Log(logger.Verbose, "coordinator run got client request.")
 			if logger.GetLogger().V(logger.Debug) {
 				logger.GetLogger().Log(logger.Debug, "coordinator run got client request.")
@@ -191,6 +203,25 @@ func (crd *Coordinator) Run() {
 				idleTimer.Reset(idleTimeoutMs)
 			}
 
+		case <-crd.draining:
+			// the server is shutting down. a command already read is served first, the next
+			// iterations pick it up as the channel is ready too
+			if len(crd.clientchannel) > 0 {
+				continue
+			}
+			if logger.GetLogger().V(logger.Debug) {
+				logger.GetLogger().Log(logger.Debug, "Coordinator exiting (draining) ...")
+			}
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+			if crd.worker != nil {
+				GetStateLog().PublishStateEvent(StateEvent{eType: ConnStateEvt, shardID: crd.worker.shardID, wType: crd.worker.Type, instID: crd.worker.instID, oldCState: Assign, newCState: Idle})
+				go crd.worker.Recover(crd.workerpool, crd.ticket, &strandedCalInfo{raddr: crd.conn.RemoteAddr().String(), laddr: crd.conn.LocalAddr().String(), nameSuffix: "_DRAIN_RECOVER"})
+				crd.resetWorkerInfo()
+			}
+			return
+
 		case <-idleTimerCh:
 			crd.done <- int(idleTimeoutMs / time.Millisecond)
 			idleTimerCh = nil
@@ -313,7 +344,19 @@ func (crd *Coordinator) dispatch(request *encoding.Packet) bool {
 		return (taferr == nil)
 	}
 
+	inTransaction := crd.inTransaction
 	deferr := crd.dispatchRequest(request)
+	if deferr == ErrQueryKilled {
+		// the worker is recovered, which rolls back the open transaction. The client is told so, and can go on
+		// with the next query
+		msg := deferr.Error()
+		if inTransaction {
+			msg += ", the transaction was rolled back"
+		}
+		np := mysqlpackets.NewMySQLPacketFrom(request.Sqid+1, mysqlpackets.ERRPacket(common.ER_QUERY_INTERRUPTED, msg))
+		crd.respond(np.Serialized[encoding.IndicatorSize:])
+		return true
+	}
 	crd.processError(deferr)
 	return (deferr == nil)
 }
@@ -393,6 +436,25 @@ func (crd *Coordinator) handleMux(request *encoding.Packet) (bool, error) {
 			crd.isRead = crd.sqlParser.IsRead(string(request.Payload[1:]))
 			return false, nil
 		}
+		if request.Cmd == common.COM_PROCESS_KILL && len(request.Payload) >= 5 {
+			// like KILL, it closes the connection
+			pos := 1
+			crd.processKill(request, mysqlpackets.ReadFixedLenInt(request.Payload, mysqlpackets.INT4, &pos), true)
+			return true, nil
+		}
+		if request.Cmd == common.COM_QUERY {
+			if connID, connection, ok := killStatement(string(request.Payload[1:])); ok {
+				crd.processKill(request, connID, connection)
+				return true, nil
+			}
+		}
+		if request.Cmd == common.COM_CHANGE_USER {
+			// the worker answers, the new user owns the connection for KILL
+			if cu, err := mysqlpackets.ReadChangeUser(request.Payload, crd.capabilities); err == nil {
+				crd.user = cu.User
+				setConnUser(crd.connID, cu.User)
+			}
+		}
 	}
 	return crd.processMuxCommand(request)
 }
@@ -408,7 +470,7 @@ func (crd *Coordinator) processMuxCommand(request *encoding.Packet) (bool, error
 	if request.IsMySQL {
 		// MySQL protocol packets are not mux commands, so anything from MySQL packets should be handled by
 		// a worker. Therefore automatically return false.
-		logger.GetLogger().Log(logger.Info, "Request is MySQL packet", request.Serialized[1:])
+		logger.GetLogger().Log(logger.Info, "Request is MySQL packet", request.Serialized[encoding.IndicatorSize:])
 		return false, nil
 
 	} else {
@@ -646,7 +708,19 @@ func (crd *Coordinator) dispatchRequest(request *encoding.Packet) error {
 	}
 
 	logger.GetLogger().Log(logger.Info, "Reached doRequest")
-	wait, err := crd.doRequest(crd.ctx, worker, request, crd.conn, nil)
+	// the query of a MySQL client can be canceled from another connection with KILL QUERY
+	ctx, cancel := context.WithCancel(crd.ctx)
+	if request.IsMySQL {
+		registerQuery(crd.connID, cancel)
+	}
+	wait, err := crd.doRequest(ctx, worker, request, crd.conn, nil)
+	if request.IsMySQL {
+		unregisterQuery(crd.connID)
+		if (err == ErrCanceled) && (crd.ctx.Err() == nil) {
+			err = ErrQueryKilled
+		}
+	}
+	cancel()
 
 	if !xShardRead {
 		if wait {
@@ -708,8 +782,29 @@ var (
 	ErrWorkerFail = errors.New("Worker error")
 	ErrTimeout    = errors.New("Timeout")
 	ErrCanceled   = errors.New("Canceled")
+	// the query was canceled with KILL QUERY
+	ErrQueryKilled = errors.New("Query execution was interrupted")
 )
 
+// sendCapabilities sends the capability flags of the MySQL client to the worker, unless the worker already
+// has them from the previous session it served
+func (crd *Coordinator) sendCapabilities(worker *WorkerClient) error {
+	if worker.capabilitiesSent && worker.capabilities == crd.capabilities {
+		return nil
+	}
+	msg := common.ControlMsgCapabilities + strconv.FormatUint(uint64(crd.capabilities), 10)
+	err := worker.Write(netstring.NewNetstringFrom(common.CmdControlMsg, []byte(msg)), 1)
+	if err != nil {
+		if logger.GetLogger().V(logger.Debug) {
+			logger.GetLogger().Log(logger.Debug, "doRequest: can't send the capabilities to worker", err)
+		}
+		return err
+	}
+	worker.capabilities = crd.capabilities
+	worker.capabilitiesSent = true
+	return nil
+}
+
 /**
  * performs a SQL, which is a communication of request & responses until EOR_... is received, or some
  * exception happens (client disconnects, worker exits, timeout)
@@ -767,6 +862,9 @@ func (crd *Coordinator) doRequest(ctx context.Context, worker *WorkerClient, req
 		} else {
 			// TODO: MySQL Packet case for sending session starter request to worker.
 			// It's written down below, but not too sure whether or not it's as simple as this.
+			if err := crd.sendCapabilities(worker); err != nil {
+				return false, ErrWorkerFail
+			}
 			logger.GetLogger().Log(logger.Info, "Wrote request to worker")
 			err := worker.Write(request, uint16(1))
 			if err != nil {
@@ -1020,3 +1118,9 @@ func (crd *Coordinator) processError(err error) {
 func (crd *Coordinator) Done() <-chan int {
 	return crd.done
 }
+
+// Exited returns the channel closed when Run returns, after the response to the last command is sent and
+// the worker recovered
+func (crd *Coordinator) Exited() <-chan struct{} {
+	return crd.exited
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"github.com/paypal/hera/utility/encoding/netstring"
+)
+
+func TestSendCapabilities(t *testing.T) {
+	proxy, worker := net.Pipe()
+	defer proxy.Close()
+	defer worker.Close()
+	worker.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// already busy, so that Write doesn't publish a state change
+	wc := &WorkerClient{workerConn: proxy, Status: wsBusy}
+	crd := &Coordinator{capabilities: 512}
+	errs := make(chan error, 1)
+	go func() { errs <- crd.sendCapabilities(wc) }()
+	ns, err := netstring.NewNetstring(worker)
+	if err != nil {
+		t.Fatal("reading the control message:", err.Error())
+	}
+	if ns.Cmd != common.CmdControlMsg || string(ns.Payload) != common.ControlMsgCapabilities+"512" {
+		t.Log("Unexpected control message", ns.Cmd, string(ns.Payload))
+		t.Fail()
+	}
+	if err = <-errs; err != nil {
+		t.Fatal("sendCapabilities:", err.Error())
+	}
+
+	// the worker already has them, nothing is written
+	proxy.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if err = crd.sendCapabilities(wc); err != nil {
+		t.Log("Expected no control message for the same capabilities, instead got", err)
+		t.Fail()
+	}
+}
+
+// testStateLog installs a state log which only buffers the events, for the tests running a WorkerClient
+func testStateLog(t *testing.T) {
+	statelogOnce.Do(func() {
+		gStateLogInstance = &StateLog{mEventChann: make(chan StateEvent, 3000)}
+	})
+	if GetStateLog() == nil {
+		t.Skip("state log initialized without a worker broker")
+	}
+}
+
+func TestDoRequestResponse(t *testing.T) {
+	testStateLog(t)
+	opsConfig := gOpsConfig
+	gOpsConfig = &OpsConfig{trIdleTimeoutMs: 5000}
+	defer func() { gOpsConfig = opsConfig }()
+
+	proxy, worker := net.Pipe()
+	defer proxy.Close()
+	defer worker.Close()
+	wc := &WorkerClient{workerConn: proxy, Status: wsBusy}
+	go wc.doRead()
+
+	// the worker answers a COM_STMT_EXECUTE opening a cursor with the column count, the definition of the
+	// column and the EOF in one EOR, the packets after the first one without the indicator byte
+	var frames []byte
+	for i, payload := range [][]byte{{1}, {3, 'd', 'e', 'f'}, {0xfe, 0, 0, 0x42, 0}} {
+		frames = append(frames, mysqlpackets.NewMySQLPacketFrom(i+1, payload).Serialized[encoding.IndicatorSize:]...)
+	}
+	eor := append([]byte{byte('0' + common.EORInCursorNotInTransaction), 0, 0, encoding.IndicatorMySQL}, frames...)
+	worker.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := worker.Write(netstring.NewNetstringFrom(common.CmdEOR, eor).Serialized); err != nil {
+		t.Fatal("writing the EOR:", err.Error())
+	}
+
+	// the request ends with the first EOR, the client gets all its packets
+	var client bytes.Buffer
+	crd := &Coordinator{done: make(chan int, 1)}
+	busy, err := crd.doRequest(context.Background(), wc, nil, &client, nil)
+	if err != nil || !busy {
+		t.Fatal("Expected the request done with the worker kept for the cursor, instead got", busy, err)
+	}
+	if !bytes.Equal(client.Bytes(), frames) {
+		t.Log("Expected the client to get", frames, "instead got", client.Bytes())
+		t.Fail()
+	}
+}
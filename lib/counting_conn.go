@@ -0,0 +1,76 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/paypal/hera/cal"
+)
+
+// countingConn is a client connection counting the bytes read and written, for the CAL event summarizing
+// the connection when it closes. It embeds the net.Conn, so the deadlines, the addresses and the close are
+// the ones of the connection, and it can itself be wrapped in a TLS connection, the bytes counted being
+// then the encrypted ones. The counters are atomic: the connection is read by the reader goroutine and
+// written by the coordinator.
+type countingConn struct {
+	net.Conn
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// newCountingConn wraps conn to count the bytes read and written
+func newCountingConn(conn net.Conn) *countingConn {
+	return &countingConn{Conn: conn}
+}
+
+// Read reads from the connection, counting the bytes read
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	return n, err
+}
+
+// Write writes to the connection, counting the bytes written, including the ones of a partial write
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	return n, err
+}
+
+// BytesIn returns the number of bytes read so far
+func (c *countingConn) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+// BytesOut returns the number of bytes written so far
+func (c *countingConn) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+// logConnSummary emits the CAL event with the traffic of a client connection when it closes: the bytes
+// read and written, handshake included, and the commands passed to the coordinator
+func logConnSummary(connID int, conn *countingConn, commands int) {
+	evt := cal.NewCalEvent("MUX", "conn_summary", cal.TransOK, "")
+	evt.AddDataInt("conn_id", int64(connID))
+	evt.AddDataInt("bytes_in", int64(conn.BytesIn()))
+	evt.AddDataInt("bytes_out", int64(conn.BytesOut()))
+	evt.AddDataInt("commands", int64(commands))
+	evt.Completed()
+}
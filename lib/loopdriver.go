@@ -18,6 +18,7 @@
 package lib
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
@@ -39,7 +40,7 @@ type heraLoopDriver struct {
 }
 
 // ConnHandlerFunc defines the signature of a fucntion that can be used as a callback by the loop driver
-type ConnHandlerFunc func(net.Conn)
+type ConnHandlerFunc func(context.Context, net.Conn)
 
 var connHandler ConnHandlerFunc
 
@@ -56,7 +57,8 @@ TODO: add another parameter for debugging/troubleshooting, IDing the client
 */
 func (driver *heraLoopDriver) Open(url string) (driver.Conn, error) {
 	cli, srv := net.Pipe()
-	go connHandler(srv)
+	// the loop connections are internal, no server drains them
+	go connHandler(context.Background(), srv)
 
 	if logger.GetLogger().V(logger.Debug) {
 		logger.GetLogger().Log(logger.Debug, "Hera loop driver driver, opening", url, ": ", cli)
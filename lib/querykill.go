@@ -0,0 +1,167 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paypal/hera/cal"
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"github.com/paypal/hera/utility/logger"
+)
+
+// runningQueries maps the MySQL connection ids to their state, so that a client can cancel the query running on
+// another of its connections, or close it, with COM_PROCESS_KILL or KILL
+var runningQueries = struct {
+	sync.Mutex
+	conns map[int]*killableConn
+}{conns: make(map[int]*killableConn)}
+
+// killableConn is a MySQL connection as seen by KILL
+type killableConn struct {
+	user   string             // the user of the client, like with MySQL only its own connections can be killed
+	cancel context.CancelFunc // cancels the query running on the connection, nil if none
+	close  func()             // closes the client connection, for KILL CONNECTION
+}
+
+var (
+	// errUnknownThread is returned by killQuery for a connection which doesn't exist
+	errUnknownThread = errors.New("Unknown thread id")
+	// errKillDenied is returned by killQuery for a connection of another user
+	errKillDenied = errors.New("You are not owner of thread")
+)
+
+// registerConn records a MySQL connection of the user, which doesn't have any query running yet. close
+// closes the client connection.
+func registerConn(connID int, user string, close func()) {
+	runningQueries.Lock()
+	runningQueries.conns[connID] = &killableConn{user: user, close: close}
+	runningQueries.Unlock()
+}
+
+// unregisterConn is called when the connection is closed
+func unregisterConn(connID int) {
+	runningQueries.Lock()
+	delete(runningQueries.conns, connID)
+	runningQueries.Unlock()
+}
+
+// setConnUser records the new user of the connection, after a COM_CHANGE_USER
+func setConnUser(connID int, user string) {
+	runningQueries.Lock()
+	if conn, ok := runningQueries.conns[connID]; ok {
+		conn.user = user
+	}
+	runningQueries.Unlock()
+}
+
+// registerQuery records the cancel function of the query starting on the connection
+func registerQuery(connID int, cancel context.CancelFunc) {
+	runningQueries.Lock()
+	if conn, ok := runningQueries.conns[connID]; ok {
+		conn.cancel = cancel
+	}
+	runningQueries.Unlock()
+}
+
+// unregisterQuery is called when the query on the connection is completed
+func unregisterQuery(connID int) {
+	registerQuery(connID, nil)
+}
+
+// killQuery cancels the query running on the connection, if any, on behalf of the user. With connection, the
+// client connection is closed too. It fails if the connection doesn't exist or belongs to another user. The
+// handshake doesn't verify the credentials, the user is the one the client claims.
+func killQuery(connID int, user string, connection bool) error {
+	runningQueries.Lock()
+	conn, ok := runningQueries.conns[connID]
+	var cancel context.CancelFunc
+	var close func()
+	var connUser string
+	if ok {
+		cancel, close, connUser = conn.cancel, conn.close, conn.user
+	}
+	runningQueries.Unlock()
+	if !ok {
+		return errUnknownThread
+	}
+	if connUser != user {
+		return errKillDenied
+	}
+	if cancel != nil {
+		cancel()
+	}
+	if connection && (close != nil) {
+		close()
+	}
+	return nil
+}
+
+var regexKill = regexp.MustCompile(`(?i)^\s*kill\s+(query\s+|connection\s+)?(\d+)\s*;?\s*$`)
+
+// killStatement tells if the SQL sent in a COM_QUERY is a KILL, returning the connection id in it and whether
+// the connection is killed too, for KILL and KILL CONNECTION, or only its query
+func killStatement(sqlQuery string) (int, bool, bool) {
+	m := regexKill.FindStringSubmatch(sqlQuery)
+	if m == nil {
+		return 0, false, false
+	}
+	connID, err := strconv.Atoi(m[2])
+	if err != nil {
+		return 0, false, false
+	}
+	return connID, !strings.EqualFold(strings.TrimSpace(m[1]), "query"), true
+}
+
+// processKill handles COM_PROCESS_KILL and KILL sent by a MySQL client, canceling the query running on the
+// target connection. The worker running the query is recovered, which rolls back the open transaction, and the
+// target client gets an ERR. With connection, for KILL CONNECTION, the target connection is closed too.
+func (crd *Coordinator) processKill(request *encoding.Packet, connID int, connection bool) {
+	evt := cal.NewCalEvent(EvtTypeMux, "kill_query", cal.TransOK, fmt.Sprintf("conn_id=%d", connID))
+	if connection {
+		evt.AddDataStr("connection", "true")
+	}
+	var np *encoding.Packet
+	switch err := killQuery(connID, crd.user, connection); err {
+	case nil:
+		if logger.GetLogger().V(logger.Info) {
+			logger.GetLogger().Log(logger.Info, crd.id, ": killed query on connection", connID)
+		}
+		status := mysqlpackets.SERVER_STATUS_AUTOCOMMIT
+		if crd.inTransaction {
+			status = mysqlpackets.SERVER_STATUS_IN_TRANS
+		}
+		np = mysqlpackets.NewMySQLPacketFrom(request.Sqid+1, mysqlpackets.OKPacket(0, 0, status, 0, crd.capabilities, ""))
+	case errKillDenied:
+		evt.SetStatus(cal.TransWarning)
+		np = mysqlpackets.NewMySQLPacketFrom(request.Sqid+1, mysqlpackets.ERRPacket(common.ER_KILL_DENIED_ERROR, fmt.Sprintf("%s %d", err.Error(), connID)))
+	default:
+		evt.SetStatus(cal.TransWarning)
+		np = mysqlpackets.NewMySQLPacketFrom(request.Sqid+1, mysqlpackets.ERRPacket(common.ER_NO_SUCH_THREAD, fmt.Sprintf("%s: %d", err.Error(), connID)))
+	}
+	evt.Completed()
+	crd.respond(np.Serialized[encoding.IndicatorSize:])
+}
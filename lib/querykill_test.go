@@ -0,0 +1,93 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKillStatement(t *testing.T) {
+	for _, tc := range []struct {
+		sql        string
+		id         int
+		connection bool
+	}{
+		{"KILL 12", 12, true},
+		{"kill query 7;", 7, false},
+		{" Kill Connection 3 ", 3, true},
+	} {
+		if got, connection, ok := killStatement(tc.sql); !ok || got != tc.id || connection != tc.connection {
+			t.Log("Expected", tc.id, tc.connection, "for", tc.sql, "got", got, connection, ok)
+			t.Fail()
+		}
+	}
+	for _, sql := range []string{"select 1", "kill", "kill query x", "killall 1"} {
+		if _, _, ok := killStatement(sql); ok {
+			t.Log("Unexpected kill statement", sql)
+			t.Fail()
+		}
+	}
+}
+
+func TestKillQuery(t *testing.T) {
+	if err := killQuery(1001, "app", false); err != errUnknownThread {
+		t.Log("Unknown connection should not be killed", err)
+		t.Fail()
+	}
+	closed := false
+	registerConn(1001, "app", func() { closed = true })
+	defer unregisterConn(1001)
+	if err := killQuery(1001, "app", false); err != nil {
+		t.Log("Idle connection should be known", err)
+		t.Fail()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	registerQuery(1001, cancel)
+	if err := killQuery(1001, "app", false); err != nil || ctx.Err() != context.Canceled || closed {
+		t.Log("Query was not canceled alone", err, closed)
+		t.Fail()
+	}
+	unregisterQuery(1001)
+	registerQuery(1002, cancel)
+	if err := killQuery(1002, "app", false); err != errUnknownThread {
+		t.Log("Query registered on unknown connection", err)
+		t.Fail()
+	}
+}
+
+func TestKillOwner(t *testing.T) {
+	closed := false
+	registerConn(1003, "app", func() { closed = true })
+	defer unregisterConn(1003)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerQuery(1003, cancel)
+
+	// the connections of another user can't be killed
+	if err := killQuery(1003, "other", true); err != errKillDenied || ctx.Err() != nil || closed {
+		t.Log("Expected the kill to be denied, instead got", err, ctx.Err(), closed)
+		t.Fail()
+	}
+	// after a change of user, the connection belongs to the new one
+	setConnUser(1003, "other")
+	if err := killQuery(1003, "other", true); err != nil || ctx.Err() != context.Canceled || !closed {
+		t.Log("Expected the query canceled and the connection closed, instead got", err, ctx.Err(), closed)
+		t.Fail()
+	}
+}
@@ -22,10 +22,12 @@ import (
 	"github.com/paypal/hera/utility/logger"
 
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,8 +42,9 @@ const (
 	BRCConnectionLimit
 )
 
-// HandlerFunc defines the signature of the callback to handle the connection
-type HandlerFunc func(net.Conn)
+// HandlerFunc defines the signature of the callback to handle the connection. drain is done when the server
+// shuts down, the handler then closes the connection after its current command
+type HandlerFunc func(drain context.Context, conn net.Conn)
 
 // Listener interface is used by the server to accept connections
 type Listener interface {
@@ -59,6 +62,10 @@ type Listener interface {
 // Server contains the Run method which is the infinite loop
 type Server interface {
 	Run()
+
+	// Shutdown stops accepting connections and closes the open ones after their current command.
+	// It returns when all the connections are closed, or the error of ctx if it is done first.
+	Shutdown(ctx context.Context) error
 }
 
 // server accepts connections from the Listener and after the validation checks it spawns a goroutine to handle it
@@ -75,11 +82,22 @@ type server struct {
 
 	bouncerStartupDelayDone bool
 	startShutdown           int64
+
+	// handlers counts the connections being handled. mu orders the Add in Run with the Wait in
+	// Shutdown, no connection is handled once shuttingDown is set
+	handlers     sync.WaitGroup
+	mu           sync.Mutex
+	shuttingDown bool
+
+	// drain is passed to the handlers, Shutdown cancels it with stopDrain
+	drain     context.Context
+	stopDrain context.CancelFunc
 }
 
 // NewServer creates a server from the Lister and the function handling the connections accepted
 func NewServer(lsn Listener, f HandlerFunc) Server {
 	srv := &server{listener: lsn, handler: f, bouncerActivated: false, capacityCheckTime: 0, capacityCheckCnt: 0, bouncerStartupDelayDone: false}
+	srv.drain, srv.stopDrain = context.WithCancel(context.Background())
 	return srv
 }
 
@@ -145,6 +163,15 @@ func (srv *server) Run() {
 		}
 
 		conn, err := srv.listener.Accept()
+		if srv.isShuttingDown() {
+			if conn != nil {
+				conn.Close()
+			}
+			if logger.GetLogger().V(logger.Info) {
+				logger.GetLogger().Log(logger.Info, "server: shut down, stop accepting")
+			}
+			return
+		}
 
 		if srv.bounceRequired(startTime, startupDelay, pollInterval) {
 			if logger.GetLogger().V(logger.Info) {
@@ -177,16 +204,62 @@ func (srv *server) Run() {
 			logger.GetLogger().Log(logger.Info, "server: accepted from ", conn.RemoteAddr())
 		}
 
+		srv.mu.Lock()
+		if srv.shuttingDown {
+			srv.mu.Unlock()
+			conn.Close()
+			return
+		}
+		srv.handlers.Add(1)
+		srv.mu.Unlock()
 		go srv.authAndHandle(conn, srv.handler)
 		// srv.authAndHandle(conn, srv.handler)
 	}
 }
 
+// isShuttingDown returns true once Shutdown is called
+func (srv *server) isShuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shuttingDown
+}
+
+// Shutdown closes the listener, so that Run returns, and drains the connections: each connection handler
+// stops reading commands and its coordinator exits after answering the command in flight, recovering the
+// worker which rollbacks any open transaction.
+func (srv *server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	if !srv.shuttingDown {
+		srv.shuttingDown = true
+		srv.listener.Close()
+		srv.stopDrain()
+		if logger.GetLogger().V(logger.Info) {
+			logger.GetLogger().Log(logger.Info, "server: shutting down, draining connections")
+		}
+		e := cal.NewCalEvent("MUX", "shutdown", cal.TransOK, "")
+		e.Completed()
+	}
+	srv.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // authAndHandle calls the Listener Init. If successful it calls the handler, otherwise closes the connection
 func (srv *server) authAndHandle(c net.Conn, f HandlerFunc) {
+	defer srv.handlers.Done()
 	conn, err := srv.listener.Init(c)
 	if err == nil {
-		f(conn)
+		f(srv.drain, conn)
 	}
 
 	e := cal.NewCalEvent("CLOSE", IPAddrStr(c.RemoteAddr()), cal.TransOK, "")
@@ -0,0 +1,129 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testListener hands out the connections of conns, Accept fails once it is closed
+type testListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestListener() *testListener {
+	return &testListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (lsn *testListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-lsn.conns:
+		return conn, nil
+	case <-lsn.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (lsn *testListener) Init(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+func (lsn *testListener) Close() error {
+	lsn.closeOnce.Do(func() {
+		close(lsn.closed)
+	})
+	return nil
+}
+
+// handle starts handling a connection the way Run does
+func handle(srv *server) {
+	_, conn := net.Pipe()
+	srv.handlers.Add(1)
+	go srv.authAndHandle(conn, srv.handler)
+}
+
+func TestServerShutdown(t *testing.T) {
+	// the handlers exit once draining, after finishing their command
+	command := make(chan struct{})
+	lsn := newTestListener()
+	srv := NewServer(lsn, func(drain context.Context, conn net.Conn) {
+		<-drain.Done()
+		<-command
+	}).(*server)
+	handle(srv)
+	handle(srv)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatal("Shutdown returned before the command was finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case <-lsn.closed:
+	default:
+		t.Log("Expected the listener to be closed")
+		t.Fail()
+	}
+	if !srv.isShuttingDown() {
+		t.Log("Expected the server to be shutting down")
+		t.Fail()
+	}
+	close(command)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Log("Expected the connections drained, instead got", err)
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return after the connections were closed")
+	}
+
+	// shutting down again returns at once
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Log("Expected a second shutdown to succeed, instead got", err)
+		t.Fail()
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := NewServer(newTestListener(), func(drain context.Context, conn net.Conn) {
+		<-release
+	}).(*server)
+	handle(srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Log("Expected the shutdown to time out, instead got", err)
+		t.Fail()
+	}
+}
@@ -94,6 +94,9 @@ type WorkerClient struct {
 	shardID    int              //
 	racID      int              // for RAC maintenance, the rac ID where the worker connected
 	dbUname    string           // the database name where the worker connected
+	// the capability flags of the MySQL client last sent to the worker, see Coordinator.sendCapabilities
+	capabilities     uint32
+	capabilitiesSent bool
 
 	//
 	// sending data message from worker to coordinator (owner == doRead thread)
@@ -759,7 +762,7 @@ func (worker *WorkerClient) doRead() {
 		logger.GetLogger().Log(logger.Info, "Using netstring packet reader")
 		ns, err := netstring.NewNetstring(worker.workerConn)
 		// If the packet is actually MySQLPacket, then try with MySQL functions.
-		if err == encoding.WRONGPACKET {
+		if errors.Is(err, encoding.WRONGPACKET) {
 			ns, err = mysqlpackets.NewMySQLPacket(worker.workerConn)
 			logger.GetLogger().Log(logger.Info, "Got another MySQLPacket", ns.Serialized)
 		}
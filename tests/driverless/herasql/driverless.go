@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/paypal/hera/cal"
 	lib "github.com/paypal/hera/lib"
@@ -146,6 +147,30 @@ func main() {
 	fmt.Println("Creating new mux server")
 	srv := lib.NewServer(lsn, lib.HandleConnection)
 
+	// on SIGTERM or SIGINT stop accepting connections and let the open ones finish their current command
+	shuttingDown := make(chan struct{})
+	go func() {
+		schannel := make(chan os.Signal, 1)
+		signal.Notify(schannel, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-schannel
+		fmt.Println("Received", sig, "shutting down")
+		close(shuttingDown)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Println("Shutdown:", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+
 	fmt.Println("Running server")
 	srv.Run()
+
+	// Run returns once the listener is closed, the signal handler exits when the connections are drained
+	select {
+	case <-shuttingDown:
+		select {}
+	default:
+	}
 }
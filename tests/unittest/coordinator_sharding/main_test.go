@@ -505,3 +505,52 @@ func TestShardingSetShardKey(t *testing.T) {
 
 	logger.GetLogger().Log(logger.Debug, "TestShardingSetShardKey done  -------------------------------------------------------------")
 }
+
+func TestShardingLoopDriver(t *testing.T) {
+	logger.GetLogger().Log(logger.Debug, "TestShardingLoopDriver begin +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++\n")
+	// the loop driver sets the shard id of the URL when it opens the connection, expecting RcOK
+	db, err := sql.Open("heraloop", "2:0:0")
+	if err != nil {
+		t.Fatal("Error starting Mux:", err)
+		return
+	}
+	db.SetMaxIdleConns(0)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Error getting connection %s\n", err.Error())
+	}
+
+	stmt, _ := conn.PrepareContext(ctx, "/*TestShardingLoopDriver*/Select id, int_val, str_val from "+tableName+" where id=1")
+	rows, _ := stmt.Query()
+	rows.Close()
+	stmt.Close()
+	out, err := testutil.BashCmd("grep 'Preparing: /\\*TestShardingLoopDriver\\*/' hera.log | grep 'WORKER shd2' | wc -l")
+	if (err != nil) || (len(out) == 0) {
+		err = nil
+		t.Fatalf("Request did not run on shard 2. err = %v, len(out) = %d", err, len(out))
+	}
+	if out[0] != '1' {
+		t.Fatalf("Expected 1 excution on shard 2, instead got %d", int(out[0]-'0'))
+	}
+
+	mux := gosqldriver.InnerConn(conn)
+	cnt, err := mux.GetNumShards()
+	if err != nil {
+		t.Fatalf("GetNumShards failed: %v", err)
+	}
+	if cnt != 3 {
+		t.Fatalf("Expected 3 shards, instead got %v", cnt)
+	}
+	err = mux.SetShardID(3)
+	if err == nil {
+		t.Fatalf("Expected error setting shard 3")
+	}
+
+	conn.Close()
+	cancel()
+
+	logger.GetLogger().Log(logger.Debug, "TestShardingLoopDriver done  -------------------------------------------------------------")
+}
@@ -16,11 +16,35 @@
 // limitations under the License.
 
 // Package encoding provides the encoding functions such as netstring etc.,
+//
+// Packets exchanged between the mux and the workers carry one extra indicator
+// byte in front of the wire format, so that either side can tell which protocol
+// the rest of the bytes are in:
+//
+//	0 - MySQL packet (3 bytes payload length, 1 byte sequence id, payload)
+//	1 - netstring (<length>:<cmd> <payload>,)
+//
+// A decoder that reads an indicator byte for the other protocol returns WRONGPACKET,
+// any other value returns UNKNOWNPACKET. Packets read directly from a client
+// connection don't have the indicator byte.
 package encoding
 
+import (
+	"errors"
+)
+
+// Indicator bytes prepended to the serialized packets
+const (
+	IndicatorMySQL     byte = 0
+	IndicatorNetstring byte = 1
+)
+
+// IndicatorSize is the length of the indicator byte in front of Serialized
+const IndicatorSize = 1
+
 type Packet struct {
 	Cmd		int			// Command byte in the payload
-	Serialized []byte 	// The entire packet
+	Serialized []byte 	// The entire packet, starting with the indicator byte
 	Payload []byte 		// The entire payload
 	Length	int 		// Length of Payload
 	Sqid int			// Sequence id
@@ -32,24 +56,35 @@ type Reader interface {
 	ReadNext() (*Packet, error)
 }
 
-type WRONG_PACKET struct {
-}
-
-func (wp WRONG_PACKET) Error() string {
-	return "Wrong packet type. Did you mix netstring with mysql?"
-}
-
-type unknown struct {
+// Packaging is a Reader for protocols splitting large messages in several packets
+type Packaging interface {
+	Reader
+	// ReadMultiplePackets reads the rest of the message starting with the given packet, returning all the packets
+	ReadMultiplePackets(*Packet) ([]*Packet, error)
+	// IsComposite tells if the last packet read is followed by more packets of the same message
+	IsComposite() bool
 }
 
-func (wp unknown) Error() string {
-	return "Unknown packet type. Neither netstring nor mysql"
-}
+// WRONGPACKET is returned when the indicator byte is for the other protocol, i.e. a netstring
+// decoder got a MySQL packet or the other way around. The caller can switch decoders.
+var WRONGPACKET = errors.New("Wrong packet type. Did you mix netstring with mysql?")
 
-var WRONGPACKET = new(WRONG_PACKET)
-var UNKNOWNPACKET = new(unknown)
+// UNKNOWNPACKET is returned when the indicator byte is neither netstring nor MySQL
+var UNKNOWNPACKET = errors.New("Unknown packet type. Neither netstring nor mysql")
 
 // IsComposite returns if the netstring is compisite, embedding multiple netstrings in it
 func (ns *Packet) IsComposite() bool {
 	return ns.Cmd == ('0' - '0')
-}
\ No newline at end of file
+}
+
+// AppendSerialized appends the serialized packet to dst and returns the extended buffer, so that
+// several packets can be written with one call. A MySQL packet without Serialized is serialized
+// from its Payload and Sqid, the same way as mysqlpackets.NewMySQLPacketFrom.
+func (ns *Packet) AppendSerialized(dst []byte) []byte {
+	if ns.Serialized != nil || !ns.IsMySQL {
+		return append(dst, ns.Serialized...)
+	}
+	length := len(ns.Payload)
+	dst = append(dst, IndicatorMySQL, byte(length), byte(length>>8), byte(length>>16), byte(ns.Sqid))
+	return append(dst, ns.Payload...)
+}
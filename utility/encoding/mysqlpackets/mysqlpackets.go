@@ -24,10 +24,18 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/paypal/hera/common"
 	"github.com/paypal/hera/utility/encoding"
 	"github.com/paypal/hera/utility/logger"
 	"io"
 	"log"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /* ==== CONSTANTS ============================================================*/
@@ -96,6 +104,53 @@ const (
 	CLIENT_REMEMBER_OPTIONS	              int = 1 << 31
 )
 
+/* ---- Cursor types. ----------------------------------------------------------
+* Flags of COM_STMT_EXECUTE, after the statement id.
+*     https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+ */
+const (
+	CURSOR_TYPE_NO_CURSOR  int = 0x00
+	CURSOR_TYPE_READ_ONLY  int = 0x01
+	CURSOR_TYPE_FOR_UPDATE int = 0x02
+	CURSOR_TYPE_SCROLLABLE int = 0x04
+)
+
+/* ---- Refresh sub-commands. --------------------------------------------------
+* Bitmap sent in COM_REFRESH, after the command byte.
+*     https://dev.mysql.com/doc/internals/en/com-refresh.html
+ */
+const (
+	REFRESH_GRANT   int = 0x01
+	REFRESH_LOG     int = 0x02
+	REFRESH_TABLES  int = 0x04
+	REFRESH_HOSTS   int = 0x08
+	REFRESH_STATUS  int = 0x10
+	REFRESH_THREADS int = 0x20
+	REFRESH_SLAVE   int = 0x40
+	REFRESH_MASTER  int = 0x80
+)
+
+/* ---- Status flags. ----------------------------------------------------------
+* Server status flags sent in OK and EOF packets.
+*     https://dev.mysql.com/doc/internals/en/status-flags.html
+ */
+const (
+	SERVER_STATUS_IN_TRANS             int = 0x0001
+	SERVER_STATUS_AUTOCOMMIT           int = 0x0002
+	SERVER_MORE_RESULTS_EXISTS         int = 0x0008
+	SERVER_STATUS_NO_GOOD_INDEX_USED   int = 0x0010
+	SERVER_STATUS_NO_INDEX_USED        int = 0x0020
+	SERVER_STATUS_CURSOR_EXISTS        int = 0x0040
+	SERVER_STATUS_LAST_ROW_SENT        int = 0x0080
+	SERVER_STATUS_DB_DROPPED           int = 0x0100
+	SERVER_STATUS_NO_BACKSLASH_ESCAPES int = 0x0200
+	SERVER_STATUS_METADATA_CHANGED     int = 0x0400
+	SERVER_QUERY_WAS_SLOW              int = 0x0800
+	SERVER_PS_OUT_PARAMS               int = 0x1000
+	SERVER_STATUS_IN_TRANS_READONLY    int = 0x2000
+	SERVER_SESSION_STATE_CHANGED       int = 0x4000
+)
+
 var EnumFieldTypes = map[string]int{
 	"DECIMAL": 			0x00, // MYSQL_TYPE_DECIMAL
 	"TINYINT": 			0x01, // MYSQL_TYPE_TINY
@@ -117,35 +172,133 @@ var EnumFieldTypes = map[string]int{
 	"NEWDECIMAL":		0xf6, // MYSQL_TYPE_NEWDECIMAL, likely to never get called because the type is mapped to Decimal in go-sql-driver
 	"ENUM": 			0xf7, // MYSQL_TYPE_ENUM
 	"SET": 				0xf8, // MYSQL_TYPE_SET
+	"JSON":				0xf5, // MYSQL_TYPE_JSON
 	"TINYBLOB": 		0xf9, // MYSQL_TYPE_TINY_BLOB
 	"MEDIUMBLOB": 		0xfa, // MYSQL_TYPE_MEDIUM_BLOB
 	"LONGBLOB":			0xfb, // MYSQL_TYPE_LONG_BLOB
 	"BLOB": 			0xfc, // MYSQL_TYPE_BLOB
 	"VAR_STRING":		0xfd, // MYSQL_TYPE_VAR_STRING, likely to never get called because the type is mapped to VARCHAR in go-sql-driver
 	"CHAR":				0xfe, // MYSQL_TYPE_STRING
+	// go-sql-driver names the types by the character set as well
+	"TINYTEXT":			0xf9,
+	"TEXT":				0xfc,
+	"MEDIUMTEXT":		0xfa,
+	"LONGTEXT":			0xfb,
+	"BINARY":			0xfe,
+	"VARBINARY":		0xfd,
 	"GEOMETRY":			0xff} // MYSQL_TYPE_GEOMETRY
 
+// Column definition flags
+// https://dev.mysql.com/doc/dev/mysql-server/8.0.12/group__group__cs__column__definition__flags.html
+const (
+	NOT_NULL_FLAG       int = 1
+	PRI_KEY_FLAG        int = 2
+	UNIQUE_KEY_FLAG     int = 4
+	MULTIPLE_KEY_FLAG   int = 8
+	BLOB_FLAG           int = 16
+	UNSIGNED_FLAG       int = 32
+	ZEROFILL_FLAG       int = 64
+	BINARY_FLAG         int = 128
+	ENUM_FLAG           int = 256
+	AUTO_INCREMENT_FLAG int = 512
+	TIMESTAMP_FLAG      int = 1024
+	SET_FLAG            int = 2048
+)
+
+// Character sets sent in the column definitions
+const (
+	CHARSET_UTF8_GENERAL_CI int = 0x21
+	CHARSET_BINARY          int = 0x3f
+)
+
+// NO_CMD is the Cmd of a zero-length packet, which doesn't have a command byte
+const NO_CMD int = -1
+
+// MaxLenEncStringSize is the largest length a length encoded string read from a packet can claim.
+// It can be lowered to limit the memory a single string can take.
+var MaxLenEncStringSize = MAX_PACKET_SIZE
+
+// MaxAllowedPacket is the largest payload read from a client, by a client Packager. It can be lowered to limit
+// the memory a single packet can take.
+var MaxAllowedPacket = MAX_PACKET_SIZE
+
+// ErrPacketTooLarge is returned reading a packet with a payload larger than MaxAllowedPacket
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// MaxMessageSize is the largest message, the payloads of all its packets, buffered by Packager.ReadNext.
+// The default is the largest max_allowed_packet of the MySQL server.
+var MaxMessageSize = 1024 * 1024 * 1024
+
+// ErrMessageTooLarge is returned reading a message split in packets whose payloads total more than MaxMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+// payloadChunkSize is how much of a payload is allocated and read at once. A payload larger than this
+// grows as its bytes arrive, so a client can't force a large allocation just by claiming a large length.
+const payloadChunkSize = 64 * 1024
+
+// ErrLenEncNull is returned reading a length encoded integer which is NULL (0xfb) instead
+var ErrLenEncNull = errors.New("NULL instead of length encoded integer")
+
+// ErrMalformedLenEncInt is returned reading a length encoded integer starting with 0xff, or longer
+// than the bytes left in the packet
+var ErrMalformedLenEncInt = errors.New("malformed length encoded integer")
+
+// ErrMalformedLenEncString is returned reading a length encoded string which claims more bytes than
+// there are left in the packet, or more than MaxLenEncStringSize
+var ErrMalformedLenEncString = errors.New("malformed length encoded string")
+
 type Packager struct {
 	reader 		io.Reader
 	writer 		io.Writer
 	sqid 		int			// Keeps track
+	client		bool		// Reads and writes the raw frames of a MySQL client, without the indicator byte
+	pkts		[]*encoding.Packet	// The fragments of the message larger than MAX_PACKET_SIZE being read by ReadNext
+	next		int			// Index in pkts of the next fragment returned by ReadNext
+	err			error		// Error reading the fragment after pkts, returned once they are all returned
 }
 
+// Packager reassembles the messages larger than MAX_PACKET_SIZE
+var _ encoding.Packaging = (*Packager)(nil)
+
 
 /* ==== FUNCTIONS ============================================================*/
 
 /* ---- HERA USE -------------------------------------------------------------*/
-// Creates a Packet from the reader, reading exactly as many
-// bytes as necessary. Assumes that the encoding.Packet being read is a COMMAND PACKET
-// only. Used for incoming requests from client.
-func NewInitSQLPacket(_reader io.Reader) (*encoding.Packet, error) {
+// readPacket creates a Packet from the reader, reading exactly as many bytes as necessary. Assumes
+// that the encoding.Packet being read is a COMMAND PACKET only. withIndicator tells if the packet
+// starts with the indicator byte, as in the internal Hera communication, or is a raw frame from a
+// client. Either way the Serialized bytes of the packet start with the indicator byte. The payload of
+// a raw frame can't be larger than MaxAllowedPacket. A zero-length packet is returned with Cmd NO_CMD
+// and an empty payload.
+func readPacket(_reader io.Reader, withIndicator bool) (*encoding.Packet, error) {
 	ns := &encoding.Packet{}
 
 	var tmp = make([]byte, INT4)
 	var err error
 
+	if withIndicator {
+		// Read in the indicator byte
+		_, err = io.ReadFull(_reader, tmp[:INT1])
+		if err != nil {
+			return nil, err
+		}
+		if tmp[0] != encoding.IndicatorMySQL {
+			// give the byte back if possible so that the caller can retry with the netstring decoder
+			if scanner, ok := _reader.(io.ByteScanner); ok {
+				scanner.UnreadByte()
+			}
+			if tmp[0] == encoding.IndicatorNetstring {
+				return nil, encoding.WRONGPACKET
+			}
+			return nil, encoding.UNKNOWNPACKET
+		}
+	}
+
 	// Read in the header
-	_, err = _reader.Read(tmp)
+	_, err = io.ReadFull(_reader, tmp)
+	if err != nil {
+		return nil, err
+	}
 
 	// A MySQL packet is formatted such that there is a four header
 	// storing length of the payload (3 bytes little endian) and sequence id (1 byte)
@@ -155,8 +308,8 @@ func NewInitSQLPacket(_reader io.Reader) (*encoding.Packet, error) {
 	// Encode sequence id
 	sqid := ReadFixedLenInt(tmp, INT1, &idx)
 
-	if payloadLength == 0 {
-		return nil, nil
+	if !withIndicator && payloadLength > MaxAllowedPacket {
+		return nil, ErrPacketTooLarge
 	}
 
 	// The total length is the header + payload, given by buff.Len() + payload
@@ -164,103 +317,69 @@ func NewInitSQLPacket(_reader io.Reader) (*encoding.Packet, error) {
 	totalLen := payloadLength + HEADER_SIZE
 	ns.Length = payloadLength
 	ns.Sqid = sqid
-	ns.Serialized = make([]byte, totalLen + 1)
-	bytesRead := 1
-	// Copy the header over into ns.Serialized
-	copy(ns.Serialized[bytesRead:], tmp)
-	// Mark number of bytes already read
-	bytesRead += len(tmp)
-
-	// Read in the payload
-	var n int
-	for bytesRead < totalLen + 1 {
-		n, err = _reader.Read(ns.Serialized[bytesRead:])
+	ns.Serialized = make([]byte, PayloadStart(true), PayloadStart(true) + min(payloadLength, payloadChunkSize))
+	ns.Serialized[0] = encoding.IndicatorMySQL
+	// Copy the header over into ns.Serialized, after the indicator byte
+	copy(ns.Serialized[encoding.IndicatorSize:], tmp)
+
+	// Read in the payload, one chunk at a time
+	for len(ns.Serialized) < totalLen + 1 {
+		start := len(ns.Serialized)
+		end := start + min(totalLen + 1 - start, payloadChunkSize)
+		if end > cap(ns.Serialized) {
+			grown := make([]byte, start, min(2 * cap(ns.Serialized), totalLen + 1))
+			copy(grown, ns.Serialized)
+			ns.Serialized = grown
+		}
+		ns.Serialized = ns.Serialized[:end]
+		_, err = io.ReadFull(_reader, ns.Serialized[start:end])
 		if err != nil {
 			return nil, err
 		}
-		bytesRead += n
-	}
-	if bytesRead - 1 != totalLen {
-		return nil, errors.New(fmt.Sprintf("Expected %d bytes, instead got %d,", totalLen, bytesRead - 1))
 	}
 
-	// Read command byte, which is the first byte after the header
-	ns.Cmd = int(ns.Serialized[HEADER_SIZE+1])
-	ns.Payload = ns.Serialized[HEADER_SIZE+1:]
+	// Read command byte, which is the first byte after the header. A zero-length
+	// packet (e.g. the terminator of a payload that is an exact multiple of
+	// MAX_PACKET_SIZE) has no command byte.
+	if payloadLength > 0 {
+		ns.Cmd = int(ns.Serialized[PayloadStart(true)])
+	} else {
+		ns.Cmd = NO_CMD
+	}
+	ns.Payload = ns.Serialized[PayloadStart(true):]
 	ns.IsMySQL = true
 
 	return ns, nil
 }
 
-// Creates a Packet from the reader, reading exactly as many
-// bytes as necessary. Assumes that the encoding.Packet being read is a COMMAND PACKET
-// only. Used for internal Hera communication only.
-func NewMySQLPacket(_reader io.Reader) (*encoding.Packet, error) {
-	logger.GetLogger().Log(logger.Info, "Inside NewMySQLPacket")
-	ns := &encoding.Packet{}
-
-	var ptype = make([]byte, INT1)
-	var tmp = make([]byte, INT4)
-	var err error
+// NewInitSQLPacket reads a packet sent by a client, without the indicator byte, like the ReadPacket of
+// a Packager created with NewClientPackager
+func NewInitSQLPacket(_reader io.Reader) (*encoding.Packet, error) {
+	return readPacket(_reader, false)
+}
 
-	// Read in the indicator byte
-	_, err = _reader.Read(ptype)
+// NewMySQLPacket reads a packet of the internal Hera communication, starting with the indicator byte, like
+// the ReadPacket of a Packager created with NewPackager
+func NewMySQLPacket(_reader io.Reader) (*encoding.Packet, error) {
+	return readPacket(_reader, true)
+}
 
-	// Check packet indicator byte.
-	if len(ptype) != 0 && ptype[0] != 0 {
-		if int(ptype[0]) == 1 {
-			return nil, encoding.WRONGPACKET
-		}
-		return nil, encoding.UNKNOWNPACKET
+// SeqByteIndex returns the index of the sequence id in a serialized MySQL packet, see PayloadStart for withIndicator
+func SeqByteIndex(withIndicator bool) int {
+	if withIndicator {
+		return encoding.IndicatorSize + INT3
 	}
+	return INT3
+}
 
-	// Read the header into tmp
-	_, err = _reader.Read(tmp)
-	logger.GetLogger().Log(logger.Info, "Read it in")
-
-	idx := 0
-	// Encode payload_length
-	payload_length := ReadFixedLenInt(tmp, INT3, &idx)
-	// Encode sequence id
-	sqid := ReadFixedLenInt(tmp, INT1, &idx)
-
-	// The total length is the header + payload, given by HEADER_SIZE + payload
-	// length read from the packet
-	totalLen := payload_length + HEADER_SIZE
-	ns.Length = payload_length
-	// Sequence id is as specified by the header
-	ns.Sqid = sqid
-
-	ns.Serialized = make([]byte, totalLen + 1) // + 1 is for the indicator byte
-	ns.Serialized[0] = ptype[0]
-
-	bytesRead := 1
-	// Copy the header over into ns.Serialized
-	copy(ns.Serialized[bytesRead:], tmp)
-	// Mark number of bytes already read
-	bytesRead += len(tmp)
-
-	// Read in the payload
-	var n int
-	for bytesRead < totalLen + 1 {
-		n, err = _reader.Read(ns.Serialized[bytesRead:])
-		if err != nil {
-			return nil, err
-		}
-		bytesRead += n
-	}
-	if (bytesRead - 1) != totalLen {
-		return nil, errors.New(fmt.Sprintf("Expected %d bytes, instead got %d,", totalLen, bytesRead - 1))
+// PayloadStart returns the index of the payload in a serialized MySQL packet, after the header. The Serialized
+// bytes of an encoding.Packet start with the indicator byte, withIndicator true, the ones written to a client,
+// Serialized[encoding.IndicatorSize:], don't.
+func PayloadStart(withIndicator bool) int {
+	if withIndicator {
+		return encoding.IndicatorSize + HEADER_SIZE
 	}
-
-	// Read command byte, which is the first byte after the header
-	ns.Cmd = int(ns.Serialized[HEADER_SIZE + 1])
-	// Set the payload of the packet.
-	ns.Payload = ns.Serialized[HEADER_SIZE + 1:]
-	ns.IsMySQL = true
-	logger.GetLogger().Log(logger.Info, "Ready to return")
-
-	return ns, nil
+	return HEADER_SIZE
 }
 
 // NewPacketFrom creates a packet from command and payload.
@@ -285,24 +404,24 @@ func NewMySQLPacketFrom(sqid int, _payload []byte) *encoding.Packet {
 	// Create an empty encoding.Packet
 	ns := &encoding.Packet{}
 
-	if payloadLen == 0 {
-		// throw error, maybe?
-		return ns
+	// Read the command byte from the payload! ;) Zero-length packets are
+	// legitimate, they just have a header and no command byte.
+	if payloadLen > 0 {
+		ns.Cmd = int(_payload[0])
+	} else {
+		ns.Cmd = NO_CMD
 	}
 
-	// Read the command byte from the payload! ;)
-	ns.Cmd = int(_payload[0])
-
 	// Create the full packet which has the header and the payload.
-	ns.Serialized = make([]byte, INT4 /* header length */ + payloadLen + 1)
-	ns.Serialized[0] = 0 				// to indicate MySQLPacket
+	ns.Serialized = make([]byte, PayloadStart(true) + payloadLen)
+	ns.Serialized[0] = encoding.IndicatorMySQL
 	ns.Length = payloadLen
 	ns.Sqid = sqid
 	ns.Payload = _payload
 	ns.IsMySQL = true
 
-	// Write in header
-	idx := 1
+	// Write in header, after the indicator byte
+	idx := encoding.IndicatorSize
 	// 3 bytes indicating payload length
 	WriteFixedLenInt(ns.Serialized, INT3, payloadLen, &idx)
 	// 1 byte indicating the sequence_id
@@ -313,7 +432,10 @@ func NewMySQLPacketFrom(sqid int, _payload []byte) *encoding.Packet {
 	return ns
 }
 
-// Write multiple (or one) packets. Copied this over from mocksqlsrv WritePacket code.
+// Write multiple (or one) packets. Copied this over from mocksqlsrv WritePacket code. The packets are
+// returned, and written to the writer of the Packager if it has one, framed as by Frame. The message ends
+// with a packet shorter than MAX_PACKET_SIZE: an empty payload is sent as one empty packet, and a payload
+// which is a multiple of MAX_PACKET_SIZE is followed by an empty packet.
 func (p *Packager) WritePacket(_payload []byte) ([]*encoding.Packet, error) {
 
 	/* Set current payload length. */
@@ -324,12 +446,19 @@ func (p *Packager) WritePacket(_payload []byte) ([]*encoding.Packet, error) {
 
 	var packets []*encoding.Packet
 
-	for length > 0 {
-		/* Determine packetLength, capped by MAX_PACKET_SIZE. */
+	for {
+		/* Determine packetLength, capped by MAX_PACKET_SIZE. The cap is fixed by the protocol, not by
+		 * the max packet size of the client: a shorter packet would end the message. */
 		packetsize := min(length, MAX_PACKET_SIZE)
 		numPackets++
 
-		packets = append(packets, NewMySQLPacketFrom(p.sqid, _payload[pidx:pidx+packetsize]))
+		pkt := NewMySQLPacketFrom(p.sqid, _payload[pidx:pidx+packetsize])
+		packets = append(packets, pkt)
+		if p.writer != nil {
+			if _, err := p.writer.Write(p.Frame(pkt)); err != nil {
+				return packets, err
+			}
+		}
 
 		pidx += packetsize
 		if pidx > len(_payload) {
@@ -338,32 +467,161 @@ func (p *Packager) WritePacket(_payload []byte) ([]*encoding.Packet, error) {
 
 		length -= packetsize
 		p.sqid++
+		if packetsize < MAX_PACKET_SIZE {
+			break
+		}
 	}
 
 	return packets, nil
 }
 
-// NewPacketReader creates a Reader, that maintains the state / aka sequence_id
-// for packets sent to the server
+// AppendPacket is like WritePacket, but instead of creating the packets it appends them serialized
+// to dst and returns the extended buffer. Used to assemble many response packets, i.e. resultset
+// rows, in one buffer which can be written with a single call.
+func (p *Packager) AppendPacket(dst []byte, _payload []byte) []byte {
+	for pidx := 0; ; {
+		packetsize := min(len(_payload)-pidx, MAX_PACKET_SIZE)
+		pkt := encoding.Packet{Payload: _payload[pidx : pidx+packetsize], Sqid: p.sqid, IsMySQL: true}
+		dst = pkt.AppendSerialized(dst)
+		pidx += packetsize
+		p.sqid++
+		if packetsize < MAX_PACKET_SIZE {
+			return dst
+		}
+	}
+}
+
+// NewPackager creates a Packager, that maintains the state / aka sequence_id
+// for packets sent to the server. It reads and writes the packets of the internal
+// Hera communication, which start with the indicator byte.
 func NewPackager(_reader io.Reader, _writer io.Writer) *Packager {
 	return &Packager{reader:_reader, writer:_writer}
 }
 
+// NewClientPackager creates a Packager for the connection with a MySQL client, which reads and writes
+// the raw frames, without the indicator byte
+func NewClientPackager(_reader io.Reader, _writer io.Writer) *Packager {
+	return &Packager{reader:_reader, writer:_writer, client:true}
+}
+
+// SetSqid sets the sequence id of the next packet written
+func (p *Packager) SetSqid(sqid int) {
+	p.sqid = sqid
+}
+
+// Frame returns the bytes of pkt to write in the mode of the Packager: the Serialized bytes, without the
+// indicator byte for a client
+func (p *Packager) Frame(pkt *encoding.Packet) []byte {
+	if p.client {
+		return pkt.Serialized[encoding.IndicatorSize:]
+	}
+	return pkt.Serialized
+}
+
+// ReadPacket reads one packet from the reader of the Packager, with the indicator byte or, for a client,
+// without. Unlike ReadNext it doesn't keep track of the sequence id.
+func (p *Packager) ReadPacket() (*encoding.Packet, error) {
+	return readPacket(p.reader, !p.client)
+}
+
 
-// ReadNext returns the next packet from the stream.
-// Note: in case of multiple packets bigger than 16 MB the Reader will buffer
-// some packets, a different function will probably have to be used. This is
-// just for grabbing one packet from the stream. encoding.Packets are not embedded.
+// ReadNext returns the next packet from the stream. Like the netstring Reader with the embedded netstrings,
+// the Packager buffers the fragments of a message larger than MAX_PACKET_SIZE: they are all read with the
+// first one, then returned one at a time by the next calls. An error reading a fragment is returned after
+// the fragments read before it.
 func (p *Packager) ReadNext() (ns *encoding.Packet, err error) {
+	if p.next < len(p.pkts) {
+		ns = p.pkts[p.next]
+		p.next++
+		if p.next == len(p.pkts) {
+			// the last fragment, the message is not kept
+			p.pkts = nil
+			p.next = 0
+		}
+		p.sqid = ns.Sqid
+		return ns, nil
+	}
+	if p.err != nil {
+		err = p.err
+		p.err = nil
+		return nil, err
+	}
 	// Read in a packet from the packager's reader.
 	logger.GetLogger().Log(logger.Info, "Inside readnext")
-	pkt, err := NewMySQLPacket(p.reader)
+	ns, err = p.ReadPacket()
 	if err != nil {
 		return nil, err
 	}
 	// Set the sequence id to what is already in the packet
-	p.sqid = pkt.Sqid
-	return pkt, err
+	p.sqid = ns.Sqid
+	if ns.Length == MAX_PACKET_SIZE {
+		p.pkts, p.err = p.readFragments(ns)
+		p.next = 1
+		if len(p.pkts) == 1 {
+			p.pkts = nil
+			p.next = 0
+		}
+	}
+	return ns, nil
+}
+
+// readFragments reads the packets following first up to the end of its message, the first packet shorter than
+// MAX_PACKET_SIZE. It returns the packets read, first included. It stops with an error at a packet out of
+// order, or before the message grows larger than MaxMessageSize.
+func (p *Packager) readFragments(first *encoding.Packet) ([]*encoding.Packet, error) {
+	pkts := []*encoding.Packet{first}
+	size := first.Length
+	for last := first; last.Length == MAX_PACKET_SIZE; {
+		if size+MAX_PACKET_SIZE > MaxMessageSize {
+			// the next packet can't be shorter than what is left, the message can't end in time
+			return pkts, ErrMessageTooLarge
+		}
+		pkt, err := p.ReadPacket()
+		if err != nil {
+			return pkts, err
+		}
+		if err = checkSqid(last, pkt); err != nil {
+			return pkts, err
+		}
+		size += pkt.Length
+		pkts = append(pkts, pkt)
+		last = pkt
+	}
+	return pkts, nil
+}
+
+// checkSqid returns an error if pkt doesn't follow last in the message
+func checkSqid(last, pkt *encoding.Packet) error {
+	if pkt.Sqid != (last.Sqid+1)&0xff {
+		return fmt.Errorf("packet out of order, expected sequence id %d, instead got %d", (last.Sqid+1)&0xff, pkt.Sqid)
+	}
+	return nil
+}
+
+// IsComposite tells if the last packet read is a fragment of a message larger than MAX_PACKET_SIZE which is
+// followed by more fragments, buffered by ReadNext or the error reading them. A message which is an exact
+// multiple of MAX_PACKET_SIZE ends with an empty packet.
+func (p *Packager) IsComposite() bool {
+	return p.next < len(p.pkts) || p.err != nil
+}
+
+// ReadMultiplePackets reads the rest of the message starting with the packet first, which was just read
+// with ReadNext. It returns all the packets of the message, first included, which ReadNext has already
+// buffered. The sequence ids must follow each other.
+func (p *Packager) ReadMultiplePackets(first *encoding.Packet) ([]*encoding.Packet, error) {
+	packets := []*encoding.Packet{first}
+	for last := first; last.Length == MAX_PACKET_SIZE; {
+		pkt, err := p.ReadNext()
+		if err != nil {
+			return packets, err
+		}
+		if err = checkSqid(last, pkt); err != nil {
+			return packets, err
+		}
+		packets = append(packets, pkt)
+		last = pkt
+	}
+	return packets, nil
 }
 
 // Length of length encoded string is length of the lenenc and length of the string
@@ -371,10 +629,165 @@ func calculateLenEncStr(s string) int {
 	return calculateLenEnc(uint64(len(s))) + len(s)
 }
 
+// ColumnTypeName returns the database type name of the column, with " UNSIGNED" appended for an unsigned
+// column whose name doesn't tell. Older drivers only tell through the scan type, newer ones prefix the name
+// with "UNSIGNED ". The size of a DECIMAL column is included, see DecimalTypeName. The names are passed to
+// the resultset row encoders, which need the signedness and the scale.
+func ColumnTypeName(colType *sql.ColumnType) string {
+	name := DecimalTypeName(colType)
+	if _, unsigned := splitUnsigned(name); unsigned {
+		return name
+	}
+	if st := colType.ScanType(); st != nil {
+		switch st.Kind() {
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return name + " UNSIGNED"
+		}
+	}
+	return name
+}
+
+// splitUnsigned returns the type name without its UNSIGNED prefix or suffix, the key of EnumFieldTypes, and
+// whether there was one
+func splitUnsigned(typeName string) (string, bool) {
+	if strings.HasPrefix(typeName, "UNSIGNED ") {
+		return strings.TrimPrefix(typeName, "UNSIGNED "), true
+	}
+	if strings.HasSuffix(typeName, " UNSIGNED") {
+		return strings.TrimSuffix(typeName, " UNSIGNED"), true
+	}
+	return typeName, false
+}
+
+// baseTypeName returns the type name without its UNSIGNED prefix or suffix and without its size, the key of
+// EnumFieldTypes, and whether it was unsigned
+func baseTypeName(typeName string) (string, bool) {
+	name, unsigned := splitUnsigned(typeName)
+	if open := strings.IndexByte(name, '('); open >= 0 {
+		name = name[:open]
+	}
+	return name, unsigned
+}
+
+// fieldType returns the MySQL field type of a type name and whether it is unsigned
+func fieldType(typeName string) (int, bool) {
+	name, unsigned := baseTypeName(typeName)
+	return EnumFieldTypes[name], unsigned
+}
+
+// isDecimalType tells if the type name, without UNSIGNED and size, is a fixed point type
+func isDecimalType(name string) bool {
+	switch name {
+	case "DECIMAL", "NEWDECIMAL", "NUMERIC":
+		return true
+	}
+	return false
+}
+
+// DecimalTypeName returns the database type name of the column followed by its precision and scale, e.g.
+// "DECIMAL(10,2)", when it is a DECIMAL or NUMERIC column whose size the driver knows. Otherwise it is the
+// database type name. The values of the column are formatted with the scale, see FormatDecimal.
+func DecimalTypeName(colType *sql.ColumnType) string {
+	name := colType.DatabaseTypeName()
+	base, unsigned := splitUnsigned(name)
+	if !isDecimalType(base) {
+		return name
+	}
+	precision, scale, ok := colType.DecimalSize()
+	if !ok {
+		return name
+	}
+	name = fmt.Sprintf("%s(%d,%d)", base, precision, scale)
+	if unsigned {
+		name += " UNSIGNED"
+	}
+	return name
+}
+
+// DecimalSize returns the precision and the scale of a type name returned by DecimalTypeName, ok is false for
+// the other type names
+func DecimalSize(typeName string) (precision, scale int, ok bool) {
+	name, _ := splitUnsigned(typeName)
+	open := strings.IndexByte(name, '(')
+	if open < 0 || !isDecimalType(name[:open]) {
+		return 0, 0, false
+	}
+	var end string
+	n, _ := fmt.Sscanf(name[open:], "(%d,%d%s", &precision, &scale, &end)
+	if n != 3 || end != ")" || scale < 0 {
+		return 0, 0, false
+	}
+	return precision, scale, true
+}
+
+// FormatDecimal writes the decimal number value with exactly scale digits after the decimal point, like the
+// MySQL server writes a DECIMAL(M,D) value: the missing digits are padded with zeros, the extra ones are
+// rounded half away from zero. A value which isn't a plain decimal number, e.g. with an exponent, is returned
+// unchanged.
+func FormatDecimal(value string, scale int) string {
+	if scale < 0 {
+		return value
+	}
+	digits := value
+	sign := ""
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		if digits[0] == '-' {
+			sign = "-"
+		}
+		digits = digits[1:]
+	}
+	intPart, frac := digits, ""
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		intPart, frac = digits[:dot], digits[dot+1:]
+	}
+	if len(intPart)+len(frac) == 0 || !isDigits(intPart) || !isDigits(frac) {
+		return value
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(frac) <= scale {
+		frac += strings.Repeat("0", scale-len(frac))
+	} else {
+		roundUp := frac[scale] >= '5'
+		frac = frac[:scale]
+		if roundUp {
+			// add one to the last digit kept, the carry may add a digit to the integer part
+			n, _ := new(big.Int).SetString("0"+intPart+frac, 10)
+			rounded := n.Add(n, big.NewInt(1)).String()
+			if len(rounded) <= scale {
+				rounded = strings.Repeat("0", scale-len(rounded)+1) + rounded
+			}
+			intPart, frac = strings.TrimLeft(rounded[:len(rounded)-scale], "0"), rounded[len(rounded)-scale:]
+		}
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+	if strings.Trim(intPart+frac, "0") == "" {
+		sign = ""
+	}
+	if scale == 0 {
+		return sign + intPart
+	}
+	return sign + intPart + "." + frac
+}
+
+// isDigits tells if str only has decimal digits
+func isDigits(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] < '0' || str[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 // Result sets function
 // https://dev.mysql.com/doc/dev/mysql-server/8.0.12/page_protocol_com_query_response_text_resultset_column_definition.html
-// This is specifically for reconstructing ColumnDefinition41 packets.
-func (p *Packager) ColumnDefinition(colName string, colType *sql.ColumnType) []byte {
+// This is specifically for reconstructing ColumnDefinition41 packets, or ColumnDefinition320 packets for a client
+// without CLIENT_PROTOCOL_41. The name of the column is the one reported by the driver, which is the alias for an
+// aliased column. orgName is the name of the column in the table, from common.SelectColumns: it is empty for an
+// expression, and when the select list is unknown pass colType.Name().
+func (p *Packager) ColumnDefinition(orgName string, colType *sql.ColumnType, capabilities uint32) []byte {
 	// TODO: Reconstruct column definition packet... Unsure how this will be done because what is returned from
 	//  a sql.Prepare(...) is a sql.Stmt. The sql.Rows is where we get sql.ColumnTypes from, which happens AFTER
 	//  we execute the query. But sql.Rows also does not expose all of the necessary fields to reconstruct the
@@ -385,72 +798,101 @@ func (p *Packager) ColumnDefinition(colName string, colType *sql.ColumnType) []b
 	schema := "temp-schema"
 	table := "temp-table"
 	org_table := "temp-table"
-	name := colName
-	org_name := colType.Name()
-	totalLen := calculateLenEncStr("def") + calculateLenEncStr(schema) + calculateLenEncStr(table) + calculateLenEncStr(org_table) +
-		calculateLenEncStr(org_name) + calculateLenEnc(uint64(0x0c)) + INT2 + INT4 + INT1 + INT2 + INT1
-	payload := make([]byte, totalLen)
-	pos := 0
+	name := colType.Name()
+	org_name := orgName
 	colLength, ok := colType.Length()
 	if !ok {
 		logger.GetLogger().Log(logger.Debug, "colType.Length()", colLength)
 	}
 
-	cTypeInt := EnumFieldTypes[colType.DatabaseTypeName()] // returns sql column type as an int
+	typeName, unsigned := baseTypeName(ColumnTypeName(colType))
+	cTypeInt := EnumFieldTypes[typeName] // returns sql column type as an int
 
 	// The flags encode a lot of information about what the column is. If it can have NULL values, is it unique,
 	// is it a primary key, is it autoincrement, is it group, etc. This is the information that gets lost between
-	// using the go-sql-driver and communication with the MySQL database.
-
-	// This section is to determine whether or not the column is of a nullable type or not.
+	// using the go-sql-driver and communication with the MySQL database: database/sql only exposes the
+	// nullability, the signedness through the scan type and the binary types through the type name, so
+	// PRI_KEY_FLAG and AUTO_INCREMENT_FLAG are never set.
 	var flags int
-	nable, ok := colType.Nullable()
-	if !ok {
-		if nable {
-			flags = 0
-		} else {
-			flags = 1
-		}
-	} else {
-		flags = 1
+	if nullable, ok := colType.Nullable(); ok && !nullable {
+		flags |= NOT_NULL_FLAG
+	}
+	if unsigned {
+		flags |= UNSIGNED_FLAG
+	}
+	switch typeName {
+	case "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "TINYTEXT", "TEXT", "MEDIUMTEXT", "LONGTEXT":
+		flags |= BLOB_FLAG
+	}
+
+	// Character columns are sent as utf8_general_ci, everything else, including the numbers and the dates
+	// like the MySQL server does, with the binary collation
+	charset := CHARSET_UTF8_GENERAL_CI
+	switch typeName {
+	case "CHAR", "VARCHAR", "TINYTEXT", "TEXT", "MEDIUMTEXT", "LONGTEXT", "ENUM", "SET", "JSON":
+	default:
+		charset = CHARSET_BINARY
+		flags |= BINARY_FLAG
 	}
 
 	// This section determines the precision (number of decimal digits to show) for the column.
+	precision, scale, hasScale := colType.DecimalSize()
 	var prec int
 	switch cTypeInt {
 	case 0x01 /* tiny int */ , 0x02 /* short */, 0x03 /* long */, 0x08 /* longlong */, 0x09 /* int24 */, 0xfe /* char */:
 		prec = 0x00
-	case 0xfd /* var_string */ , 0x0f /* varchar */ , 0x05 /* double */, 0x04 /* float */:
+	case 0xfd /* var_string */ , 0x0f /* varchar */:
+		prec = 0x1f
+	case 0x05 /* double */, 0x04 /* float */:
 		prec = 0x1f
+		if hasScale && scale < 0x1f {
+			prec = int(scale)
+		}
 	case 0x00 /* decimal */, 0xf6 /* new_decimal*/:
-		tmp, _, ok := colType.DecimalSize()
-		if !ok {
+		if !hasScale {
 			logger.GetLogger().Log(logger.Warning, "Decimal size")
 		}
-		prec = int(tmp)
+		prec = int(scale)
+	case 0x07 /* timestamp */, 0x0b /* time */, 0x0c /* datetime */:
+		prec = int(scale)
 	}
 
+	// The driver doesn't always know the length, the display width of the numbers and the dates can be
+	// computed from the type like the MySQL server does.
+	if !ok || colLength == 0 {
+		colLength = displayWidth(cTypeInt, unsigned, precision, scale)
+	}
+
+	if !Supports(capabilities, CLIENT_PROTOCOL_41) {
+		return columnDefinition320(table, name, colLength, cTypeInt, flags, prec, capabilities)
+	}
+
+	totalLen := calculateLenEncStr("def") + calculateLenEncStr(schema) + calculateLenEncStr(table) + calculateLenEncStr(org_table) +
+		calculateLenEncStr(name) + calculateLenEncStr(org_name) + calculateLenEnc(uint64(0x0c)) + INT2 + INT4 + INT1 + INT2 + INT1 + INT2
+	payload := make([]byte, totalLen)
+	pos := 0
+
 	// Write catalog
-	WriteString(payload, ctl, LENENCSTR, &pos, 0)
+	WriteString(payload, ctl, LENENCSTR, &pos, len(ctl))
 	// Write schema
-	WriteString(payload, schema, LENENCSTR, &pos, 0)
+	WriteString(payload, schema, LENENCSTR, &pos, len(schema))
 	// Write table
-	WriteString(payload, table, LENENCSTR, &pos, 0)
+	WriteString(payload, table, LENENCSTR, &pos, len(table))
 	// Write org_table
-	WriteString(payload, org_table, LENENCSTR, &pos, 0)
+	WriteString(payload, org_table, LENENCSTR, &pos, len(org_table))
 	// Write name
-	WriteString(payload, name, LENENCSTR, &pos, 0)
+	WriteString(payload, name, LENENCSTR, &pos, len(name))
 	// Write org_name
-	WriteString(payload, org_name, LENENCSTR, &pos, 0)
+	WriteString(payload, org_name, LENENCSTR, &pos, len(org_name))
 	// write length of fixed length fields
 	WriteLenEncInt(payload, 0x0c, &pos)
-	// char set (temporarily utf8_general_ci which is 0x21)
-	WriteFixedLenInt(payload, INT2, 0x21, &pos)
+	// character set
+	WriteFixedLenInt(payload, INT2, charset, &pos)
 	// column-length
 	WriteFixedLenInt(payload, INT4, int(colLength), &pos)
 	// column scan type
 	WriteFixedLenInt(payload, INT1, cTypeInt, &pos)
-	// flags (mainly used for checking nullable)
+	// flags
 	WriteFixedLenInt(payload, INT2, flags, &pos)
 	// decimals
 	WriteFixedLenInt(payload, INT1, prec, &pos)
@@ -465,57 +907,576 @@ func (p *Packager) ColumnDefinition(colName string, colType *sql.ColumnType) []b
 	return payload
 }
 
-// Stmt Prepare OK content pre-Column definition (if any)
-// https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html#packet-COM_STMT_PREPARE_OK
-// This is specifically for ColumnDefinition41 packets.
-func StmtPrepareOK(stmt_id, num_columns,  num_params int) []byte {
-	payload := make([]byte, INT1 /* status */ + INT4 /* stmtid */ + INT2 /* cols */ + INT2 /* params */ + INT1 /* filler */ + INT2 /* warnings */)
+// ParamDefinition returns the definition of a parameter of a prepared statement sent after COM_STMT_PREPARE_OK,
+// for a client with the capabilities. Like with MySQL it is a binary VAR_STRING named "?": the type of the
+// parameter is only known from the execute.
+func ParamDefinition(capabilities uint32) []byte {
+	if !Supports(capabilities, CLIENT_PROTOCOL_41) {
+		return columnDefinition320("", "?", 0, EnumFieldTypes["VAR_STRING"], BINARY_FLAG, 0, capabilities)
+	}
+	totalLen := calculateLenEncStr("def") + 3*calculateLenEncStr("") + calculateLenEncStr("?") + calculateLenEncStr("") +
+		calculateLenEnc(uint64(0x0c)) + INT2 + INT4 + INT1 + INT2 + INT1 + INT2
+	payload := make([]byte, totalLen)
+	pos := 0
+
+	// Write catalog
+	WriteString(payload, "def", LENENCSTR, &pos, len("def"))
+	// Write schema, table and org_table
+	for i := 0; i < 3; i++ {
+		WriteString(payload, "", LENENCSTR, &pos, 0)
+	}
+	// Write name
+	WriteString(payload, "?", LENENCSTR, &pos, len("?"))
+	// Write org_name
+	WriteString(payload, "", LENENCSTR, &pos, 0)
+	// write length of fixed length fields
+	WriteLenEncInt(payload, 0x0c, &pos)
+	// character set
+	WriteFixedLenInt(payload, INT2, CHARSET_BINARY, &pos)
+	// column-length
+	WriteFixedLenInt(payload, INT4, 0, &pos)
+	// column scan type
+	WriteFixedLenInt(payload, INT1, EnumFieldTypes["VAR_STRING"], &pos)
+	// flags
+	WriteFixedLenInt(payload, INT2, BINARY_FLAG, &pos)
+	// decimals
+	WriteFixedLenInt(payload, INT1, 0, &pos)
+	// filler
+	WriteFixedLenInt(payload, INT2, 0x00, &pos)
+	return payload
+}
+
+// columnDefinition320 returns the column definition of a client without CLIENT_PROTOCOL_41. There is no catalog,
+// schema, original names nor character set, and each fixed length field is prefixed by its length. The flags are
+// two bytes with CLIENT_LONG_FLAG, otherwise only the low byte is sent. The column length is three bytes.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnDefinition320
+func columnDefinition320(table, name string, colLength int64, fieldType, flags, decimals int, capabilities uint32) []byte {
+	flagsLen := INT1
+	if Supports(capabilities, CLIENT_LONG_FLAG) {
+		flagsLen = INT2
+	}
+	if colLength > 0xffffff {
+		colLength = 0xffffff
+	}
+	payload := make([]byte, calculateLenEncStr(table)+calculateLenEncStr(name)+1+INT3+1+INT1+1+flagsLen+INT1)
+	pos := 0
+	WriteLenEncString(payload, table, &pos)
+	WriteLenEncString(payload, name, &pos)
+	// length of the column length, column length
+	WriteLenEncInt(payload, uint64(INT3), &pos)
+	WriteFixedLenInt(payload, INT3, int(colLength), &pos)
+	// length of the type, type
+	WriteLenEncInt(payload, uint64(INT1), &pos)
+	WriteFixedLenInt(payload, INT1, fieldType, &pos)
+	// length of the flags and decimals, flags, decimals
+	WriteLenEncInt(payload, uint64(flagsLen+INT1), &pos)
+	WriteFixedLenInt(payload, flagsLen, flags&(1<<(8*uint(flagsLen))-1), &pos)
+	WriteFixedLenInt(payload, INT1, decimals, &pos)
+	return payload
+}
+
+// displayWidth is the column length the MySQL server sends for the numeric and temporal types, i.e.
+// 11 for a signed INT. For DECIMAL it includes the sign and the decimal point. It returns 0 for the
+// other types, whose length depends on the column definition.
+func displayWidth(fieldType int, unsigned bool, precision, scale int64) int64 {
+	var sign int64 = 1
+	if unsigned {
+		sign = 0
+	}
+	switch fieldType {
+	case 0x01 /* tiny int */:
+		return 3 + sign
+	case 0x02 /* short */:
+		return 5 + sign
+	case 0x09 /* int24 */:
+		return 8 + sign
+	case 0x03 /* long */:
+		return 10 + sign
+	case 0x08 /* longlong */:
+		return 20
+	case 0x04 /* float */:
+		return 12
+	case 0x05 /* double */:
+		return 22
+	case 0x00 /* decimal */, 0xf6 /* new_decimal*/:
+		if scale > 0 {
+			return precision + 2
+		}
+		return precision + 1
+	case 0x0a /* date */:
+		return 10
+	case 0x0d /* year */:
+		return 4
+	case 0x0b /* time */:
+		if scale > 0 {
+			return 11 + scale
+		}
+		return 10
+	case 0x07 /* timestamp */, 0x0c /* datetime */:
+		if scale > 0 {
+			return 20 + scale
+		}
+		return 19
+	}
+	return 0
+}
+
+// Stmt Prepare OK content pre-Column definition (if any)
+// https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html#packet-COM_STMT_PREPARE_OK
+// This is specifically for ColumnDefinition41 packets. The response is followed by the definitions of the
+// parameters and of the columns, each list ended by an EOF unless it is empty or CLIENT_DEPRECATE_EOF is set.
+func StmtPrepareOK(stmt_id, num_columns, num_params, warnings int) []byte {
+	payload := make([]byte, INT1 /* status */ + INT4 /* stmtid */ + INT2 /* cols */ + INT2 /* params */ + INT1 /* filler */ + INT2 /* warnings */)
+	pos := 0
+	// Write status
+	WriteFixedLenInt(payload, INT1, 0x00, &pos)
+	// Write stmt_id, which is the id the client uses in COM_STMT_EXECUTE / COM_STMT_CLOSE
+	WriteFixedLenInt(payload, INT4, stmt_id, &pos)
+	// Write num_columns
+	WriteFixedLenInt(payload, INT2, num_columns, &pos)
+	// Write num_params
+	WriteFixedLenInt(payload, INT2, num_params, &pos)
+	// Write reserved_1, the filler
+	WriteFixedLenInt(payload, INT1, 0x00, &pos)
+	// Write warning_count
+	WriteFixedLenInt(payload, INT2, warnings, &pos)
+
+	logger.GetLogger().Log(logger.Info, "Writing OK packet payload:", payload)
+	return payload
+}
+
+// ValueFormatter translates a column value from the database format before it is written
+// in a result row. The worker uses CmdProcessorAdapter.ProcessMySQLResult, the dates must stay in the
+// database format, which parseDateTime reads for the binary protocol.
+type ValueFormatter func(colType string, res string) string
+
+// formatValue applies the formatter, if any, to a non-NULL value. The value of a DECIMAL column is first
+// written with the scale of the column, the database type name having its size, see DecimalTypeName.
+func formatValue(colType string, value sql.NullString, format ValueFormatter) string {
+	str := value.String
+	if _, scale, ok := DecimalSize(colType); ok {
+		str = FormatDecimal(str, scale)
+	}
+	if format == nil {
+		return str
+	}
+	return format(colType, str)
+}
+
+// Result set row in the text protocol, each value is a length encoded string and NULL is 0xfb.
+// colTypes are the database type names of the columns, as returned by ColumnTypeName.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::ResultsetRow
+func TextResultsetRow(colTypes []string, values []sql.NullString, format ValueFormatter) []byte {
+	fields := make([]sql.NullString, len(values))
+	pLen := 0
+	for i := range values {
+		if values[i].Valid {
+			fields[i] = sql.NullString{String: formatValue(colTypes[i], values[i], format), Valid: true}
+		}
+		pLen += textFieldLen(fields[i])
+	}
+	payload := make([]byte, pLen)
+	pos := 0
+	for i := range fields {
+		writeTextField(payload, fields[i], &pos)
+	}
+	return payload
+}
+
+// textFieldLen returns the length of a value in a text resultset row
+func textFieldLen(value sql.NullString) int {
+	if !value.Valid {
+		return INT1
+	}
+	return calculateLenEncStr(value.String)
+}
+
+// writeTextField writes a value of a text resultset row. NULL is the single byte 0xfb, any other value,
+// the empty string included, is a length encoded string.
+func writeTextField(data []byte, value sql.NullString, pos *int) {
+	if !value.Valid {
+		WriteFixedLenInt(data, INT1, 0xfb, pos)
+		return
+	}
+	WriteString(data, value.String, LENENCSTR, pos, len(value.String))
+}
+
+// binaryValueLen returns the length of a value in the binary protocol, based on the column type
+func binaryValueLen(cTypeInt int, str string) int {
+	switch cTypeInt {
+	case 0x01 /* tiny */:
+		return INT1
+	case 0x02 /* short */, 0x0d /* year */:
+		return INT2
+	case 0x03 /* long */, 0x09 /* int24 */, 0x04 /* float */:
+		return INT4
+	case 0x08 /* longlong */, 0x05 /* double */:
+		return INT8
+	case 0x07 /* timestamp */, 0x0a /* date */, 0x0c /* datetime */:
+		return WriteBinaryDateTime(nil, parseDateTime(str), nil)
+	case 0x0b /* time */:
+		return WriteBinaryTime(nil, parseTime(str), nil)
+	}
+	return calculateLenEncStr(str)
+}
+
+// writeBinaryValue writes a value in the binary protocol format of the column type. The value of an unsigned
+// integer column is parsed as unsigned, so that a BIGINT UNSIGNED above 2^63 keeps all its bits. So is a value
+// out of the signed range: go-sql-driver 1.4 scans a nullable unsigned column as sql.NullInt64, without telling
+// it is unsigned.
+func writeBinaryValue(data []byte, cTypeInt int, unsigned bool, str string, pos *int) {
+	switch cTypeInt {
+	case 0x01 /* tiny */, 0x02 /* short */, 0x0d /* year */, 0x03 /* long */, 0x09 /* int24 */, 0x08 /* longlong */:
+		var n int
+		if unsigned {
+			u, err := strconv.ParseUint(str, 10, 64)
+			if err != nil {
+				logger.GetLogger().Log(logger.Warning, "Can't convert to unsigned integer:", str, err.Error())
+			}
+			n = int(u)
+		} else {
+			i, err := strconv.ParseInt(str, 10, 64)
+			if errors.Is(err, strconv.ErrRange) {
+				var u uint64
+				if u, err = strconv.ParseUint(str, 10, 64); err == nil {
+					i = int64(u)
+				}
+			}
+			if err != nil {
+				logger.GetLogger().Log(logger.Warning, "Can't convert to integer:", str, err.Error())
+			}
+			n = int(i)
+		}
+		WriteFixedLenInt(data, binaryValueLen(cTypeInt, str), n, pos)
+	case 0x04 /* float */:
+		f, err := strconv.ParseFloat(str, 32)
+		if err != nil {
+			logger.GetLogger().Log(logger.Warning, "Can't convert to float:", str, err.Error())
+		}
+		WriteFixedLenInt(data, INT4, int(math.Float32bits(float32(f))), pos)
+	case 0x05 /* double */:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			logger.GetLogger().Log(logger.Warning, "Can't convert to double:", str, err.Error())
+		}
+		WriteFixedLenInt(data, INT8, int(math.Float64bits(f)), pos)
+	case 0x07 /* timestamp */, 0x0a /* date */, 0x0c /* datetime */:
+		WriteBinaryDateTime(data, parseDateTime(str), pos)
+	case 0x0b /* time */:
+		WriteBinaryTime(data, parseTime(str), pos)
+	default:
+		WriteString(data, str, LENENCSTR, pos, len(str))
+	}
+}
+
+// parseDateTime parses a DATE, DATETIME or TIMESTAMP value in the text format of the database. The zero
+// date 0000-00-00 and the values which can't be parsed are the zero time.Time.
+func parseDateTime(str string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t
+		}
+	}
+	if !strings.HasPrefix(str, "0000-00-00") {
+		logger.GetLogger().Log(logger.Warning, "Can't convert to datetime:", str)
+	}
+	return time.Time{}
+}
+
+// parseTime parses a TIME value, [-]hhh:mm:ss[.ffffff], in the text format of the database
+func parseTime(str string) time.Duration {
+	var d time.Duration
+	negative := strings.HasPrefix(str, "-")
+	fields := strings.SplitN(strings.TrimPrefix(str, "-"), ":", 3)
+	if len(fields) != 3 {
+		logger.GetLogger().Log(logger.Warning, "Can't convert to time:", str)
+		return 0
+	}
+	for i, unit := range []time.Duration{time.Hour, time.Minute} {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			logger.GetLogger().Log(logger.Warning, "Can't convert to time:", str, err.Error())
+			return 0
+		}
+		d += time.Duration(n) * unit
+	}
+	sec, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		logger.GetLogger().Log(logger.Warning, "Can't convert to time:", str, err.Error())
+		return 0
+	}
+	d += time.Duration(math.Round(sec*1e6)) * time.Microsecond
+	if negative {
+		d = -d
+	}
+	return d
+}
+
+// WriteBinaryDateTime writes a DATE, DATETIME or TIMESTAMP value in the binary protocol: the length, 0, 4, 7
+// or 11, followed by the fields which are not zero. The zero time.Time is the zero date 0000-00-00 and
+// has length 0. Returns the number of bytes, if data is nil it only returns the number of bytes.
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html#packet-ProtocolBinary::MYSQL_TYPE_DATETIME
+func WriteBinaryDateTime(data []byte, t time.Time, pos *int) int {
+	length := 0
+	micro := t.Nanosecond() / 1000
+	switch {
+	case t.IsZero():
+	case micro != 0:
+		length = 11
+	case t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0:
+		length = 7
+	default:
+		length = 4
+	}
+	if data == nil {
+		return INT1 + length
+	}
+	WriteFixedLenInt(data, INT1, length, pos)
+	if length >= 4 {
+		WriteFixedLenInt(data, INT2, t.Year(), pos)
+		WriteFixedLenInt(data, INT1, int(t.Month()), pos)
+		WriteFixedLenInt(data, INT1, t.Day(), pos)
+	}
+	if length >= 7 {
+		WriteFixedLenInt(data, INT1, t.Hour(), pos)
+		WriteFixedLenInt(data, INT1, t.Minute(), pos)
+		WriteFixedLenInt(data, INT1, t.Second(), pos)
+	}
+	if length == 11 {
+		WriteFixedLenInt(data, INT4, micro, pos)
+	}
+	return INT1 + length
+}
+
+// ReadBinaryDateTime reads a DATE, DATETIME or TIMESTAMP value written in the binary protocol, in UTC.
+// The zero date is the zero time.Time. pos is not moved if the value is malformed.
+func ReadBinaryDateTime(data []byte, pos *int) (time.Time, error) {
+	if *pos >= len(data) {
+		return time.Time{}, ErrMalformedPacket
+	}
+	length := int(data[*pos])
+	if (length != 0 && length != 4 && length != 7 && length != 11) || *pos+INT1+length > len(data) {
+		return time.Time{}, ErrMalformedPacket
+	}
+	idx := *pos + INT1
+	var year, month, day, hour, min, sec, micro int
+	if length >= 4 {
+		year = ReadFixedLenInt(data, INT2, &idx)
+		month = ReadFixedLenInt(data, INT1, &idx)
+		day = ReadFixedLenInt(data, INT1, &idx)
+	}
+	if length >= 7 {
+		hour = ReadFixedLenInt(data, INT1, &idx)
+		min = ReadFixedLenInt(data, INT1, &idx)
+		sec = ReadFixedLenInt(data, INT1, &idx)
+	}
+	if length == 11 {
+		micro = ReadFixedLenInt(data, INT4, &idx)
+	}
+	*pos = idx
+	if length == 0 {
+		return time.Time{}, nil
+	}
+	return time.Date(year, time.Month(month), day, hour, min, sec, micro*1000, time.UTC), nil
+}
+
+// WriteBinaryTime writes a TIME value in the binary protocol: the length, 0, 8 or 12, followed by the sign,
+// the days, hours, minutes, seconds and the microseconds if not zero. Returns the number of bytes, if data
+// is nil it only returns the number of bytes.
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html#packet-ProtocolBinary::MYSQL_TYPE_TIME
+func WriteBinaryTime(data []byte, d time.Duration, pos *int) int {
+	negative := 0
+	if d < 0 {
+		negative = 1
+		d = -d
+	}
+	length := 0
+	micro := int((d % time.Second) / time.Microsecond)
+	switch {
+	case d == 0:
+	case micro != 0:
+		length = 12
+	default:
+		length = 8
+	}
+	if data == nil {
+		return INT1 + length
+	}
+	WriteFixedLenInt(data, INT1, length, pos)
+	if length >= 8 {
+		WriteFixedLenInt(data, INT1, negative, pos)
+		WriteFixedLenInt(data, INT4, int(d/(24*time.Hour)), pos)
+		WriteFixedLenInt(data, INT1, int(d/time.Hour%24), pos)
+		WriteFixedLenInt(data, INT1, int(d/time.Minute%60), pos)
+		WriteFixedLenInt(data, INT1, int(d/time.Second%60), pos)
+	}
+	if length == 12 {
+		WriteFixedLenInt(data, INT4, micro, pos)
+	}
+	return INT1 + length
+}
+
+// ReadBinaryTime reads a TIME value written in the binary protocol. pos is not moved if the value is malformed.
+func ReadBinaryTime(data []byte, pos *int) (time.Duration, error) {
+	if *pos >= len(data) {
+		return 0, ErrMalformedPacket
+	}
+	length := int(data[*pos])
+	if (length != 0 && length != 8 && length != 12) || *pos+INT1+length > len(data) {
+		return 0, ErrMalformedPacket
+	}
+	idx := *pos + INT1
+	var d time.Duration
+	negative := false
+	if length >= 8 {
+		negative = ReadFixedLenInt(data, INT1, &idx) == 1
+		d += time.Duration(ReadFixedLenInt(data, INT4, &idx)) * 24 * time.Hour
+		d += time.Duration(ReadFixedLenInt(data, INT1, &idx)) * time.Hour
+		d += time.Duration(ReadFixedLenInt(data, INT1, &idx)) * time.Minute
+		d += time.Duration(ReadFixedLenInt(data, INT1, &idx)) * time.Second
+	}
+	if length == 12 {
+		d += time.Duration(ReadFixedLenInt(data, INT4, &idx)) * time.Microsecond
+	}
+	*pos = idx
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// Result set row in the binary protocol, used for the response of COM_STMT_EXECUTE. NULL values
+// are marked in the NULL bitmap, the other values are encoded based on the column type.
+// colTypes are the database type names of the columns, as returned by ColumnTypeName.
+// https://dev.mysql.com/doc/internals/en/binary-protocol-resultset-row.html
+func BinaryResultsetRow(colTypes []string, values []sql.NullString, format ValueFormatter) []byte {
+	nullBitmap := NewNullBitmap(len(values), ResultsetRowNullOffset)
+	strs := make([]string, len(values))
+	pLen := 1 /* header */ + len(nullBitmap.Bytes())
+	for i := range values {
+		if values[i].Valid {
+			strs[i] = formatValue(colTypes[i], values[i], format)
+			cTypeInt, _ := fieldType(colTypes[i])
+			pLen += binaryValueLen(cTypeInt, strs[i])
+		}
+	}
+	payload := make([]byte, pLen)
 	pos := 0
-	// Write status
+	// Write packet header
 	WriteFixedLenInt(payload, INT1, 0x00, &pos)
-	// Write stmt_id
-	WriteFixedLenInt(payload, INT4, stmt_id + 1, &pos)
-	// Write num_columns
-	WriteFixedLenInt(payload, INT2, num_columns, &pos)
-	// Write num_params
-	WriteFixedLenInt(payload, INT2, num_params, &pos)
+	// Write NULL bitmap
+	for i := range values {
+		if !values[i].Valid {
+			nullBitmap.Set(i)
+		}
+	}
+	pos += copy(payload[pos:], nullBitmap.Bytes())
+	// Write values
+	for i := range values {
+		if values[i].Valid {
+			cTypeInt, unsigned := fieldType(colTypes[i])
+			writeBinaryValue(payload, cTypeInt, unsigned, strs[i], &pos)
+		}
+	}
+	return payload
+}
 
-	logger.GetLogger().Log(logger.Info, "Writing OK packet payload:", payload)
+// NullStrings converts a row of values, as returned by a database/sql driver, to the strings written by
+// TextResultsetRow and BinaryResultsetRow. nil is NULL, time.Time is written in the MySQL DATETIME format.
+func NullStrings(values []interface{}) []sql.NullString {
+	strs := make([]sql.NullString, len(values))
+	for i, value := range values {
+		var str string
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			str = v
+		case []byte:
+			str = string(v)
+		case int64:
+			str = strconv.FormatInt(v, 10)
+		case float64:
+			str = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			if v {
+				str = "1"
+			} else {
+				str = "0"
+			}
+		case time.Time:
+			str = v.Format("2006-01-02 15:04:05.999999")
+		default:
+			str = fmt.Sprint(v)
+		}
+		strs[i] = sql.NullString{String: str, Valid: true}
+	}
+	return strs
+}
+
+// TextResultsetRowValues is TextResultsetRow for a row of driver values, see NullStrings
+func TextResultsetRowValues(colTypes []string, values []interface{}, format ValueFormatter) []byte {
+	return TextResultsetRow(colTypes, NullStrings(values), format)
+}
+
+// BinaryResultsetRowValues is BinaryResultsetRow for a row of driver values, see NullStrings
+func BinaryResultsetRowValues(colTypes []string, values []interface{}, format ValueFormatter) []byte {
+	return BinaryResultsetRow(colTypes, NullStrings(values), format)
+}
+
+// ColumnCountPacket returns the payload of the packet starting a resultset, the number of columns as a
+// length encoded integer
+func ColumnCountPacket(columnCount int) []byte {
+	payload := make([]byte, calculateLenEnc(uint64(columnCount)))
+	pos := 0
+	WriteLenEncInt(payload, uint64(columnCount), &pos)
 	return payload
 }
 
-//
-//// Result sets function .... sigh
-func (p *Packager) ResultsetRow(rows *sql.Rows) []byte {
-	cols, err := rows.Columns()
+// Resultset reads the rows and returns the frames of the whole text resultset, in the order they are
+// written: the column count, the column definitions, an EOF, the rows and the EOF ending them. The frames
+// are serialized in the mode of the Packager, with the sequence ids following each other from sqid. The
+// values are written as the database returns them, with TextResultsetRow. column_count must be the number
+// of columns of rows.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::Resultset
+func (p *Packager) Resultset(column_count, sqid int, rows *sql.Rows) ([][]byte, error) {
+	colTypes, err := rows.ColumnTypes()
 	if err != nil {
-		logger.GetLogger().Log(logger.Warning, err.Error())
+		return nil, err
 	}
-	// null_bitmap_length := (len(cols) + 7 + 2) / 8
-	readCols := make([]interface{}, len(cols))
-	writeCols := make([]sql.NullString, len(cols))
-	for i := range writeCols {
-		readCols[i] = &writeCols[i]
+	if len(colTypes) != column_count {
+		return nil, fmt.Errorf("expected %d columns, the rows have %d", column_count, len(colTypes))
 	}
-	for rows.Next() {
-		err = rows.Scan(readCols...)
+	var frames [][]byte
+	add := func(payload []byte) {
+		frames = append(frames, p.Frame(NewMySQLPacketFrom(sqid&0xff, payload)))
+		sqid++
 	}
-	for i := range writeCols {
-		if writeCols[i].Valid {
-		}
+
+	add(ColumnCountPacket(column_count))
+	typeNames := make([]string, column_count)
+	for i, colType := range colTypes {
+		typeNames[i] = ColumnTypeName(colType)
+		add(p.ColumnDefinition(colType.Name(), colType, uint32(CLIENT_PROTOCOL_41)))
 	}
-	return []byte{}
-}
+	add(EOFPacket(0, SERVER_STATUS_AUTOCOMMIT, uint32(CLIENT_PROTOCOL_41)))
 
-// Result sets function for the single packet containing the length encoded integer. Returns payload and updated
-// stmtid
-// https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::Resultset
-func (p *Packager) Resultset(column_count, stmtid int, rows *sql.Rows) ([]byte) {
-	cpLen := calculateLenEnc(uint64(column_count))
-	count_packet := make([]byte, cpLen)
-	pos := 0
-	WriteLenEncInt(count_packet, uint64(column_count), &pos)
-	return count_packet
+	values := make([]sql.NullString, column_count)
+	dest := make([]interface{}, column_count)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		add(TextResultsetRow(typeNames, values, nil))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	add(EOFPacket(0, SERVER_STATUS_AUTOCOMMIT, uint32(CLIENT_PROTOCOL_41)))
+	return frames, nil
 }
 
 
@@ -524,11 +1485,22 @@ func (p *Packager) Resultset(column_count, stmtid int, rows *sql.Rows) ([]byte)
 * are written below.
  */
 
+// OKPacket returns the payload of an OK packet. The warnings are only sent to CLIENT_PROTOCOL_41 clients.
+// A client which negotiated CLIENT_SESSION_TRACK reads the message as a length encoded string, without
+// session state changes.
 // https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
-func OKPacket(affectedRows int, lastInsertId int, capabilities uint32, msg string) []byte {
+func OKPacket(affectedRows int, lastInsertId int, statusFlags int, warnings int, capabilities uint32, msg string) []byte {
 	pLen := 1 + calculateLenEnc(uint64(affectedRows)) + calculateLenEnc(uint64(lastInsertId))
 	if Supports(capabilities, CLIENT_PROTOCOL_41) {
 		pLen += 4
+	} else if Supports(capabilities, CLIENT_TRANSACTIONS) {
+		pLen += 2
+	}
+	sessionTrack := Supports(capabilities, CLIENT_SESSION_TRACK)
+	if sessionTrack && msg != "" {
+		pLen += calculateLenEncStr(msg)
+	} else {
+		pLen += len(msg)
 	}
 	payload := make([]byte, pLen)
 	pos := 0
@@ -541,25 +1513,67 @@ func OKPacket(affectedRows int, lastInsertId int, capabilities uint32, msg strin
 	WriteLenEncInt(payload, uint64(lastInsertId), &pos)
 
 	if Supports(capabilities, CLIENT_PROTOCOL_41) {
-		WriteFixedLenInt(payload, INT2, /* status_flags */ 0x00, &pos)
-		WriteFixedLenInt(payload, INT2, /* warnings */ 0x00, &pos)
+		WriteFixedLenInt(payload, INT2, statusFlags, &pos)
+		WriteFixedLenInt(payload, INT2, warnings, &pos)
+	} else if Supports(capabilities, CLIENT_TRANSACTIONS) {
+		WriteFixedLenInt(payload, INT2, statusFlags, &pos)
 	}
 
-	/* There's several things to do with client capabilities....that are all ignored
-	*
-	*  if capabilities & CLIENT_PROTOCOL_41 { write status_flags int<2> and warnings int<2>}
-	*  elseif capabilities & CLIENT_TRANSACTIONS { status_flags <2> }
-	*  if capabilities & CLIENT_SESSION_TRACK { info string<lenenc> ;
-	*     if status_flags & SERVER_SESSION_STATE_CHANGED { session_state_changes string<lenenc> }
-	*  }
-	*  else { do what is written below }
-	 */
-
-	WriteString(payload, msg, EOFSTR, &pos, 0)
+	// With CLIENT_SESSION_TRACK the info is a string<lenenc>, omitted when empty like the MySQL server does,
+	// SERVER_SESSION_STATE_CHANGED is never set here, see SchemaOKPacket for the session state changes
+	if sessionTrack && msg != "" {
+		WriteLenEncString(payload, msg, &pos)
+	} else {
+		WriteString(payload, msg, EOFSTR, &pos, 0)
+	}
 	logger.GetLogger().Log(logger.Info, "Writing OK packet payload:", payload)
 	return payload
 }
 
+// HandshakeOKPacket is the OK packet ending the connection phase. Unlike the OK packets of the
+// command phase, which are built with the capabilities of the command processor, it uses the
+// capabilities just negotiated in the handshake response, so that a 4.1 client gets the status
+// flags and the warnings.
+func HandshakeOKPacket(capabilities uint32, msg string) []byte {
+	return OKPacket(0, 0, SERVER_STATUS_AUTOCOMMIT, 0, capabilities, msg)
+}
+
+// Types of the session state changes reported in the OK packet to the CLIENT_SESSION_TRACK clients
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_ok_packet.html
+const (
+	SESSION_TRACK_SYSTEM_VARIABLES int = 0x00
+	SESSION_TRACK_SCHEMA           int = 0x01
+	SESSION_TRACK_STATE_CHANGE     int = 0x02
+)
+
+// SchemaOKPacket returns the payload of the OK packet of a change of the default schema. A client which
+// negotiated CLIENT_SESSION_TRACK is told the new schema with a SESSION_TRACK_SCHEMA change, the others
+// get the plain OK packet.
+func SchemaOKPacket(statusFlags int, warnings int, capabilities uint32, schema string) []byte {
+	if !Supports(capabilities, CLIENT_PROTOCOL_41) || !Supports(capabilities, CLIENT_SESSION_TRACK) {
+		return OKPacket(0, 0, statusFlags, warnings, capabilities, "")
+	}
+	// type int<1>, then the data string<lenenc>, which holds the schema string<lenenc>
+	entryLen := calculateLenEncStr(schema)
+	changesLen := 1 + calculateLenEnc(uint64(entryLen)) + entryLen
+	pLen := 1 + 1 + 1 + INT2 + INT2 + calculateLenEnc(0) + calculateLenEnc(uint64(changesLen)) + changesLen
+	payload := make([]byte, pLen)
+	pos := 0
+	WriteFixedLenInt(payload, INT1, 0x00, &pos)
+	// affected_rows and last_insert_id
+	WriteLenEncInt(payload, 0, &pos)
+	WriteLenEncInt(payload, 0, &pos)
+	WriteFixedLenInt(payload, INT2, statusFlags|SERVER_SESSION_STATE_CHANGED, &pos)
+	WriteFixedLenInt(payload, INT2, warnings, &pos)
+	// empty info
+	WriteLenEncString(payload, "", &pos)
+	WriteLenEncInt(payload, uint64(changesLen), &pos)
+	WriteFixedLenInt(payload, INT1, SESSION_TRACK_SCHEMA, &pos)
+	WriteLenEncInt(payload, uint64(entryLen), &pos)
+	WriteLenEncString(payload, schema, &pos)
+	return payload
+}
+
 // https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
 func ERRPacket(errcode int, msg string) []byte {
 	payload := make([]byte, 1 + 2 + len(msg))
@@ -578,9 +1592,84 @@ func ERRPacket(errcode int, msg string) []byte {
 	return payload
 }
 
+// ERRPacketWithState returns the payload of an ERR packet with the SQL state, for CLIENT_PROTOCOL_41 clients
+// https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+func ERRPacketWithState(errcode int, sqlState string, msg string) []byte {
+	payload := make([]byte, 1 + 2 + 1 + 5 + len(msg))
+	pos := 0
+	WriteFixedLenInt(payload, INT1, 0xff, &pos)
+	WriteFixedLenInt(payload, INT2, errcode, &pos)
+	// sql_state_marker and sql_state
+	WriteString(payload, "#", FIXEDSTR, &pos, 1)
+	WriteString(payload, sqlState, FIXEDSTR, &pos, 5)
+	WriteString(payload, msg, EOFSTR, &pos, 0)
+	return payload
+}
+
+// ClientERRPacket returns the payload of an ERR packet for a client with the capabilities: with the SQL state
+// for a CLIENT_PROTOCOL_41 client, otherwise the older layout without it, the one of ERRPacket
+func ClientERRPacket(errcode int, sqlState string, msg string, capabilities uint32) []byte {
+	if !Supports(capabilities, CLIENT_PROTOCOL_41) {
+		return ERRPacket(errcode, msg)
+	}
+	return ERRPacketWithState(errcode, sqlState, msg)
+}
+
+// SQLSTATE_GENERAL_ERROR is the SQL state of the errors without a more specific one
+const SQLSTATE_GENERAL_ERROR = "HY000"
+
+// sqlStates maps the numbers of the common MySQL server errors to their SQL state. The others are HY000
+// https://dev.mysql.com/doc/refman/8.0/en/server-error-reference.html
+var sqlStates = map[uint16]string{
+	1022: "23000", // ER_DUP_KEY
+	1044: "42000", // ER_DBACCESS_DENIED_ERROR
+	1045: "28000", // ER_ACCESS_DENIED_ERROR
+	1048: "23000", // ER_BAD_NULL_ERROR
+	1049: "42000", // ER_BAD_DB_ERROR
+	1050: "42S01", // ER_TABLE_EXISTS_ERROR
+	1051: "42S02", // ER_BAD_TABLE_ERROR
+	1054: "42S22", // ER_BAD_FIELD_ERROR
+	1062: "23000", // ER_DUP_ENTRY
+	1064: "42000", // ER_PARSE_ERROR
+	1146: "42S02", // ER_NO_SUCH_TABLE
+	1213: "40001", // ER_LOCK_DEADLOCK
+	1216: "23000", // ER_NO_REFERENCED_ROW
+	1217: "23000", // ER_ROW_IS_REFERENCED
+	1264: "22003", // ER_WARN_DATA_OUT_OF_RANGE
+	1406: "22001", // ER_DATA_TOO_LONG
+	1451: "23000", // ER_ROW_IS_REFERENCED_2
+	1452: "23000", // ER_NO_REFERENCED_ROW_2
+	1586: "23000", // ER_DUP_ENTRY_WITH_KEY_NAME
+}
+
+// ErrorFromDriver returns the error number, the SQL state and the message for the ERR packet of err, an
+// error returned by the database driver. The errors of the MySQL server keep their number, any other error
+// is common.ER_UNKNOWN_ERROR with the SQL state HY000.
+func ErrorFromDriver(err error) (code int, sqlState, msg string) {
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+		sqlState, ok = sqlStates[mysqlErr.Number]
+		if !ok {
+			sqlState = SQLSTATE_GENERAL_ERROR
+		}
+		return int(mysqlErr.Number), sqlState, mysqlErr.Message
+	}
+	return common.ER_UNKNOWN_ERROR, SQLSTATE_GENERAL_ERROR, err.Error()
+}
+
+// DriverERRPacket returns the payload of the ERR packet for err, an error returned by the database driver, for a
+// client with the capabilities, see ClientERRPacket
+func DriverERRPacket(err error, capabilities uint32) []byte {
+	code, sqlState, msg := ErrorFromDriver(err)
+	return ClientERRPacket(code, sqlState, msg, capabilities)
+}
+
 // https://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
 func EOFPacket(warnings, status_flags int, capabilities uint32) []byte {
-	payload := make([]byte, 1)
+	pLen := 1
+	if Supports(capabilities, CLIENT_PROTOCOL_41) {
+		pLen += INT2 + INT2
+	}
+	payload := make([]byte, pLen)
 	pos := 0
 	// Write EOF packet header
 	WriteFixedLenInt(payload, INT1, 0xfe, &pos)
@@ -592,6 +1681,446 @@ func EOFPacket(warnings, status_flags int, capabilities uint32) []byte {
 	return payload
 }
 
+// TerminatorPacket returns the packet ending the rows of a result set. It is an EOF packet, or an
+// OK packet with the 0xfe header when the client negotiated CLIENT_DEPRECATE_EOF. Like the other
+// packet functions it returns the payload, the sequence id is set with NewMySQLPacketFrom.
+// https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
+func TerminatorPacket(statusFlags, warnings int, capabilities uint32) []byte {
+	if !Supports(capabilities, CLIENT_DEPRECATE_EOF) {
+		return EOFPacket(warnings, statusFlags, capabilities)
+	}
+	pLen := 1 + calculateLenEnc(0) /* affected rows */ + calculateLenEnc(0) /* last insert id */
+	if Supports(capabilities, CLIENT_PROTOCOL_41) {
+		pLen += INT2 + INT2
+	} else if Supports(capabilities, CLIENT_TRANSACTIONS) {
+		pLen += INT2
+	}
+	payload := make([]byte, pLen)
+	pos := 0
+	// Write OK packet header, 0xfe to mark the end of the result set
+	WriteFixedLenInt(payload, INT1, 0xfe, &pos)
+	// Write affected_rows and last_insert_id
+	WriteLenEncInt(payload, 0, &pos)
+	WriteLenEncInt(payload, 0, &pos)
+	if Supports(capabilities, CLIENT_PROTOCOL_41) {
+		WriteFixedLenInt(payload, INT2, statusFlags, &pos)
+		WriteFixedLenInt(payload, INT2, warnings, &pos)
+	} else if Supports(capabilities, CLIENT_TRANSACTIONS) {
+		WriteFixedLenInt(payload, INT2, statusFlags, &pos)
+	}
+	return payload
+}
+
+// AuthSwitchRequest asks the client to authenticate again with another authentication method.
+// The client answers with an AuthSwitchResponse, read with ReadAuthResponse.
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthSwitchRequest
+func AuthSwitchRequest(pluginName string, authData []byte) []byte {
+	payload := make([]byte, 1 + len(pluginName) + 1 + len(authData))
+	pos := 0
+	// Write auth switch request header
+	WriteFixedLenInt(payload, INT1, 0xfe, &pos)
+	// Write plugin name
+	WriteString(payload, pluginName, NULLSTR, &pos, 0)
+	// Write the auth plugin data
+	copy(payload[pos:], authData)
+	return payload
+}
+
+// ReadAuthSwitchRequest returns the plugin name and the auth plugin data of an auth switch request
+func ReadAuthSwitchRequest(payload []byte) (string, []byte, error) {
+	if len(payload) == 0 || payload[0] != 0xfe {
+		return "", nil, errors.New("not an auth switch request")
+	}
+	end := bytes.IndexByte(payload[1:], 0x00)
+	if end < 0 {
+		return "", nil, errors.New("auth switch request plugin name not terminated")
+	}
+	pluginName := string(payload[1 : 1 + end])
+	authData := make([]byte, len(payload) - 1 - end - 1)
+	copy(authData, payload[1 + end + 1:])
+	return pluginName, authData, nil
+}
+
+// AuthMoreData carries extra data of the authentication method, e.g. the result of the fast
+// authentication of caching_sha2_password.
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthMoreData
+func AuthMoreData(data []byte) []byte {
+	payload := make([]byte, 1 + len(data))
+	pos := 0
+	// Write auth more data header
+	WriteFixedLenInt(payload, INT1, 0x01, &pos)
+	// Write the plugin data
+	copy(payload[pos:], data)
+	return payload
+}
+
+// ReadAuthMoreData returns the plugin data of an auth more data packet
+func ReadAuthMoreData(payload []byte) ([]byte, error) {
+	if len(payload) == 0 || payload[0] != 0x01 {
+		return nil, errors.New("not an auth more data packet")
+	}
+	data := make([]byte, len(payload) - 1)
+	copy(data, payload[1:])
+	return data, nil
+}
+
+// ReadAuthResponse returns the data the client sends to continue the authentication, in response to
+// an auth switch request or auth more data. The whole payload is the data of the authentication method.
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthSwitchResponse
+func ReadAuthResponse(payload []byte) []byte {
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	return data
+}
+
+// ReadConnectAttrs reads the connection attributes at the end of the handshake response, when
+// CLIENT_CONNECT_ATTRS is negotiated: the total length followed by the key / value pairs, all length
+// encoded strings. In case of error the attributes read so far are returned.
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse41
+func ReadConnectAttrs(data []byte, pos *int) (map[string]string, error) {
+	attrs := make(map[string]string)
+	n, err := ReadLenEncInt(data, pos)
+	if err != nil {
+		return attrs, err
+	}
+	if n > len(data) - *pos {
+		return attrs, ErrMalformedLenEncString
+	}
+	end := *pos + n
+	for *pos < end {
+		key, err := ReadLenEncString(data[:end], pos)
+		if err != nil {
+			return attrs, err
+		}
+		value, err := ReadLenEncString(data[:end], pos)
+		if err != nil {
+			return attrs, err
+		}
+		attrs[string(key)] = string(value)
+	}
+	return attrs, nil
+}
+
+// ChangeUser is a decoded COM_CHANGE_USER request. The character set, plugin and attributes are only
+// sent by newer clients, they keep their zero value otherwise.
+type ChangeUser struct {
+	User         string
+	AuthResponse []byte
+	Schema       string
+	CharacterSet int
+	AuthPlugin   string
+	Attrs        map[string]string
+}
+
+// readNulTerminated returns the bytes up to the next NUL and moves pos past the NUL
+func readNulTerminated(data []byte, pos *int) ([]byte, error) {
+	if *pos > len(data) {
+		return nil, ErrMalformedPacket
+	}
+	end := bytes.IndexByte(data[*pos:], 0x00)
+	if end < 0 {
+		return nil, ErrMalformedPacket
+	}
+	str := data[*pos : *pos + end]
+	*pos += end + 1
+	return str, nil
+}
+
+// ReadChangeUser decodes the payload of a COM_CHANGE_USER, including the command byte. The capabilities
+// are the ones negotiated during the handshake, they decide how the auth response is encoded.
+// https://dev.mysql.com/doc/internals/en/com-change-user.html
+func ReadChangeUser(payload []byte, capabilities uint32) (*ChangeUser, error) {
+	if len(payload) == 0 || payload[0] != byte(common.COM_CHANGE_USER) {
+		return nil, errors.New("not a change user request")
+	}
+	pos := 1
+	user, err := readNulTerminated(payload, &pos)
+	if err != nil {
+		return nil, err
+	}
+	cu := &ChangeUser{User: string(user)}
+	var auth []byte
+	if Supports(capabilities, CLIENT_RESERVED2) {
+		// CLIENT_SECURE_CONNECTION: one byte length followed by the auth response
+		if pos >= len(payload) {
+			return nil, ErrMalformedPacket
+		}
+		n := int(payload[pos])
+		pos++
+		if n > len(payload) - pos {
+			return nil, ErrMalformedPacket
+		}
+		auth = payload[pos : pos + n]
+		pos += n
+	} else {
+		auth, err = readNulTerminated(payload, &pos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cu.AuthResponse = make([]byte, len(auth))
+	copy(cu.AuthResponse, auth)
+	schema, err := readNulTerminated(payload, &pos)
+	if err != nil {
+		return nil, err
+	}
+	cu.Schema = string(schema)
+	// The rest is optional
+	if pos + INT2 > len(payload) {
+		return cu, nil
+	}
+	cu.CharacterSet = ReadFixedLenInt(payload, INT2, &pos)
+	if Supports(capabilities, CLIENT_PLUGIN_AUTH) && pos < len(payload) {
+		plugin, err := readNulTerminated(payload, &pos)
+		if err != nil {
+			return nil, err
+		}
+		cu.AuthPlugin = string(plugin)
+	}
+	if Supports(capabilities, CLIENT_CONNECT_ATTRS) && pos < len(payload) {
+		cu.Attrs, err = ReadConnectAttrs(payload, &pos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cu, nil
+}
+
+// binaryParamLen returns the length of the parameter value at pos of a COM_STMT_EXECUTE, based on its type. For a
+// length encoded string it is the length of the string, the prefix is skipped by moving pos past it.
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func binaryParamLen(data []byte, fieldType byte, pos *int) (int, error) {
+	switch fieldType {
+	case 0x06 /* null */:
+		return 0, nil
+	case 0x01 /* tiny */:
+		return INT1, nil
+	case 0x02 /* short */, 0x0d /* year */:
+		return INT2, nil
+	case 0x03 /* long */, 0x09 /* int24 */, 0x04 /* float */:
+		return INT4, nil
+	case 0x08 /* longlong */, 0x05 /* double */:
+		return INT8, nil
+	case 0x07 /* timestamp */, 0x0a /* date */, 0x0c /* datetime */, 0x0b /* time */:
+		// the length byte is part of the value
+		if *pos >= len(data) {
+			return 0, ErrMalformedPacket
+		}
+		return INT1 + int(data[*pos]), nil
+	}
+	n, err := ReadLenEncInt(data, pos)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// DecodeExecutePacket decodes the payload of a COM_STMT_EXECUTE, including the command byte, for a statement
+// with numParams parameters. The null bitmap, the types and the values are only there when numParams > 0, the
+// types and the values only when newParams is set. There are two bytes of type per parameter, the type and
+// the flags, 0x80 being unsigned. There is one value per parameter, nil if the parameter is NULL, otherwise
+// the bytes encoding it in the binary protocol without the length prefix of a length encoded string.
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+func DecodeExecutePacket(payload []byte, numParams int) (stmtID int, flags byte, iteration uint32, nullBitmap []byte,
+	newParams bool, paramTypes []byte, values [][]byte, err error) {
+	if len(payload) == 0 || payload[0] != byte(common.COM_STMT_EXECUTE) {
+		err = errors.New("not a stmt execute request")
+		return
+	}
+	pos := 1
+	if len(payload) < pos+INT4+INT1+INT4 {
+		err = ErrMalformedPacket
+		return
+	}
+	stmtID = ReadFixedLenInt(payload, INT4, &pos)
+	flags = payload[pos]
+	pos++
+	iteration = uint32(ReadFixedLenInt(payload, INT4, &pos))
+	if numParams <= 0 {
+		return
+	}
+	nullBitmap, newParams, paramTypes, values, err = decodeParamSet(payload, &pos, numParams, nil)
+	return
+}
+
+// DecodeExecuteValues decodes the values of a COM_STMT_EXECUTE sent without the new params flag, with paramTypes,
+// the types bound by a previous execute of the statement. The values are returned as by DecodeExecutePacket, or
+// nil when the packet ends with the flag while some parameter isn't NULL: the client binds the values of the
+// previous execute again.
+func DecodeExecuteValues(payload []byte, numParams int, paramTypes []byte) (values [][]byte, err error) {
+	pos := 1 + INT4 + INT1 + INT4
+	if numParams <= 0 || len(paramTypes) != 2*numParams {
+		return nil, ErrMalformedPacket
+	}
+	bitmapPos := pos
+	nullBitmap, err := ReadNullBitmap(payload, numParams, ExecuteNullOffset, &bitmapPos)
+	if err != nil || len(payload) < bitmapPos+INT1 {
+		return nil, ErrMalformedPacket
+	}
+	if len(payload) == bitmapPos+INT1 {
+		for i := 0; i < numParams; i++ {
+			if !nullBitmap.Get(i) {
+				return nil, nil
+			}
+		}
+	}
+	_, _, _, values, err = decodeParamSet(payload, &pos, numParams, paramTypes)
+	return values, err
+}
+
+// decodeParamSet decodes the parameter set of a COM_STMT_EXECUTE at pos: the null bitmap, the new params
+// flag, the types if the flag is set, and the values. Without the flag the values are decoded with
+// prevTypes, the types of the previous set, and left undecoded if there are none. pos is moved past what
+// was decoded.
+func decodeParamSet(payload []byte, pos *int, numParams int, prevTypes []byte) (nullBitmap []byte, newParams bool,
+	paramTypes []byte, values [][]byte, err error) {
+	bitmap, err := ReadNullBitmap(payload, numParams, ExecuteNullOffset, pos)
+	if err != nil || len(payload) < *pos+INT1 {
+		err = ErrMalformedPacket
+		return
+	}
+	nullBitmap = bitmap.Bytes()
+	newParams = payload[*pos] == 1
+	*pos++
+	if newParams {
+		if len(payload) < *pos+2*numParams {
+			err = ErrMalformedPacket
+			return
+		}
+		paramTypes = payload[*pos : *pos+2*numParams]
+		*pos += 2 * numParams
+	} else if prevTypes != nil {
+		paramTypes = prevTypes
+	} else {
+		// the values are encoded with the types of the previous execute, they can't be split here
+		return
+	}
+	values = make([][]byte, numParams)
+	for i := range values {
+		if bitmap.Get(i) {
+			continue
+		}
+		var n int
+		n, err = binaryParamLen(payload, paramTypes[2*i], pos)
+		if err != nil {
+			return
+		}
+		if n > len(payload)-*pos {
+			err = ErrMalformedPacket
+			return
+		}
+		if paramTypes[2*i] != 0x06 /* null */ {
+			values[i] = payload[*pos : *pos+n]
+		}
+		*pos += n
+	}
+	return
+}
+
+// ErrNoParamTypes is returned by DecodeExecuteBatch when the first parameter set doesn't bind the types
+var ErrNoParamTypes = errors.New("the first parameter set of a batch has no types")
+
+// DecodeExecuteBatch decodes the parameter sets of a COM_STMT_EXECUTE with an iteration count, the array
+// binding of the drivers doing bulk inserts. The MySQL server always sends an iteration count of 1, Hera
+// takes the count as the number of parameter sets following the header, each laid out as the single set
+// of DecodeExecutePacket. The first set must bind the types, the next ones bind new types or reuse the
+// ones of the set before. It returns the types and the values of each set, the values as returned by
+// DecodeExecutePacket. The payload must end with the last set.
+func DecodeExecuteBatch(payload []byte, numParams int) (paramTypes [][]byte, values [][][]byte, err error) {
+	_, _, iterations, _, _, _, _, err := DecodeExecutePacket(payload, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if numParams <= 0 {
+		return nil, nil, ErrMalformedPacket
+	}
+	// each set takes at least its null bitmap and new params flag
+	if int64(iterations) > int64(len(payload)) {
+		return nil, nil, ErrMalformedPacket
+	}
+	pos := 1 + INT4 + INT1 + INT4
+	var types []byte
+	for i := uint32(0); i < iterations; i++ {
+		_, newParams, setTypes, setValues, err := decodeParamSet(payload, &pos, numParams, types)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 && !newParams {
+			return nil, nil, ErrNoParamTypes
+		}
+		types = setTypes
+		paramTypes = append(paramTypes, setTypes)
+		values = append(values, setValues)
+	}
+	if pos != len(payload) {
+		return nil, nil, ErrMalformedPacket
+	}
+	return paramTypes, values, nil
+}
+
+// formatTime formats a TIME value in the text format of the database, [-]hhh:mm:ss[.ffffff], the reverse of parseTime
+func formatTime(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	str := fmt.Sprintf("%s%02d:%02d:%02d", sign, d/time.Hour, d/time.Minute%60, d/time.Second%60)
+	if micro := d % time.Second / time.Microsecond; micro != 0 {
+		str += fmt.Sprintf(".%06d", micro)
+	}
+	return str
+}
+
+// BinaryParamValue converts a parameter value of COM_STMT_EXECUTE, as returned by DecodeExecutePacket, to the
+// Go value passed to the driver: int64, or uint64 if unsigned, for the integers, float64, time.Time for the
+// dates, a string for TIME and the text types, []byte for the binary types. A nil raw value is NULL.
+func BinaryParamValue(fieldType byte, unsigned bool, raw []byte) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	switch fieldType {
+	case 0x01 /* tiny */, 0x02 /* short */, 0x0d /* year */, 0x03 /* long */, 0x09 /* int24 */, 0x08 /* longlong */:
+		var pos int
+		l := len(raw)
+		if l != INT1 && l != INT2 && l != INT4 && l != INT8 {
+			return nil, ErrMalformedPacket
+		}
+		u := uint64(ReadFixedLenInt(raw, l, &pos))
+		if unsigned {
+			return u, nil
+		}
+		// sign extend
+		shift := uint(64 - 8*l)
+		return int64(u<<shift) >> shift, nil
+	case 0x04 /* float */:
+		if len(raw) != INT4 {
+			return nil, ErrMalformedPacket
+		}
+		var pos int
+		return float64(math.Float32frombits(uint32(ReadFixedLenInt(raw, INT4, &pos)))), nil
+	case 0x05 /* double */:
+		if len(raw) != INT8 {
+			return nil, ErrMalformedPacket
+		}
+		var pos int
+		return math.Float64frombits(uint64(ReadFixedLenInt(raw, INT8, &pos))), nil
+	case 0x07 /* timestamp */, 0x0a /* date */, 0x0c /* datetime */:
+		var pos int
+		return ReadBinaryDateTime(raw, &pos)
+	case 0x0b /* time */:
+		var pos int
+		d, err := ReadBinaryTime(raw, &pos)
+		if err != nil {
+			return nil, err
+		}
+		return formatTime(d), nil
+	case 0x10 /* bit */, 0xf9 /* tiny blob */, 0xfa /* medium blob */, 0xfb /* long blob */, 0xfc /* blob */, 0xff /* geometry */:
+		return raw, nil
+	}
+	return string(raw), nil
+}
+
 /*---- MISC. FUNCTIONS ---------------------------------------------------------
 * Miscellaneous functions that perform common operations. Includes mostly
 * arithmetic.
@@ -716,6 +2245,20 @@ func WriteLenEncInt(data []byte, n uint64, pos *int) {
 
 }
 
+/* Writes the string str as a length encoded string into the slice data and
+* returns the number of bytes written. With a nil data nothing is written, it
+* only returns the size, to allocate the buffer before writing.
+ */
+func WriteLenEncString(data []byte, str string, pos *int) int {
+	n := calculateLenEncStr(str)
+	if data == nil {
+		return n
+	}
+	WriteLenEncInt(data, uint64(len(str)), pos)
+	*pos += copy(data[*pos:], str)
+	return n
+}
+
 /* Writes a string str into the slice data. The method of writing is different
 * depending on the string type. l is supposed to be an optional argument
 * for when the length needs to specified (i.e. FIXEDSTR, EOFSTR). The intptr
@@ -799,35 +2342,77 @@ func ReadFixedLenInt(data []byte, l int, pos *int) int {
 
 
 /* Reads an unsigned integer n as a length encoded integer
-* from the slice data. */
-func ReadLenEncInt(data []byte, pos *int) int {
-	l := 0         // length of the length encoded integer
+* from the slice data. 0xfb is not an integer but NULL, it returns ErrLenEncNull.
+* 0xff is not valid either (it is the header of an ERR packet), like data too
+* short for the integer it returns ErrMalformedLenEncInt. In case of error pos
+* is left unchanged. */
+func ReadLenEncInt(data []byte, pos *int) (int, error) {
+	if *pos >= len(data) {
+		return 0, ErrMalformedLenEncInt
+	}
 
 	// Check the first byte to determine the length.
 	fb := byte(data[*pos])
 
-	// If the first byte is < 0xfb, then l = 1.
+	// If the first byte is < 0xfb, it is the integer.
 	if fb < 0xfb {
-		l = 1
+		return ReadFixedLenInt(data, INT1, pos), nil
 	}
 
-	if l == 1 {
-		// Read 1 byte for lenenc<1>.
-		return ReadFixedLenInt(data, INT1, pos)
-	}
-
-	*pos++
-
 	// Otherwise read the appropriate length according to the
 	// encoded length.
+	var l int
 	switch fb {
+	case 0xfb: // NULL
+		return 0, ErrLenEncNull
 	case 0xfc: // 2-byte integer
-		return ReadFixedLenInt(data, INT2, pos)
+		l = INT2
 	case 0xfd: // 3-byte integer
-		return ReadFixedLenInt(data, INT3, pos)
-	default : // 8-byte integer
-		return ReadFixedLenInt(data, INT8, pos)
+		l = INT3
+	case 0xfe: // 8-byte integer
+		l = INT8
+	default:
+		return 0, ErrMalformedLenEncInt
+	}
+	if l >= len(data) - *pos {
+		return 0, ErrMalformedLenEncInt
+	}
+	*pos++
+	return ReadFixedLenInt(data, l, pos), nil
+}
+
+
+/* Reads a length encoded string from the slice data. The length is validated
+* against the bytes left in data and MaxLenEncStringSize before allocating, in
+* case of error pos is left unchanged. */
+func ReadLenEncString(data []byte, pos *int) ([]byte, error) {
+	start := *pos
+	n, err := ReadLenEncInt(data, pos)
+	if err != nil {
+		return nil, ErrMalformedLenEncString
+	}
+	if n < 0 || n > MaxLenEncStringSize || n > len(data) - *pos {
+		*pos = start
+		return nil, ErrMalformedLenEncString
+	}
+	str := make([]byte, n)
+	copy(str, data[*pos:])
+	*pos += n
+	return str, nil
+}
+
+
+/* Reads a length encoded string which can be NULL, like a column value of a
+* text result set row. NULL is the single byte 0xfb, for which it returns a nil
+* value and isNull true, while an empty string is a non nil empty value. In case
+* of error pos is left unchanged. */
+func ReadNullableLenEncString(data []byte, pos *int) (value []byte, isNull bool, err error) {
+	if *pos < len(data) && data[*pos] == 0xfb {
+		*pos++
+		return nil, true, nil
 	}
+	value, err = ReadLenEncString(data, pos)
+	return value, false, err
 }
 
 
@@ -835,9 +2420,12 @@ func ReadLenEncInt(data []byte, pos *int) int {
 * depending on the string type. l is supposed to be an optional argument
 * for when the length needs to specified (i.e. FIXEDSTR (specified), and
 * EOFSTR, where the length of the string to be read in is calculated from
-* current position and remaining length of packet).
+* current position and remaining length of packet). If data holds less than
+* the l bytes of a FIXEDSTR or EOFSTR, it returns ErrMalformedPacket and pos
+* is left unchanged. A LENENCSTR which is NULL (0xfb) is skipped and returns
+* ErrLenEncNull, use ReadNullableLenEncString where NULL is expected.
  */
-func ReadString(data []byte, stype string_t, pos *int, l int) []byte {
+func ReadString(data []byte, stype string_t, pos *int, l int) ([]byte, error) {
 	buf := bytes.NewBuffer(data[*pos:])
 	switch stype {
 	case NULLSTR:
@@ -849,48 +2437,33 @@ func ReadString(data []byte, stype string_t, pos *int, l int) []byte {
 			log.Fatal(err)
 		}
 		*pos += len(line)
-		return line
+		return line, nil
 
 	case LENENCSTR:
-		n := ReadLenEncInt(data, pos)
-		if n == 0 {
-			break
+		str, isNull, err := ReadNullableLenEncString(data, pos)
+		if isNull {
+			return nil, ErrLenEncNull
 		}
-		buf.ReadByte()
-		temp := make([]byte, n)
-		n2, err := buf.Read(temp)
 		if err != nil {
-			// log.Fatal(err)
-			// if log.V(logger.Warning) {
-			// 	log.Log(logger.Warning, err)
-			// }
-		} else if n2 != n {
-			// if log.V(logger.Warning) {
-			// 	log.Log(logger.Warning,
-			//            fmt.Sprintf("Read %d, expected %d", n2, n))
-			// }
-			// log.Fatal(fmt.Sprintf("Read %d, expected %d", n2, n))
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "ReadString:", err.Error())
+			}
+			break
 		}
-		*pos += n
-		return temp
+		return str, nil
 
 	case FIXEDSTR, EOFSTR:
 		temp := make([]byte, l)
-		n2, err := buf.Read(temp)
+		// a single Read can return less than l bytes, read until all of them are in
+		n2, err := io.ReadFull(buf, temp)
 		if err != nil {
-			// log.Fatal(err)
-			// if log.V(logger.Warning) {
-			// 	log.Log(logger.Warning, err)
-			// }
-		} else if n2 != l {
-			// if log.V(logger.Warning) {
-			// 	log.Log(logger.Warning,
-			//            fmt.Sprintf("Read %d, expected %d", n2, l))
-			// }
-			// log.Fatal(fmt.Sprintf("Read %d, expected %d", n2, l))
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, fmt.Sprintf("ReadString: read %d, expected %d", n2, l))
+			}
+			return nil, ErrMalformedPacket
 		}
 		*pos += l
-		return temp
+		return temp, nil
 	}
-	return []byte{}
+	return []byte{}, nil
 }
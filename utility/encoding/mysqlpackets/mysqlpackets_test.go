@@ -27,8 +27,18 @@ import (
 
 	"testing"
 	"bytes"
+	"encoding/hex"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"errors"
+	"github.com/go-sql-driver/mysql"
 	"github.com/paypal/hera/common"
 	"reflect"
+	"math"
+	"testing/iotest"
+	"time"
+	"strings"
 )
 
 var codes map[int]string
@@ -182,13 +192,10 @@ func TestPackagerReadNext(t *testing.T) {
 
 	t.Log("Running with ", numPackets, " packets and ", endPacketLength, " length end packet")
 
+	// the fragments of a message have consecutive sequence ids
 	big_payload := make([]byte, 0)
-	idx := 0
 	for i := 0; i < numPackets - 1; i++ {
-		big_payload = append(big_payload, expectedPacket.Serialized...)
-		expectedPacket.Sqid++
-		t.Log(expectedPacket.Sqid)
-		idx += expectedPacket.Length
+		big_payload = append(big_payload, NewMySQLPacketFrom(i, expectedPacket.Payload).Serialized...)
 	}
 	big_payload = append(big_payload, endPacket.Serialized...)
 	if len(big_payload) != (numPackets - 1) * (MAX_PACKET_SIZE + 4) + endPacketLength + 4 {
@@ -215,9 +222,9 @@ func TestPackagerReadNext(t *testing.T) {
 		if ns.Length != MAX_PACKET_SIZE {
 			testPacket = endPacket
 		} else {
-			testPacket = expectedPacket
+			testPacket = NewMySQLPacketFrom(expectedPacket.Sqid, expectedPacket.Payload)
 		}
-		t.Log("Packet number: ", expectedPacket.Serialized[3])
+		t.Log("Packet number: ", testPacket.Serialized[SeqByteIndex(true)])
 
 		// Test that the next packet read is as expected!
 		if ns.Length != testPacket.Length {
@@ -289,12 +296,9 @@ func TestPackagerWriteMultiple(t *testing.T) {
 	expectedPacket.Sqid = 0
 
 
+	// the packets are written to the writer of the packager
 	packets, _ := packager.WritePacket(big_payload)
 
-	for _, tp := range packets {
-		b.Write(tp.Serialized)
-	}
-
 	packager.reader = bytes.NewReader(b.Bytes())
 
 	if len(packets) != numPackets {
@@ -321,7 +325,7 @@ func TestPackagerWriteMultiple(t *testing.T) {
 		} else {
 			testPacket = expectedPacket
 		}
-		t.Log("Packet number: ", testPacket.Serialized[4])
+		t.Log("Packet number: ", testPacket.Serialized[SeqByteIndex(true)])
 
 		// Test that the next packet read is as expected!
 		if ns.Length != testPacket.Length {
@@ -330,8 +334,8 @@ func TestPackagerWriteMultiple(t *testing.T) {
 		if ns.Sqid != testPacket.Sqid {
 			t.Log("Sequence id expected", testPacket.Sqid, "instead got", ns.Sqid)
 		}
-		if ns.Sqid != int(ns.Serialized[4]) {
-			t.Log("Out of sync sqid with packet and load: expected", ns.Sqid, "instead got", ns.Serialized[4])
+		if ns.Sqid != int(ns.Serialized[SeqByteIndex(true)]) {
+			t.Log("Out of sync sqid with packet and load: expected", ns.Sqid, "instead got", ns.Serialized[SeqByteIndex(true)])
 		}
 		if ns.Cmd != testPacket.Cmd {
 			t.Log("Command expected", testPacket.Cmd, "instead got", ns.Cmd)
@@ -344,7 +348,7 @@ func TestPackagerWriteMultiple(t *testing.T) {
 		}
 
 		expectedPacket.Sqid++
-		expectedPacket.Serialized[4] = expectedPacket.Serialized[4] + 1
+		expectedPacket.Serialized[SeqByteIndex(true)]++
 		t.Log("Just read one of these")
 	}
 
@@ -380,7 +384,7 @@ func TestWrongPacket(t *testing.T) {
 	t.Log("Case 2 : Tried to read mysqlpacket using netstring")
 
 	_, err := netstring.NewNetstring(bytes.NewReader(cases[0].Serialized))
-	if err == encoding.WRONGPACKET {
+	if errors.Is(err, encoding.WRONGPACKET) {
 		t.Log("Correctly identified wrong packet ")
 	} else if err != nil {
 		t.Log(err.Error())
@@ -392,7 +396,7 @@ func TestWrongPacket(t *testing.T) {
 
 	t.Log("Case 2 : Tried to read netstring packet using mysql")
 	_, err = NewMySQLPacket(bytes.NewReader(cases[1].Serialized))
-	if  err == encoding.WRONGPACKET {
+	if errors.Is(err, encoding.WRONGPACKET) {
 		t.Log("Correctly identified wrong packet ")
 	} else if err != nil {
 		t.Log(err.Error())
@@ -404,10 +408,10 @@ func TestWrongPacket(t *testing.T) {
 
 	t.Log("Case 3 MySQL : Tried to read unknown packet")
 	_, err = NewMySQLPacket(bytes.NewReader(cases[2].Serialized))
-	if err == encoding.WRONGPACKET {
+	if errors.Is(err, encoding.WRONGPACKET) {
 		t.Log("Should be unknown packet")
 		t.Fail()
-	} else if err != encoding.UNKNOWNPACKET {
+	} else if !errors.Is(err, encoding.UNKNOWNPACKET) {
 		t.Log("Failed to identify unknown packet")
 		t.Fail()
 	} else {
@@ -416,10 +420,10 @@ func TestWrongPacket(t *testing.T) {
 
 	t.Log("Case 3 Netstring : Tried to read unknown packet")
 	_, err = netstring.NewNetstring(bytes.NewReader(cases[2].Serialized))
-	if err == encoding.WRONGPACKET {
+	if errors.Is(err, encoding.WRONGPACKET) {
 		t.Log("Should be unknown packet")
 		t.Fail()
-	} else if err != encoding.UNKNOWNPACKET {
+	} else if !errors.Is(err, encoding.UNKNOWNPACKET) {
 		t.Log("Failed to identify unknown packet")
 		t.Fail()
 	} else {
@@ -427,4 +431,1541 @@ func TestWrongPacket(t *testing.T) {
 	}
 
 	t.Log("TestWrongPacket End+++++++++++++++++")
-}
\ No newline at end of file
+}
+/* Tests that a zero-length packet is a valid frame that can be read back. */
+func TestZeroLengthPacket(t *testing.T) {
+	t.Log("Start TestZeroLengthPacket +++++++++++++")
+	ns := NewMySQLPacketFrom(3, []byte{})
+	expected := []byte{0x00, 0, 0, 0, 3}
+	if !reflect.DeepEqual(ns.Serialized, expected) {
+		t.Log("Serialized expected", expected, "instead got", ns.Serialized)
+		t.Fail()
+	}
+	if ns.Cmd != NO_CMD {
+		t.Log("Command expected", NO_CMD, "instead got", ns.Cmd)
+		t.Fail()
+	}
+
+	rs, err := NewMySQLPacket(bytes.NewReader(ns.Serialized))
+	if err != nil {
+		t.Fatal("Failed to read zero-length packet:", err.Error())
+	}
+	if rs.Length != 0 || len(rs.Payload) != 0 {
+		t.Log("Expected empty payload, instead got", rs.Payload)
+		t.Fail()
+	}
+	if rs.Sqid != 3 {
+		t.Log("Sequence id expected 3 instead got", rs.Sqid)
+		t.Fail()
+	}
+	if rs.Cmd != NO_CMD {
+		t.Log("Command expected", NO_CMD, "instead got", rs.Cmd)
+		t.Fail()
+	}
+	t.Log("End TestZeroLengthPacket +++++++++++++")
+}
+
+func TestEOFPacket(t *testing.T) {
+	t.Log("Start TestEOFPacket +++++++++++++")
+	eof := EOFPacket(1, SERVER_STATUS_AUTOCOMMIT, uint32(CLIENT_PROTOCOL_41))
+	expected := []byte{0xfe, 1, 0, byte(SERVER_STATUS_AUTOCOMMIT), 0}
+	if !reflect.DeepEqual(eof, expected) {
+		t.Log("CLIENT_PROTOCOL_41 EOF expected", expected, "instead got", eof)
+		t.Fail()
+	}
+	eof = EOFPacket(1, SERVER_STATUS_AUTOCOMMIT, 0)
+	expected = []byte{0xfe}
+	if !reflect.DeepEqual(eof, expected) {
+		t.Log("EOF expected", expected, "instead got", eof)
+		t.Fail()
+	}
+	t.Log("End TestEOFPacket +++++++++++++")
+}
+
+func TestTerminatorPacket(t *testing.T) {
+	t.Log("Start TestTerminatorPacket +++++++++++++")
+	capabilities := uint32(CLIENT_PROTOCOL_41)
+	term := TerminatorPacket(SERVER_STATUS_AUTOCOMMIT, 2, capabilities)
+	expected := EOFPacket(2, SERVER_STATUS_AUTOCOMMIT, capabilities)
+	if !reflect.DeepEqual(term, expected) {
+		t.Log("Without CLIENT_DEPRECATE_EOF expected", expected, "instead got", term)
+		t.Fail()
+	}
+
+	capabilities |= uint32(CLIENT_DEPRECATE_EOF)
+	term = TerminatorPacket(SERVER_STATUS_AUTOCOMMIT, 2, capabilities)
+	expected = []byte{0xfe, 0, 0, byte(SERVER_STATUS_AUTOCOMMIT), 0, 2, 0}
+	if !reflect.DeepEqual(term, expected) {
+		t.Log("With CLIENT_DEPRECATE_EOF expected", expected, "instead got", term)
+		t.Fail()
+	}
+	// an OK packet with the 0xfe header must be longer than an EOF packet, that's how clients tell them apart
+	if len(term) < 7 {
+		t.Log("OK terminator too short", len(term))
+		t.Fail()
+	}
+	t.Log("End TestTerminatorPacket +++++++++++++")
+}
+
+func TestLenEncStringTooLong(t *testing.T) {
+	t.Log("Start TestLenEncStringTooLong +++++++++++++")
+	// 8-byte length claiming 2^62 bytes, followed by a few bytes only
+	data := []byte{0xfe, 0, 0, 0, 0, 0, 0, 0, 0x40, 'a', 'b', 'c'}
+	pos := 0
+	_, err := ReadLenEncString(data, &pos)
+	if !errors.Is(err, ErrMalformedLenEncString) {
+		t.Log("Expected ErrMalformedLenEncString, instead got", err)
+		t.Fail()
+	}
+	if pos != 0 {
+		t.Log("Expected position unchanged, instead got", pos)
+		t.Fail()
+	}
+	// truncated length
+	pos = 0
+	_, err = ReadLenEncString(data[:3], &pos)
+	if !errors.Is(err, ErrMalformedLenEncString) {
+		t.Log("Expected ErrMalformedLenEncString for truncated length, instead got", err)
+		t.Fail()
+	}
+	// ReadString doesn't allocate either, it returns an empty string
+	pos = 0
+	str, _ := ReadString(data, LENENCSTR, &pos, 0)
+	if len(str) != 0 {
+		t.Log("Expected empty string, instead got", str)
+		t.Fail()
+	}
+
+	// within the buffer but above the configured cap
+	maxSize := MaxLenEncStringSize
+	MaxLenEncStringSize = 2
+	pos = 0
+	_, err = ReadLenEncString([]byte{0x03, 'a', 'b', 'c'}, &pos)
+	MaxLenEncStringSize = maxSize
+	if !errors.Is(err, ErrMalformedLenEncString) {
+		t.Log("Expected ErrMalformedLenEncString above the cap, instead got", err)
+		t.Fail()
+	}
+
+	pos = 0
+	str, err = ReadLenEncString([]byte{0x03, 'a', 'b', 'c', 'd'}, &pos)
+	if err != nil || string(str) != "abc" || pos != 4 {
+		t.Log("Expected abc at position 4, instead got", string(str), pos, err)
+		t.Fail()
+	}
+	t.Log("End TestLenEncStringTooLong +++++++++++++")
+}
+
+func TestAuthSwitchRequest(t *testing.T) {
+	t.Log("Start TestAuthSwitchRequest +++++++++++++")
+	scramble := []byte("0123456789abcdefghij\x00")
+	payload := AuthSwitchRequest("mysql_native_password", scramble)
+	ns := NewMySQLPacketFrom(2, payload)
+	rs, err := NewMySQLPacket(bytes.NewReader(ns.Serialized))
+	if err != nil {
+		t.Fatal("Failed to read auth switch request:", err.Error())
+	}
+	pluginName, authData, err := ReadAuthSwitchRequest(rs.Payload)
+	if err != nil {
+		t.Fatal("Failed to parse auth switch request:", err.Error())
+	}
+	if pluginName != "mysql_native_password" {
+		t.Log("Plugin name expected mysql_native_password, instead got", pluginName)
+		t.Fail()
+	}
+	if !reflect.DeepEqual(authData, scramble) {
+		t.Log("Auth data expected", scramble, "instead got", authData)
+		t.Fail()
+	}
+	if _, _, err = ReadAuthSwitchRequest(AuthMoreData(scramble)); err == nil {
+		t.Log("Auth more data parsed as auth switch request")
+		t.Fail()
+	}
+	t.Log("End TestAuthSwitchRequest +++++++++++++")
+}
+
+func TestAuthMoreData(t *testing.T) {
+	t.Log("Start TestAuthMoreData +++++++++++++")
+	// caching_sha2_password fast auth success
+	payload := AuthMoreData([]byte{0x03})
+	ns := NewMySQLPacketFrom(4, payload)
+	rs, err := NewMySQLPacket(bytes.NewReader(ns.Serialized))
+	if err != nil {
+		t.Fatal("Failed to read auth more data:", err.Error())
+	}
+	data, err := ReadAuthMoreData(rs.Payload)
+	if err != nil {
+		t.Fatal("Failed to parse auth more data:", err.Error())
+	}
+	if !reflect.DeepEqual(data, []byte{0x03}) {
+		t.Log("Data expected [3], instead got", data)
+		t.Fail()
+	}
+	if _, err = ReadAuthMoreData([]byte{}); err == nil {
+		t.Log("Empty payload parsed as auth more data")
+		t.Fail()
+	}
+
+	// the client continues with the raw auth data
+	response := ReadAuthResponse([]byte("scrambled"))
+	if string(response) != "scrambled" {
+		t.Log("Auth response expected scrambled, instead got", string(response))
+		t.Fail()
+	}
+	t.Log("End TestAuthMoreData +++++++++++++")
+}
+
+func batchPayloads() [][]byte {
+	payloads := make([][]byte, 100)
+	for i := range payloads {
+		payloads[i] = bytes.Repeat([]byte{byte(i)}, 1+i*3)
+	}
+	return payloads
+}
+
+func TestAppendPacket(t *testing.T) {
+	t.Log("Start TestAppendPacket +++")
+	payloads := batchPayloads()
+	var expected []byte
+	p := NewPackager(nil, nil)
+	for _, payload := range payloads {
+		pkts, err := p.WritePacket(payload)
+		if err != nil {
+			t.Log("WritePacket failed:", err)
+			t.Fail()
+		}
+		for _, pkt := range pkts {
+			expected = append(expected, pkt.Serialized...)
+		}
+	}
+	var buf []byte
+	p = NewPackager(nil, nil)
+	for _, payload := range payloads {
+		buf = p.AppendPacket(buf, payload)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Log("Appended packets differ from the serialized packets")
+		t.Fail()
+	}
+	pkt := NewMySQLPacketFrom(7, []byte("hello"))
+	if !bytes.Equal(pkt.AppendSerialized([]byte{1}), append([]byte{1}, pkt.Serialized...)) {
+		t.Log("AppendSerialized differs from Serialized")
+		t.Fail()
+	}
+	t.Log("End TestAppendPacket +++")
+}
+
+func TestWritePacketTerminator(t *testing.T) {
+	t.Log("Start TestWritePacketTerminator +++")
+	// the message ends with a packet shorter than MAX_PACKET_SIZE, empty if needed
+	tests := []struct {
+		size    int
+		lengths []int
+	}{
+		{0, []int{0}},
+		{10, []int{10}},
+		{MAX_PACKET_SIZE, []int{MAX_PACKET_SIZE, 0}},
+		{MAX_PACKET_SIZE + 1, []int{MAX_PACKET_SIZE, 1}},
+		{2 * MAX_PACKET_SIZE, []int{MAX_PACKET_SIZE, MAX_PACKET_SIZE, 0}},
+	}
+	for _, test := range tests {
+		payload := bytes.Repeat([]byte{byte(common.COM_QUERY)}, test.size)
+		var written bytes.Buffer
+		pkts, err := NewPackager(nil, &written).WritePacket(payload)
+		if err != nil {
+			t.Fatal("size", test.size, "WritePacket:", err.Error())
+		}
+		var lengths []int
+		for i, pkt := range pkts {
+			lengths = append(lengths, pkt.Length)
+			if pkt.Sqid != i {
+				t.Error("size", test.size, "packet", i, "has sequence id", pkt.Sqid)
+			}
+		}
+		if !reflect.DeepEqual(lengths, test.lengths) {
+			t.Error("size", test.size, "expected packets of", test.lengths, "instead got", lengths)
+		}
+		if appended := NewPackager(nil, nil).AppendPacket(nil, payload); !bytes.Equal(appended, written.Bytes()) {
+			t.Error("size", test.size, "AppendPacket differs from WritePacket")
+		}
+
+		p := NewPackager(&written, nil)
+		first, err := p.ReadNext()
+		if err != nil {
+			t.Fatal("size", test.size, "ReadNext:", err.Error())
+		}
+		read, err := p.ReadMultiplePackets(first)
+		if err != nil || len(read) != len(pkts) || written.Len() != 0 {
+			t.Error("size", test.size, "read back", len(read), "packets, left", written.Len(), "bytes", err)
+		}
+	}
+	t.Log("End TestWritePacketTerminator +++")
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	payloads := batchPayloads()
+	var out bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		out.Reset()
+		for sqid, payload := range payloads {
+			out.Write(NewMySQLPacketFrom(sqid, payload).Serialized)
+		}
+	}
+}
+
+func BenchmarkAppendPacket(b *testing.B) {
+	payloads := batchPayloads()
+	var out bytes.Buffer
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		out.Reset()
+		buf = buf[:0]
+		p := NewPackager(nil, nil)
+		for _, payload := range payloads {
+			buf = p.AppendPacket(buf, payload)
+		}
+		out.Write(buf)
+	}
+}
+
+// colDefDriver is a database/sql driver returning no rows, only the column metadata of colDefColumns
+type colDefDriver struct{}
+type colDefConn struct{}
+type colDefStmt struct{}
+type colDefRows struct {
+	next int
+}
+
+type colDefColumn struct {
+	name      string
+	typeName  string
+	length    int64
+	hasLength bool
+	nullable  bool
+	precision int64
+	scale     int64
+	scanType  reflect.Type
+}
+
+var colDefColumns = []colDefColumn{
+	{name: "id", typeName: "INT", scanType: reflect.TypeOf(int32(0))},
+	{name: "name", typeName: "VARCHAR", length: 30, hasLength: true, nullable: true, scanType: reflect.TypeOf(sql.RawBytes{})},
+	{name: "price", typeName: "DECIMAL", nullable: true, precision: 10, scale: 2, scanType: reflect.TypeOf(sql.RawBytes{})},
+}
+
+func init() {
+	sql.Register("coldeftest", &colDefDriver{})
+}
+
+func (d *colDefDriver) Open(name string) (driver.Conn, error) { return &colDefConn{}, nil }
+func (c *colDefConn) Prepare(query string) (driver.Stmt, error) { return &colDefStmt{}, nil }
+func (c *colDefConn) Close() error { return nil }
+func (c *colDefConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+func (s *colDefStmt) Close() error { return nil }
+func (s *colDefStmt) NumInput() int { return -1 }
+func (s *colDefStmt) Exec(args []driver.Value) (driver.Result, error) { return nil, errors.New("not supported") }
+func (s *colDefStmt) Query(args []driver.Value) (driver.Rows, error) { return &colDefRows{}, nil }
+func (r *colDefRows) Close() error { return nil }
+
+// colDefData are the rows the coldeftest driver returns, none by default
+var colDefData [][]driver.Value
+
+func (r *colDefRows) Next(dest []driver.Value) error {
+	if r.next >= len(colDefData) {
+		return io.EOF
+	}
+	copy(dest, colDefData[r.next])
+	r.next++
+	return nil
+}
+
+func (r *colDefRows) Columns() []string {
+	names := make([]string, len(colDefColumns))
+	for i, col := range colDefColumns {
+		names[i] = col.name
+	}
+	return names
+}
+
+func (r *colDefRows) ColumnTypeDatabaseTypeName(index int) string {
+	return colDefColumns[index].typeName
+}
+
+func (r *colDefRows) ColumnTypeLength(index int) (int64, bool) {
+	return colDefColumns[index].length, colDefColumns[index].hasLength
+}
+
+func (r *colDefRows) ColumnTypeNullable(index int) (bool, bool) {
+	return colDefColumns[index].nullable, true
+}
+
+func (r *colDefRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	col := colDefColumns[index]
+	return col.precision, col.scale, col.typeName == "DECIMAL"
+}
+
+func (r *colDefRows) ColumnTypeScanType(index int) reflect.Type {
+	return colDefColumns[index].scanType
+}
+
+func TestColumnDefinition(t *testing.T) {
+	t.Log("Start TestColumnDefinition +++")
+	db, err := sql.Open("coldeftest", "")
+	if err != nil {
+		t.Fatal("sql.Open:", err.Error())
+	}
+	defer db.Close()
+	rows, err := db.Query("select id, name, price from test")
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal("ColumnTypes:", err.Error())
+	}
+
+	// the fixed length fields: length of the fields, character set, column length, type, flags, decimals, filler
+	expected := [][]byte{
+		{0x0c, 0x3f, 0x00, 11, 0x00, 0x00, 0x00, 0x03, 0x81, 0x00, 0x00, 0x00, 0x00},
+		{0x0c, 0x21, 0x00, 30, 0x00, 0x00, 0x00, 0x0f, 0x00, 0x00, 0x1f, 0x00, 0x00},
+		{0x0c, 0x3f, 0x00, 12, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x02, 0x00, 0x00},
+	}
+	p := NewPackager(nil, nil)
+	for i, colType := range colTypes {
+		payload := p.ColumnDefinition(colType.Name(), colType, uint32(CLIENT_PROTOCOL_41))
+		if !bytes.HasSuffix(payload, expected[i]) {
+			t.Log(colType.DatabaseTypeName(), "expected column definition ending with", expected[i], "instead got", payload)
+			t.Fail()
+		}
+		pos := 0
+		var fields []string
+		for j := 0; j < 6; j++ {
+			field, err := ReadLenEncString(payload, &pos)
+			if err != nil {
+				t.Fatal(colType.DatabaseTypeName(), "reading field", j, err.Error())
+			}
+			fields = append(fields, string(field))
+		}
+		if fields[0] != "def" || fields[4] != colType.Name() || fields[5] != colType.Name() {
+			t.Log(colType.DatabaseTypeName(), "unexpected fields", fields)
+			t.Fail()
+		}
+		if pos != len(payload)-len(expected[i]) {
+			t.Log(colType.DatabaseTypeName(), "unexpected length", len(payload))
+			t.Fail()
+		}
+	}
+	t.Log("End TestColumnDefinition +++")
+}
+
+func TestUnsignedBigint(t *testing.T) {
+	// newer drivers tell in the type name, go-sql-driver 1.4 only through the scan type
+	saved := colDefColumns
+	colDefColumns = []colDefColumn{
+		{name: "a", typeName: "BIGINT UNSIGNED", scanType: reflect.TypeOf(uint64(0))},
+		{name: "b", typeName: "BIGINT", scanType: reflect.TypeOf(uint64(0))},
+		{name: "c", typeName: "BIGINT", scanType: reflect.TypeOf(int64(0))},
+	}
+	defer func() { colDefColumns = saved }()
+	db, err := sql.Open("coldeftest", "")
+	if err != nil {
+		t.Fatal("sql.Open:", err.Error())
+	}
+	defer db.Close()
+	rows, err := db.Query("select a, b, c from test")
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal("ColumnTypes:", err.Error())
+	}
+
+	typeNames := make([]string, len(colTypes))
+	p := NewPackager(nil, nil)
+	for i, colType := range colTypes {
+		typeNames[i] = ColumnTypeName(colType)
+		def, err := ReadColumnDefinition(p.ColumnDefinition(colType.Name(), colType, uint32(CLIENT_PROTOCOL_41)), uint32(CLIENT_PROTOCOL_41))
+		if err != nil {
+			t.Fatal("ReadColumnDefinition:", err.Error())
+		}
+		unsigned := i < 2
+		if def.Type != EnumFieldTypes["BIGINT"] || (def.Flags&UNSIGNED_FLAG != 0) != unsigned || def.Length != 20 {
+			t.Log(colType.Name(), "unexpected column definition", def)
+			t.Fail()
+		}
+	}
+	if !reflect.DeepEqual(typeNames, []string{"BIGINT UNSIGNED", "BIGINT UNSIGNED", "BIGINT"}) {
+		t.Log("Unexpected type names", typeNames)
+		t.Fail()
+	}
+
+	// 2^63 + 5 keeps its high bit instead of failing to parse as a signed integer
+	values := []sql.NullString{{String: "9223372036854775813", Valid: true}, {String: "18446744073709551615", Valid: true},
+		{String: "-2", Valid: true}}
+	row := BinaryResultsetRow(typeNames, values, nil)
+	pos := 2 // header and NULL bitmap
+	for i, expected := range []uint64{1<<63 + 5, math.MaxUint64, uint64(1<<64 - 2)} {
+		if n := uint64(ReadFixedLenInt(row, INT8, &pos)); n != expected {
+			t.Log("Value", i, "expected", expected, "instead got", n)
+			t.Fail()
+		}
+	}
+	if pos != len(row) {
+		t.Log("Unexpected row length", len(row), row)
+		t.Fail()
+	}
+
+	// go-sql-driver 1.4 scans a nullable unsigned column as sql.NullInt64, the value above 2^63 is unsigned
+	row = BinaryResultsetRow([]string{"BIGINT"}, []sql.NullString{{String: "18446744073709551615", Valid: true}}, nil)
+	pos = 2
+	if n := uint64(ReadFixedLenInt(row, INT8, &pos)); n != math.MaxUint64 {
+		t.Log("Expected", uint64(math.MaxUint64), "for a nullable unsigned column, instead got", n)
+		t.Fail()
+	}
+}
+
+func TestFormatDecimal(t *testing.T) {
+	tests := []struct {
+		value    string
+		scale    int
+		expected string
+	}{
+		{"1.5", 2, "1.50"},
+		{"1.50", 2, "1.50"},
+		{"1", 2, "1.00"},
+		{"-0.5", 2, "-0.50"},
+		{".5", 2, "0.50"},
+		{"007.25", 2, "7.25"},
+		{"1.505", 2, "1.51"},
+		{"1.504", 2, "1.50"},
+		{"-9.995", 2, "-10.00"},
+		{"-0.001", 2, "0.00"},
+		{"0.005", 2, "0.01"},
+		{"2.5", 0, "3"},
+		{"12345678.9", 2, "12345678.90"},
+		{"1.5e2", 2, "1.5e2"},
+		{"", 2, ""},
+		{"abc", 2, "abc"},
+	}
+	for _, test := range tests {
+		if str := FormatDecimal(test.value, test.scale); str != test.expected {
+			t.Error("FormatDecimal", test.value, test.scale, "expected", test.expected, "instead got", str)
+		}
+	}
+}
+
+func TestDecimalScale(t *testing.T) {
+	t.Log("Start TestDecimalScale +++")
+	db, err := sql.Open("coldeftest", "")
+	if err != nil {
+		t.Fatal("sql.Open:", err.Error())
+	}
+	defer db.Close()
+	rows, err := db.Query("select id, name, price from test")
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal("ColumnTypes:", err.Error())
+	}
+	typeNames := make([]string, len(colTypes))
+	for i, colType := range colTypes {
+		typeNames[i] = ColumnTypeName(colType)
+	}
+	if !reflect.DeepEqual(typeNames, []string{"INT", "VARCHAR", "DECIMAL(10,2)"}) {
+		t.Fatal("Unexpected type names", typeNames)
+	}
+	if precision, scale, ok := DecimalSize(typeNames[2]); !ok || precision != 10 || scale != 2 {
+		t.Error("DecimalSize expected 10, 2 instead got", precision, scale, ok)
+	}
+	if _, _, ok := DecimalSize(typeNames[1]); ok {
+		t.Error("DecimalSize expected no size for", typeNames[1])
+	}
+
+	// the driver stringified the DECIMAL(10,2) value without its trailing zero
+	values := []sql.NullString{{String: "1", Valid: true}, {String: "a", Valid: true}, {String: "1.5", Valid: true}}
+	text, err := readTextResultsetRow(TextResultsetRow(typeNames, values, nil), len(values))
+	if err != nil {
+		t.Fatal("readTextResultsetRow:", err.Error())
+	}
+	if text[2].String != "1.50" {
+		t.Error("Text row expected 1.50 instead got", text[2].String)
+	}
+	row := BinaryResultsetRow(typeNames, values, nil)
+	pos := 2 /* header and NULL bitmap */ + INT4 /* id */
+	ReadLenEncString(row, &pos)
+	price, err := ReadLenEncString(row, &pos)
+	if err != nil || string(price) != "1.50" || pos != len(row) {
+		t.Error("Binary row expected 1.50 instead got", string(price), err, row)
+	}
+	t.Log("End TestDecimalScale +++")
+}
+
+func TestReadMultiplePackets(t *testing.T) {
+	t.Log("Start TestReadMultiplePackets +++")
+	for _, size := range []int{10, MAX_PACKET_SIZE + 10, MAX_PACKET_SIZE} {
+		payload := bytes.Repeat([]byte{byte(common.COM_QUERY)}, size)
+		pkts, err := NewPackager(nil, nil).WritePacket(payload)
+		if err != nil {
+			t.Fatal("WritePacket:", err.Error())
+		}
+		var stream bytes.Buffer
+		for _, pkt := range pkts {
+			stream.Write(pkt.Serialized)
+		}
+		// followed by another message, which must not be read
+		stream.Write(NewMySQLPacketFrom(0, []byte{byte(common.COM_PING)}).Serialized)
+
+		var p encoding.Packaging = NewPackager(&stream, nil)
+		first, err := p.ReadNext()
+		if err != nil {
+			t.Fatal("ReadNext:", err.Error())
+		}
+		if p.IsComposite() != (size >= MAX_PACKET_SIZE) {
+			t.Log("size", size, "unexpected IsComposite", p.IsComposite())
+			t.Fail()
+		}
+		read, err := p.ReadMultiplePackets(first)
+		if err != nil {
+			t.Fatal("ReadMultiplePackets:", err.Error())
+		}
+		if len(read) != len(pkts) {
+			t.Fatal("size", size, "expected", len(pkts), "packets, instead got", len(read))
+		}
+		total := 0
+		for _, pkt := range read {
+			total += pkt.Length
+		}
+		if total != size || p.IsComposite() {
+			t.Log("size", size, "read", total, "bytes, IsComposite", p.IsComposite())
+			t.Fail()
+		}
+		next, err := p.ReadNext()
+		if err != nil || next.Cmd != common.COM_PING {
+			t.Log("size", size, "next message not read correctly", err)
+			t.Fail()
+		}
+	}
+	t.Log("End TestReadMultiplePackets +++")
+}
+
+func TestPackagerReadNextFragments(t *testing.T) {
+	t.Log("Start TestPackagerReadNextFragments +++")
+	// a 40MB message is sent in 3 packets
+	size := 40 * 1024 * 1024
+	payload := bytes.Repeat([]byte{byte(common.COM_QUERY)}, size)
+	pkts, err := NewPackager(nil, nil).WritePacket(payload)
+	if err != nil || len(pkts) != 3 {
+		t.Fatal("WritePacket:", len(pkts), err)
+	}
+	ping := NewMySQLPacketFrom(0, []byte{byte(common.COM_PING)})
+	var stream bytes.Buffer
+	for _, pkt := range pkts {
+		stream.Write(pkt.Serialized)
+	}
+	stream.Write(ping.Serialized)
+	serialized := stream.Bytes()
+
+	p := NewPackager(&stream, nil)
+	total := 0
+	for i := range pkts {
+		pkt, err := p.ReadNext()
+		if err != nil {
+			t.Fatal("fragment", i, ":", err.Error())
+		}
+		if i == 0 && stream.Len() != len(ping.Serialized) {
+			t.Log("Expected the whole message read with the first fragment, left", stream.Len())
+			t.Fail()
+		}
+		if pkt.Sqid != i || pkt.Length != pkts[i].Length || p.IsComposite() != (i < len(pkts)-1) {
+			t.Log("fragment", i, "unexpected sequence id", pkt.Sqid, "length", pkt.Length, "IsComposite", p.IsComposite())
+			t.Fail()
+		}
+		total += pkt.Length
+	}
+	if total != size {
+		t.Log("Expected", size, "bytes, instead got", total)
+		t.Fail()
+	}
+	next, err := p.ReadNext()
+	if err != nil || next.Cmd != common.COM_PING || p.IsComposite() {
+		t.Log("Next message not read correctly", err)
+		t.Fail()
+	}
+
+	// the fragments read before an error are returned first
+	truncated := serialized[:len(serialized)-len(ping.Serialized)-10]
+	p = NewPackager(bytes.NewReader(truncated), nil)
+	for i := 0; i < 2; i++ {
+		if _, err = p.ReadNext(); err != nil || !p.IsComposite() {
+			t.Fatal("truncated fragment", i, ":", err, p.IsComposite())
+		}
+	}
+	if _, err = p.ReadNext(); err != io.ErrUnexpectedEOF || p.IsComposite() {
+		t.Log("Expected io.ErrUnexpectedEOF, instead got", err)
+		t.Fail()
+	}
+
+	// ReadMultiplePackets returns the buffered fragments, which must follow each other
+	outOfOrder := append([]byte{}, serialized...)
+	outOfOrder[len(pkts[0].Serialized)+SeqByteIndex(true)] = 5
+	p = NewPackager(bytes.NewReader(outOfOrder), nil)
+	first, err := p.ReadNext()
+	if err != nil || !p.IsComposite() {
+		t.Fatal("first fragment:", err)
+	}
+	if _, err = p.ReadMultiplePackets(first); err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Log("Expected packet out of order, instead got", err)
+		t.Fail()
+	}
+
+	// a message larger than MaxMessageSize is not buffered
+	maxMessageSize := MaxMessageSize
+	defer func() { MaxMessageSize = maxMessageSize }()
+	MaxMessageSize = 2 * MAX_PACKET_SIZE
+	reader := bytes.NewReader(serialized)
+	p = NewPackager(reader, nil)
+	first, err = p.ReadNext()
+	if err != nil || !p.IsComposite() {
+		t.Fatal("first fragment:", err)
+	}
+	if reader.Len() != len(serialized)-len(pkts[0].Serialized)-len(pkts[1].Serialized) {
+		t.Log("Expected the message read up to MaxMessageSize, left", reader.Len())
+		t.Fail()
+	}
+	if _, err = p.ReadMultiplePackets(first); err != ErrMessageTooLarge {
+		t.Log("Expected ErrMessageTooLarge, instead got", err)
+		t.Fail()
+	}
+	t.Log("End TestPackagerReadNextFragments +++")
+}
+
+func TestLenEncIntBoundaries(t *testing.T) {
+	t.Log("Start TestLenEncIntBoundaries +++")
+	cases := []struct {
+		data []byte
+		n    int
+		pos  int
+		err  error
+	}{
+		{[]byte{0xfa}, 250, 1, nil},
+		{[]byte{0xfb}, 0, 0, ErrLenEncNull},
+		{[]byte{0xfc, 0xfb, 0x00}, 251, 3, nil},
+		{[]byte{0xfc, 0xfb}, 0, 0, ErrMalformedLenEncInt},
+		{[]byte{0xfd, 0x00, 0x00, 0x01}, 1 << 16, 4, nil},
+		{[]byte{0xfe, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, 1 << 24, 9, nil},
+		{[]byte{0xfe, 0x00, 0x00, 0x00, 0x01}, 0, 0, ErrMalformedLenEncInt},
+		{[]byte{0xff, 0x15, 0x04}, 0, 0, ErrMalformedLenEncInt},
+		{[]byte{}, 0, 0, ErrMalformedLenEncInt},
+	}
+	for _, c := range cases {
+		pos := 0
+		n, err := ReadLenEncInt(c.data, &pos)
+		if n != c.n || pos != c.pos || err != c.err {
+			t.Log("data", c.data, "expected", c.n, c.pos, c.err, "instead got", n, pos, err)
+			t.Fail()
+		}
+		if err != nil || c.data[0] == 0xfa {
+			continue
+		}
+		// the integer is written back the same way
+		data := make([]byte, len(c.data))
+		pos = 0
+		WriteLenEncInt(data, uint64(c.n), &pos)
+		if !bytes.Equal(data, c.data) {
+			t.Log("Expected", c.n, "written as", c.data, "instead got", data)
+			t.Fail()
+		}
+	}
+
+	for _, str := range []string{"", "abc", string(bytes.Repeat([]byte{'a'}, 251))} {
+		size := WriteLenEncString(nil, str, nil)
+		data := make([]byte, size)
+		pos := 0
+		n := WriteLenEncString(data, str, &pos)
+		if n != size || pos != size {
+			t.Log("Expected", size, "bytes written, instead got", n, pos)
+			t.Fail()
+		}
+		pos = 0
+		read, err := ReadLenEncString(data, &pos)
+		if err != nil || string(read) != str || pos != size {
+			t.Log("Expected", len(str), "bytes string, instead got", len(read), err)
+			t.Fail()
+		}
+	}
+	t.Log("End TestLenEncIntBoundaries +++")
+}
+
+func TestReadConnectAttrs(t *testing.T) {
+	t.Log("Start TestReadConnectAttrs +++")
+	data := []byte{0x0c, 0x02, 'o', 's', 0x05, 'l', 'i', 'n', 'u', 'x', 0x01, 'a', 0x00, 0xff}
+	pos := 0
+	attrs, err := ReadConnectAttrs(data, &pos)
+	if err != nil {
+		t.Fatal("Unexpected error", err.Error())
+	}
+	if len(attrs) != 2 || attrs["os"] != "linux" || attrs["a"] != "" {
+		t.Log("Unexpected attributes", attrs)
+		t.Fail()
+	}
+	if pos != 13 {
+		t.Log("Expected to stop at the end of the attributes, instead pos is", pos)
+		t.Fail()
+	}
+
+	// the length of the attributes goes past the end of the packet
+	pos = 0
+	if _, err = ReadConnectAttrs([]byte{0x0c, 0x02, 'o', 's'}, &pos); err == nil {
+		t.Log("Expected error for truncated attributes")
+		t.Fail()
+	}
+	// the value goes past the length of the attributes
+	pos = 0
+	if _, err = ReadConnectAttrs([]byte{0x04, 0x02, 'o', 's', 0x01, 'x'}, &pos); err == nil {
+		t.Log("Expected error for a value past the attributes")
+		t.Fail()
+	}
+	t.Log("End TestReadConnectAttrs +++")
+}
+
+func TestNewInitSQLPacketMaxAllowed(t *testing.T) {
+	t.Log("Start TestNewInitSQLPacketMaxAllowed +++")
+	maxAllowed := MaxAllowedPacket
+	defer func() { MaxAllowedPacket = maxAllowed }()
+	MaxAllowedPacket = 4
+
+	// the header alone is rejected, before the payload is read
+	_, err := NewInitSQLPacket(bytes.NewReader([]byte{0x05, 0x00, 0x00, 0x00}))
+	if err != ErrPacketTooLarge {
+		t.Log("Expected ErrPacketTooLarge, instead got", err)
+		t.Fail()
+	}
+	ns, err := NewInitSQLPacket(bytes.NewReader([]byte{0x04, 0x00, 0x00, 0x00, 0x03, 's', 'q', 'l'}))
+	if err != nil || string(ns.Payload) != "\x03sql" {
+		t.Log("Expected the payload within the limit, instead got", ns, err)
+		t.Fail()
+	}
+
+	// a payload spanning several chunks is read completely
+	MaxAllowedPacket = maxAllowed
+	payload := make([]byte, 3*payloadChunkSize+1)
+	rand.Read(payload)
+	ns, err = NewInitSQLPacket(bytes.NewReader(NewMySQLPacketFrom(0, payload).Serialized[1:]))
+	if err != nil || !bytes.Equal(ns.Payload, payload) {
+		t.Log("Large payload not read back", err)
+		t.Fail()
+	}
+
+	// the client claims more bytes than it sends
+	_, err = NewInitSQLPacket(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x00, 0x03}))
+	if err != io.ErrUnexpectedEOF {
+		t.Log("Expected io.ErrUnexpectedEOF, instead got", err)
+		t.Fail()
+	}
+	t.Log("End TestNewInitSQLPacketMaxAllowed +++")
+}
+
+func TestClientPackager(t *testing.T) {
+	t.Log("Start TestClientPackager +++")
+	payload := []byte{0x03, 's', 'q', 'l'}
+	for _, client := range []bool{false, true} {
+		var stream bytes.Buffer
+		p := NewPackager(nil, &stream)
+		if client {
+			p = NewClientPackager(nil, &stream)
+		}
+		p.SetSqid(2)
+		pkts, err := p.WritePacket(payload)
+		if err != nil || len(pkts) != 1 {
+			t.Fatal("Failed to write the packet:", err)
+		}
+		// a client gets the frame without the indicator byte
+		expected := pkts[0].Serialized
+		if client {
+			expected = expected[encoding.IndicatorSize:]
+		}
+		if !bytes.Equal(stream.Bytes(), expected) {
+			t.Log("Client", client, "unexpected bytes written", stream.Bytes())
+			t.Fail()
+		}
+
+		reader := NewPackager(&stream, nil)
+		if client {
+			reader = NewClientPackager(&stream, nil)
+		}
+		ns, err := reader.ReadPacket()
+		if err != nil || !bytes.Equal(ns.Payload, payload) || ns.Sqid != 2 || !bytes.Equal(ns.Serialized, pkts[0].Serialized) {
+			t.Log("Client", client, "packet not read back", ns, err)
+			t.Fail()
+		}
+	}
+	t.Log("End TestClientPackager +++")
+}
+
+func TestNewInitSQLPacketEmpty(t *testing.T) {
+	t.Log("Start TestNewInitSQLPacketEmpty +++")
+	ns, err := NewInitSQLPacket(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x03}))
+	if err != nil || ns == nil {
+		t.Fatal("Expected empty packet, instead got", ns, err)
+	}
+	if ns.Cmd != NO_CMD || len(ns.Payload) != 0 || ns.Sqid != 3 || len(ns.Serialized) != HEADER_SIZE+1 {
+		t.Log("Unexpected empty packet", ns.Cmd, ns.Payload, ns.Sqid, ns.Serialized)
+		t.Fail()
+	}
+	t.Log("End TestNewInitSQLPacketEmpty +++")
+}
+
+func TestResultsetRowValues(t *testing.T) {
+	t.Log("Start TestResultsetRowValues +++")
+	colTypes := []string{"BIGINT", "VARCHAR", "DOUBLE", "DATETIME", "INT"}
+	row := []interface{}{int64(7), []byte("seven"), 7.5, time.Date(2019, 4, 1, 12, 30, 0, 0, time.UTC), nil}
+
+	// text protocol
+	text, err := readTextResultsetRow(TextResultsetRowValues(colTypes, row, nil), len(row))
+	if err != nil {
+		t.Fatal("reading text row:", err.Error())
+	}
+	expected := []sql.NullString{{String: "7", Valid: true}, {String: "seven", Valid: true}, {String: "7.5", Valid: true},
+		{String: "2019-04-01 12:30:00", Valid: true}, {}}
+	for i := range expected {
+		if text[i] != expected[i] {
+			t.Log("Text column", i, "expected", expected[i], "instead got", text[i])
+			t.Fail()
+		}
+	}
+
+	// binary protocol: header, NULL bitmap with offset 2, then the non-NULL values
+	binary := BinaryResultsetRowValues(colTypes, row, nil)
+	if binary[0] != 0x00 || binary[1] != 1<<(4+2) {
+		t.Fatal("Unexpected header or NULL bitmap", binary[:2])
+	}
+	pos := 2
+	if n := ReadFixedLenInt(binary, INT8, &pos); n != 7 {
+		t.Log("Expected BIGINT 7, instead got", n)
+		t.Fail()
+	}
+	if str, err := ReadLenEncString(binary, &pos); err != nil || string(str) != "seven" {
+		t.Log("Expected VARCHAR seven, instead got", string(str), err)
+		t.Fail()
+	}
+	if f := math.Float64frombits(uint64(ReadFixedLenInt(binary, INT8, &pos))); f != 7.5 {
+		t.Log("Expected DOUBLE 7.5, instead got", f)
+		t.Fail()
+	}
+	if dt, err := ReadBinaryDateTime(binary, &pos); err != nil || !dt.Equal(time.Date(2019, 4, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Log("Expected DATETIME, instead got", dt, err)
+		t.Fail()
+	}
+	if pos != len(binary) {
+		t.Log("Unexpected data after the values", binary[pos:])
+		t.Fail()
+	}
+	t.Log("End TestResultsetRowValues +++")
+}
+
+func TestWriteTextField(t *testing.T) {
+	t.Log("Start TestWriteTextField +++")
+	cases := []struct {
+		value    sql.NullString
+		expected []byte
+	}{
+		{sql.NullString{}, []byte{0xfb}},
+		{sql.NullString{Valid: true}, []byte{0x00}},
+		{sql.NullString{String: "a", Valid: true}, []byte{0x01, 'a'}},
+	}
+	for _, c := range cases {
+		data := make([]byte, textFieldLen(c.value))
+		pos := 0
+		writeTextField(data, c.value, &pos)
+		if !bytes.Equal(data, c.expected) || pos != len(data) {
+			t.Log("Field", c.value, "expected", c.expected, "instead got", data, pos)
+			t.Fail()
+		}
+	}
+
+	// SELECT NULL, '' returns two distinguishable values
+	row := TextResultsetRow([]string{"VARCHAR", "VARCHAR"}, []sql.NullString{{}, {Valid: true}}, nil)
+	if !bytes.Equal(row, []byte{0xfb, 0x00}) {
+		t.Log("Expected NULL and empty string, instead got", row)
+		t.Fail()
+	}
+	t.Log("End TestWriteTextField +++")
+}
+
+func TestColumnDefinitionAlias(t *testing.T) {
+	t.Log("Start TestColumnDefinitionAlias +++")
+	db, err := sql.Open("coldeftest", "")
+	if err != nil {
+		t.Fatal("sql.Open:", err.Error())
+	}
+	defer db.Close()
+	// like MySQL, the driver reports the alias as the column name
+	query := "select id, cost as price from test"
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal("ColumnTypes:", err.Error())
+	}
+	// colDefColumns has price as its third column
+	orgNames := common.SelectColumns(query)
+	def, err := ReadColumnDefinition(NewPackager(nil, nil).ColumnDefinition(orgNames[1], colTypes[2], uint32(CLIENT_PROTOCOL_41)), uint32(CLIENT_PROTOCOL_41))
+	if err != nil {
+		t.Fatal("ReadColumnDefinition:", err.Error())
+	}
+	if def.Name != "price" || def.OrgName != "cost" {
+		t.Log("Expected name price and org_name cost, instead got", def.Name, def.OrgName)
+		t.Fail()
+	}
+	t.Log("End TestColumnDefinitionAlias +++")
+}
+
+func TestParamDefinition(t *testing.T) {
+	t.Log("Start TestParamDefinition +++")
+	for _, capabilities := range []uint32{uint32(CLIENT_PROTOCOL_41), 0} {
+		def, err := ReadColumnDefinition(ParamDefinition(capabilities), capabilities)
+		if err != nil {
+			t.Fatal("ReadColumnDefinition:", err.Error())
+		}
+		if def.Name != "?" || def.Type != EnumFieldTypes["VAR_STRING"] || def.Flags&BINARY_FLAG == 0 {
+			t.Log("Expected a binary VAR_STRING named ?, instead got", def.Name, def.Type, def.Flags)
+			t.Fail()
+		}
+	}
+	t.Log("End TestParamDefinition +++")
+}
+
+func TestResultset(t *testing.T) {
+	t.Log("Start TestResultset +++")
+	colDefData = [][]driver.Value{{int64(1), []byte("one"), []byte("1.50")}, {int64(2), nil, nil}}
+	defer func() { colDefData = nil }()
+	db, err := sql.Open("coldeftest", "")
+	if err != nil {
+		t.Fatal("sql.Open:", err.Error())
+	}
+	defer db.Close()
+	rows, err := db.Query("select id, name, price from test")
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+
+	frames, err := NewClientPackager(nil, nil).Resultset(len(colDefColumns), 1, rows)
+	if err != nil {
+		t.Fatal("Resultset:", err.Error())
+	}
+	// column count, 3 column definitions, EOF, 2 rows, EOF
+	if len(frames) != 8 {
+		t.Fatal("Expected 8 frames, instead got", len(frames))
+	}
+	var stream bytes.Buffer
+	for i, frame := range frames {
+		if int(frame[SeqByteIndex(false)]) != i+1 {
+			t.Log("Frame", i, "has sequence id", frame[SeqByteIndex(false)])
+			t.Fail()
+		}
+		stream.Write(frame)
+	}
+	resp, err := ReadCommandResponse(NewClientPackager(&stream, nil), uint32(CLIENT_PROTOCOL_41))
+	if err != nil || resp.Resultset == nil {
+		t.Fatal("Expected a resultset, instead got", resp, err)
+	}
+	if len(resp.Resultset.Columns) != 3 || resp.Resultset.Columns[1].Name != "name" {
+		t.Log("Unexpected columns", resp.Resultset.Columns)
+		t.Fail()
+	}
+	expected := [][]sql.NullString{
+		{{String: "1", Valid: true}, {String: "one", Valid: true}, {String: "1.50", Valid: true}},
+		{{String: "2", Valid: true}, {}, {}},
+	}
+	if !reflect.DeepEqual(resp.Resultset.Rows, expected) {
+		t.Log("Expected rows", expected, "instead got", resp.Resultset.Rows)
+		t.Fail()
+	}
+
+	// the column count must match the rows
+	rows, err = db.Query("select id, name, price from test")
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+	if _, err = NewClientPackager(nil, nil).Resultset(2, 1, rows); err == nil {
+		t.Log("Expected an error for a wrong column count")
+		t.Fail()
+	}
+	t.Log("End TestResultset +++")
+}
+
+func TestBinaryDateTime(t *testing.T) {
+	t.Log("Start TestBinaryDateTime +++")
+	cases := []struct {
+		t      time.Time
+		length int
+	}{
+		{time.Time{}, 0},
+		{time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC), 4},
+		{time.Date(2019, 4, 1, 12, 30, 5, 0, time.UTC), 7},
+		{time.Date(2019, 4, 1, 12, 30, 5, 123456000, time.UTC), 11},
+	}
+	for _, c := range cases {
+		data := make([]byte, WriteBinaryDateTime(nil, c.t, nil))
+		pos := 0
+		n := WriteBinaryDateTime(data, c.t, &pos)
+		if n != len(data) || pos != n || int(data[0]) != c.length {
+			t.Log(c.t, "expected length", c.length, "instead got", data)
+			t.Fail()
+		}
+		pos = 0
+		read, err := ReadBinaryDateTime(data, &pos)
+		if err != nil || !read.Equal(c.t) || pos != len(data) {
+			t.Log(c.t, "read back as", read, err)
+			t.Fail()
+		}
+	}
+
+	// the zero date of the database is written with length 0
+	data := make([]byte, binaryValueLen(EnumFieldTypes["DATETIME"], "0000-00-00 00:00:00"))
+	pos := 0
+	writeBinaryValue(data, EnumFieldTypes["DATETIME"], false, "0000-00-00 00:00:00", &pos)
+	if !bytes.Equal(data, []byte{0x00}) {
+		t.Log("Expected zero length for the zero date, instead got", data)
+		t.Fail()
+	}
+	// fractional seconds from the text format
+	data = make([]byte, binaryValueLen(EnumFieldTypes["DATETIME"], "2019-04-01 12:30:05.5"))
+	pos = 0
+	writeBinaryValue(data, EnumFieldTypes["DATETIME"], false, "2019-04-01 12:30:05.5", &pos)
+	if !bytes.Equal(data, []byte{11, 0xe3, 0x07, 4, 1, 12, 30, 5, 0x20, 0xa1, 0x07, 0x00}) {
+		t.Log("Unexpected DATETIME with fractional seconds", data)
+		t.Fail()
+	}
+
+	// truncated and invalid lengths
+	for _, bad := range [][]byte{{}, {4, 0xe3, 0x07, 4}, {5, 0, 0, 0, 0, 0}} {
+		pos = 0
+		if _, err := ReadBinaryDateTime(bad, &pos); err != ErrMalformedPacket || pos != 0 {
+			t.Log("Expected ErrMalformedPacket for", bad, "instead got", err, pos)
+			t.Fail()
+		}
+	}
+	t.Log("End TestBinaryDateTime +++")
+}
+
+func TestBinaryTime(t *testing.T) {
+	t.Log("Start TestBinaryTime +++")
+	cases := []struct {
+		d      time.Duration
+		length int
+	}{
+		{0, 0},
+		{26*time.Hour + 3*time.Minute + 4*time.Second, 8},
+		{-(time.Hour + 500*time.Microsecond), 12},
+	}
+	for _, c := range cases {
+		data := make([]byte, WriteBinaryTime(nil, c.d, nil))
+		pos := 0
+		WriteBinaryTime(data, c.d, &pos)
+		if int(data[0]) != c.length || pos != len(data) {
+			t.Log(c.d, "expected length", c.length, "instead got", data)
+			t.Fail()
+		}
+		pos = 0
+		read, err := ReadBinaryTime(data, &pos)
+		if err != nil || read != c.d || pos != len(data) {
+			t.Log(c.d, "read back as", read, err)
+			t.Fail()
+		}
+	}
+	if d := parseTime("-838:59:59.000001"); d != -(838*time.Hour + 59*time.Minute + 59*time.Second + time.Microsecond) {
+		t.Log("Unexpected TIME", d)
+		t.Fail()
+	}
+	t.Log("End TestBinaryTime +++")
+}
+
+func TestReadStringFixed(t *testing.T) {
+	t.Log("Start TestReadStringFixed +++")
+	data := []byte("\x01abcdef")
+	for _, stype := range []string_t{FIXEDSTR, EOFSTR} {
+		// the buffer holds exactly l bytes
+		pos := 1
+		str, err := ReadString(data, stype, &pos, len(data)-1)
+		if err != nil || string(str) != "abcdef" || pos != len(data) {
+			t.Log("Expected abcdef, instead got", string(str), err, pos)
+			t.Fail()
+		}
+		// the buffer is short
+		pos = 1
+		str, err = ReadString(data, stype, &pos, len(data))
+		if err != ErrMalformedPacket || str != nil || pos != 1 {
+			t.Log("Expected ErrMalformedPacket for a short buffer, instead got", str, err, pos)
+			t.Fail()
+		}
+	}
+	t.Log("End TestReadStringFixed +++")
+}
+
+func TestReadNullableLenEncString(t *testing.T) {
+	t.Log("Start TestReadNullableLenEncString +++")
+	// a text result set row: 'one', NULL, '', then a truncated value
+	row := []byte{3, 'o', 'n', 'e', 0xfb, 0, 5, 'x'}
+	expected := []struct {
+		value  []byte
+		isNull bool
+		pos    int
+	}{
+		{[]byte("one"), false, 4},
+		{nil, true, 5},
+		{[]byte{}, false, 6},
+	}
+	pos := 0
+	for i, exp := range expected {
+		value, isNull, err := ReadNullableLenEncString(row, &pos)
+		if err != nil || isNull != exp.isNull || !bytes.Equal(value, exp.value) || (value == nil) != exp.isNull || pos != exp.pos {
+			t.Log("Value", i, "expected", exp.value, exp.isNull, exp.pos, "instead got", value, isNull, pos, err)
+			t.Fail()
+		}
+	}
+	_, _, err := ReadNullableLenEncString(row, &pos)
+	if err != ErrMalformedLenEncString || pos != 6 {
+		t.Log("Expected ErrMalformedLenEncString for the truncated value, instead got", err, pos)
+		t.Fail()
+	}
+
+	// ReadString tells NULL from the empty string with ErrLenEncNull
+	pos = 4
+	str, err := ReadString(row, LENENCSTR, &pos, 0)
+	if err != ErrLenEncNull || str != nil || pos != 5 {
+		t.Log("Expected ErrLenEncNull for NULL, instead got", str, err, pos)
+		t.Fail()
+	}
+	str, err = ReadString(row, LENENCSTR, &pos, 0)
+	if err != nil || str == nil || len(str) != 0 || pos != 6 {
+		t.Log("Expected the empty string, instead got", str, err, pos)
+		t.Fail()
+	}
+	t.Log("End TestReadNullableLenEncString +++")
+}
+
+func TestSeqByteIndex(t *testing.T) {
+	t.Log("Start TestSeqByteIndex +++")
+	payload := []byte{byte(common.COM_PING)}
+	ns := NewMySQLPacketFrom(7, payload)
+	if ns.Serialized[0] != encoding.IndicatorMySQL {
+		t.Log("Expected the indicator byte first, instead got", ns.Serialized)
+		t.Fail()
+	}
+	if int(ns.Serialized[SeqByteIndex(true)]) != 7 || !bytes.Equal(ns.Serialized[PayloadStart(true):], payload) {
+		t.Log("Unexpected sequence id or payload with the indicator byte", ns.Serialized)
+		t.Fail()
+	}
+	// the bytes sent to a client don't have the indicator byte
+	wire := ns.Serialized[encoding.IndicatorSize:]
+	if int(wire[SeqByteIndex(false)]) != 7 || !bytes.Equal(wire[PayloadStart(false):], payload) {
+		t.Log("Unexpected sequence id or payload without the indicator byte", wire)
+		t.Fail()
+	}
+	// reading the wire bytes back gets the same indices
+	read, err := NewInitSQLPacket(bytes.NewReader(wire))
+	if err != nil || read.Sqid != 7 || int(read.Serialized[SeqByteIndex(true)]) != 7 || !bytes.Equal(read.Serialized, ns.Serialized) {
+		t.Log("Unexpected packet read back", read, err)
+		t.Fail()
+	}
+	t.Log("End TestSeqByteIndex +++")
+}
+
+func TestErrorFromDriver(t *testing.T) {
+	t.Log("Start TestErrorFromDriver +++")
+	for _, tc := range []struct {
+		err      error
+		code     int
+		sqlState string
+		msg      string
+	}{
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"}, 1062, "23000", "Duplicate entry '1' for key 'PRIMARY'"},
+		{&mysql.MySQLError{Number: 1146, Message: "Table 'test.nope' doesn't exist"}, 1146, "42S02", "Table 'test.nope' doesn't exist"},
+		{&mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded; try restarting transaction"}, 1205, "HY000", "Lock wait timeout exceeded; try restarting transaction"},
+		{errors.New("sql: connection is already closed"), common.ER_UNKNOWN_ERROR, "HY000", "sql: connection is already closed"},
+	} {
+		code, sqlState, msg := ErrorFromDriver(tc.err)
+		if code != tc.code || sqlState != tc.sqlState || msg != tc.msg {
+			t.Log("Expected", tc.code, tc.sqlState, tc.msg, "instead got", code, sqlState, msg)
+			t.Fail()
+		}
+		e, err := ReadERRPacket(DriverERRPacket(tc.err, uint32(CLIENT_PROTOCOL_41)), uint32(CLIENT_PROTOCOL_41))
+		if err != nil || *e != (ERRResponse{Code: tc.code, SQLState: tc.sqlState, Message: tc.msg}) {
+			t.Log("Unexpected ERR packet", e, err)
+			t.Fail()
+		}
+		// without CLIENT_PROTOCOL_41 there is no SQL state
+		e, err = ReadERRPacket(DriverERRPacket(tc.err, 0), 0)
+		if err != nil || *e != (ERRResponse{Code: tc.code, Message: tc.msg}) {
+			t.Log("Unexpected ERR packet without CLIENT_PROTOCOL_41", e, err)
+			t.Fail()
+		}
+	}
+	t.Log("End TestErrorFromDriver +++")
+}
+
+func TestReadChangeUser(t *testing.T) {
+	t.Log("Start TestReadChangeUser +++")
+	capabilities := uint32(CLIENT_PROTOCOL_41 | CLIENT_RESERVED2 | CLIENT_PLUGIN_AUTH | CLIENT_CONNECT_ATTRS)
+	payload := []byte{byte(common.COM_CHANGE_USER), 'b', 'o', 'b', 0x00, 0x03, 0x01, 0x00, 0x02,
+		'd', 'b', 0x00, 0x21, 0x00}
+	payload = append(payload, []byte("mysql_native_password")...)
+	payload = append(payload, 0x00, 0x05, 0x01, 'k', 0x02, 'v', 'v')
+	cu, err := ReadChangeUser(payload, capabilities)
+	if err != nil {
+		t.Fatal("Unexpected error", err.Error())
+	}
+	if cu.User != "bob" || !bytes.Equal(cu.AuthResponse, []byte{0x01, 0x00, 0x02}) || cu.Schema != "db" {
+		t.Log("Unexpected user, auth response or schema", cu.User, cu.AuthResponse, cu.Schema)
+		t.Fail()
+	}
+	if cu.CharacterSet != 0x21 || cu.AuthPlugin != "mysql_native_password" || cu.Attrs["k"] != "vv" {
+		t.Log("Unexpected character set, plugin or attributes", cu.CharacterSet, cu.AuthPlugin, cu.Attrs)
+		t.Fail()
+	}
+
+	// an old client without the optional fields and a NUL terminated auth response
+	cu, err = ReadChangeUser([]byte{byte(common.COM_CHANGE_USER), 'b', 0x00, 'p', 0x00, 0x00}, uint32(CLIENT_PROTOCOL_41))
+	if err != nil {
+		t.Fatal("Unexpected error", err.Error())
+	}
+	if cu.User != "b" || string(cu.AuthResponse) != "p" || cu.Schema != "" || cu.CharacterSet != 0 {
+		t.Log("Unexpected change user", cu)
+		t.Fail()
+	}
+
+	// the auth response goes past the end of the packet
+	if _, err = ReadChangeUser([]byte{byte(common.COM_CHANGE_USER), 'b', 0x00, 0x05, 'p'}, capabilities); err != ErrMalformedPacket {
+		t.Log("Expected malformed packet, instead got", err)
+		t.Fail()
+	}
+	// the user is not terminated
+	if _, err = ReadChangeUser([]byte{byte(common.COM_CHANGE_USER), 'b'}, capabilities); err != ErrMalformedPacket {
+		t.Log("Expected malformed packet, instead got", err)
+		t.Fail()
+	}
+	t.Log("End TestReadChangeUser +++")
+}
+
+// executePackets are COM_STMT_EXECUTE payloads with the parameter values they decode to. The first ones were
+// captured from go-sql-driver/mysql v1.4.1, which binds every parameter as a new one, the last is built per
+// the protocol documentation for the types and flags the driver doesn't send.
+var executePackets = []struct {
+	name      string
+	payload   string
+	numParams int
+	flags     byte
+	types     string
+	args      []interface{}
+}{
+	{"no params", "17010000000001000000", 0, 0, "", nil},
+	{"int64", "17010000000001000000000108000100000000000000", 1, 0, "0800", []interface{}{int64(1)}},
+	{"negative, string and nil", "1701000000000100000004010800fe000600feffffffffffffff0374776f", 3, 0, "0800fe000600",
+		[]interface{}{int64(-2), "two", nil}},
+	{"float64, bool and []byte", "17010000000001000000000105000100fe00000000000000f83f010200ff", 3, 0, "05000100fe00",
+		[]interface{}{1.5, int64(1), "\x00\xff"}},
+	{"time.Time", "170100000000010000000001fe0013323031392d30342d30312031303a32303a3330", 1, 0, "fe00",
+		[]interface{}{"2019-04-01 10:20:30"}},
+	{"two bytes of null bitmap", "170100000000010000000001010800080008000800080008000800080006000000000000000000010000000000000002000000000000000300000000000000040000000000000005000000000000000600000000000000070000000000000000",
+		9, 0, "080008000800080008000800080008000600",
+		[]interface{}{int64(0), int64(1), int64(2), int64(3), int64(4), int64(5), int64(6), int64(7), nil}},
+	{"uint64 above 2^63", "170100000000010000000001fe001339323233333732303336383534373735383133", 1, 0, "fe00",
+		[]interface{}{"9223372036854775813"}},
+	{"unsigned, short, long, float, date and time with a cursor", "1702000000010100000000010280030004000a000b000880" +
+		"fffffeffffff0000c03f04e3070401080101000000020304ffffffffffffffff", 6, byte(CURSOR_TYPE_READ_ONLY), "0280030004000a000b000880",
+		[]interface{}{uint64(65535), int64(-2), 1.5, time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC), "-26:03:04", uint64(math.MaxUint64)}},
+}
+
+func TestDecodeExecutePacket(t *testing.T) {
+	for _, tc := range executePackets {
+		payload, err := hex.DecodeString(tc.payload)
+		if err != nil {
+			t.Fatal(tc.name, "bad hex:", err.Error())
+		}
+		stmtID, flags, iteration, nullBitmap, newParams, paramTypes, values, err := DecodeExecutePacket(payload, tc.numParams)
+		if err != nil {
+			t.Log(tc.name, "unexpected error", err.Error())
+			t.Fail()
+			continue
+		}
+		if stmtID != int(payload[1]) || flags != tc.flags || iteration != 1 || newParams != (tc.numParams > 0) {
+			t.Log(tc.name, "unexpected header", stmtID, flags, iteration, newParams)
+			t.Fail()
+		}
+		if len(nullBitmap) != (tc.numParams+7)/8 || hex.EncodeToString(paramTypes) != tc.types || len(values) != len(tc.args) {
+			t.Log(tc.name, "unexpected null bitmap, types or values", nullBitmap, paramTypes, values)
+			t.Fail()
+			continue
+		}
+		for i, value := range values {
+			arg, err := BinaryParamValue(paramTypes[2*i], paramTypes[2*i+1]&0x80 != 0, value)
+			if err != nil || !reflect.DeepEqual(arg, tc.args[i]) {
+				t.Logf("%s: parameter %d expected %#v, instead got %#v %v", tc.name, i, tc.args[i], arg, err)
+				t.Fail()
+			}
+		}
+	}
+
+	// the values of a statement executed again, without new params, are left to the caller
+	payload, _ := hex.DecodeString("170100000000010000000000" + "0100000000000000")
+	_, _, _, nullBitmap, newParams, paramTypes, values, err := DecodeExecutePacket(payload, 1)
+	if err != nil || newParams || len(nullBitmap) != 1 || paramTypes != nil || values != nil {
+		t.Log("Unexpected decoding without new params", nullBitmap, newParams, paramTypes, values, err)
+		t.Fail()
+	}
+
+	for _, bad := range []struct {
+		name      string
+		payload   string
+		numParams int
+	}{
+		{"short header", "1701000000000100", 0},
+		{"no null bitmap", "17010000000001000000", 1},
+		{"short types", "170100000000010000000001fe", 1},
+		{"value past the end", "170100000000010000000001fe000574776f", 1},
+		{"short integer", "1701000000000100000000010800010000", 1},
+		{"short datetime", "1701000000000100000000010c000be307", 1},
+	} {
+		payload, _ := hex.DecodeString(bad.payload)
+		if _, _, _, _, _, _, _, err = DecodeExecutePacket(payload, bad.numParams); err != ErrMalformedPacket {
+			t.Log(bad.name, "expected malformed packet, instead got", err)
+			t.Fail()
+		}
+	}
+	if _, _, _, _, _, _, _, err = DecodeExecutePacket([]byte{byte(common.COM_QUERY)}, 0); err == nil {
+		t.Log("Expected an error for a COM_QUERY")
+		t.Fail()
+	}
+}
+
+func TestDecodeExecuteBatch(t *testing.T) {
+	// (1, "one"), (NULL, "two") with the types of the first set, (3, 0x00ff) binding a blob
+	payload, _ := hex.DecodeString("170100000000030000" + "00" +
+		"0001" + "0800fe00" + "0100000000000000" + "036f6e65" +
+		"0100" + "0374776f" +
+		"0001" + "0800fc00" + "0300000000000000" + "0200ff")
+	paramTypes, values, err := DecodeExecuteBatch(payload, 2)
+	if err != nil {
+		t.Fatal("Unexpected error", err.Error())
+	}
+	expected := [][]interface{}{{int64(1), "one"}, {nil, "two"}, {int64(3), []byte{0x00, 0xff}}}
+	if len(paramTypes) != len(expected) || len(values) != len(expected) {
+		t.Fatal("Expected 3 parameter sets, instead got", paramTypes, values)
+	}
+	for i, set := range expected {
+		for j, arg := range set {
+			value, err := BinaryParamValue(paramTypes[i][2*j], paramTypes[i][2*j+1]&0x80 != 0, values[i][j])
+			if err != nil || !reflect.DeepEqual(value, arg) {
+				t.Logf("set %d: parameter %d expected %#v, instead got %#v %v", i, j, arg, value, err)
+				t.Fail()
+			}
+		}
+	}
+
+	for _, bad := range []struct {
+		name      string
+		payload   string
+		numParams int
+		err       error
+	}{
+		{"no types in the first set", "17010000000002000000" + "0000" + "0100000000000000" + "0000" + "0200000000000000", 1, ErrNoParamTypes},
+		{"missing set", "17010000000002000000" + "000108000100000000000000", 1, ErrMalformedPacket},
+		{"bytes after the last set", "17010000000001000000" + "000108000100000000000000" + "00", 1, ErrMalformedPacket},
+		{"no params", "17010000000002000000", 0, ErrMalformedPacket},
+		{"huge iteration count", "170100000000ffffffff" + "000108000100000000000000", 1, ErrMalformedPacket},
+	} {
+		payload, _ := hex.DecodeString(bad.payload)
+		if _, _, err = DecodeExecuteBatch(payload, bad.numParams); err != bad.err {
+			t.Log(bad.name, "expected", bad.err, "instead got", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestDecodeExecuteValues(t *testing.T) {
+	types, _ := hex.DecodeString("0800fe00")
+
+	// (2, "two") encoded with the types of a previous execute
+	payload, _ := hex.DecodeString("170100000000010000000000" + "0200000000000000" + "0374776f")
+	values, err := DecodeExecuteValues(payload, 2, types)
+	if err != nil || len(values) != 2 || !bytes.Equal(values[0], []byte{2, 0, 0, 0, 0, 0, 0, 0}) || string(values[1]) != "two" {
+		t.Log("Expected the values of 2 and two, instead got", values, err)
+		t.Fail()
+	}
+
+	// no values, the previous ones are bound again
+	payload, _ = hex.DecodeString("170100000000010000000000")
+	if values, err = DecodeExecuteValues(payload, 2, types); err != nil || values != nil {
+		t.Log("Expected no values, instead got", values, err)
+		t.Fail()
+	}
+
+	// no values since both are NULL
+	payload, _ = hex.DecodeString("170100000000010000000300")
+	if values, err = DecodeExecuteValues(payload, 2, types); err != nil || len(values) != 2 || values[0] != nil || values[1] != nil {
+		t.Log("Expected two NULL values, instead got", values, err)
+		t.Fail()
+	}
+
+	// a value cut short, or types for another number of parameters
+	payload, _ = hex.DecodeString("170100000000010000000000" + "02000000")
+	if _, err = DecodeExecuteValues(payload, 2, types); err != ErrMalformedPacket {
+		t.Log("Expected ErrMalformedPacket for a truncated value, instead got", err)
+		t.Fail()
+	}
+	payload, _ = hex.DecodeString("1701000000000100000000000200000000000000")
+	if _, err = DecodeExecuteValues(payload, 1, types); err != ErrMalformedPacket {
+		t.Log("Expected ErrMalformedPacket for the types of 2 parameters, instead got", err)
+		t.Fail()
+	}
+}
+
+// fuzzReads is the most packets read from one fuzz input
+const fuzzReads = 16
+
+// FuzzNewMySQLPacket feeds arbitrary bytes to the packet readers, as they arrive at once and one byte at a
+// time, for the internal and the client framing. They must return an error for a malformed input, never panic.
+func FuzzNewMySQLPacket(f *testing.F) {
+	f.Add(NewMySQLPacketFrom(0, []byte{0x03, 's', 'q', 'l'}).Serialized)
+	f.Add(NewMySQLPacketFrom(0, []byte{0x03, 's', 'q', 'l'}).Serialized[encoding.IndicatorSize:])
+	f.Add([]byte{0x00, 0xff, 0xff, 0xff, 0x00, 0x03})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x04})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, oneByte := range []bool{false, true} {
+			for _, client := range []bool{false, true} {
+				var r io.Reader = bytes.NewReader(data)
+				if oneByte {
+					r = iotest.OneByteReader(r)
+				}
+				p := NewPackager(r, nil)
+				if client {
+					p = NewClientPackager(r, nil)
+				}
+				for i := 0; i < fuzzReads; i++ {
+					ns, err := p.ReadNext()
+					if err != nil {
+						break
+					}
+					if ns.Length != len(ns.Payload) {
+						t.Fatal("Payload length", len(ns.Payload), "instead of", ns.Length)
+					}
+					if p.IsComposite() {
+						p.ReadMultiplePackets(ns)
+					}
+				}
+			}
+		}
+	})
+}
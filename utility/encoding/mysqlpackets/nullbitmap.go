@@ -0,0 +1,83 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+// Offsets of the NULL bitmaps, the number of bits before the bit of the first value
+const (
+	// ResultsetRowNullOffset is the offset of the NULL bitmap of a binary resultset row
+	ResultsetRowNullOffset = 2
+	// ExecuteNullOffset is the offset of the NULL bitmap of the parameters of COM_STMT_EXECUTE
+	ExecuteNullOffset = 0
+)
+
+// NullBitmap marks the NULL values of a row or of a parameter set of the binary protocol, with one bit
+// per value after the offset bits. Value i is bit (i+offset)%8 of byte (i+offset)/8.
+// https://dev.mysql.com/doc/internals/en/null-bitmap.html
+type NullBitmap struct {
+	bits   []byte
+	count  int
+	offset int
+}
+
+// NullBitmapLen returns the number of bytes of the NULL bitmap of count values
+func NullBitmapLen(count, offset int) int {
+	return (count + offset + 7) / 8
+}
+
+// NewNullBitmap creates the NULL bitmap of count values, none of them NULL
+func NewNullBitmap(count, offset int) *NullBitmap {
+	return &NullBitmap{bits: make([]byte, NullBitmapLen(count, offset)), count: count, offset: offset}
+}
+
+// ReadNullBitmap returns the NULL bitmap of count values at pos of data, and moves pos past it. The bitmap
+// shares the bytes of data.
+func ReadNullBitmap(data []byte, count, offset int, pos *int) (*NullBitmap, error) {
+	n := NullBitmapLen(count, offset)
+	if *pos < 0 || n > len(data)-*pos {
+		return nil, ErrMalformedPacket
+	}
+	bitmap := &NullBitmap{bits: data[*pos : *pos+n], count: count, offset: offset}
+	*pos += n
+	return bitmap, nil
+}
+
+// Set marks value i as NULL. It panics if i isn't one of the values of the bitmap.
+func (bitmap *NullBitmap) Set(i int) {
+	byteIdx, mask := bitmap.bit(i)
+	bitmap.bits[byteIdx] |= mask
+}
+
+// Get returns true if value i is NULL. It panics if i isn't one of the values of the bitmap.
+func (bitmap *NullBitmap) Get(i int) bool {
+	byteIdx, mask := bitmap.bit(i)
+	return bitmap.bits[byteIdx]&mask != 0
+}
+
+// Bytes returns the bitmap as written in a packet
+func (bitmap *NullBitmap) Bytes() []byte {
+	return bitmap.bits
+}
+
+// bit returns the byte and the mask of the bit of value i
+func (bitmap *NullBitmap) bit(i int) (int, byte) {
+	if i < 0 || i >= bitmap.count {
+		panic("mysqlpackets: NULL bitmap index out of range")
+	}
+	i += bitmap.offset
+	return i / 8, 1 << uint(i%8)
+}
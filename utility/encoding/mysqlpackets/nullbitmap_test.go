@@ -0,0 +1,114 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNullBitmap(t *testing.T) {
+	for _, offset := range []int{ExecuteNullOffset, ResultsetRowNullOffset} {
+		for count := 0; count <= 25; count++ {
+			if n := NullBitmapLen(count, offset); n*8 < count+offset || (n > 0 && (n-1)*8 >= count+offset) {
+				t.Errorf("offset %d, count %d: %d bytes is not the smallest bitmap", offset, count, n)
+			}
+
+			// each value alone
+			for i := 0; i < count; i++ {
+				bitmap := NewNullBitmap(count, offset)
+				bitmap.Set(i)
+				expected := make([]byte, NullBitmapLen(count, offset))
+				expected[(i+offset)/8] = 1 << uint((i+offset)%8)
+				if !bytes.Equal(bitmap.Bytes(), expected) {
+					t.Errorf("offset %d, count %d: NULL value %d expected %08b, instead got %08b", offset, count, i, expected, bitmap.Bytes())
+				}
+				for j := 0; j < count; j++ {
+					if bitmap.Get(j) != (i == j) {
+						t.Errorf("offset %d, count %d: NULL value %d, unexpected Get(%d) %v", offset, count, i, j, bitmap.Get(j))
+					}
+				}
+			}
+
+			// all the values, the offset bits and the bits past the last value stay clear
+			bitmap := NewNullBitmap(count, offset)
+			for i := 0; i < count; i++ {
+				bitmap.Set(i)
+			}
+			for bit := 0; bit < 8*len(bitmap.Bytes()); bit++ {
+				set := bitmap.Bytes()[bit/8]&(1<<uint(bit%8)) != 0
+				if set != (bit >= offset && bit < offset+count) {
+					t.Errorf("offset %d, count %d: all NULL, unexpected bit %d %v", offset, count, bit, set)
+				}
+			}
+		}
+	}
+
+	// the bitmap of a resultset row with 7 columns takes a second byte for the last one
+	bitmap := NewNullBitmap(7, ResultsetRowNullOffset)
+	bitmap.Set(0)
+	bitmap.Set(5)
+	bitmap.Set(6)
+	if !bytes.Equal(bitmap.Bytes(), []byte{0x84, 0x01}) {
+		t.Errorf("Expected the bitmap 0x84 0x01, instead got %#v", bitmap.Bytes())
+	}
+}
+
+func TestReadNullBitmap(t *testing.T) {
+	data := []byte{0xff, 0x05, 0x01, 0xff}
+	pos := 1
+	bitmap, err := ReadNullBitmap(data, 9, ExecuteNullOffset, &pos)
+	if err != nil || pos != 3 {
+		t.Fatal("Expected a bitmap of 2 bytes, instead got", pos, err)
+	}
+	for i, expected := range []bool{true, false, true, false, false, false, false, false, true} {
+		if bitmap.Get(i) != expected {
+			t.Errorf("Expected value %d NULL %v", i, expected)
+		}
+	}
+
+	// setting a value changes the packet
+	bitmap.Set(1)
+	if data[1] != 0x07 {
+		t.Errorf("Expected the bitmap to share the packet bytes, instead got %#x", data[1])
+	}
+
+	// not enough bytes left
+	pos = 3
+	if _, err = ReadNullBitmap(data, 9, ExecuteNullOffset, &pos); err != ErrMalformedPacket || pos != 3 {
+		t.Error("Expected ErrMalformedPacket, instead got", pos, err)
+	}
+	pos = 0
+	if _, err = ReadNullBitmap(data, 31, ResultsetRowNullOffset, &pos); err != ErrMalformedPacket {
+		t.Error("Expected ErrMalformedPacket for 5 bytes of bitmap, instead got", err)
+	}
+}
+
+func TestNullBitmapOutOfRange(t *testing.T) {
+	bitmap := NewNullBitmap(6, ResultsetRowNullOffset)
+	for _, i := range []int{-1, 6, 7} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Get(%d) to panic for 6 values", i)
+				}
+			}()
+			bitmap.Get(i)
+		}()
+	}
+}
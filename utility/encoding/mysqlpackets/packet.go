@@ -0,0 +1,93 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"io"
+
+	"github.com/paypal/hera/utility/encoding"
+)
+
+// MySQLPacket is a MySQL packet of the internal Hera communication together with the reader of the packets
+// following it. It embeds the encoding.Packet, which is the last packet read, and implements
+// encoding.Packaging like the netstring Reader, delegating to a Packager created with NewPackager.
+type MySQLPacket struct {
+	encoding.Packet
+	packager *Packager // nil for a packet created with NewPacketFrom
+}
+
+// MySQLPacket reads the packets of the message following it
+var _ encoding.Packaging = (*MySQLPacket)(nil)
+
+// NewPacket reads a packet from reader, starting with the indicator byte like NewMySQLPacket. The next
+// packets are read from reader by ReadNext and ReadMultiplePackets.
+func NewPacket(reader io.Reader) (*MySQLPacket, error) {
+	p := NewPacketReader(reader)
+	if _, err := p.ReadNext(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewPacketFrom creates the packet with the sequence id and the payload, like NewMySQLPacketFrom. There
+// is no packet to read after it, ReadNext returns io.EOF.
+func NewPacketFrom(sqid int, payload []byte) *MySQLPacket {
+	return &MySQLPacket{Packet: *NewMySQLPacketFrom(sqid, payload)}
+}
+
+// NewPacketReader creates an empty packet, the packets are read from reader by ReadNext
+func NewPacketReader(reader io.Reader) *MySQLPacket {
+	return &MySQLPacket{packager: NewPackager(reader, nil)}
+}
+
+// ReadNext reads the next packet, which becomes the packet of p, and returns it
+func (p *MySQLPacket) ReadNext() (*encoding.Packet, error) {
+	if p.packager == nil {
+		return nil, io.EOF
+	}
+	pkt, err := p.packager.ReadNext()
+	if err != nil {
+		return nil, err
+	}
+	p.Packet = *pkt
+	return pkt, nil
+}
+
+// IsComposite tells if the packet is a fragment of a message larger than MAX_PACKET_SIZE, i.e. it is
+// followed by more packets, see Packager.IsComposite. It hides the IsComposite of encoding.Packet, which
+// is about netstrings.
+func (p *MySQLPacket) IsComposite() bool {
+	if p.packager == nil {
+		return false
+	}
+	return p.packager.IsComposite()
+}
+
+// ReadMultiplePackets reads the rest of the message starting with first, see Packager.ReadMultiplePackets.
+// The last packet read becomes the packet of p.
+func (p *MySQLPacket) ReadMultiplePackets(first *encoding.Packet) ([]*encoding.Packet, error) {
+	if p.packager == nil {
+		if first.Length == MAX_PACKET_SIZE {
+			return []*encoding.Packet{first}, io.ErrUnexpectedEOF
+		}
+		return []*encoding.Packet{first}, nil
+	}
+	packets, err := p.packager.ReadMultiplePackets(first)
+	p.Packet = *packets[len(packets)-1]
+	return packets, err
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding"
+)
+
+func TestMySQLPacket(t *testing.T) {
+	// a message split in two packets, followed by a COM_PING
+	payload := bytes.Repeat([]byte{byte(common.COM_QUERY)}, MAX_PACKET_SIZE+10)
+	pkts, err := NewPackager(nil, nil).WritePacket(payload)
+	if err != nil {
+		t.Fatal("WritePacket:", err.Error())
+	}
+	var stream bytes.Buffer
+	for _, pkt := range pkts {
+		stream.Write(pkt.Serialized)
+	}
+	stream.Write(NewPacketFrom(0, []byte{byte(common.COM_PING)}).Serialized)
+
+	p, err := NewPacket(&stream)
+	if err != nil {
+		t.Fatal("NewPacket:", err.Error())
+	}
+	if p.Cmd != common.COM_QUERY || p.Length != MAX_PACKET_SIZE || !p.IsComposite() {
+		t.Fatal("Unexpected first packet", p.Cmd, p.Length, p.IsComposite())
+	}
+	var reader encoding.Packaging = p
+	read, err := reader.ReadMultiplePackets(&p.Packet)
+	if err != nil || len(read) != 2 || read[1].Length != 10 {
+		t.Fatal("Expected the two packets of the message, instead got", len(read), err)
+	}
+	if p.Sqid != 1 || p.IsComposite() {
+		t.Log("Expected the last packet read, instead got", p.Sqid, p.Length)
+		t.Fail()
+	}
+	next, err := reader.ReadNext()
+	if err != nil || next.Cmd != common.COM_PING || p.Cmd != common.COM_PING {
+		t.Log("Unexpected next packet", next, err)
+		t.Fail()
+	}
+	if _, err = reader.ReadNext(); err != io.EOF {
+		t.Log("Expected io.EOF at the end of the stream, instead got", err)
+		t.Fail()
+	}
+
+	// a packet created from its payload has nothing to read after it
+	p = NewPacketFrom(3, []byte{byte(common.COM_PING)})
+	if p.Sqid != 3 || p.Cmd != common.COM_PING || p.IsComposite() {
+		t.Log("Unexpected packet", p.Packet)
+		t.Fail()
+	}
+	if _, err = p.ReadNext(); err != io.EOF {
+		t.Log("Expected io.EOF, instead got", err)
+		t.Fail()
+	}
+	if read, err = p.ReadMultiplePackets(&p.Packet); err != nil || len(read) != 1 {
+		t.Log("Expected the packet alone, instead got", read, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrMalformedPacket is returned decoding a response packet which is shorter than its content requires
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// OKResponse is the decoded OK packet of a command
+type OKResponse struct {
+	AffectedRows int
+	LastInsertId int
+	StatusFlags  int
+	Warnings     int
+	Info         string
+	// Schema is the default schema reported in the session state changes, if it changed
+	Schema string
+}
+
+// ERRResponse is the decoded ERR packet of a command
+type ERRResponse struct {
+	Code     int
+	SQLState string // empty if the server didn't send it
+	Message  string
+}
+
+// EOFResponse is the decoded EOF packet ending the column definitions or the rows of a result set
+type EOFResponse struct {
+	Warnings    int
+	StatusFlags int
+}
+
+// StmtPrepareOKResponse is the decoded first packet of the response to a COM_STMT_PREPARE
+type StmtPrepareOKResponse struct {
+	StmtID     int
+	NumColumns int
+	NumParams  int
+	Warnings   int
+}
+
+// ColumnDefinitionResponse is a decoded ColumnDefinition41 packet
+type ColumnDefinitionResponse struct {
+	Catalog  string
+	Schema   string
+	Table    string
+	OrgTable string
+	Name     string
+	OrgName  string
+	Charset  int
+	Length   int
+	Type     int
+	Flags    int
+	Decimals int
+}
+
+// ResultsetResponse is a decoded text protocol result set, with the status of the packet ending it
+type ResultsetResponse struct {
+	Columns     []ColumnDefinitionResponse
+	Rows        [][]sql.NullString
+	StatusFlags int
+	Warnings    int
+}
+
+// Response is the response of the server to a COM_QUERY. Exactly one of the fields is set.
+type Response struct {
+	OK        *OKResponse
+	ERR       *ERRResponse
+	Resultset *ResultsetResponse
+}
+
+// ReadCommandResponse reads the response to a COM_QUERY with the packager, i.e. for a Hera forwarding
+// the queries to another Hera. The response is an OK packet, an ERR packet, or a text protocol result
+// set, whose rows are ended by an EOF packet, or an OK packet if CLIENT_DEPRECATE_EOF is in capabilities.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html
+func ReadCommandResponse(p *Packager, capabilities uint32) (Response, error) {
+	pkt, err := p.ReadNext()
+	if err != nil {
+		return Response{}, err
+	}
+	if len(pkt.Payload) == 0 {
+		return Response{}, ErrMalformedPacket
+	}
+	switch pkt.Payload[0] {
+	case 0x00:
+		ok, err := ReadOKPacket(pkt.Payload, capabilities)
+		return Response{OK: ok}, err
+	case 0xff:
+		e, err := ReadERRPacket(pkt.Payload, capabilities)
+		return Response{ERR: e}, err
+	case 0xfb:
+		return Response{}, errors.New("LOCAL INFILE request is not supported")
+	}
+
+	pos := 0
+	columnCount, err := ReadLenEncInt(pkt.Payload, &pos)
+	if err != nil {
+		return Response{}, err
+	}
+	rs := &ResultsetResponse{Columns: make([]ColumnDefinitionResponse, 0, columnCount)}
+	for i := 0; i < columnCount; i++ {
+		pkt, err = p.ReadNext()
+		if err != nil {
+			return Response{}, err
+		}
+		col, err := ReadColumnDefinition(pkt.Payload, capabilities)
+		if err != nil {
+			return Response{}, err
+		}
+		rs.Columns = append(rs.Columns, col)
+	}
+	if !Supports(capabilities, CLIENT_DEPRECATE_EOF) {
+		pkt, err = p.ReadNext()
+		if err != nil {
+			return Response{}, err
+		}
+		if !isEOFPacket(pkt.Payload) {
+			return Response{}, fmt.Errorf("expected EOF after the column definitions, instead got %v", pkt.Payload)
+		}
+	}
+
+	for {
+		pkt, err = p.ReadNext()
+		if err != nil {
+			return Response{}, err
+		}
+		payload := pkt.Payload
+		switch {
+		case len(payload) > 0 && payload[0] == 0xff:
+			e, err := ReadERRPacket(payload, capabilities)
+			return Response{ERR: e}, err
+		case Supports(capabilities, CLIENT_DEPRECATE_EOF) && len(payload) > 0 && payload[0] == 0xfe && len(payload) < MAX_PACKET_SIZE:
+			ok, err := ReadOKPacket(payload, capabilities)
+			if err != nil {
+				return Response{}, err
+			}
+			rs.StatusFlags = ok.StatusFlags
+			rs.Warnings = ok.Warnings
+			return Response{Resultset: rs}, nil
+		case !Supports(capabilities, CLIENT_DEPRECATE_EOF) && isEOFPacket(payload):
+			if Supports(capabilities, CLIENT_PROTOCOL_41) {
+				if len(payload) < 5 {
+					return Response{}, ErrMalformedPacket
+				}
+				pos := 1
+				rs.Warnings = ReadFixedLenInt(payload, INT2, &pos)
+				rs.StatusFlags = ReadFixedLenInt(payload, INT2, &pos)
+			}
+			return Response{Resultset: rs}, nil
+		}
+		row, err := readTextResultsetRow(payload, columnCount)
+		if err != nil {
+			return Response{}, err
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+}
+
+// ReadOKPacket decodes an OK packet, having the 0x00 header or the 0xfe header ending a result set
+// https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
+func ReadOKPacket(payload []byte, capabilities uint32) (*OKResponse, error) {
+	if len(payload) == 0 || (payload[0] != 0x00 && payload[0] != 0xfe) {
+		return nil, ErrMalformedPacket
+	}
+	ok := &OKResponse{}
+	pos := 1
+	var err error
+	if ok.AffectedRows, err = ReadLenEncInt(payload, &pos); err != nil {
+		return nil, err
+	}
+	if ok.LastInsertId, err = ReadLenEncInt(payload, &pos); err != nil {
+		return nil, err
+	}
+	if Supports(capabilities, CLIENT_PROTOCOL_41) {
+		if len(payload)-pos < INT2+INT2 {
+			return nil, ErrMalformedPacket
+		}
+		ok.StatusFlags = ReadFixedLenInt(payload, INT2, &pos)
+		ok.Warnings = ReadFixedLenInt(payload, INT2, &pos)
+	} else if Supports(capabilities, CLIENT_TRANSACTIONS) {
+		if len(payload)-pos < INT2 {
+			return nil, ErrMalformedPacket
+		}
+		ok.StatusFlags = ReadFixedLenInt(payload, INT2, &pos)
+	}
+	if !Supports(capabilities, CLIENT_SESSION_TRACK) || pos == len(payload) {
+		ok.Info = string(payload[pos:])
+		return ok, nil
+	}
+	info, err := ReadLenEncString(payload, &pos)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+	ok.Info = string(info)
+	if ok.StatusFlags&SERVER_SESSION_STATE_CHANGED != 0 {
+		changes, err := ReadLenEncString(payload, &pos)
+		if err != nil {
+			return nil, ErrMalformedPacket
+		}
+		if err = readSessionState(ok, changes); err != nil {
+			return nil, err
+		}
+	}
+	return ok, nil
+}
+
+// readSessionState decodes the session state changes of an OK packet, a list of type int<1> and
+// data string<lenenc>. Only the schema is kept, the other changes are skipped.
+func readSessionState(ok *OKResponse, changes []byte) error {
+	for pos := 0; pos < len(changes); {
+		typ := ReadFixedLenInt(changes, INT1, &pos)
+		data, err := ReadLenEncString(changes, &pos)
+		if err != nil {
+			return ErrMalformedPacket
+		}
+		if typ == SESSION_TRACK_SCHEMA {
+			dpos := 0
+			schema, err := ReadLenEncString(data, &dpos)
+			if err != nil {
+				return ErrMalformedPacket
+			}
+			ok.Schema = string(schema)
+		}
+	}
+	return nil
+}
+
+// ReadERRPacket decodes an ERR packet. The SQL state is optional, since ERRPacket doesn't write it
+// https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+func ReadERRPacket(payload []byte, capabilities uint32) (*ERRResponse, error) {
+	if len(payload) < INT1+INT2 || payload[0] != 0xff {
+		return nil, ErrMalformedPacket
+	}
+	e := &ERRResponse{}
+	pos := 1
+	e.Code = ReadFixedLenInt(payload, INT2, &pos)
+	if Supports(capabilities, CLIENT_PROTOCOL_41) && len(payload)-pos >= 6 && payload[pos] == '#' {
+		e.SQLState = string(payload[pos+1 : pos+6])
+		pos += 6
+	}
+	e.Message = string(payload[pos:])
+	return e, nil
+}
+
+// ReadEOFPacket decodes an EOF packet, which has the warnings and the status flags only for a
+// CLIENT_PROTOCOL_41 client
+// https://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
+func ReadEOFPacket(payload []byte, capabilities uint32) (*EOFResponse, error) {
+	if !isEOFPacket(payload) {
+		return nil, ErrMalformedPacket
+	}
+	eof := &EOFResponse{}
+	if !Supports(capabilities, CLIENT_PROTOCOL_41) {
+		if len(payload) != 1 {
+			return nil, ErrMalformedPacket
+		}
+		return eof, nil
+	}
+	if len(payload) != INT1+INT2+INT2 {
+		return nil, ErrMalformedPacket
+	}
+	pos := 1
+	eof.Warnings = ReadFixedLenInt(payload, INT2, &pos)
+	eof.StatusFlags = ReadFixedLenInt(payload, INT2, &pos)
+	return eof, nil
+}
+
+// ReadStmtPrepareOK decodes a COM_STMT_PREPARE_OK packet, as written by StmtPrepareOK
+// https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html#packet-COM_STMT_PREPARE_OK
+func ReadStmtPrepareOK(payload []byte) (*StmtPrepareOKResponse, error) {
+	if len(payload) != INT1+INT4+INT2+INT2+INT1+INT2 || payload[0] != 0x00 || payload[INT1+INT4+INT2+INT2] != 0x00 {
+		return nil, ErrMalformedPacket
+	}
+	ok := &StmtPrepareOKResponse{}
+	pos := 1
+	ok.StmtID = ReadFixedLenInt(payload, INT4, &pos)
+	ok.NumColumns = ReadFixedLenInt(payload, INT2, &pos)
+	ok.NumParams = ReadFixedLenInt(payload, INT2, &pos)
+	pos++ // filler
+	ok.Warnings = ReadFixedLenInt(payload, INT2, &pos)
+	return ok, nil
+}
+
+// ReadColumnDefinition decodes a ColumnDefinition41 packet, or a ColumnDefinition320 packet for a client
+// without CLIENT_PROTOCOL_41, as written by Packager.ColumnDefinition
+func ReadColumnDefinition(payload []byte, capabilities uint32) (ColumnDefinitionResponse, error) {
+	if !Supports(capabilities, CLIENT_PROTOCOL_41) {
+		return readColumnDefinition320(payload)
+	}
+	var col ColumnDefinitionResponse
+	pos := 0
+	for _, field := range []*string{&col.Catalog, &col.Schema, &col.Table, &col.OrgTable, &col.Name, &col.OrgName} {
+		str, err := ReadLenEncString(payload, &pos)
+		if err != nil {
+			return col, err
+		}
+		*field = string(str)
+	}
+	fixedLen, err := ReadLenEncInt(payload, &pos)
+	if err != nil {
+		return col, err
+	}
+	if fixedLen < INT2+INT4+INT1+INT2+INT1 || len(payload)-pos < fixedLen {
+		return col, ErrMalformedPacket
+	}
+	col.Charset = ReadFixedLenInt(payload, INT2, &pos)
+	col.Length = ReadFixedLenInt(payload, INT4, &pos)
+	col.Type = ReadFixedLenInt(payload, INT1, &pos)
+	col.Flags = ReadFixedLenInt(payload, INT2, &pos)
+	col.Decimals = ReadFixedLenInt(payload, INT1, &pos)
+	return col, nil
+}
+
+// readColumnDefinition320 decodes a ColumnDefinition320 packet: the table and the name, then the column length,
+// the type and the flags with the decimals, each prefixed by its length. The flags are one byte without
+// CLIENT_LONG_FLAG, which the length tells.
+func readColumnDefinition320(payload []byte) (ColumnDefinitionResponse, error) {
+	var col ColumnDefinitionResponse
+	pos := 0
+	for _, field := range []*string{&col.Table, &col.Name} {
+		str, err := ReadLenEncString(payload, &pos)
+		if err != nil {
+			return col, err
+		}
+		*field = string(str)
+	}
+	// length of the column length, column length
+	if n, err := ReadLenEncInt(payload, &pos); err != nil || n != INT3 || len(payload)-pos < INT3 {
+		return col, ErrMalformedPacket
+	}
+	col.Length = ReadFixedLenInt(payload, INT3, &pos)
+	// length of the type, type
+	if n, err := ReadLenEncInt(payload, &pos); err != nil || n != INT1 || len(payload)-pos < INT1 {
+		return col, ErrMalformedPacket
+	}
+	col.Type = ReadFixedLenInt(payload, INT1, &pos)
+	// length of the flags and decimals, flags, decimals
+	n, err := ReadLenEncInt(payload, &pos)
+	if err != nil || (n != INT1+INT1 && n != INT2+INT1) || len(payload)-pos < n {
+		return col, ErrMalformedPacket
+	}
+	col.Flags = ReadFixedLenInt(payload, n-INT1, &pos)
+	col.Decimals = ReadFixedLenInt(payload, INT1, &pos)
+	if pos != len(payload) {
+		return col, ErrMalformedPacket
+	}
+	return col, nil
+}
+
+// readTextResultsetRow decodes a row written by TextResultsetRow
+func readTextResultsetRow(payload []byte, columnCount int) ([]sql.NullString, error) {
+	row := make([]sql.NullString, columnCount)
+	pos := 0
+	for i := range row {
+		str, isNull, err := ReadNullableLenEncString(payload, &pos)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = sql.NullString{String: string(str), Valid: !isNull}
+	}
+	if pos != len(payload) {
+		return nil, ErrMalformedPacket
+	}
+	return row, nil
+}
+
+// isEOFPacket tells if the payload is an EOF packet. A row can start with 0xfe too, but then it is
+// at least 9 bytes long
+func isEOFPacket(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == 0xfe && len(payload) < 9
+}
@@ -0,0 +1,312 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+)
+
+// responseStream serializes the payloads as the packets of one response
+func responseStream(payloads ...[]byte) *bytes.Buffer {
+	var stream bytes.Buffer
+	for i, payload := range payloads {
+		stream.Write(NewMySQLPacketFrom(i+1, payload).Serialized)
+	}
+	return &stream
+}
+
+// testColumnDefinition builds a ColumnDefinition41 payload for a VARCHAR column
+func testColumnDefinition(name string) []byte {
+	payload := make([]byte, 256)
+	pos := 0
+	for _, field := range []string{"def", "db", "test", "test", name, name} {
+		WriteString(payload, field, LENENCSTR, &pos, len(field))
+	}
+	WriteLenEncInt(payload, 0x0c, &pos)
+	WriteFixedLenInt(payload, INT2, CHARSET_UTF8_GENERAL_CI, &pos)
+	WriteFixedLenInt(payload, INT4, 30, &pos)
+	WriteFixedLenInt(payload, INT1, EnumFieldTypes["VARCHAR"], &pos)
+	WriteFixedLenInt(payload, INT2, NOT_NULL_FLAG, &pos)
+	WriteFixedLenInt(payload, INT1, 0, &pos)
+	WriteFixedLenInt(payload, INT2, 0, &pos)
+	return payload[:pos]
+}
+
+func TestReadCommandResponse(t *testing.T) {
+	t.Log("Start TestReadCommandResponse +++")
+	capabilities := uint32(CLIENT_PROTOCOL_41)
+
+	ok := OKPacket(3, 7, SERVER_STATUS_IN_TRANS, 2, capabilities, "info")
+	resp, err := ReadCommandResponse(NewPackager(responseStream(ok), nil), capabilities)
+	if err != nil || resp.OK == nil {
+		t.Fatal("Expected OK, instead got", resp, err)
+	}
+	if *resp.OK != (OKResponse{AffectedRows: 3, LastInsertId: 7, StatusFlags: SERVER_STATUS_IN_TRANS, Warnings: 2, Info: "info"}) {
+		t.Log("Unexpected OK", *resp.OK)
+		t.Fail()
+	}
+
+	errPayload := append(ERRPacket(1065, ""), []byte("#42000Query was empty")...)
+	resp, err = ReadCommandResponse(NewPackager(responseStream(errPayload), nil), capabilities)
+	if err != nil || resp.ERR == nil {
+		t.Fatal("Expected ERR, instead got", resp, err)
+	}
+	if *resp.ERR != (ERRResponse{Code: 1065, SQLState: "42000", Message: "Query was empty"}) {
+		t.Log("Unexpected ERR", *resp.ERR)
+		t.Fail()
+	}
+
+	colTypes := []string{"VARCHAR", "VARCHAR"}
+	rows := [][]sql.NullString{{{String: "1", Valid: true}, {String: "one", Valid: true}}, {{String: "2", Valid: true}, {}}}
+	for _, deprecateEOF := range []bool{false, true} {
+		caps := capabilities
+		payloads := [][]byte{{2}, testColumnDefinition("id"), testColumnDefinition("name")}
+		if deprecateEOF {
+			caps |= uint32(CLIENT_DEPRECATE_EOF)
+		} else {
+			payloads = append(payloads, EOFPacket(0, SERVER_STATUS_AUTOCOMMIT, caps))
+		}
+		for _, row := range rows {
+			payloads = append(payloads, TextResultsetRow(colTypes, row, nil))
+		}
+		payloads = append(payloads, TerminatorPacket(SERVER_STATUS_AUTOCOMMIT, 1, caps))
+
+		resp, err = ReadCommandResponse(NewPackager(responseStream(payloads...), nil), caps)
+		if err != nil || resp.Resultset == nil {
+			t.Fatal("deprecate EOF", deprecateEOF, "expected result set, instead got", resp, err)
+		}
+		rs := resp.Resultset
+		if len(rs.Columns) != 2 || rs.Columns[1].Name != "name" || rs.Columns[1].Type != EnumFieldTypes["VARCHAR"] ||
+			rs.Columns[1].Flags != NOT_NULL_FLAG || rs.Columns[1].Length != 30 {
+			t.Log("deprecate EOF", deprecateEOF, "unexpected columns", rs.Columns)
+			t.Fail()
+		}
+		if len(rs.Rows) != len(rows) || rs.Rows[0][1] != rows[0][1] || rs.Rows[1][1].Valid {
+			t.Log("deprecate EOF", deprecateEOF, "unexpected rows", rs.Rows)
+			t.Fail()
+		}
+		if rs.StatusFlags != SERVER_STATUS_AUTOCOMMIT || rs.Warnings != 1 {
+			t.Log("deprecate EOF", deprecateEOF, "unexpected status", rs.StatusFlags, rs.Warnings)
+			t.Fail()
+		}
+	}
+
+	// truncated OK packet
+	_, err = ReadCommandResponse(NewPackager(responseStream([]byte{0x00, 0x01}), nil), capabilities)
+	if err != ErrMalformedLenEncInt {
+		t.Log("Expected ErrMalformedLenEncInt, instead got", err)
+		t.Fail()
+	}
+	t.Log("End TestReadCommandResponse +++")
+}
+
+func TestSchemaOKPacket(t *testing.T) {
+	t.Log("Start TestSchemaOKPacket +++")
+	capabilities := uint32(CLIENT_PROTOCOL_41 | CLIENT_SESSION_TRACK)
+	ok, err := ReadOKPacket(SchemaOKPacket(SERVER_STATUS_AUTOCOMMIT, 0, capabilities, "sales"), capabilities)
+	if err != nil {
+		t.Fatal("Failed to read the OK packet:", err)
+	}
+	if ok.Schema != "sales" || ok.StatusFlags != SERVER_STATUS_AUTOCOMMIT|SERVER_SESSION_STATE_CHANGED {
+		t.Log("Unexpected OK", *ok)
+		t.Fail()
+	}
+
+	// without session tracking it is the plain OK packet
+	capabilities = uint32(CLIENT_PROTOCOL_41)
+	payload := SchemaOKPacket(SERVER_STATUS_AUTOCOMMIT, 0, capabilities, "sales")
+	if !bytes.Equal(payload, OKPacket(0, 0, SERVER_STATUS_AUTOCOMMIT, 0, capabilities, "")) {
+		t.Log("Expected the plain OK packet, instead got", payload)
+		t.Fail()
+	}
+	t.Log("End TestSchemaOKPacket +++")
+}
+
+// checkPacketLayouts builds the common packets for a client which negotiated capabilities, checks their
+// bytes against the layout of the protocol documentation, then decodes them like the client does. colType
+// is the column of the ColumnDefinition41 packet, which is only sent to CLIENT_PROTOCOL_41 clients.
+func checkPacketLayouts(t *testing.T, capabilities uint32, colType *sql.ColumnType) {
+	t.Helper()
+	protocol41 := Supports(capabilities, CLIENT_PROTOCOL_41)
+	transactions := Supports(capabilities, CLIENT_TRANSACTIONS)
+	sessionTrack := Supports(capabilities, CLIENT_SESSION_TRACK)
+
+	// OK: header, affected rows, last insert id, status flags and warnings for 4.1 or the status flags
+	// with CLIENT_TRANSACTIONS, info
+	ok := OKPacket(3, 300, SERVER_STATUS_IN_TRANS, 2, capabilities, "done")
+	expected := []byte{0x00, 3, 0xfc, 0x2c, 0x01}
+	expectedOK := OKResponse{AffectedRows: 3, LastInsertId: 300, Info: "done"}
+	if protocol41 {
+		expected = append(expected, byte(SERVER_STATUS_IN_TRANS), 0, 2, 0)
+		expectedOK.StatusFlags, expectedOK.Warnings = SERVER_STATUS_IN_TRANS, 2
+	} else if transactions {
+		expected = append(expected, byte(SERVER_STATUS_IN_TRANS), 0)
+		expectedOK.StatusFlags = SERVER_STATUS_IN_TRANS
+	}
+	if sessionTrack {
+		expected = append(expected, 4)
+	}
+	expected = append(expected, "done"...)
+	if !bytes.Equal(ok, expected) {
+		t.Errorf("capabilities %#x: expected OK %v, instead got %v", capabilities, expected, ok)
+	}
+	if decoded, err := ReadOKPacket(ok, capabilities); err != nil || *decoded != expectedOK {
+		t.Errorf("capabilities %#x: expected to decode OK %v, instead got %v %v", capabilities, expectedOK, decoded, err)
+	}
+
+	// ERR: header, error code, the SQL state only for 4.1, message
+	errPayload := ERRPacket(1064, "syntax")
+	expected = append([]byte{0xff, 0x28, 0x04}, "syntax"...)
+	if !bytes.Equal(errPayload, expected) {
+		t.Errorf("capabilities %#x: expected ERR %v, instead got %v", capabilities, expected, errPayload)
+	}
+	if decoded, err := ReadERRPacket(errPayload, capabilities); err != nil || *decoded != (ERRResponse{Code: 1064, Message: "syntax"}) {
+		t.Errorf("capabilities %#x: unexpected ERR decoded %v %v", capabilities, decoded, err)
+	}
+	errPayload = ClientERRPacket(1064, "42000", "syntax", capabilities)
+	expected = append([]byte{0xff, 0x28, 0x04}, "syntax"...)
+	expectedERR := ERRResponse{Code: 1064, Message: "syntax"}
+	if protocol41 {
+		expected = append([]byte{0xff, 0x28, 0x04, '#', '4', '2', '0', '0', '0'}, "syntax"...)
+		expectedERR.SQLState = "42000"
+	}
+	if !bytes.Equal(errPayload, expected) {
+		t.Errorf("capabilities %#x: expected ERR %v, instead got %v", capabilities, expected, errPayload)
+	}
+	if decoded, err := ReadERRPacket(errPayload, capabilities); err != nil || *decoded != expectedERR {
+		t.Errorf("capabilities %#x: expected to decode ERR %v, instead got %v %v", capabilities, expectedERR, decoded, err)
+	}
+
+	// EOF: header, warnings and status flags only for 4.1
+	eof := EOFPacket(2, SERVER_STATUS_AUTOCOMMIT, capabilities)
+	expected = []byte{0xfe}
+	expectedEOF := EOFResponse{}
+	if protocol41 {
+		expected = append(expected, 2, 0, byte(SERVER_STATUS_AUTOCOMMIT), 0)
+		expectedEOF = EOFResponse{Warnings: 2, StatusFlags: SERVER_STATUS_AUTOCOMMIT}
+	}
+	if !bytes.Equal(eof, expected) {
+		t.Errorf("capabilities %#x: expected EOF %v, instead got %v", capabilities, expected, eof)
+	}
+	if decoded, err := ReadEOFPacket(eof, capabilities); err != nil || *decoded != expectedEOF {
+		t.Errorf("capabilities %#x: expected to decode EOF %v, instead got %v %v", capabilities, expectedEOF, decoded, err)
+	}
+
+	// the end of the rows: the EOF packet, or with CLIENT_DEPRECATE_EOF an OK packet with the 0xfe header
+	term := TerminatorPacket(SERVER_STATUS_AUTOCOMMIT, 2, capabilities)
+	if !Supports(capabilities, CLIENT_DEPRECATE_EOF) {
+		if !bytes.Equal(term, eof) {
+			t.Errorf("capabilities %#x: expected the EOF packet %v ending the rows, instead got %v", capabilities, eof, term)
+		}
+	} else {
+		expected = []byte{0xfe, 0, 0}
+		expectedOK = OKResponse{}
+		if protocol41 {
+			expected = append(expected, byte(SERVER_STATUS_AUTOCOMMIT), 0, 2, 0)
+			expectedOK.StatusFlags, expectedOK.Warnings = SERVER_STATUS_AUTOCOMMIT, 2
+		} else if transactions {
+			expected = append(expected, byte(SERVER_STATUS_AUTOCOMMIT), 0)
+			expectedOK.StatusFlags = SERVER_STATUS_AUTOCOMMIT
+		}
+		if !bytes.Equal(term, expected) {
+			t.Errorf("capabilities %#x: expected the OK packet %v ending the rows, instead got %v", capabilities, expected, term)
+		}
+		if decoded, err := ReadOKPacket(term, capabilities); err != nil || *decoded != expectedOK {
+			t.Errorf("capabilities %#x: expected to decode OK %v, instead got %v %v", capabilities, expectedOK, decoded, err)
+		}
+	}
+
+	// COM_STMT_PREPARE_OK: status, statement id, columns, parameters, filler, warnings
+	prepareOK := StmtPrepareOK(0x01020304, 3, 2, 0x0105)
+	expected = []byte{0x00, 0x04, 0x03, 0x02, 0x01, 3, 0, 2, 0, 0x00, 0x05, 0x01}
+	if !bytes.Equal(prepareOK, expected) {
+		t.Errorf("capabilities %#x: expected COM_STMT_PREPARE_OK %v, instead got %v", capabilities, expected, prepareOK)
+	}
+	decodedPrepare, err := ReadStmtPrepareOK(prepareOK)
+	if err != nil || *decodedPrepare != (StmtPrepareOKResponse{StmtID: 0x01020304, NumColumns: 3, NumParams: 2, Warnings: 0x0105}) {
+		t.Errorf("capabilities %#x: unexpected COM_STMT_PREPARE_OK decoded %v %v", capabilities, decodedPrepare, err)
+	}
+
+	if colType == nil {
+		return
+	}
+	colDef := NewPackager(nil, nil).ColumnDefinition(colType.Name(), colType, capabilities)
+	col, err := ReadColumnDefinition(colDef, capabilities)
+	if !protocol41 {
+		// ColumnDefinition320: table and name strings<lenenc>, then the length, the type and the flags with the
+		// decimals, each prefixed by its length, the flags taking two bytes with CLIENT_LONG_FLAG
+		if err != nil || col.Table != "temp-table" || col.Name != colType.Name() || col.Catalog != "" ||
+			col.Type != EnumFieldTypes[colType.DatabaseTypeName()] {
+			t.Errorf("capabilities %#x: unexpected column definition decoded %v %v", capabilities, col, err)
+		}
+		flagsLen := INT1
+		if Supports(capabilities, CLIENT_LONG_FLAG) {
+			flagsLen = INT2
+		}
+		fixed := colDef[len(colDef)-(1+INT3+1+INT1+1+flagsLen+INT1):]
+		if int(fixed[0]) != INT3 || int(fixed[1+INT3]) != INT1 || fixed[1+INT3+1] != byte(col.Type) || int(fixed[1+INT3+1+INT1]) != flagsLen+INT1 {
+			t.Errorf("capabilities %#x: unexpected fixed length fields of the column definition %v", capabilities, fixed)
+		}
+		return
+	}
+	// ColumnDefinition41: six strings<lenenc>, the 0x0c long fixed length fields ending with the filler
+	if err != nil || col.Catalog != "def" || col.Name != colType.Name() || col.OrgName != colType.Name() ||
+		col.Type != EnumFieldTypes[colType.DatabaseTypeName()] {
+		t.Errorf("capabilities %#x: unexpected column definition decoded %v %v", capabilities, col, err)
+	}
+	fixed := colDef[len(colDef)-13:]
+	if fixed[0] != 0x0c || fixed[11] != 0 || fixed[12] != 0 {
+		t.Errorf("capabilities %#x: unexpected fixed length fields of the column definition %v", capabilities, fixed)
+	}
+}
+
+func TestPacketLayouts(t *testing.T) {
+	db, err := sql.Open("coldeftest", "")
+	if err != nil {
+		t.Fatal("sql.Open:", err.Error())
+	}
+	defer db.Close()
+	rows, err := db.Query("select id from test")
+	if err != nil {
+		t.Fatal("Query:", err.Error())
+	}
+	defer rows.Close()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal("ColumnTypes:", err.Error())
+	}
+
+	for _, capabilities := range []int{
+		0,
+		CLIENT_TRANSACTIONS,
+		CLIENT_TRANSACTIONS | CLIENT_DEPRECATE_EOF,
+		CLIENT_PROTOCOL_41,
+		CLIENT_PROTOCOL_41 | CLIENT_TRANSACTIONS,
+		CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF,
+		CLIENT_PROTOCOL_41 | CLIENT_SESSION_TRACK,
+		CLIENT_PROTOCOL_41 | CLIENT_SESSION_TRACK | CLIENT_DEPRECATE_EOF | CLIENT_TRANSACTIONS,
+		CLIENT_SESSION_TRACK,
+		CLIENT_LONG_FLAG,
+		CLIENT_TRANSACTIONS | CLIENT_LONG_FLAG,
+		CLIENT_PROTOCOL_41 | CLIENT_LONG_FLAG,
+	} {
+		checkPacketLayouts(t, uint32(capabilities), colTypes[0])
+	}
+}
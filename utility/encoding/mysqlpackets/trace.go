@@ -0,0 +1,132 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding"
+)
+
+// EnvProtocolTrace is the environment variable turning on the protocol trace, set to a true value as
+// parsed by strconv.ParseBool. The workers inherit it from the mux.
+const EnvProtocolTrace = "HERA_PROTOCOL_TRACE"
+
+// traceEnabled is read once, tests can set it directly
+var traceEnabled = func() bool {
+	on, _ := strconv.ParseBool(os.Getenv(EnvProtocolTrace))
+	return on
+}()
+
+// TraceEnabled tells if the packets are logged decoded with Trace, see EnvProtocolTrace
+func TraceEnabled() bool {
+	return traceEnabled
+}
+
+// traceMaxString is the number of bytes of a query or a message kept in a trace
+const traceMaxString = 256
+
+// traceCapabilities are the capabilities the responses are decoded with, the ones Hera always announces
+const traceCapabilities = uint32(CLIENT_PROTOCOL_41)
+
+// Trace returns a one line description of a MySQL packet of the command phase: the packet name, the sequence
+// id and the decoded fields. A packet with sequence id 0 starts a command, the fields of COM_QUERY,
+// COM_INIT_DB, COM_STMT_PREPARE, COM_STMT_EXECUTE and of the commands on a statement id are decoded. Any other
+// packet is a response, decoded as OK, ERR, EOF or ColumnDefinition by its header. The other responses, i.e.
+// the column count and the rows, only have their length, except a binary protocol row, which starts with
+// 0x00 like an OK packet and is shown as one.
+func Trace(p *encoding.Packet) string {
+	if p == nil {
+		return "<nil>"
+	}
+	payload := p.Payload
+	if p.Sqid == 0 && len(payload) > 0 {
+		return traceCommand(p.Sqid, payload)
+	}
+	if len(payload) > 0 {
+		switch {
+		case payload[0] == 0xff:
+			if e, err := ReadERRPacket(payload, traceCapabilities); err == nil {
+				return fmt.Sprintf("ERR sqid=%d code=%d sql_state=%q message=%q", p.Sqid, e.Code, e.SQLState,
+					traceString([]byte(e.Message)))
+			}
+		case isEOFPacket(payload):
+			if eof, err := ReadEOFPacket(payload, traceCapabilities); err == nil {
+				return fmt.Sprintf("EOF sqid=%d warnings=%d status_flags=0x%04x", p.Sqid, eof.Warnings, eof.StatusFlags)
+			}
+		case payload[0] == 0x00:
+			if ok, err := ReadOKPacket(payload, traceCapabilities); err == nil {
+				return fmt.Sprintf("OK sqid=%d affected_rows=%d last_insert_id=%d status_flags=0x%04x warnings=%d info=%q",
+					p.Sqid, ok.AffectedRows, ok.LastInsertId, ok.StatusFlags, ok.Warnings, traceString([]byte(ok.Info)))
+			}
+		case isColumnDefinition(payload):
+			if col, err := ReadColumnDefinition(payload, traceCapabilities); err == nil {
+				return fmt.Sprintf("ColumnDefinition sqid=%d schema=%q table=%q org_table=%q name=%q org_name=%q charset=%d "+
+					"length=%d type=0x%02x flags=0x%04x decimals=%d", p.Sqid, col.Schema, col.Table, col.OrgTable, col.Name,
+					col.OrgName, col.Charset, col.Length, col.Type, col.Flags, col.Decimals)
+			}
+		}
+	}
+	return fmt.Sprintf("packet sqid=%d len=%d", p.Sqid, len(payload))
+}
+
+// traceCommand describes the packet starting a command
+func traceCommand(sqid int, payload []byte) string {
+	cmd := int(payload[0])
+	name, ok := common.SQLcmds[cmd]
+	if !ok {
+		name = fmt.Sprintf("COM_UNKNOWN(0x%02x)", cmd)
+	}
+	switch cmd {
+	case common.COM_QUERY, common.COM_STMT_PREPARE:
+		return fmt.Sprintf("%s sqid=%d query=%q", name, sqid, traceString(payload[1:]))
+	case common.COM_INIT_DB:
+		return fmt.Sprintf("%s sqid=%d schema=%q", name, sqid, traceString(payload[1:]))
+	case common.COM_STMT_EXECUTE:
+		stmtID, flags, iteration, _, _, _, _, err := DecodeExecutePacket(payload, 0)
+		if err != nil {
+			break
+		}
+		// the parameters can't be decoded without the number of parameters of the statement
+		return fmt.Sprintf("%s sqid=%d stmt_id=%d flags=0x%02x iteration=%d params_len=%d", name, sqid, stmtID, flags,
+			iteration, len(payload)-(INT1+INT4+INT1+INT4))
+	case common.COM_STMT_CLOSE, common.COM_STMT_RESET, common.COM_STMT_FETCH, common.COM_STMT_SEND_LONG_DATA:
+		if len(payload) < INT1+INT4 {
+			break
+		}
+		pos := 1
+		return fmt.Sprintf("%s sqid=%d stmt_id=%d", name, sqid, ReadFixedLenInt(payload, INT4, &pos))
+	}
+	return fmt.Sprintf("%s sqid=%d len=%d", name, sqid, len(payload))
+}
+
+// isColumnDefinition tells if the payload starts like a ColumnDefinition41, whose catalog is always "def"
+func isColumnDefinition(payload []byte) bool {
+	return len(payload) > 4 && payload[0] == 3 && string(payload[1:4]) == "def"
+}
+
+// traceString returns str, cut to traceMaxString bytes
+func traceString(str []byte) string {
+	if len(str) <= traceMaxString {
+		return string(str)
+	}
+	return string(str[:traceMaxString]) + "..."
+}
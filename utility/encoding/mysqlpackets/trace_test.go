@@ -0,0 +1,65 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlpackets
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paypal/hera/common"
+)
+
+func TestTrace(t *testing.T) {
+	t.Log("Start TestTrace +++")
+	capabilities := uint32(CLIENT_PROTOCOL_41)
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 7, 0, 0, 0, 0, 1, 0, 0, 0, 0x00, 0x01, 0x03, 0x00, 5, 0, 0, 0}
+	tests := []struct {
+		sqid    int
+		payload []byte
+		trace   string
+	}{
+		{0, append([]byte{byte(common.COM_QUERY)}, "select 1"...), `COM_QUERY sqid=0 query="select 1"`},
+		{0, append([]byte{byte(common.COM_INIT_DB)}, "test"...), `COM_INIT_DB sqid=0 schema="test"`},
+		{0, execute, "COM_STMT_EXECUTE sqid=0 stmt_id=7 flags=0x00 iteration=1 params_len=8"},
+		{0, []byte{byte(common.COM_STMT_CLOSE), 7, 0, 0, 0}, "COM_STMT_CLOSE sqid=0 stmt_id=7"},
+		{0, []byte{byte(common.COM_PING)}, "COM_PING sqid=0 len=1"},
+		{0, []byte{0x60}, "COM_UNKNOWN(0x60) sqid=0 len=1"},
+		{1, OKPacket(3, 7, SERVER_STATUS_AUTOCOMMIT, 2, capabilities, "info"),
+			`OK sqid=1 affected_rows=3 last_insert_id=7 status_flags=0x0002 warnings=2 info="info"`},
+		{1, ERRPacketWithState(common.ER_EMPTY_QUERY, "42000", "Query was empty"),
+			`ERR sqid=1 code=1065 sql_state="42000" message="Query was empty"`},
+		{3, EOFPacket(1, SERVER_STATUS_IN_TRANS, capabilities), "EOF sqid=3 warnings=1 status_flags=0x0001"},
+		{2, testColumnDefinition("id"), `ColumnDefinition sqid=2 schema="db" table="test" org_table="test" name="id" ` +
+			`org_name="id" charset=33 length=30 type=0x0f flags=0x0001 decimals=0`},
+		{1, ColumnCountPacket(2), "packet sqid=1 len=1"},
+		{1, nil, "packet sqid=1 len=0"},
+	}
+	for _, test := range tests {
+		trace := Trace(NewMySQLPacketFrom(test.sqid, test.payload))
+		if trace != test.trace {
+			t.Error("Expected", test.trace, "instead got", trace)
+		}
+	}
+
+	long := append([]byte{byte(common.COM_QUERY)}, strings.Repeat("x", traceMaxString+10)...)
+	trace := Trace(NewMySQLPacketFrom(0, long))
+	if !strings.HasSuffix(trace, strings.Repeat("x", traceMaxString)+`..."`) {
+		t.Error("Expected the query cut to", traceMaxString, "bytes, instead got", trace)
+	}
+	t.Log("End TestTrace +++")
+}
@@ -26,6 +26,8 @@ import (
 	"github.com/paypal/hera/utility/encoding"
 	"github.com/paypal/hera/utility/logger"
 	"io"
+	"strconv"
+	"time"
 )
 
 const (
@@ -34,8 +36,53 @@ const (
 	space byte = ' '
 	// CodeSubCommand is a special command used to define that the payload contains multiple netstrings
 	CodeSubCommand = '0'
+	// maxLength is the largest length a netstring can claim, a longer one is most likely not a length
+	maxLength = 1<<31 - 1
+	// chunkSize is how much of a netstring is allocated and read at once. A netstring larger than this grows
+	// as its bytes arrive, so that a bad length can't force a large allocation.
+	chunkSize = 64 * 1024
 )
 
+// ErrLengthTooLarge is returned reading a netstring which claims a length larger than maxLength
+var ErrLengthTooLarge = errors.New("netstring length too large")
+
+// ErrMissingComma is returned reading a netstring whose last byte, after as many bytes as its length, is not
+// the comma: the length is wrong or the bytes are not a netstring
+var ErrMissingComma = errors.New("netstring not terminated by a comma")
+
+// readRest returns the Serialized bytes of a netstring of totalLen bytes, of which the header, the length
+// and the colon, was already read. The rest is read from _reader, one chunk at a time.
+func readRest(_reader io.Reader, header []byte, totalLen int) ([]byte, error) {
+	size := len(header) + 1 + chunkSize
+	if size > totalLen+1 {
+		size = totalLen + 1
+	}
+	serialized := make([]byte, len(header)+1, size) // + 1 is for indicator byte
+	serialized[0] = encoding.IndicatorNetstring
+	copy(serialized[1:], header)
+	for len(serialized) < totalLen+1 {
+		start := len(serialized)
+		end := start + chunkSize
+		if end > totalLen+1 {
+			end = totalLen + 1
+		}
+		if end > cap(serialized) {
+			size = 2 * cap(serialized)
+			if size > totalLen+1 {
+				size = totalLen + 1
+			}
+			grown := make([]byte, start, size)
+			copy(grown, serialized)
+			serialized = grown
+		}
+		serialized = serialized[:end]
+		if _, err := io.ReadFull(_reader, serialized[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	return serialized, nil
+}
+
 // NewInitNetstring creates a Netstring from the reader, reading exactly as many bytes as necessary. Assumes
 // that this is the initial request received from the client, so it doesn't initially have the MySQL vs netstring
 // encoding indicator byte.
@@ -59,6 +106,14 @@ func NewInitNetstring(_reader io.Reader) (*encoding.Packet, error) {
 		if err != nil {
 			return nil, err
 		}
+		if buff.Len() == 0 && !isDigit(b) {
+			// a netstring always starts with the length, so this is most likely a MySQL client.
+			// give the byte back if possible so that the caller can retry with the MySQL decoder
+			if scanner, ok := _reader.(io.ByteScanner); ok {
+				scanner.UnreadByte()
+			}
+			return nil, encoding.WRONGPACKET
+		}
 		buff.WriteByte(b)
 		if b == colon {
 			break
@@ -68,52 +123,67 @@ func NewInitNetstring(_reader io.Reader) (*encoding.Packet, error) {
 				return nil, errors.New("Expected digit reading length")
 			}
 			length = length*10 + digit
+			if length > maxLength {
+				return nil, ErrLengthTooLarge
+			}
 		}
 	}
 
 	//read the rest
 	totalLen := length + buff.Len() + 1 /*comma*/
-	ns.Serialized = make([]byte, totalLen + 1) // + 1 is for indicator byte
-	ns.Serialized[0] = 1 // indicates netstring
-	copy(ns.Serialized[1:], buff.Bytes())
-	bytesRead := buff.Len() + 1
-	var n int
-	for bytesRead < totalLen {
-		n, err = _reader.Read(ns.Serialized[bytesRead:])
-		if err != nil {
-			return nil, err
-		}
-		bytesRead += n
+	ns.Serialized, err = readRest(_reader, buff.Bytes(), totalLen)
+	if err != nil {
+		return nil, err
 	}
-	// read command
-	next := buff.Len() + 1
-	for next < (totalLen) {
-		if ns.Serialized[next] == space {
+	if err = parseBody(ns, buff.Len()+1, totalLen); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// parseBody checks that the netstring in ns.Serialized, totalLen bytes after the indicator byte, ends with the
+// comma, then decodes the command starting at next, the digits up to the space or the comma, and the payload
+func parseBody(ns *encoding.Packet, next int, totalLen int) error {
+	if last := ns.Serialized[totalLen]; last != comma {
+		return fmt.Errorf("%w, got %q", ErrMissingComma, last)
+	}
+	start := next
+	for next < totalLen {
+		if ns.Serialized[next] == space && next > start {
 			next++
 			break
 		}
-		digit = int(ns.Serialized[next] - '0')
-		if (digit < 0) || (digit > 9) {
-			return nil, errors.New("Expected digit reading command")
+		if !isDigit(ns.Serialized[next]) {
+			return errors.New("Expected digit reading command")
 		}
-		ns.Cmd = ns.Cmd*10 + digit
+		ns.Cmd = ns.Cmd*10 + int(ns.Serialized[next]-'0')
 		next++
 	}
+	if next == start {
+		return errors.New("Expected digit reading command")
+	}
 	ns.IsMySQL = false
-	ns.Payload = ns.Serialized[next : totalLen]
-	return ns, nil
+	ns.Payload = ns.Serialized[next:totalLen]
+	return nil
 }
 
-// NewNetstring creates a Netstring from the reader, reading exactly as many bytes as necessary
+func isDigit(b byte) bool {
+	return (b >= '0') && (b <= '9')
+}
+
+// NewNetstring creates a Netstring from the reader. The reader is wrapped in a bufio.Reader, which may
+// read ahead: when reading several netstrings from the same stream use NewNetstringBuffered
 func NewNetstring(reader io.Reader) (*encoding.Packet, error) {
+	return NewNetstringBuffered(bufio.NewReader(reader))
+}
+
+// NewNetstringBuffered creates a Netstring from the buffered reader, reading exactly as many bytes as necessary.
+// The bytes after the netstring stay in the reader for the next call.
+func NewNetstringBuffered(_reader *bufio.Reader) (*encoding.Packet, error) {
 	logger.GetLogger().Log(logger.Info, "Inside Netstring")
 	ns := &encoding.Packet{}
 
-	_reader := bufio.NewReader(reader)
-
 	var buff bytes.Buffer
-	// var tp = make([]byte, 1)
-	var tmp = make([]byte, 1)
 	var digit int
 	var err error
 
@@ -122,12 +192,14 @@ func NewNetstring(reader io.Reader) (*encoding.Packet, error) {
 	length := 0
 	// Read in type byte
 	ttp, err := _reader.ReadByte()
-	if err == io.EOF {
+	if err != nil {
 		return nil, err
 	}
 
-	if int(ttp) != 1 {
-		if int(ttp) == 0 {
+	if ttp != encoding.IndicatorNetstring {
+		// give the byte back so that the caller can retry with the MySQL decoder
+		_reader.UnreadByte()
+		if ttp == encoding.IndicatorMySQL {
 			return nil, encoding.WRONGPACKET
 		}
 		return nil, encoding.UNKNOWNPACKET
@@ -135,8 +207,8 @@ func NewNetstring(reader io.Reader) (*encoding.Packet, error) {
 
 
 	for {
-		_, err = _reader.Read(tmp)
-		b := tmp[0]
+		var b byte
+		b, err = _reader.ReadByte()
 		if err != nil {
 			return nil, err
 		}
@@ -149,62 +221,52 @@ func NewNetstring(reader io.Reader) (*encoding.Packet, error) {
 				return nil, errors.New("Expected digit reading length")
 			}
 			length = length*10 + digit
+			if length > maxLength {
+				return nil, ErrLengthTooLarge
+			}
 		}
 	}
 
 	//read the rest
 	totalLen := length + buff.Len() + 1 /*comma*/
-	ns.Serialized = make([]byte, totalLen + 1) // + 1 is for indicator byte
-	ns.Serialized[0] = 1 // indicates netstring
-	copy(ns.Serialized[1:], buff.Bytes())
-	bytesRead := buff.Len() + 1
-	var n int
-	for bytesRead < totalLen {
-		n, err = _reader.Read(ns.Serialized[bytesRead:])
-		if err != nil {
-			return nil, err
-		}
-		bytesRead += n
+	ns.Serialized, err = readRest(_reader, buff.Bytes(), totalLen)
+	if err != nil {
+		return nil, err
 	}
-	// read command
-	next := buff.Len() + 1
-	for next < (totalLen) {
-		if ns.Serialized[next] == space {
-			next++
-			break
-		}
-		digit = int(ns.Serialized[next] - '0')
-		if (digit < 0) || (digit > 9) {
-			return nil, errors.New("Expected digit reading command")
-		}
-		ns.Cmd = ns.Cmd*10 + digit
-		next++
+	if err = parseBody(ns, buff.Len()+1, totalLen); err != nil {
+		return nil, err
 	}
-	ns.IsMySQL = false
-	ns.Payload = ns.Serialized[next : totalLen]
 	logger.GetLogger().Log(logger.Info, "Finished Netstring")
 	return ns, nil
 }
 
 // NewNetstringFrom creates a Netstring from command and Payload
 func NewNetstringFrom(_cmd int, _payload []byte) *encoding.Packet {
-	// TODO: optimize
 	payloadLen := len(_payload)
-	cmdStr := fmt.Sprintf("%d", _cmd)
-	var str string
-	if payloadLen == 0 {
-		str = fmt.Sprintf("%d:%s,", len(cmdStr), cmdStr)
-	} else {
-		str = fmt.Sprintf("%d:%s %s,", payloadLen+len(cmdStr)+1 /*the space*/, cmdStr, string(_payload))
+	var cmdBuf, lenBuf [20]byte
+	cmd := strconv.AppendInt(cmdBuf[:0], int64(_cmd), 10)
+	nsLen := len(cmd)
+	if payloadLen > 0 {
+		nsLen += 1 /*the space*/ + payloadLen
 	}
+	length := strconv.AppendInt(lenBuf[:0], int64(nsLen), 10)
+	totalLen := 1 /*indicator byte*/ + len(length) + 1 /*colon*/ + nsLen + 1 /*comma*/
+	serialized := make([]byte, 0, totalLen)
+	serialized = append(serialized, encoding.IndicatorNetstring)
+	serialized = append(serialized, length...)
+	serialized = append(serialized, colon)
+	serialized = append(serialized, cmd...)
+	if payloadLen > 0 {
+		serialized = append(serialized, space)
+		serialized = append(serialized, _payload...)
+	}
+	serialized = append(serialized, comma)
 	ns := new(encoding.Packet)
 	ns.Cmd = _cmd
 	ns.IsMySQL = false
-	byteStr := []byte(str)
-	ns.Serialized = append([]byte{1}, byteStr...)
+	ns.Serialized = serialized
 	if payloadLen > 0 {
-		totalLen := len(ns.Serialized[1:])
-		ns.Payload = ns.Serialized[totalLen-payloadLen : totalLen]
+		ns.Payload = serialized[totalLen-1-payloadLen : totalLen-1]
 	}
 
 	return ns
@@ -236,22 +298,50 @@ func NewNetstringEmbedded(_netstrings []*encoding.Packet) *encoding.Packet {
 	return ns
 }
 
-// SubNetstrings parses the embedded Netstrings
+// EncodeEmbedded writes to w the same bytes as NewNetstringEmbedded(nss).Serialized, without assembling them
+// in one buffer: the header is written first, then each Netstring as it is. It returns the number of bytes written.
+func EncodeEmbedded(w io.Writer, nss []*encoding.Packet) (int, error) {
+	payloadLen := 0
+	for _, ns := range nss {
+		payloadLen += len(ns.Serialized)
+	}
+	header := make([]byte, 0, 16)
+	header = append(header, encoding.IndicatorNetstring)
+	header = strconv.AppendInt(header, int64(payloadLen+2 /*len("0 ")*/), 10)
+	header = append(header, colon, CodeSubCommand, space)
+	total, err := w.Write(header)
+	if err != nil {
+		return total, err
+	}
+	for _, ns := range nss {
+		var n int
+		n, err = w.Write(ns.Serialized)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := w.Write([]byte{comma})
+	return total + n, err
+}
+
+// SubNetstrings parses the embedded Netstrings. In case of error the Netstrings before the malformed one
+// are returned with the error
 func SubNetstrings(_ns *encoding.Packet) ([]*encoding.Packet, error) {
 	//  TODO: optimize for zero-copy
 	var nss []*encoding.Packet
-	reader := bytes.NewReader(_ns.Payload)
+	reader := bufio.NewReader(bytes.NewReader(_ns.Payload))
 	// fmt.Println("SubNetstrings: ", _ns.Payload)
 	var ns *encoding.Packet
 	var err error
 	for {
-		ns, err = NewNetstring(reader)
+		ns, err = NewNetstringBuffered(reader)
 		if err == io.EOF {
 			break
 		}
 		// fmt.Println(ns.Serialized)
 		if err != nil {
-			return nil, err
+			return nss, err
 		}
 		nss = append(nss, ns)
 	}
@@ -260,19 +350,41 @@ func SubNetstrings(_ns *encoding.Packet) ([]*encoding.Packet, error) {
 
 // Reader decodes netstrings from a buffer
 type Reader struct {
-	reader io.Reader
+	reader *bufio.Reader
+	src    io.Reader // the stream buffered by reader, for ReadNextDeadline
 	ns     *encoding.Packet
 	nss    []*encoding.Packet
 	next   int
+	// error parsing the embedded Netstrings, returned after the ones parsed successfully
+	err error
 }
 
+// Reader splits the embedded Netstrings the same way mysqlpackets.Packager reassembles the split MySQL messages
+var _ encoding.Packaging = (*Reader)(nil)
+
 // NewNetstringReader creates a Reader, that maintains the state for embedded Netstrings
 func NewNetstringReader(_reader io.Reader) *Reader {
 	nsr := new(Reader)
-	nsr.reader = _reader
+	nsr.reader = bufio.NewReader(_reader)
+	nsr.src = _reader
 	return nsr
 }
 
+// Reset discards the Netstrings buffered by the Reader and makes it read from _reader, so that a
+// Reader can be reused for a new stream instead of allocating a new one
+func (reader *Reader) Reset(_reader io.Reader) {
+	if reader.reader == nil {
+		reader.reader = bufio.NewReader(_reader)
+	} else {
+		reader.reader.Reset(_reader)
+	}
+	reader.src = _reader
+	reader.ns = nil
+	reader.nss = nil
+	reader.next = 0
+	reader.err = nil
+}
+
 // ReadNext returns the next Netstring from the stream. Note: in case of embedded netstrings,
 // the Reader will buffer some Netstrings
 func (reader *Reader) ReadNext() (ns *encoding.Packet, err error) {
@@ -288,18 +400,80 @@ func (reader *Reader) ReadNext() (ns *encoding.Packet, err error) {
 			reader.next++
 			return
 		}
-		reader.ns, err = NewNetstring(reader.reader)
+		if reader.err != nil {
+			err = reader.err
+			reader.err = nil
+			return nil, err
+		}
+		reader.ns, err = NewNetstringBuffered(reader.reader)
 		if err != nil {
 			return nil, err
 		}
 		if reader.ns.Cmd == (CodeSubCommand - '0') {
 			reader.nss, err = SubNetstrings(reader.ns)
 			if err != nil {
-				return nil, err
+				if len(reader.nss) == 0 {
+					return nil, err
+				}
+				reader.err = err
+				err = nil
 			}
 
 			reader.ns = nil
 			reader.next = 0
 		}
 	}
-}
\ No newline at end of file
+}
+// deadlineReader is a stream whose reads can be given a deadline, like a net.Conn
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ErrNoDeadline is returned by ReadNextDeadline when the stream doesn't support read deadlines
+var ErrNoDeadline = errors.New("netstring reader without read deadline")
+
+// ReadNextDeadline is ReadNext with the read deadline of the stream set to t, so that it returns the timeout
+// error of the stream, a net.Error, once t is reached instead of blocking. The Netstrings already buffered are
+// returned without reading. The deadline is cleared before returning. After a timeout with no byte of the next
+// Netstring read, the Reader can be used again, otherwise the rest of the Netstring is out of sync.
+func (reader *Reader) ReadNextDeadline(t time.Time) (*encoding.Packet, error) {
+	if reader.ns != nil || reader.next < len(reader.nss) || reader.err != nil {
+		return reader.ReadNext()
+	}
+	conn, ok := reader.src.(deadlineReader)
+	if !ok {
+		return nil, ErrNoDeadline
+	}
+	err := conn.SetReadDeadline(t)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	return reader.ReadNext()
+}
+
+// IsComposite tells if the last Netstring read was embedded in a composite Netstring and is followed
+// by more Netstrings of the same composite
+func (reader *Reader) IsComposite() bool {
+	return reader.next < len(reader.nss)
+}
+
+// ReadMultiplePackets returns all the Netstrings of the composite Netstring which first is part of,
+// starting with first. If first is a composite Netstring itself, it returns the Netstrings embedded
+// in it. For any other Netstring it returns just first.
+func (reader *Reader) ReadMultiplePackets(first *encoding.Packet) ([]*encoding.Packet, error) {
+	if first.IsComposite() {
+		return SubNetstrings(first)
+	}
+	nss := []*encoding.Packet{first}
+	for reader.IsComposite() {
+		nss = append(nss, reader.nss[reader.next])
+		reader.next++
+	}
+	if reader.err != nil {
+		err := reader.err
+		reader.err = nil
+		return nss, err
+	}
+	return nss, nil
+}
@@ -18,10 +18,18 @@
 package netstring
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/paypal/hera/utility/encoding"
 	"io"
+	"io/ioutil"
+	"net"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type nsCase struct {
@@ -205,6 +213,80 @@ func TestNetstringReader(t *testing.T) {
 	}
 }
 
+func TestReaderReset(t *testing.T) {
+	first := NewNetstringEmbedded([]*encoding.Packet{NewNetstringFrom(1, []byte("one")), NewNetstringFrom(2, []byte("two"))})
+	reader := NewNetstringReader(bytes.NewReader(append(first.Serialized, NewNetstringFrom(3, []byte("three")).Serialized...)))
+	ns, err := reader.ReadNext()
+	if err != nil || ns.Cmd != 1 || !reader.IsComposite() {
+		t.Fatal("Expected the first embedded Netstring, instead got", ns, err)
+	}
+
+	// the embedded and unread Netstrings of the first stream are dropped
+	second := []*encoding.Packet{NewNetstringFrom(4, []byte("four")), NewNetstringFrom(5, []byte("five"))}
+	reader.Reset(bytes.NewReader(append(second[0].Serialized, second[1].Serialized...)))
+	if reader.IsComposite() {
+		t.Log("Expected no buffered Netstrings after Reset")
+		t.Fail()
+	}
+	for _, expected := range second {
+		ns, err = reader.ReadNext()
+		if err != nil || ns.Cmd != expected.Cmd || !bytes.Equal(ns.Payload, expected.Payload) {
+			t.Log("Expected", expected.Cmd, string(expected.Payload), "instead got", ns, err)
+			t.Fail()
+		}
+	}
+	if ns, err = reader.ReadNext(); err != io.EOF {
+		t.Log("Expected EOF, instead got", ns, err)
+		t.Fail()
+	}
+
+	// a zero Reader can be reset too
+	reader = new(Reader)
+	reader.Reset(bytes.NewReader(second[0].Serialized))
+	if ns, err = reader.ReadNext(); err != nil || ns.Cmd != second[0].Cmd {
+		t.Log("Expected", second[0].Cmd, "instead got", ns, err)
+		t.Fail()
+	}
+}
+
+func TestReadNextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	reader := NewNetstringReader(server)
+
+	// nothing is written, the read times out
+	start := time.Now()
+	ns, err := reader.ReadNextDeadline(start.Add(50 * time.Millisecond))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() || ns != nil {
+		t.Fatal("Expected a timeout, instead got", ns, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Log("Expected the read to time out after 50ms, instead it took", elapsed)
+		t.Fail()
+	}
+
+	// the reader is still usable, the embedded netstrings after the first are returned from the buffer
+	embedded := NewNetstringEmbedded([]*encoding.Packet{NewNetstringFrom(1, nil), NewNetstringFrom(2, nil)})
+	go client.Write(embedded.Serialized)
+	ns, err = reader.ReadNextDeadline(time.Now().Add(5 * time.Second))
+	if err != nil || ns.Cmd != 1 {
+		t.Fatal("Expected the first embedded netstring, instead got", ns, err)
+	}
+	ns, err = reader.ReadNextDeadline(time.Now().Add(-time.Second))
+	if err != nil || ns.Cmd != 2 {
+		t.Log("Expected the second embedded netstring from the buffer, instead got", ns, err)
+		t.Fail()
+	}
+
+	// a stream without deadlines
+	reader = NewNetstringReader(strings.NewReader("1:1,"))
+	if _, err = reader.ReadNextDeadline(time.Now().Add(time.Second)); err != ErrNoDeadline {
+		t.Log("Expected ErrNoDeadline, instead got", err)
+		t.Fail()
+	}
+}
+
 func TestBadInput(t *testing.T) {
 	reader := NewNetstringReader(strings.NewReader(reEncodeNetstring("54:0 " + reEncodeNetstring("16:502 "))))
 	_, err := reader.ReadNext()
@@ -214,7 +296,7 @@ func TestBadInput(t *testing.T) {
 		t.Log("Bad input should have failed - incomplete Netstring")
 		t.Fail()
 	}
-	reader = NewNetstringReader(strings.NewReader(reEncodeNetstring("55:0 " +reEncodeNetstring ("16:502 xyzwx*abcdef,") + reEncodeNetstring("50:5,") + reEncodeNetstring("24:25 1234567890*1234567890,,"))))
+	reader = NewNetstringReader(strings.NewReader(reEncodeNetstring("58:0 " +reEncodeNetstring ("16:502 xyzwx*abcdef,") + reEncodeNetstring("50:5,") + reEncodeNetstring("24:25 1234567890*1234567890,,"))))
 	// first NS is fine
 	_, err = reader.ReadNext()
 	if err != nil {
@@ -231,6 +313,111 @@ func TestBadInput(t *testing.T) {
 	}
 }
 
+func TestBadTerminator(t *testing.T) {
+	// the length is right but the comma is replaced by another byte
+	for _, str := range []string{"5:502 0;", "3:5020", "0:0 0,"} {
+		_, err := NewNetstring(strings.NewReader(reEncodeNetstring(str)))
+		if !errors.Is(err, ErrMissingComma) {
+			t.Log(str, "expected ErrMissingComma, instead got", err)
+			t.Fail()
+		}
+		_, err = NewInitNetstring(strings.NewReader(str))
+		if !errors.Is(err, ErrMissingComma) {
+			t.Log(str, "init, expected ErrMissingComma, instead got", err)
+			t.Fail()
+		}
+	}
+	_, err := NewNetstringReader(strings.NewReader(reEncodeNetstring("5:502 0."))).ReadNext()
+	if !errors.Is(err, ErrMissingComma) {
+		t.Log("Reader expected ErrMissingComma, instead got", err)
+		t.Fail()
+	}
+
+	// the command is missing or not a number
+	for _, str := range []string{"0:,", "2: 0,", "5:5x2 0,"} {
+		_, err = NewNetstring(strings.NewReader(reEncodeNetstring(str)))
+		if err == nil || errors.Is(err, ErrMissingComma) {
+			t.Log(str, "expected malformed command, instead got", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestInitWrongPacket(t *testing.T) {
+	// a MySQL COM_QUERY packet as sent by the client, no indicator byte
+	query := []byte{0x09, 0x00, 0x00, 0x00, 0x03, 's', 'e', 'l', 'e', 'c', 't', ' ', '1'}
+	reader := bufio.NewReader(bytes.NewReader(query))
+	_, err := NewInitNetstring(reader)
+	if !errors.Is(err, encoding.WRONGPACKET) {
+		t.Log("Expected WRONGPACKET, instead got", err)
+		t.Fail()
+	}
+	// the first byte must still be available for the MySQL decoder
+	b, err := reader.ReadByte()
+	if err != nil || b != query[0] {
+		t.Log("Expected first byte to be unread, instead got", b, err)
+		t.Fail()
+	}
+
+	ns, err := NewInitNetstring(strings.NewReader("5:502 0,"))
+	if err != nil {
+		t.Log("Unexpected error:", err.Error())
+		t.Fail()
+	} else if ns.Cmd != 502 {
+		t.Log("Command expected 502 instead got", ns.Cmd)
+		t.Fail()
+	}
+}
+
+func TestInitShortReads(t *testing.T) {
+	// the reader returns one byte at a time, the comma must still be read with its netstring
+	reader := iotest.OneByteReader(strings.NewReader("5:502 0,2:25,"))
+	for _, cmd := range []int{502, 25} {
+		ns, err := NewInitNetstring(reader)
+		if err != nil || ns.Cmd != cmd {
+			t.Fatal("Expected command", cmd, ", instead got", ns, err)
+		}
+	}
+
+	_, err := NewInitNetstring(strings.NewReader("99999999999999999999:0,"))
+	if err != ErrLengthTooLarge {
+		t.Log("Expected ErrLengthTooLarge, instead got", err)
+		t.Fail()
+	}
+}
+
+func TestNetstringBuffered(t *testing.T) {
+	nss := []*encoding.Packet{NewNetstringFrom(502, []byte("xyzwx*abcdef")), NewNetstringFrom(5, nil)}
+	var stream []byte
+	for _, ns := range nss {
+		stream = append(stream, ns.Serialized...)
+	}
+	// a MySQL packet after the netstrings
+	stream = append(stream, encoding.IndicatorMySQL, 0x01, 0x00, 0x00, 0x00, 0x0e)
+	reader := bufio.NewReader(bytes.NewReader(stream))
+	for _, expected := range nss {
+		ns, err := NewNetstringBuffered(reader)
+		if err != nil {
+			t.Fatal("Unexpected error:", err.Error())
+		}
+		if !bytes.Equal(ns.Serialized, expected.Serialized) {
+			t.Log("Serialized expected", string(expected.Serialized), "instead got", string(ns.Serialized))
+			t.Fail()
+		}
+	}
+	_, err := NewNetstringBuffered(reader)
+	if !errors.Is(err, encoding.WRONGPACKET) {
+		t.Log("Expected WRONGPACKET, instead got", err)
+		t.Fail()
+	}
+	// the indicator byte must still be available for the MySQL decoder
+	b, err := reader.ReadByte()
+	if err != nil || b != encoding.IndicatorMySQL {
+		t.Log("Expected the indicator byte to be unread, instead got", b, err)
+		t.Fail()
+	}
+}
+
 // per https://dave.cheney.net/2013/06/30/how-to-write-benchmarks-in-go, to avoid compiler optimizations
 var result *encoding.Packet
 
@@ -323,4 +510,154 @@ BenchmarkEncode-4      	  300000	      5160 ns/op
 BenchmarkEncodeOne-4   	 3000000	       548 ns/op
 BenchmarkDecode-4      	  500000	      2449 ns/op
 BenchmarkDecodeOne-4   	 5000000	       299 ns/op
-*/
\ No newline at end of file
+*/
+func TestReadMultiplePackets(t *testing.T) {
+	nss := []*encoding.Packet{NewNetstringFrom(502, []byte("xyzwx*abcdef")), NewNetstringFrom(5, []byte("")),
+		NewNetstringFrom(25, []byte("1234567890*1234567890"))}
+	last := NewNetstringFrom(8, []byte("commit"))
+	stream := append(NewNetstringEmbedded(nss).Serialized, last.Serialized...)
+
+	var reader encoding.Packaging = NewNetstringReader(bytes.NewReader(stream))
+	first, err := reader.ReadNext()
+	if err != nil {
+		t.Fatal("ReadNext:", err.Error())
+	}
+	if !reader.IsComposite() {
+		t.Log("Expected the first embedded netstring to be composite")
+		t.Fail()
+	}
+	read, err := reader.ReadMultiplePackets(first)
+	if err != nil {
+		t.Fatal("ReadMultiplePackets:", err.Error())
+	}
+	if len(read) != len(nss) {
+		t.Fatal("Expected", len(nss), "netstrings, instead got", len(read))
+	}
+	for i := range read {
+		if !bytes.Equal(read[i].Serialized, nss[i].Serialized) {
+			t.Log("Expected", string(nss[i].Serialized), "instead got", string(read[i].Serialized))
+			t.Fail()
+		}
+	}
+	if reader.IsComposite() {
+		t.Log("Unexpected composite after reading all the embedded netstrings")
+		t.Fail()
+	}
+
+	ns, err := reader.ReadNext()
+	if err != nil || ns.Cmd != last.Cmd {
+		t.Fatal("Expected the netstring after the composite, instead got", ns, err)
+	}
+	read, err = reader.ReadMultiplePackets(ns)
+	if err != nil || len(read) != 1 || reader.IsComposite() {
+		t.Log("Expected a single netstring, instead got", len(read), err)
+		t.Fail()
+	}
+}
+
+func TestEncodeEmbedded(t *testing.T) {
+	nss := []*encoding.Packet{NewNetstringFrom(502, []byte("abc")), NewNetstringFrom(5, nil), NewNetstringFrom(25, []byte("1234567890?"))}
+	var buf bytes.Buffer
+	n, err := EncodeEmbedded(&buf, nss)
+	expected := NewNetstringEmbedded(nss).Serialized
+	if err != nil || n != len(expected) || !bytes.Equal(buf.Bytes(), expected) {
+		t.Log("Expected", string(expected), "instead got", n, buf.String(), err)
+		t.Fail()
+	}
+
+	// the stream can be read back
+	ns, err := NewNetstringReader(&buf).ReadNext()
+	if err != nil || ns.Cmd != 502 || string(ns.Payload) != "abc" {
+		t.Log("Unexpected first embedded netstring", ns, err)
+		t.Fail()
+	}
+}
+
+func TestNewNetstringFrom(t *testing.T) {
+	payloads := []string{"", "0", "abc", strings.Repeat("x", 9), strings.Repeat("x", 99), strings.Repeat("y", 12345)}
+	for _, cmd := range []int{0, 1, 9, 10, 25, 502, 1000000, -1, -17} {
+		for _, payload := range payloads {
+			var expected string
+			if len(payload) == 0 {
+				expected = fmt.Sprintf("%d:%d,", len(fmt.Sprintf("%d", cmd)), cmd)
+			} else {
+				expected = fmt.Sprintf("%d:%d %s,", len(payload)+len(fmt.Sprintf("%d", cmd))+1, cmd, payload)
+			}
+			ns := NewNetstringFrom(cmd, []byte(payload))
+			if string(ns.Serialized) != reEncodeNetstring(expected) || ns.Cmd != cmd || string(ns.Payload) != payload {
+				t.Log("Expected", expected, "instead got", ns.Cmd, string(ns.Serialized), string(ns.Payload))
+				t.Fail()
+				continue
+			}
+			// the payload points into the serialized bytes
+			if len(payload) > 0 && &ns.Payload[0] != &ns.Serialized[len(ns.Serialized)-1-len(payload)] {
+				t.Log("Expected the payload to be a sub-slice of Serialized for", cmd, len(payload))
+				t.Fail()
+			}
+		}
+	}
+}
+
+// fetchPage is a fetch response with many column values
+func fetchPage() []*encoding.Packet {
+	nss := make([]*encoding.Packet, 5000)
+	for i := range nss {
+		nss[i] = NewNetstringFrom(3 /*RcValue*/, []byte("2211 North First Street, San Jose"))
+	}
+	return nss
+}
+
+func BenchmarkNewNetstringEmbeddedPage(b *testing.B) {
+	nss := fetchPage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ioutil.Discard.Write(NewNetstringEmbedded(nss).Serialized)
+	}
+}
+
+func BenchmarkEncodeEmbeddedPage(b *testing.B) {
+	nss := fetchPage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeEmbedded(ioutil.Discard, nss)
+	}
+}
+
+// fuzzReads is the most netstrings read from one fuzz input
+const fuzzReads = 16
+
+// FuzzNewNetstring feeds arbitrary bytes to the netstring readers, as they arrive at once and one byte at a time.
+// They must return an error for a malformed input, never panic.
+func FuzzNewNetstring(f *testing.F) {
+	f.Add([]byte("5:0 abc,"))
+	f.Add(append([]byte{encoding.IndicatorNetstring}, []byte("5:0 abc,")...))
+	f.Add(NewNetstringEmbedded([]*encoding.Packet{NewNetstringFrom(25, []byte("abc")), NewNetstringFrom(7, nil)}).Serialized)
+	f.Add([]byte("99999999999999999999:0,"))
+	f.Add([]byte{encoding.IndicatorNetstring, '0', ':', ','})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, oneByte := range []bool{false, true} {
+			reader := func() io.Reader {
+				if oneByte {
+					return iotest.OneByteReader(bytes.NewReader(data))
+				}
+				return bytes.NewReader(data)
+			}
+			r := reader()
+			for i := 0; i < fuzzReads; i++ {
+				if _, err := NewInitNetstring(r); err != nil {
+					break
+				}
+			}
+			buffered := bufio.NewReader(reader())
+			for i := 0; i < fuzzReads; i++ {
+				ns, err := NewNetstringBuffered(buffered)
+				if err != nil {
+					break
+				}
+				if ns.IsComposite() {
+					SubNetstrings(ns)
+				}
+			}
+		}
+	})
+}
@@ -26,7 +26,8 @@ import (
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
 	"github.com/paypal/hera/utility/logger"
 	"github.com/paypal/hera/worker/shared"
 )
@@ -55,7 +56,7 @@ func (adapter *mysqlAdapter) InitDB() (*sql.DB, error) {
 	var err error
 	is_writable := false
 	for idx, curDs := range strings.Split(ds, "||") {
-		db, err = sql.Open("mysql", fmt.Sprintf("%s:%s@%s", user, pass, curDs))
+		db, err = sql.Open("mysql", dataSourceName(fmt.Sprintf("%s:%s@%s", user, pass, curDs)))
 		if err != nil {
 			if logger.GetLogger().V(logger.Warning) {
 				logger.GetLogger().Log(logger.Warning, user+" failed to connect to "+curDs+fmt.Sprintf(" %d", idx))
@@ -81,6 +82,25 @@ func (adapter *mysqlAdapter) InitDB() (*sql.DB, error) {
 	return db, err
 }
 
+// dataSourceName returns the data source name dsn without clientFoundRows. The affected rows reported to the
+// MySQL clients are the ones counted by the worker connection, and Hera doesn't announce CLIENT_FOUND_ROWS: with
+// clientFoundRows the worker would count the matched rows instead of the changed rows, and INSERT ... ON
+// DUPLICATE KEY UPDATE would report 1 instead of 0 when the existing row is left unchanged. Without it, like
+// for a MySQL client without CLIENT_FOUND_ROWS, an upsert reports 1 for an inserted row, 2 for an updated row
+// and 0 for an unchanged row.
+func dataSourceName(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil || !cfg.ClientFoundRows {
+		// sql.Open reports the error
+		return dsn
+	}
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "ignoring clientFoundRows in mysql_datasource")
+	}
+	cfg.ClientFoundRows = false
+	return cfg.FormatDSN()
+}
+
 // Checking master status
 func (adapter *mysqlAdapter) Heartbeat(db *sql.DB) bool {
 	ctx, _ /*cancel*/ := context.WithTimeout(context.Background(), 10*time.Second)
@@ -138,6 +158,12 @@ func (adapter *mysqlAdapter) UseBindNames() bool {
 	return false
 }
 
+// BindParamValue converts the parameter with the conversions of the binary protocol, go-sql-driver/mysql
+// sending the values back with the same types
+func (adapter *mysqlAdapter) BindParamValue(mysqlType byte, unsigned bool, raw []byte) (interface{}, error) {
+	return mysqlpackets.BinaryParamValue(mysqlType, unsigned, raw)
+}
+
 /**
  * @TODO infra.hera.jdbc.HeraResultSetMetaData mysql type to java type map.
  */
@@ -203,6 +229,12 @@ func (adapter *mysqlAdapter) ProcessError(errToProcess error, workerScope *share
 	}
 }
 
+// ProcessMySQLResult returns the value unchanged, the MySQL clients get the database format. The DECIMAL
+// values are written with the scale of the column by the row encoders.
+func (adapter *mysqlAdapter) ProcessMySQLResult(colType string, res string) string {
+	return res
+}
+
 func (adapter *mysqlAdapter) ProcessResult(colType string, res string) string {
 	switch colType {
 	case "DATE":
@@ -214,6 +246,10 @@ func (adapter *mysqlAdapter) ProcessResult(colType string, res string) string {
 		fmt.Sscanf(res, "%d-%d-%d %d:%d:%d", &year, &month, &day, &hour, &min, &sec)
 		return fmt.Sprintf("%02d-%02d-%d %02d:%02d:%02d.000", day, month, year, hour, min, sec)
 	default:
+		// DECIMAL(M,D) keeps its D digits, e.g. 1.50, whatever the driver stringifies
+		if _, scale, ok := mysqlpackets.DecimalSize(colType); ok {
+			return mysqlpackets.FormatDecimal(res, scale)
+		}
 		return res
 	}
 }
@@ -18,9 +18,14 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"log"
 	"regexp"
 	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
 )
 
 func TestExtractAndReplaceBindVar(t *testing.T) {
@@ -46,3 +51,59 @@ func TestExtractAndReplaceBindVar(t *testing.T) {
 	}
 	log.Println(re.ReplaceAllString(query, "?$1"))
 }
+
+func TestProcessResultDecimal(t *testing.T) {
+	adapter := &mysqlAdapter{}
+	tests := []struct {
+		colType  string
+		res      string
+		expected string
+	}{
+		{"DECIMAL(10,2)", "1.5", "1.50"},
+		{"DECIMAL(10,2)", "1.50", "1.50"},
+		{"DECIMAL(10,2) UNSIGNED", "3", "3.00"},
+		{"DECIMAL", "1.5", "1.5"},
+		{"VARCHAR", "1.5", "1.5"},
+		{"DATE", "2019-04-01", "01-04-2019 00:00:00.000"},
+	}
+	for _, test := range tests {
+		if str := adapter.ProcessResult(test.colType, test.res); str != test.expected {
+			t.Error("ProcessResult", test.colType, test.res, "expected", test.expected, "instead got", str)
+		}
+	}
+}
+
+func TestProcessMySQLResultDate(t *testing.T) {
+	adapter := &mysqlAdapter{}
+	colTypes := []string{"DATE"}
+	values := []sql.NullString{{String: "2024-01-02", Valid: true}}
+
+	// the text row is the length encoded value in the database format
+	row := mysqlpackets.TextResultsetRow(colTypes, values, adapter.ProcessMySQLResult)
+	if expected := append([]byte{10}, "2024-01-02"...); !bytes.Equal(row, expected) {
+		t.Error("Expected the text row", expected, "instead got", row)
+	}
+
+	// the binary row is the header, the NULL bitmap and the date: length 4, year 2024, month 1, day 2
+	row = mysqlpackets.BinaryResultsetRow(colTypes, values, adapter.ProcessMySQLResult)
+	if expected := []byte{0x00, 0x00, 4, 0xe8, 0x07, 1, 2}; !bytes.Equal(row, expected) {
+		t.Error("Expected the binary row", expected, "instead got", row)
+	}
+}
+
+func TestDataSourceNameFoundRows(t *testing.T) {
+	// the worker counts the changed rows, the upserts leaving the row unchanged report 0 affected rows
+	cfg, err := mysql.ParseDSN(dataSourceName("user:pass@tcp(127.0.0.1:3306)/myschema?timeout=9s&clientFoundRows=true"))
+	if err != nil {
+		t.Fatal("ParseDSN:", err.Error())
+	}
+	if cfg.ClientFoundRows || cfg.Timeout.Seconds() != 9 || cfg.DBName != "myschema" || cfg.User != "user" || cfg.Addr != "127.0.0.1:3306" {
+		t.Error("Expected the data source without clientFoundRows, instead got", cfg)
+	}
+
+	for _, dsn := range []string{"user:pass@tcp(127.0.0.1:3306)/myschema?timeout=9s", "not a dsn"} {
+		if str := dataSourceName(dsn); str != dsn {
+			t.Error("Expected", dsn, "unchanged, instead got", str)
+		}
+	}
+}
@@ -23,10 +23,12 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
-	_ "gopkg.in/goracle.v2"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
 	"github.com/paypal/hera/utility/logger"
 	"github.com/paypal/hera/worker/shared"
+	_ "gopkg.in/goracle.v2"
 )
 
 type oracleAdapter struct {
@@ -105,3 +107,32 @@ func (adapter *oracleAdapter) ProcessResult(colType string, res string) string {
 		return res
 	}
 }
+
+// ProcessMySQLResult returns the value unchanged, the dates in the RFC 3339 format of the driver are
+// converted by the binary row encoder
+func (adapter *oracleAdapter) ProcessMySQLResult(colType string, res string) string {
+	return res
+}
+
+// BindParamValue converts the parameter with the conversions of the binary protocol, except for the dates, see
+// oracleDate
+func (adapter *oracleAdapter) BindParamValue(mysqlType byte, unsigned bool, raw []byte) (interface{}, error) {
+	value, err := mysqlpackets.BinaryParamValue(mysqlType, unsigned, raw)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := value.(time.Time); ok {
+		return oracleDate(t), nil
+	}
+	return value, nil
+}
+
+// oracleDate converts a MySQL DATE, DATETIME or TIMESTAMP parameter to the value goracle binds as an Oracle DATE
+// or TIMESTAMP. The MySQL values have no time zone, they are bound with the same wall clock in the local time zone,
+// which goracle doesn't convert. Oracle has no zero date, 0000-00-00 is bound as NULL.
+func oracleDate(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
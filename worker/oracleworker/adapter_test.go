@@ -0,0 +1,49 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBindParamValueDates(t *testing.T) {
+	adapter := &oracleAdapter{}
+	// DATETIME 2019-04-01 12:30:05 in the binary protocol
+	value, err := adapter.BindParamValue(0x0c, false, []byte{7, 0xe3, 0x07, 4, 1, 12, 30, 5})
+	if err != nil {
+		t.Fatal("BindParamValue:", err.Error())
+	}
+	expected := time.Date(2019, time.April, 1, 12, 30, 5, 0, time.Local)
+	if d, ok := value.(time.Time); !ok || !d.Equal(expected) || d.Location() != time.Local {
+		t.Error("Expected", expected, "instead got", value)
+	}
+
+	// the zero date
+	if value, err = adapter.BindParamValue(0x0a, false, []byte{0}); err != nil || value != nil {
+		t.Error("Expected NULL for the zero date, instead got", value, err)
+	}
+
+	// the other types have the conversions of the binary protocol
+	if value, err = adapter.BindParamValue(0x08, false, []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}); err != nil || value != int64(-2) {
+		t.Error("Expected -2, instead got", value, err)
+	}
+	if _, err = adapter.BindParamValue(0x0c, false, []byte{7, 0xe3}); err == nil {
+		t.Error("Expected an error for a malformed date")
+	}
+}
@@ -21,15 +21,18 @@ package shared
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/paypal/hera/utility/encoding"
 	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/paypal/hera/cal"
@@ -51,7 +54,12 @@ type CmdProcessorAdapter interface {
 	ProcessError(errToProcess error, workerScope *WorkerScopeType, queryScope *QueryScopeType)
 	// ProcessResult is used for date related types to translate between the database format to the mux format
 	ProcessResult(colType string, res string) string
+	// ProcessMySQLResult translates a value of the MySQL protocol result rows. The MySQL clients expect the database
+	// format, the dates in particular are not in the mux format of ProcessResult
+	ProcessMySQLResult(colType string, res string) string
 	UseBindNames() bool
+	// BindParamValue converts a parameter of COM_STMT_EXECUTE, with its MySQL type, to the value passed to the driver
+	BindParamValue(mysqlType byte, unsigned bool, raw []byte) (interface{}, error)
 }
 
 // bindType defines types of bind variables
@@ -64,6 +72,27 @@ const (
 	btOut
 )
 
+func (bt bindType) String() string {
+	switch bt {
+	case btIn:
+		return "in"
+	case btOut:
+		return "out"
+	}
+	return "unknown"
+}
+
+// BindState describes a bind variable of the current statement, for diagnostics. The value itself is
+// not included since it can hold sensitive data
+type BindState struct {
+	Name     string
+	Position int
+	Type     string // "in", "out" or "unknown" if the client didn't bind it yet
+	DataType common.DataType
+	Valid    bool // whether the client has passed in a value
+	MaxSize  int  // the maximum size of an out bind value, 0 if the client didn't tell
+}
+
 // BindValue is a placeholder for a bind value, with index tracking its position in the query.
 type BindValue struct {
 	index int
@@ -79,17 +108,24 @@ type BindValue struct {
 	btype bindType
 	// the data type
 	dataType common.DataType
+	// the maximum size of an out bind value, 0 if the client didn't tell
+	maxSize int
 }
 
 // CmdProcessor holds the data needed to process the client commmands
 type CmdProcessor struct {
-	ctx context.Context
+	// the context of the session, the database calls are made with. It is canceled when the mux recovers
+	// the worker, usually because the client went away, aborting the running query.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// guards cancel, which is called from the goroutine waiting for signals
+	sessionMu sync.Mutex
 	// adapter for various databases
 	adapter CmdProcessorAdapter
 	//
-	// socket to mux
+	// socket to mux, the file of the socket except in tests which collect the responses
 	//
-	SocketOut *os.File
+	SocketOut io.Writer
 	//
 	// db instance.
 	//
@@ -108,9 +144,41 @@ type CmdProcessor struct {
 	hasResult bool
 	// tells if the current connection is in transaction. it becomes true if a DML ran successfull
 	inTrans bool
+	// tells if the transaction was started by a MySQL client with START TRANSACTION READ ONLY
+	readOnlyTrans bool
 	// tells if the current connection has an open cursor
 	inCursor bool
 	//
+	// start a transaction for the first DML, instead of running it in autocommit. on by default
+	// for netstring clients. MySQL clients expect autocommit, so by default they get a transaction
+	// only with an explicit BEGIN
+	//
+	implicitTrans      bool
+	implicitTransMySQL bool
+	//
+	// the maximum number of columns of a result set, the bigger results are rejected instead of
+	// being fetched. 0 means no limit
+	//
+	maxColumns int
+	// the maximum length of the SQL of a prepare, 0 for no limit
+	maxSQLLength int
+	// query the warnings count after a MySQL statement, to report it in the OK packet
+	countWarnings bool
+	// the MySQL statements running longer are reported to the client with SERVER_QUERY_WAS_SLOW, 0 to
+	// never report them
+	slowQueryThreshold time.Duration
+	// tells if the last MySQL statement exceeded slowQueryThreshold
+	querySlow bool
+	// the number of shards, returned to CmdGetNumShards
+	numShards int
+	// the shard id set by the client with CmdSetShardID, -1 if none
+	shardID int
+	// the payload of the last CmdShardKey
+	shardKey string
+	// the sequence id of the next packet of the response to the current MySQL command, every packet of
+	// the response takes the next one
+	sqid int
+	//
 	// all bindvar for the query after parsing.
 	// using map with name key instead of array with position index for faster matching
 	// when processing CmdBindName/Value since some queres can set hundreds of bindvar.
@@ -128,12 +196,27 @@ type CmdProcessor struct {
 	//
 
 	stmts map[int]*sql.Stmt 				// each stmt is given a stmtid to identify it by. this map contains the mappings
-	currsid int // current available stmt.id
-
-	stmtParams map[*sql.Stmt]int			// each stmt has a numParams required to execute or query the db. this map records the number for each stmt
-
-	numColumns int				// number of columns specified in query
+	currsid int // current available stmt.id, the same id is sent to the client in COM_STMT_PREPARE_OK
+
+	stmtParams map[int]int			// each stmt has a numParams required to execute or query the db. this map records the number for each stmtid
+	stmtLRU *list.List			// the stmtids in order of use, the most recently used first
+	stmtElems map[int]*list.Element		// the element of each stmtid in stmtLRU
+	maxStmts int				// beyond this number of stmts the least recently used is closed, 0 for no limit
+	colDefs map[int]*columnDefs		// the column definitions of the result set of each stmtid, built by its first execute
+	stmtBinds map[int]*paramBind		// the parameters of the last execute of each stmtid, for the executes without the new params flag
+	stmtCalls map[int]string		// the procedure called by each stmtid which is a CALL, its result sets end with an OK packet
+	stmtColumns map[int][]string		// the original names of the select list of each stmtid, from common.SelectColumns
+	stmtResults map[int]bool		// tells if each stmtid returns a result set, like hasResult for the current SQL
+
+	numParams int				// number of parameters of the query, its "?" placeholders
+	cursorType int				// cursor flags of the last COM_STMT_EXECUTE, mysqlpackets.CURSOR_TYPE_*
+	cursorStmt int				// stmtid whose rows are open for COM_STMT_FETCH, 0 for none
+	cursors map[int][][]byte		// the binary rows left in the cursor of each stmtid whose rows were read by parkCursor
+	schema string				// schema chosen by COM_INIT_DB, USE or COM_CHANGE_USER, the worker stays with the client while set
+	defaultSchema sql.NullString		// schema the connection was opened with, put back by restoreSchema
 	packager *mysqlpackets.Packager // in charge of writing packets
+	capabilities uint32 // capability flags negotiated with the MySQL client
+	counters *cmdCounters // the counters of the MySQL commands processed, returned by Stats
 	//
 	// hera protocol let client sends bindname in one ns command and bindvalue for the
 	// bindname in the very next ns command. this parameter is used to track which
@@ -149,6 +232,10 @@ type CmdProcessor struct {
 	//
 	result sql.Result
 	//
+	// the query returned sql.ErrNoRows instead of rows, the client gets an empty result set
+	//
+	noRows bool
+	//
 	//
 	//
 	sqlParser     common.SQLParser
@@ -161,6 +248,8 @@ type CmdProcessor struct {
 	calExecTxn cal.Transaction
 	// last error
 	lastErr error
+	// a bind name not in the query, reported to the client by the execute
+	bindErr error
 	// the FNV hash of the SQL, for logging
 	sqlHash uint32
 	// the name of the cal TXN
@@ -168,7 +257,7 @@ type CmdProcessor struct {
 	heartbeat         bool
 	// counter for requests, acting like ID
 	rqId uint16
-	// used in eor() to send the right code
+	// used in eor() to send the right code, nil means no more requests
 	moreIncomingRequests func() bool
 	queryScope           QueryScopeType
 	WorkerScope          WorkerScopeType
@@ -182,6 +271,72 @@ type WorkerScopeType struct {
 	Child_shutdown_flag bool
 }
 
+// DefaultMaxColumns is the default limit of columns in a result set, the maximum number of columns of a
+// MySQL table
+const DefaultMaxColumns = 4096
+
+// ErrTooManyColumns is returned fetching a result set with more than the configured maximum number of columns
+var ErrTooManyColumns = errors.New("Too many columns")
+
+// DefaultMaxSQLLength is the default limit of the length of the SQL of a prepare
+const DefaultMaxSQLLength = 1024 * 1024
+
+// ErrSQLTooLong is returned preparing a SQL longer than the configured maximum length
+var ErrSQLTooLong = errors.New("SQL too long")
+
+// DefaultMaxStmts is the default limit of prepared statements a worker keeps open for a MySQL client
+const DefaultMaxStmts = 1024
+
+// ErrNoParamsBound is returned executing a statement without the new params flag before any execute of the
+// statement bound the parameter types
+var ErrNoParamsBound = errors.New("No parameters bound by a previous execute")
+
+// paramBind is the parameter set of the last execute of a statement
+type paramBind struct {
+	types []byte // two bytes per parameter, the type and the flags
+	args  []interface{}
+}
+
+// columnDefs are the column definition payloads of the result set of a statement, with the names and the database
+// types of the columns they were built for
+type columnDefs struct {
+	names    []string
+	types    []string
+	payloads [][]byte
+}
+
+// newColumnDefs returns the definitions of the columns cts, of the payloads built for them
+func newColumnDefs(cts []*sql.ColumnType, payloads [][]byte) *columnDefs {
+	defs := &columnDefs{names: make([]string, len(cts)), types: make([]string, len(cts)), payloads: payloads}
+	for i, ct := range cts {
+		defs.names[i] = ct.Name()
+		defs.types[i] = ct.DatabaseTypeName()
+	}
+	return defs
+}
+
+// describe tells if the definitions were built for columns of the same names and database types as cts
+func (defs *columnDefs) describe(cts []*sql.ColumnType) bool {
+	if len(cts) != len(defs.names) {
+		return false
+	}
+	for i, ct := range cts {
+		if ct.Name() != defs.names[i] || ct.DatabaseTypeName() != defs.types[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrBadShardID is returned to a CmdSetShardID with a shard id which is not -1 or a shard, the same
+// error as the mux
+var ErrBadShardID = errors.New("HERA-201: shard id out of range")
+
+// noMoreIncomingRequests is the moreIncomingRequests of a command processor not reading from the mux
+func noMoreIncomingRequests() bool {
+	return false
+}
+
 // NewCmdProcessor creates the processor using th egiven adapter
 func NewCmdProcessor(adapter CmdProcessorAdapter, sockMux *os.File) *CmdProcessor {
 	cs := os.Getenv("CAL_CLIENT_SESSION")
@@ -189,8 +344,19 @@ func NewCmdProcessor(adapter CmdProcessorAdapter, sockMux *os.File) *CmdProcesso
 		cs = "CLIENT_SESSION"
 	}
 	stmts := make(map[int]*sql.Stmt)
-
-	return &CmdProcessor{adapter: adapter, SocketOut: sockMux, calSessionTxnName: cs, stmts:stmts, heartbeat: true}
+	stmtParams := make(map[int]int)
+	stmtElems := make(map[int]*list.Element)
+	colDefs := make(map[int]*columnDefs)
+	stmtBinds := make(map[int]*paramBind)
+	stmtCalls := make(map[int]string)
+	stmtColumns := make(map[int][]string)
+	stmtResults := make(map[int]bool)
+	cursors := make(map[int][][]byte)
+
+	// statement ids start at 1, like in MySQL
+	return &CmdProcessor{adapter: adapter, SocketOut: sockMux, calSessionTxnName: cs, stmts:stmts, stmtParams: stmtParams, stmtLRU: list.New(), stmtElems: stmtElems, colDefs: colDefs, stmtBinds: stmtBinds, stmtCalls: stmtCalls, stmtColumns: stmtColumns, stmtResults: stmtResults, cursors: cursors, maxStmts: DefaultMaxStmts, currsid: 1,
+		counters: &cmdCounters{}, capabilities: uint32(mysqlpackets.CLIENT_PROTOCOL_41), implicitTrans: true, maxColumns: DefaultMaxColumns, maxSQLLength: DefaultMaxSQLLength, heartbeat: true,
+		numShards: 1, shardID: -1, moreIncomingRequests: noMoreIncomingRequests}
 }
 
 // TODO: Needs MySQL integration
@@ -207,41 +373,90 @@ func (cp *CmdProcessor) ProcessCmd(ns *encoding.Packet) error {
 	cp.queryScope.NsCmd = fmt.Sprintf("%d", ns.Cmd)
 	if ns.IsMySQL {
 			logger.GetLogger().Log(logger.Info, "IsMySQL=", ns.IsMySQL, ", received packet with command:", common.SQLcmds[ns.Cmd])
+			if mysqlpackets.TraceEnabled() {
+				logger.GetLogger().Log(logger.Info, "trace in:", mysqlpackets.Trace(ns))
+			}
+			cp.querySlow = false
+			cp.sqid = ns.Sqid + 1
+			// the result of the previous command was already sent
+			cp.result = nil
+			cp.noRows = false
+			start := time.Now()
 			// otherloop:
 			switch ns.Cmd {
 			case common.COM_QUERY:
 				logger.GetLogger().Log(logger.Info, "common.COM_QUERY")
-				/* Right now this is only good for simple queries that don't ask for anything aside from an OK packet.
-				* Reason being that COM_QUERY_RESPONSE packets fall into several categories. OK, ERR, or a series of packets
-				* that include ColumnDefinition packets. We currently have no good way of honest replication of
-				* ColumnDefinition.
-				 */
+				cp.parkCursor()
+				// The response is an OK or ERR packet, or the rows of a SELECT in a text resultset
 				if logger.GetLogger().V(logger.Debug) {
 					logger.GetLogger().Log(logger.Debug, "Executing ", cp.inTrans)
 				}
 
 				// Get the query from the payload
 				sqlQuery := cp.preprocess(ns)
+				if rejected, rerr := cp.emptyQuery(ns, sqlQuery); rejected {
+					err = rerr
+					break
+				}
+
+				if rejected, rerr := cp.loadDataLocal(sqlQuery); rejected {
+					err = rerr
+					break
+				}
+
+				// COMMIT and ROLLBACK end the transaction the worker holds
+				if commit, ok := endTransStatement(sqlQuery); ok {
+					err = cp.mysqlEndTrans(ns, commit)
+					break
+				}
+				if readOnly, ok := beginTransStatement(sqlQuery); ok {
+					err = cp.mysqlBeginTrans(ns, readOnly)
+					break
+				}
+				// like COM_INIT_DB, USE changes the schema the worker is kept for
+				if schema, ok := useStatement(sqlQuery); ok {
+					err = cp.mysqlUseSchema(ns, schema)
+					break
+				}
+
+				//
+				// start a new transaction for the first dml request, if configured.
+				//
+				var startTrans bool
+				cp.hasResult, startTrans = cp.sqlParser.Parse(sqlQuery)
+				if rejected, rerr := cp.readOnlyViolation(ns); rejected {
+					err = rerr
+					break
+				}
+				if (cp.tx == nil) && (startTrans) && cp.implicitTransMySQL {
+					cp.tx, err = cp.db.BeginTx(cp.ctx, nil)
+				}
 
 				// If the sqlQuery contains a select, use Query -- otherwise use Exec
-				if cp.hasResult {
-					cp.rows, err = cp.db.Query(sqlQuery)
-				} else {
-					cp.result, err = cp.db.Exec(sqlQuery)
+				if err == nil {
+					start := time.Now()
+					if cp.tx != nil {
+						if cp.hasResult {
+							cp.rows, err = cp.tx.QueryContext(cp.ctx, sqlQuery)
+						} else {
+							cp.result, err = cp.tx.ExecContext(cp.ctx, sqlQuery)
+						}
+					} else {
+						if cp.hasResult {
+							cp.rows, err = cp.db.QueryContext(cp.ctx, sqlQuery)
+						} else {
+							cp.result, err = cp.db.ExecContext(cp.ctx, sqlQuery)
+						}
+					}
+					cp.checkSlowQuery(start)
 					logger.GetLogger().Log(logger.Debug, "cp.result", cp.result != nil)
+					err = cp.checkNoRows(err)
 				}
 
 				if err != nil {
 					cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
 					cp.calExecErr("RC", err.Error())
-					if logger.GetLogger().V(logger.Warning) {
-						logger.GetLogger().Log(logger.Warning, "Execute error:", err.Error())
-					}
-					if cp.inTrans {
-						cp.eor(common.EORInTransaction, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
-					} else {
-						cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
-					}
+					cp.sendExecResult(nil, err)
 					cp.lastErr = err
 					err = nil
 					break
@@ -251,57 +466,35 @@ func (cp *CmdProcessor) ProcessCmd(ns *encoding.Packet) error {
 					cp.inTrans = true
 				}
 
-				if cp.result != nil {
-					logger.GetLogger().Log(logger.Debug, "cp.result != nil case")
-					var rowcnt int64
-					rowcnt, err = cp.result.RowsAffected()
-					logger.GetLogger().Log(logger.Debug, "Got RowsAffected")
-					if err != nil {
-						if logger.GetLogger().V(logger.Debug) {
-							logger.GetLogger().Log(logger.Debug, "RowsAffected():", err.Error())
-						}
-						cp.calExecErr("RowsAffected", err.Error())
-						break
-					}
-					if logger.GetLogger().V(logger.Debug) {
-						logger.GetLogger().Log(logger.Debug, "exe row", rowcnt)
-					}
-
-					// Get the last insert id from the sql.Result
-					var liid int64
-					liid, err = cp.result.LastInsertId()
-					logger.GetLogger().Log(logger.Debug, "Got LastInsertID")
-					if err != nil {
-						if logger.GetLogger().V(logger.Debug) {
-							logger.GetLogger().Log(logger.Debug, "LastInsertId():", err.Error())
-						}
-						cp.calExecErr("LastInsertId", err.Error())
-						break
-					}
-					if logger.GetLogger().V(logger.Debug) {
-						logger.GetLogger().Log(logger.Debug, "exe LastInsertId", rowcnt)
-					}
-					logger.GetLogger().Log(logger.Debug, "Making new SQL packet, prev sqid", ns.Sqid)
-					// Set an OK packet reporting the number of rows affected and last insert id. I don't know what to put for the message though...
-					np := mysqlpackets.NewMySQLPacketFrom(ns.Sqid + 1, mysqlpackets.OKPacket(int(rowcnt), int(liid), uint32(mysqlpackets.CLIENT_PROTOCOL_41),"This packet has to be over 7 bytes."))
-					logger.GetLogger().Log(logger.Debug, "Wrote with serialized, sqid", np.Serialized, np.Sqid)
-					// Send OK packet.
-					err = cp.eor(common.EORFree, np)
-
+				// Without the column definitions, which come with the rows, the empty result set is sent
+				// as an OK packet
+				if cp.noRows {
+					np := cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), cp.warningCount(), cp.capabilities, ""))
+					err = cp.respond(np)
+					break
+				}
 
+				if cp.rows != nil {
+					err = cp.sendTextResultset(sqlQuery)
+					break
 				}
+				err = cp.sendExecResult(cp.result, nil)
 			case common.COM_STMT_PREPARE:
-				// TODO: The server always sends back a COM_STMT_PREPARE_RESPONSE to a prepared stmt command.
-				// This requires Protocol::ColumnDefinition packets, which as of right now have not been implemented.
-				//
-
-				// WORK IN PROGRESS.
+				cp.parkCursor()
 				cp.queryScope = QueryScopeType{}
 				cp.lastErr = nil
 				cp.sqlHash = 0
 				cp.heartbeat = false // for hb
 
 				sqlQuery := cp.preprocess(ns)
+				if rejected, rerr := cp.emptyQuery(ns, sqlQuery); rejected {
+					err = rerr
+					break
+				}
+				if rejected, rerr := cp.sqlTooLong(ns, sqlQuery); rejected {
+					err = rerr
+					break
+				}
 
 				if logger.GetLogger().V(logger.Verbose) {
 					logger.GetLogger().Log(logger.Verbose, "Preparing:", sqlQuery)
@@ -312,66 +505,59 @@ func (cp *CmdProcessor) ProcessCmd(ns *encoding.Packet) error {
 				//
 				var startTrans bool
 				cp.hasResult, startTrans = cp.sqlParser.Parse(sqlQuery)
+				// the result sets of a stored procedure are read like the rows of a select
+				procedure := calledProcedure(sqlQuery)
+				if procedure != "" {
+					cp.hasResult = true
+				}
 				if cp.calSessionTxn == nil {
 					cp.calSessionTxn = cal.NewCalTransaction(cal.TransTypeAPI, cp.calSessionTxnName, cal.TransOK, "", cal.DefaultTGName)
 				}
 				cp.sqlHash = utility.GetSQLHash(string(ns.Payload))
 				cp.queryScope.SqlHash = fmt.Sprintf("%d", cp.sqlHash)
 				cp.calExecTxn = cal.NewCalTransaction(cal.TransTypeExec, fmt.Sprintf("%d", cp.sqlHash), cal.TransOK, "", cal.DefaultTGName)
-				if (cp.tx == nil) && (startTrans) {
-					cp.tx, err = cp.db.Begin()
+				if (cp.tx == nil) && (startTrans) && cp.implicitTransMySQL {
+					cp.tx, err = cp.db.BeginTx(cp.ctx, nil)
 				}
 
 				if cp.tx != nil {
-					cp.stmt, err = cp.tx.Prepare(sqlQuery)
+					cp.stmt, err = cp.tx.PrepareContext(cp.ctx, sqlQuery)
 				} else {
-					cp.stmt, err = cp.db.Prepare(sqlQuery)
+					cp.stmt, err = cp.db.PrepareContext(cp.ctx, sqlQuery)
+				}
+				if err == nil {
+					cp.addStmt(cp.currsid, cp.stmt, cp.numParams)
+					if procedure != "" {
+						cp.stmtCalls[cp.currsid] = procedure
+					}
+					cp.stmtColumns[cp.currsid] = common.SelectColumns(sqlQuery)
+					cp.stmtResults[cp.currsid] = cp.hasResult
 				}
-				cp.stmts[cp.currsid] = cp.stmt
-				cp.stmtParams[cp.stmt] = len(cp.bindVars)
-
 
+				// a statement which failed to prepare doesn't get an id
 				if err != nil {
 					cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
 					cp.calExecErr("Prepare", err.Error())
 					cp.lastErr = err
-					err = nil
-				}
-
-				// This is the part we need to send out a COM_STMT_PREPARE_OK packet. Which requires
-				// column definition packets, which... means we need to figure out how to reconstruct
-				// this guy.
-
-				// Write the COM_STMT_PREPARE_OK prologue packets.
-				prepareOK := mysqlpackets.NewMySQLPacketFrom(ns.Sqid + 1, mysqlpackets.StmtPrepareOK(cp.currsid, cp.numColumns, len(cp.bindVars)))
-				// write prepareOK to conn
-				cp.eor(common.EORFree, prepareOK)
-
-				// Write column definitions to conn for each parameter and each column.
-				// BIG PROBLEM: ColumnTypes can only be obtained from the go-sql-driver AFTER executing the query.
-				for i := 0; i < len(cp.bindVars); i++ {
-					// TODO: Send column definition for each parameter.
-					// mysqlpackets.ColumnDefinition(...) in utility/encoding/mysqlpackets
-					// cp.eor(...)
-				}
-
-				if len(cp.bindVars) > 0 {
-					// TODO: Send EOF packet.
-					// mysqlpackets.EOFPacket(warnings, status_flags int, capabilities uint32)
+					err = cp.respond(cp.mysqlPacket(mysqlpackets.DriverERRPacket(cp.lastErr, cp.capabilities)))
+					break
 				}
 
-				for i := 0; i < cp.numColumns; i++ {
-					// TODO: Send column definition for each column.
-					// mysqlpackets.ColumnDefinition(...) in utility/encoding/mysqlpackets
-					// cp.eor(...)
+				// The COM_STMT_PREPARE_OK is followed by a definition of each parameter, whose type is only
+				// known from the execute, like with MySQL. The columns are not described: database/sql only
+				// gives their types with the rows, so the client takes them from the result set of the execute,
+				// as MySQL does for a CALL. With CLIENT_DEPRECATE_EOF the definitions are not followed by any
+				// packet, the OK packet replacing EOF (mysqlpackets.TerminatorPacket) only ends the rows of a
+				// result set.
+				resp := cp.appendPacket(nil, mysqlpackets.StmtPrepareOK(cp.currsid, 0, cp.numParams, cp.warningCount()))
+				for i := 0; i < cp.numParams; i++ {
+					resp = cp.appendPacket(resp, mysqlpackets.ParamDefinition(cp.capabilities))
 				}
-
-				if cp.numColumns > 0 {
-					// TODO: Send EOF packet.
-					// mysqlpackets.EOFPacket(warnings, status_flags int, capabilities uint32)
+				if cp.numParams > 0 && !mysqlpackets.Supports(cp.capabilities, mysqlpackets.CLIENT_DEPRECATE_EOF) {
+					resp = cp.appendPacket(resp, mysqlpackets.EOFPacket(0, cp.statusFlags(), cp.capabilities))
 				}
+				err = cp.eorResponse(cp.cursorEOR(), resp)
 
-				cp.rows = nil
 				cp.result = nil
 				cp.bindOuts = cp.bindOuts[:0]
 				cp.numBindOuts = 0
@@ -380,61 +566,66 @@ func (cp *CmdProcessor) ProcessCmd(ns *encoding.Packet) error {
 			case common.COM_STMT_EXECUTE:
 				// First read in the stmt-id and obtain it from the map of stmt-id to stmts.
 				pos := 1 // start at 1 to skip the command byte
-				stmtid := mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
-				cp.stmt = cp.stmts[stmtid]
-
-				// get numParams from stmtParams
-				numParams := cp.stmtParams[cp.stmt]
-				nullBitmap := []byte{}
-				paramTypes := []byte{}
-				values := []byte{}
-				var newParams bool
-				if numParams > 0 {
-					// get null_bitmap from com stmt execute packet
-					nullBitmap = mysqlpackets.ReadString(ns.Payload, mysqlpackets.VARSTR, &pos, (numParams + 7) / 8)
-					// also get the new_params_bind_flag which is 1 fixed len integer
-					if mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT1, &pos) == 1 {
-						newParams = true
+				stmtid := -1
+				if len(ns.Payload) >= pos+mysqlpackets.INT4 {
+					stmtid = mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
+				}
+				// like with MySQL, executing the statement again closes its cursor, the other cursors stay open
+				cp.closeCursor(stmtid)
+				cp.parkCursor()
+				cp.stmt = cp.useStmt(stmtid)
+				if cp.stmt == nil {
+					// never prepared, closed or evicted
+					np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_UNKNOWN_STMT_HANDLER,
+						fmt.Sprintf("Unknown prepared statement handler (%d) given to mysqld_stmt_execute", stmtid)))
+					err = cp.respond(np)
+					break
+				}
+
+				// other statements may have been prepared since this one
+				cp.hasResult = cp.stmtResults[stmtid]
+
+				// The rest of the packet is decoded with the number of parameters of the statement
+				numParams := cp.stmtParams[stmtid]
+				_, flags, iterations, nullBitmap, newParams, paramTypes, values, perr := mysqlpackets.DecodeExecutePacket(ns.Payload, numParams)
+				var args []interface{}
+				if perr == nil && numParams > 0 && iterations <= 1 {
+					args, paramTypes, perr = cp.bindParams(ns, stmtid, newParams, paramTypes, values)
+				}
+				if perr != nil {
+					if logger.GetLogger().V(logger.Warning) {
+						logger.GetLogger().Log(logger.Warning, "stmt execute", stmtid, "malformed packet:", perr.Error())
 					}
+					np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_MALFORMED_PACKET, perr.Error()))
+					err = cp.respond(np)
+					break
 				}
-				if newParams {
-					// get parameter types
-					paramTypes = mysqlpackets.ReadString(ns.Payload, mysqlpackets.VARSTR, &pos, numParams * 2)
-					// also get value of each parameter
-					values = mysqlpackets.ReadString(ns.Payload, mysqlpackets.EOFSTR, &pos, 0)
+				if logger.GetLogger().V(logger.Debug) {
+					logger.GetLogger().Log(logger.Debug, "stmt execute", stmtid, "null bitmap", nullBitmap, "param types", paramTypes)
+				}
+
+				// The iteration count is always 1 with the MySQL server. Drivers doing array binding send a
+				// bigger count followed by as many parameter sets, executed as a batch.
+				cp.cursorType = int(flags)
+				if iterations > 1 {
+					err = cp.executeBatch(ns, stmtid, iterations)
+					break
 				}
 
 				// Then use either Query or Exec to obtain results and/or rows.
 				if cp.stmt != nil {
+					start := time.Now()
 
-					if !newParams {
-						//
-						// @TODO: do we keep a flag for curent statement.
-						//
-						if cp.hasResult {
-							cp.rows, err = cp.stmt.Query()
-						} else {
-							cp.result, err = cp.stmt.Exec()
-						}
+					if cp.hasResult {
+						cp.rows, err = cp.stmt.QueryContext(cp.ctx, args...)
 					} else {
-						// Get the new bound parameters and send them in as arguments.
-						if cp.hasResult {
-							cp.rows, err = cp.stmt.Query(values)
-						} else {
-							cp.result, err = cp.stmt.Exec(values)
-						}
+						cp.result, err = cp.stmt.ExecContext(cp.ctx, args...)
 					}
+					cp.checkSlowQuery(start)
 					if err != nil {
 						cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
 						cp.calExecErr("RC", err.Error())
-						if logger.GetLogger().V(logger.Warning) {
-							logger.GetLogger().Log(logger.Warning, "Execute error:", err.Error())
-						}
-						if cp.inTrans {
-							cp.eor(common.EORInTransaction, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
-						} else {
-							cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
-						}
+						cp.sendExecResult(nil, err)
 						cp.lastErr = err
 						err = nil
 						break
@@ -443,107 +634,166 @@ func (cp *CmdProcessor) ProcessCmd(ns *encoding.Packet) error {
 						cp.inTrans = true
 					}
 
-					cp.calExecTxn.Completed()
-					cp.calExecTxn = nil
+					// the cal txn started by the prepare is completed by the first execute
+					if cp.calExecTxn != nil {
+						cp.calExecTxn.Completed()
+						cp.calExecTxn = nil
+					}
 
+					// with a read-only cursor the rows are sent by COM_STMT_FETCH
+					if cp.cursorType&mysqlpackets.CURSOR_TYPE_READ_ONLY != 0 && cp.rows != nil {
+						err = cp.openCursor(stmtid)
+						break
+					}
+					if cp.rows != nil {
+						err = cp.sendResultsets(stmtid)
+						break
+					}
+					err = cp.sendExecResult(cp.result, nil)
 				}
 
-				// Then use rows.Scan to obtain the column values for a returned result row.
-
-
-				// Package into COM_STMT_EXECUTE response with resultsets.
-
-				// Send to conn
-
 			case common.COM_STMT_FETCH:
 				// Fetches from an existing resultset.... dude
 				pos := 1 // Start past the command byte
+				if len(ns.Payload) < pos+2*mysqlpackets.INT4 {
+					np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_MALFORMED_PACKET, "Malformed COM_STMT_FETCH"))
+					err = cp.respond(np)
+					break
+				}
 				stmtid := mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
 				numRows := mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
 
 				// Fetch from existing resultset keyed in to an already executed statement
+				if logger.GetLogger().V(logger.Debug) {
+					logger.GetLogger().Log(logger.Debug, "stmt fetch", stmtid, "rows", numRows)
+				}
+				err = cp.fetchCursor(stmtid, numRows)
 
-			case common.COM_CREATE_DB, common.COM_DROP_DB, common.COM_INIT_DB:
-				pos := 1
-				schema_name := mysqlpackets.ReadString(ns.Payload, mysqlpackets.EOFSTR, &pos, 0)
+			case common.COM_CREATE_DB, common.COM_DROP_DB:
+				// the schema name is the rest of the packet
+				schema_name := string(ns.Payload[1:])
 				// Send this directly to the db as a query.
 				var query string
 				if ns.Cmd == common.COM_CREATE_DB {
-					query = fmt.Sprintf("CREATE DATABASE %s;", schema_name)
-				} else if ns.Cmd == common.COM_DROP_DB {
-					query = fmt.Sprintf("DROP DATABASE IF EXISTS %s;", schema_name)
+					query = "CREATE DATABASE " + quoteIdentifier(schema_name)
 				} else {
-					query = fmt.Sprintf("USE %s;", schema_name)
+					query = "DROP DATABASE IF EXISTS " + quoteIdentifier(schema_name)
 				}
-				cp.result, err = cp.db.Exec(query)
+				cp.result, err = cp.db.ExecContext(cp.ctx, query)
 				if err != nil {
 					logger.GetLogger().Log(logger.Debug, common.SQLcmds[ns.Cmd], "failure to act on DB: ", err.Error())
-					// Construct ERRPACKET.
-					np := mysqlpackets.NewMySQLPacketFrom(ns.Sqid + 1, mysqlpackets.ERRPacket(0/* */, "0"/* */ ))
-					logger.GetLogger().Log(logger.Debug, "Wrote with serialized, sqid", np.Serialized, np.Sqid)
-					// Send ERR packet.
-					err = cp.eor(common.EORFree, np)
-				}
-				if cp.result != nil {
-					logger.GetLogger().Log(logger.Debug, "cp.result != nil case")
-					var rowcnt int64
-					rowcnt, err = cp.result.RowsAffected()
-					logger.GetLogger().Log(logger.Debug, "Got RowsAffected")
-					if err != nil {
-						if logger.GetLogger().V(logger.Debug) {
-							logger.GetLogger().Log(logger.Debug, "RowsAffected():", err.Error())
-						}
-						cp.calExecErr("RowsAffected", err.Error())
-						break
-					}
-					if logger.GetLogger().V(logger.Debug) {
-						logger.GetLogger().Log(logger.Debug, "exe row", rowcnt)
-					}
-
-					// Get the last insert id from the sql.Result
-					var liid int64
-					liid, err = cp.result.LastInsertId()
-					logger.GetLogger().Log(logger.Debug, "Got LastInsertID")
-					if err != nil {
-						if logger.GetLogger().V(logger.Debug) {
-							logger.GetLogger().Log(logger.Debug, "LastInsertId():", err.Error())
-						}
-						cp.calExecErr("LastInsertId", err.Error())
-						break
-					}
-					if logger.GetLogger().V(logger.Debug) {
-						logger.GetLogger().Log(logger.Debug, "exe LastInsertId", rowcnt)
-					}
-					logger.GetLogger().Log(logger.Debug, "Making new SQL packet, prev sqid", ns.Sqid)
-					// Set an OK packet reporting the number of rows affected and last insert id. I don't know what to put for the message though...
-					np := mysqlpackets.NewMySQLPacketFrom(ns.Sqid + 1, mysqlpackets.OKPacket(int(rowcnt), int(liid), uint32(mysqlpackets.CLIENT_PROTOCOL_41),"This packet has to be over 7 bytes."))
-					logger.GetLogger().Log(logger.Debug, "Wrote with serialized, sqid", np.Serialized, np.Sqid)
-					// Send OK packet.
-					err = cp.eor(common.EORFree, np)
 				}
+				err = cp.sendExecResult(cp.result, err)
+
+			case common.COM_INIT_DB:
+				err = cp.mysqlUseSchema(ns, string(ns.Payload[1:]))
 
 			case common.COM_STMT_CLOSE:
 				// Read in the stmtid from the pakcet
 				pos := 1
-				stmtid := mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
-				// Close the statement
-				err := cp.stmts[stmtid].Close()
-				if err != nil {
-					// Other cal logging and eor stuff
-					logger.GetLogger().Log(logger.Warning, "Tried to close statement but got", err.Error())
+				if len(ns.Payload) < pos+mysqlpackets.INT4 {
+					// like MySQL, the malformed packet is ignored, the client doesn't wait for a response
+					if logger.GetLogger().V(logger.Warning) {
+						logger.GetLogger().Log(logger.Warning, "stmt close: malformed packet", ns.Payload)
+					}
+					break
 				}
-				// Also remove the current stmtid - sttmt mapping from the stmts map
-				delete(cp.stmts, stmtid)
+				stmtid := mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
+				// Close the statement and remove the stmtid - stmt mapping
+				cp.closeStmt(stmtid)
 
 				// No response is sent back to the client.
 
+			case common.COM_STMT_RESET:
+				// The long data is not supported, resetting the statement closes its cursor and forgets its
+				// column definitions
+				pos := 1
+				stmtid := -1
+				if len(ns.Payload) >= pos+mysqlpackets.INT4 {
+					stmtid = mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
+				}
+				var np *encoding.Packet
+				if _, ok := cp.stmts[stmtid]; !ok {
+					np = cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_UNKNOWN_STMT_HANDLER,
+						fmt.Sprintf("Unknown prepared statement handler (%d) given to mysqld_stmt_reset", stmtid)))
+				} else {
+					cp.closeCursor(stmtid)
+					delete(cp.colDefs, stmtid)
+					np = cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), 0, cp.capabilities, ""))
+				}
+				err = cp.respond(np)
+
 			case common.COM_STMT_SEND_LONG_DATA:
 				// pos := 1
 				// stmtid := mysqlpackets.ReadFixedLenInt(ns.Payload, mysqlpackets.INT4, &pos)
+
+			case common.COM_RESET_CONNECTION:
+				cp.resetSession()
+				np := cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), 0, cp.capabilities, ""))
+				err = cp.eor(common.EORFree, np)
+
+			case common.COM_CHANGE_USER:
+				// The handshake does not verify credentials, neither does the change of user: the new user is
+				// accepted and the session reset as for COM_RESET_CONNECTION.
+				cu, perr := mysqlpackets.ReadChangeUser(ns.Payload, cp.capabilities)
+				if perr != nil {
+					np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_MALFORMED_PACKET, perr.Error()))
+					err = cp.respond(np)
+					break
+				}
+				if logger.GetLogger().V(logger.Info) {
+					logger.GetLogger().Log(logger.Info, "COM_CHANGE_USER: user", cu.User, "schema", cu.Schema, "plugin", cu.AuthPlugin)
+				}
+				evt := cal.NewCalEvent("CHANGE_USER", cu.User, cal.TransOK, "")
+				evt.AddDataStr("schema", cu.Schema)
+				evt.Completed()
+				cp.resetSession()
+				if cu.Schema != "" {
+					res, uerr := cp.useSchema(cu.Schema)
+					err = cp.sendExecResult(res, uerr)
+					break
+				}
+				// like a new connection, the new user gets the schema the connection was opened with
+				if err = cp.restoreSchema(); err != nil {
+					break
+				}
+				np := cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), 0, cp.capabilities, ""))
+				err = cp.eor(common.EORFree, np)
+
+			case common.COM_REFRESH:
+				// The database is shared by all the workers, flushing it for one client is left to the DBAs.
+				// Only REFRESH_STATUS is honored, resetting the command counters of the worker, the other
+				// sub-commands are acknowledged without doing anything.
+				if len(ns.Payload) < 2 {
+					np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_MALFORMED_PACKET, "Malformed COM_REFRESH"))
+					err = cp.respond(np)
+					break
+				}
+				subCommand := int(ns.Payload[1])
+				if logger.GetLogger().V(logger.Info) {
+					logger.GetLogger().Log(logger.Info, "COM_REFRESH: sub-command", subCommand)
+				}
+				if subCommand&mysqlpackets.REFRESH_STATUS != 0 {
+					cp.counters.reset()
+				}
+				np := cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), 0, cp.capabilities, ""))
+				err = cp.respond(np)
+
+			case common.COM_DEBUG:
+				// MySQL dumps its debug info to the error log, we log the state of the worker instead
+				if logger.GetLogger().V(logger.Info) {
+					logger.GetLogger().Log(logger.Info, "COM_DEBUG: open statements", len(cp.stmts), "in transaction", cp.inTrans,
+						"read only", cp.readOnlyTrans, "last sql hash", cp.sqlHash, "binds", cp.DumpBindState())
+				}
+				np := cp.mysqlPacket(mysqlpackets.EOFPacket(0, cp.statusFlags(), cp.capabilities))
+				err = cp.respond(np)
 			}
+			cp.counters.command(ns, start, err)
 	} else {
 outloop:
 	switch ns.Cmd {
+	case common.CmdControlMsg:
+		cp.processControlMsg(ns.Payload)
 	case common.CmdClientCalCorrelationID:
 		logger.GetLogger().Log(logger.Verbose, "Got to CmdClientCalCorrelationID")
 		//
@@ -557,6 +807,16 @@ outloop:
 		cp.lastErr = nil
 		cp.sqlHash = 0
 		cp.heartbeat = false // for hb
+		// the error is returned by the execute, like when the prepare fails
+		cp.lastErr = cp.checkSQLLength(len(ns.Payload))
+		if cp.lastErr != nil {
+			cp.stmt = nil
+			cp.rows = nil
+			cp.result = nil
+			cp.noRows = false
+			cp.bindErr = nil
+			break
+		}
 		//
 		// need to turn "select * from table where ca=:a and cb=:b"
 		// to "select * from table where ca=? and cb=?"
@@ -579,13 +839,13 @@ outloop:
 		cp.sqlHash = utility.GetSQLHash(string(ns.Payload))
 		cp.queryScope.SqlHash = fmt.Sprintf("%d", cp.sqlHash)
 		cp.calExecTxn = cal.NewCalTransaction(cal.TransTypeExec, fmt.Sprintf("%d", cp.sqlHash), cal.TransOK, "", cal.DefaultTGName)
-		if (cp.tx == nil) && (startTrans) {
-			cp.tx, err = cp.db.Begin()
+		if (cp.tx == nil) && (startTrans) && cp.implicitTrans {
+			cp.tx, err = cp.db.BeginTx(cp.ctx, nil)
 		}
 		if cp.tx != nil {
-			cp.stmt, err = cp.tx.Prepare(sqlQuery)
+			cp.stmt, err = cp.tx.PrepareContext(cp.ctx, sqlQuery)
 		} else {
-			cp.stmt, err = cp.db.Prepare(sqlQuery)
+			cp.stmt, err = cp.db.PrepareContext(cp.ctx, sqlQuery)
 		}
 		if err != nil {
 			cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
@@ -595,6 +855,8 @@ outloop:
 		}
 		cp.rows = nil
 		cp.result = nil
+		cp.noRows = false
+		cp.bindErr = nil
 		cp.bindOuts = cp.bindOuts[:0]
 		cp.numBindOuts = 0
 	case common.CmdBindName, common.CmdBindOutName:
@@ -609,14 +871,7 @@ outloop:
 				cp.currentBindName = buffer.String()
 			}
 			if cp.bindVars[cp.currentBindName] == nil {
-				//
-				// @TODO a bindname not in the query.
-				//
-				if logger.GetLogger().V(logger.Warning) {
-					logger.GetLogger().Log(logger.Warning, "nonexisting bindname", cp.currentBindName)
-				}
-				err = fmt.Errorf("bindname not found in query: %s", cp.currentBindName)
-				cp.calExecErr("Bind error", cp.currentBindName)
+				cp.unknownBindName("Bind error")
 				break
 			}
 			if ns.Cmd == common.CmdBindName {
@@ -636,23 +891,46 @@ outloop:
 				cp.calExecErr("BindTypeConv", err.Error())
 				break
 			}
+			if cp.bindVars[cp.currentBindName] == nil {
+				cp.unknownBindName("BindTypeNF")
+				break
+			}
 			cp.bindVars[cp.currentBindName].dataType = common.DataType(btype)
 		}
+	case common.CmdBindValueMaxSize:
+		if cp.stmt != nil {
+			var size int
+			size, err = strconv.Atoi(string(ns.Payload))
+			if err != nil {
+				cp.calExecErr("BindValueMaxSizeConv", err.Error())
+				break
+			}
+			if cp.bindVars[cp.currentBindName] == nil {
+				cp.unknownBindName("BindValueMaxSizeNF")
+				break
+			}
+			cp.bindVars[cp.currentBindName].maxSize = size
+		}
 	case common.CmdBindValue:
 		if cp.stmt != nil {
 			//
 			// double check to make sure.
 			//
 			if cp.bindVars[cp.currentBindName] == nil {
-				if logger.GetLogger().V(logger.Warning) {
-					logger.GetLogger().Log(logger.Warning, "nonexisting bindname", cp.currentBindName)
-				}
-				err = fmt.Errorf("bindname not found in query: %s", cp.currentBindName)
-				cp.calExecErr("BindValNF", cp.currentBindName)
+				cp.unknownBindName("BindValNF")
 				break
 			} else {
 				if len(ns.Payload) == 0 {
-					cp.bindVars[cp.currentBindName].value = sql.NullString{}
+					// the NULL of the type of the column. an empty binary value is not NULL, Oracle stores
+					// it as NULL anyway
+					switch cp.bindVars[cp.currentBindName].dataType {
+					case common.DataTypeTimestamp, common.DataTypeTimestampTZ:
+						cp.bindVars[cp.currentBindName].value = sql.NullTime{}
+					case common.DataTypeRaw, common.DataTypeBlob:
+						cp.bindVars[cp.currentBindName].value = []byte{}
+					default:
+						cp.bindVars[cp.currentBindName].value = sql.NullString{}
+					}
 					if logger.GetLogger().V(logger.Verbose) {
 						logger.GetLogger().Log(logger.Verbose, "BindValue:", cp.currentBindName, ":", cp.bindVars[cp.currentBindName].dataType, ":<nil>")
 					}
@@ -668,17 +946,52 @@ outloop:
 						// Note: the Go Oracle driver ignores th elocation, always uses time.Local
 						cp.bindVars[cp.currentBindName].value = time.Date(year, time.Month(month), day, hour, min, sec, ms*1000000, time.FixedZone("Custom", tzh*3600))
 					case common.DataTypeRaw, common.DataTypeBlob:
-						cp.bindVars[cp.currentBindName].value = ns.Payload
+						// binary values are passed as is, embedded NUL bytes included. the copy keeps the
+						// value valid if the buffer of the netstring is reused
+						value := make([]byte, len(ns.Payload))
+						copy(value, ns.Payload)
+						cp.bindVars[cp.currentBindName].value = value
+					case common.DataTypeClob:
+						// large character data, bound as text. the whole value comes in this payload, the
+						// protocol doesn't split bind values (CmdBindValueMaxSize sizes the out binds)
+						cp.bindVars[cp.currentBindName].value = string(ns.Payload)
 					default:
 						cp.bindVars[cp.currentBindName].value = sql.NullString{String: string(ns.Payload), Valid: true}
 					}
 					if logger.GetLogger().V(logger.Verbose) {
-						logger.GetLogger().Log(logger.Verbose, "BindValue:", cp.currentBindName, ":", cp.bindVars[cp.currentBindName].dataType, ":", cp.bindVars[cp.currentBindName].value)
+						switch cp.bindVars[cp.currentBindName].dataType {
+						case common.DataTypeRaw, common.DataTypeBlob, common.DataTypeClob:
+							// large objects are not dumped to the log
+							logger.GetLogger().Log(logger.Verbose, "BindValue:", cp.currentBindName, ":", cp.bindVars[cp.currentBindName].dataType, ": length", len(ns.Payload))
+						default:
+							logger.GetLogger().Log(logger.Verbose, "BindValue:", cp.currentBindName, ":", cp.bindVars[cp.currentBindName].dataType, ":", cp.bindVars[cp.currentBindName].value)
+						}
 					}
 				}
 				cp.bindVars[cp.currentBindName].valid = true
 			}
 		}
+	case common.CmdShardKey:
+		// sent with the statement, the execute following it answers
+		cp.shardKey = string(ns.Payload)
+		if logger.GetLogger().V(logger.Verbose) {
+			logger.GetLogger().Log(logger.Verbose, "Shard key:", cp.shardKey)
+		}
+	case common.CmdSetShardID:
+		// -1 resets the shard id
+		shardID, perr := strconv.Atoi(string(ns.Payload))
+		var resns *encoding.Packet
+		if perr != nil || shardID < -1 || shardID >= cp.numShards {
+			resns = netstring.NewNetstringFrom(common.RcError, []byte(ErrBadShardID.Error()))
+		} else {
+			cp.shardID = shardID
+			resns = netstring.NewNetstringFrom(common.RcOK, nil)
+		}
+		err = cp.respond(resns)
+	case common.CmdGetNumShards:
+		// the count is in an RcOK response, as the mux and the client drivers do
+		resns := netstring.NewNetstringFrom(common.RcOK, []byte(strconv.Itoa(cp.numShards)))
+		err = cp.respond(resns)
 	case common.CmdBindNum:
 		if cp.stmt != nil {
 			err = fmt.Errorf("Batch not supported")
@@ -686,6 +999,16 @@ outloop:
 			break
 		}
 	case common.CmdExecute:
+		if cp.bindErr != nil {
+			if cp.inTrans {
+				cp.eor(common.EORInTransaction, netstring.NewNetstringFrom(common.RcError, []byte(cp.bindErr.Error())))
+			} else {
+				cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcError, []byte(cp.bindErr.Error())))
+			}
+			cp.lastErr = cp.bindErr
+			cp.bindErr = nil
+			break
+		}
 		if cp.stmt != nil {
 			//
 			// step through bindvar at each location to build bindinput.
@@ -737,17 +1060,18 @@ outloop:
 				// @TODO: do we keep a flag for curent statement.
 				//
 				if cp.hasResult {
-					cp.rows, err = cp.stmt.Query()
+					cp.rows, err = cp.stmt.QueryContext(cp.ctx)
 				} else {
-					cp.result, err = cp.stmt.Exec()
+					cp.result, err = cp.stmt.ExecContext(cp.ctx)
 				}
 			} else {
 				if cp.hasResult {
-					cp.rows, err = cp.stmt.Query(bindinput...)
+					cp.rows, err = cp.stmt.QueryContext(cp.ctx, bindinput...)
 				} else {
-					cp.result, err = cp.stmt.Exec(bindinput...)
+					cp.result, err = cp.stmt.ExecContext(cp.ctx, bindinput...)
 				}
 			}
+			err = cp.checkNoRows(err)
 			if err != nil {
 				cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
 				cp.calExecErr("RC", err.Error())
@@ -804,9 +1128,11 @@ outloop:
 				resns := netstring.NewNetstringEmbedded(nss)
 				err = cp.eor(common.EORInTransaction, resns)
 			}
-			if cp.rows != nil {
+			if cp.rows != nil || cp.noRows {
 				var cols []string
-				cols, err = cp.rows.Columns()
+				if cp.rows != nil {
+					cols, err = cp.rows.Columns()
+				}
 				if err != nil {
 					if logger.GetLogger().V(logger.Warning) {
 						logger.GetLogger().Log(logger.Warning, "rows.Columns()", err.Error())
@@ -870,6 +1196,21 @@ outloop:
 				calt.Completed()
 				break
 			}
+			err = cp.checkColumns(len(cts))
+			if err != nil {
+				calt.AddDataStr("RC", err.Error())
+				calt.SetStatus(cal.TransError)
+				calt.Completed()
+				cp.rows.Close()
+				cp.rows = nil
+				if cp.inTrans {
+					cp.eor(common.EORInTransaction, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
+				} else {
+					cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
+				}
+				err = nil
+				break
+			}
 			var nss []*encoding.Packet
 			cols, _ := cp.rows.Columns()
 			readCols := make([]interface{}, len(cols))
@@ -877,6 +1218,11 @@ outloop:
 			for i := range writeCols {
 				readCols[i] = &writeCols[i]
 			}
+			// the DECIMAL type names have the size of the column, for the adapter to keep the scale
+			typeNames := make([]string, len(cts))
+			for i := range cts {
+				typeNames[i] = mysqlpackets.DecimalTypeName(cts[i])
+			}
 			for cp.rows.Next() {
 				err = cp.rows.Scan(readCols...)
 				if err != nil {
@@ -892,7 +1238,7 @@ outloop:
 				for i := range writeCols {
 					var outstr string
 					if writeCols[i].Valid {
-						outstr = cp.adapter.ProcessResult(cts[i].DatabaseTypeName(), writeCols[i].String)
+						outstr = cp.adapter.ProcessResult(typeNames[i], writeCols[i].String)
 					}
 					if logger.GetLogger().V(logger.Debug) {
 						logger.GetLogger().Log(logger.Debug, "query result", outstr)
@@ -920,6 +1266,13 @@ outloop:
 				cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcNoMoreData, nil))
 			}
 			cp.rows = nil
+		} else if cp.noRows {
+			cp.noRows = false
+			if cp.inTrans {
+				cp.eor(common.EORInTransaction, netstring.NewNetstringFrom(common.RcNoMoreData, nil))
+			} else {
+				cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcNoMoreData, nil))
+			}
 		} else {
 			// send back to client only if last result was ok
 			var nsr *encoding.Packet
@@ -933,6 +1286,10 @@ outloop:
 			}
 		}
 	case common.CmdColsInfo:
+		if cp.rows == nil && cp.noRows {
+			err = WriteAll(cp.SocketOut, netstring.NewNetstringFrom(common.RcValue, []byte("0")))
+			break
+		}
 		if cp.rows == nil {
 			if logger.GetLogger().V(logger.Warning) {
 				logger.GetLogger().Log(logger.Warning, "CmdColsInfo with no cursor, possible after a failed query?")
@@ -1033,6 +1390,10 @@ outloop:
 		if cp.tx != nil {
 			calevt := cal.NewCalEvent("ROLLBACK", "Local", cal.TransOK, "")
 			err = cp.tx.Rollback()
+			if err == sql.ErrTxDone {
+				// the session was canceled, which rolled the transaction back already
+				err = nil
+			}
 			if err != nil {
 				cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
 				if logger.GetLogger().V(logger.Warning) {
@@ -1051,6 +1412,12 @@ outloop:
 		}
 		if err == nil {
 			cp.inTrans = false
+			// the worker is freed for the next client, without the cursors of the client and with the schema
+			// the connection was opened with
+			cp.closeCursors()
+			if err = cp.restoreSchema(); err != nil {
+				return err
+			}
 			cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcOK, nil))
 		} else {
 			cp.eor(common.EORInTransaction, netstring.NewNetstringFrom(common.RcSQLError, []byte(err.Error())))
@@ -1082,7 +1449,7 @@ func (cp *CmdProcessor) InitDB() error {
 		}
 		return err
 	}
-	cp.ctx = context.Background()
+	cp.newSession()
 	cp.db.SetMaxIdleConns(1)
 	cp.db.SetMaxOpenConns(1)
 
@@ -1108,7 +1475,13 @@ func (cp *CmdProcessor) InitDB() error {
 
 // TODO: Needs MySQL integration
 func (cp *CmdProcessor) eor(code int, ns *encoding.Packet) error {
-	if (code == common.EORFree) && cp.moreIncomingRequests() {
+	// the schema of the connection is the one of the client, the worker can't serve another client. Like any
+	// code but EORFree, the mux keeps the worker with the client, until the client goes away or the idle
+	// timeout of the worker expires, then recovers it with CmdRollback, which puts back the schema
+	if (code == common.EORFree) && (cp.schema != "") {
+		code = common.EORInSessionNotInTransaction
+	}
+	if (code == common.EORFree) && (cp.moreIncomingRequests != nil) && cp.moreIncomingRequests() {
 		code = common.EORMoreIncomingRequests
 	}
 	if (code == common.EORFree) && (cp.calSessionTxn != nil) {
@@ -1129,22 +1502,1044 @@ func (cp *CmdProcessor) eor(code int, ns *encoding.Packet) error {
 	return WriteAll(cp.SocketOut, netstring.NewNetstringFrom(common.CmdEOR, payload))
 }
 
-func (cp *CmdProcessor) calExecErr(field string, err string) {
-	cp.calExecTxn.AddDataStr(field, err)
-	cp.calExecTxn.SetStatus(cal.TransError)
-	cp.calExecTxn.Completed()
-	cp.calExecTxn = nil
+// endTransStatement tells if the SQL sent in a COM_QUERY is a COMMIT (first return value true) or a
+// ROLLBACK (first return value false). The second return value is false for any other SQL
+func endTransStatement(sqlQuery string) (bool, bool) {
+	stmt := strings.ToLower(strings.TrimSpace(strings.TrimRight(strings.TrimSpace(sqlQuery), ";")))
+	switch stmt {
+	case "commit", "commit work":
+		return true, true
+	case "rollback", "rollback work":
+		return false, true
+	}
+	return false, false
 }
 
-/**
- * extract bindnames and save them in bindVars with their position index.
+// beginTransStatement tells if the SQL sent in a COM_QUERY starts a transaction (second return value)
+// and if the transaction is READ ONLY (first return value). START TRANSACTION can have the
+// READ ONLY / READ WRITE and WITH CONSISTENT SNAPSHOT modifiers, separated by commas
+func beginTransStatement(sqlQuery string) (bool, bool) {
+	stmt := strings.ToLower(strings.TrimSpace(strings.TrimRight(strings.TrimSpace(sqlQuery), ";")))
+	switch stmt {
+	case "begin", "begin work":
+		return false, true
+	}
+	words := strings.Fields(stmt)
+	if len(words) < 2 || words[0] != "start" || words[1] != "transaction" {
+		return false, false
+	}
+	modifiers := strings.TrimSpace(strings.Join(words[2:], " "))
+	if len(modifiers) == 0 {
+		return false, true
+	}
+	readOnly := false
+	for _, modifier := range strings.Split(modifiers, ",") {
+		switch strings.Join(strings.Fields(modifier), " ") {
+		case "read only":
+			readOnly = true
+		case "read write":
+			readOnly = false
+		case "with consistent snapshot":
+		default:
+			return false, false
+		}
+	}
+	return readOnly, true
+}
+
+// mysqlBeginTrans starts a transaction for a BEGIN sent by a MySQL client and responds with an OK
+// packet having SERVER_STATUS_IN_TRANS set, and SERVER_STATUS_IN_TRANS_READONLY for a read only
+// transaction. A BEGIN inside a transaction keeps the current one
+func (cp *CmdProcessor) mysqlBeginTrans(ns *encoding.Packet, readOnly bool) error {
+	if cp.tx == nil {
+		var err error
+		cp.tx, err = cp.db.BeginTx(cp.ctx, &sql.TxOptions{ReadOnly: readOnly})
+		if err != nil {
+			cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "Begin error:", err.Error())
+			}
+			cp.tx = nil
+			np := cp.mysqlPacket(mysqlpackets.DriverERRPacket(err, cp.capabilities))
+			return cp.eor(common.EORFree, np)
+		}
+		cp.readOnlyTrans = readOnly
+	}
+	cp.inTrans = true
+	np := cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), 0, cp.capabilities, ""))
+	return cp.eor(common.EORInTransaction, np)
+}
+
+// mysqlEndTrans commits or rollbacks the current transaction for a COMMIT / ROLLBACK sent by a MySQL client
+// and responds with an OK packet having SERVER_STATUS_IN_TRANS cleared
+func (cp *CmdProcessor) mysqlEndTrans(ns *encoding.Packet, commit bool) error {
+	var err error
+	if cp.tx != nil {
+		var calevt cal.Event
+		if commit {
+			calevt = cal.NewCalEvent("COMMIT", "Local", cal.TransOK, "")
+			err = cp.tx.Commit()
+		} else {
+			calevt = cal.NewCalEvent("ROLLBACK", "Local", cal.TransOK, "")
+			err = cp.tx.Rollback()
+		}
+		if err != nil {
+			cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "Commit/Rollback error:", err.Error())
+			}
+			calevt.AddDataStr("RC", err.Error())
+			calevt.SetStatus(cal.TransError)
+		} else {
+			cp.tx = nil
+			cp.readOnlyTrans = false
+		}
+		calevt.Completed()
+	} else {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "Commit/Rollback issued without a transaction")
+		}
+	}
+	if err != nil {
+		np := cp.mysqlPacket(mysqlpackets.DriverERRPacket(err, cp.capabilities))
+		return cp.eor(common.EORInTransaction, np)
+	}
+	cp.inTrans = false
+	np := cp.mysqlPacket(mysqlpackets.OKPacket(0, 0, cp.statusFlags(), 0, cp.capabilities, ""))
+	return cp.eor(common.EORFree, np)
+}
+
+// resetSession brings the session back to the state of a new connection, for COM_RESET_CONNECTION and
+// COM_CHANGE_USER: the transaction is rolled back, the prepared statements are closed and the pending
+// results and errors are discarded.
+func (cp *CmdProcessor) resetSession() {
+	if cp.rows != nil {
+		cp.rows.Close()
+		cp.rows = nil
+	}
+	if cp.tx != nil {
+		calevt := cal.NewCalEvent("ROLLBACK", "Reset", cal.TransOK, "")
+		err := cp.tx.Rollback()
+		if err != nil {
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "Rollback on session reset error:", err.Error())
+			}
+			calevt.AddDataStr("RC", err.Error())
+			calevt.SetStatus(cal.TransError)
+		}
+		calevt.Completed()
+		cp.tx = nil
+	}
+	cp.inTrans = false
+	cp.readOnlyTrans = false
+	for stmtid := range cp.stmts {
+		cp.closeStmt(stmtid)
+	}
+	cp.stmt = nil
+	cp.result = nil
+	cp.noRows = false
+	cp.bindVars = nil
+	cp.bindPos = nil
+	cp.bindOuts = nil
+	cp.numBindOuts = 0
+	cp.querySlow = false
+	cp.lastErr = nil
+	cp.bindErr = nil
+}
+
+// newSession creates the context of a new session, replacing the one canceled by cancelSession
+func (cp *CmdProcessor) newSession() {
+	cp.sessionMu.Lock()
+	defer cp.sessionMu.Unlock()
+	if cp.cancel != nil {
+		cp.cancel()
+	}
+	cp.ctx, cp.cancel = context.WithCancel(context.Background())
+}
+
+// cancelSession cancels the context of the session, aborting the database call in progress if any. It can be
+// called from any goroutine. Once canceled, the database calls fail until newSession is called.
+func (cp *CmdProcessor) cancelSession() {
+	cp.sessionMu.Lock()
+	defer cp.sessionMu.Unlock()
+	if cp.cancel != nil {
+		cp.cancel()
+	}
+}
+
+// processControlMsg handles a control message of the proxy. The only one is the capability flags negotiated
+// with the MySQL client, which the responses are then built for. There is no response.
+func (cp *CmdProcessor) processControlMsg(payload []byte) {
+	msg := string(payload)
+	if !strings.HasPrefix(msg, common.ControlMsgCapabilities) {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "Unknown control message:", msg)
+		}
+		return
+	}
+	capabilities, err := strconv.ParseUint(msg[len(common.ControlMsgCapabilities):], 10, 32)
+	if err != nil {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "Bad capabilities in control message:", msg)
+		}
+		return
+	}
+	if logger.GetLogger().V(logger.Debug) {
+		logger.GetLogger().Log(logger.Debug, "MySQL client capabilities", capabilities)
+	}
+	cp.capabilities = uint32(capabilities)
+}
+
+// mysqlPacket frames the payload of the next packet of the response to the current MySQL command
+func (cp *CmdProcessor) mysqlPacket(payload []byte) *encoding.Packet {
+	np := mysqlpackets.NewMySQLPacketFrom(cp.sqid, payload)
+	cp.sqid++
+	cp.counters.sent(len(np.Serialized), payload)
+	if mysqlpackets.TraceEnabled() {
+		logger.GetLogger().Log(logger.Info, "trace out:", mysqlpackets.Trace(np))
+	}
+	return np
+}
+
+// appendPacket appends the packet of payload, with the next sequence id, to resp, a response of several packets
+// sent by eorResponse. resp starts with the indicator byte, followed by the packets without theirs, since the mux
+// writes the EOR payload to the client as is after the indicator byte.
+func (cp *CmdProcessor) appendPacket(resp []byte, payload []byte) []byte {
+	if len(resp) == 0 {
+		resp = append(resp, encoding.IndicatorMySQL)
+	}
+	length := len(payload)
+	resp = append(resp, byte(length), byte(length>>8), byte(length>>16), byte(cp.sqid))
+	resp = append(resp, payload...)
+	if mysqlpackets.TraceEnabled() {
+		logger.GetLogger().Log(logger.Info, "trace out:", mysqlpackets.Trace(mysqlpackets.NewMySQLPacketFrom(cp.sqid, payload)))
+	}
+	cp.sqid++
+	cp.counters.sent(encoding.IndicatorSize+mysqlpackets.HEADER_SIZE+length, payload)
+	return resp
+}
+
+// eorResponse sends resp, the packets appended by appendPacket, in one EOR. The mux forwards the response to a
+// command up to the first EOR, all the packets of the response must be in it.
+func (cp *CmdProcessor) eorResponse(code int, resp []byte) error {
+	return cp.eor(code, &encoding.Packet{Serialized: resp, IsMySQL: true})
+}
+
+// addStmt records the statement prepared for stmtid as the most recently used. Beyond maxStmts the least
+// recently used statement is closed, a later execute of its id gets ER_UNKNOWN_STMT_HANDLER.
+func (cp *CmdProcessor) addStmt(stmtid int, stmt *sql.Stmt, numParams int) {
+	cp.stmts[stmtid] = stmt
+	cp.stmtParams[stmtid] = numParams
+	cp.stmtElems[stmtid] = cp.stmtLRU.PushFront(stmtid)
+	for cp.maxStmts > 0 && cp.stmtLRU.Len() > cp.maxStmts {
+		evicted := cp.stmtLRU.Back().Value.(int)
+		if logger.GetLogger().V(logger.Info) {
+			logger.GetLogger().Log(logger.Info, "Evicting prepared statement", evicted, "open statements", cp.stmtLRU.Len())
+		}
+		cp.closeStmt(evicted)
+	}
+}
+
+// useStmt returns the statement of stmtid, nil if there is none, and makes it the most recently used
+func (cp *CmdProcessor) useStmt(stmtid int) *sql.Stmt {
+	elem, ok := cp.stmtElems[stmtid]
+	if !ok {
+		return nil
+	}
+	cp.stmtLRU.MoveToFront(elem)
+	return cp.stmts[stmtid]
+}
+
+// closeStmt closes the statement of stmtid, and its cursor if open, and forgets it
+func (cp *CmdProcessor) closeStmt(stmtid int) {
+	stmt, ok := cp.stmts[stmtid]
+	if !ok {
+		return
+	}
+	cp.closeCursor(stmtid)
+	err := stmt.Close()
+	if err != nil && logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "Tried to close statement", stmtid, "but got", err.Error())
+	}
+	delete(cp.stmts, stmtid)
+	delete(cp.stmtParams, stmtid)
+	delete(cp.colDefs, stmtid)
+	delete(cp.stmtBinds, stmtid)
+	delete(cp.stmtCalls, stmtid)
+	delete(cp.stmtColumns, stmtid)
+	delete(cp.stmtResults, stmtid)
+	if elem, ok := cp.stmtElems[stmtid]; ok {
+		cp.stmtLRU.Remove(elem)
+		delete(cp.stmtElems, stmtid)
+	}
+}
+
+// bindParams returns the arguments of an execute of stmtid and their types. With the new params flag the values
+// are converted with paramTypes, and kept for the next executes. Without the flag the values are decoded with
+// the types of the last execute, or the arguments of the last execute are bound again if the client sent none.
+func (cp *CmdProcessor) bindParams(ns *encoding.Packet, stmtid int, newParams bool, paramTypes []byte, values [][]byte) ([]interface{}, []byte, error) {
+	numParams := cp.stmtParams[stmtid]
+	if !newParams {
+		last, ok := cp.stmtBinds[stmtid]
+		if !ok {
+			return nil, nil, ErrNoParamsBound
+		}
+		var err error
+		values, err = mysqlpackets.DecodeExecuteValues(ns.Payload, numParams, last.types)
+		if err != nil {
+			return nil, nil, err
+		}
+		if values == nil {
+			return last.args, last.types, nil
+		}
+		paramTypes = last.types
+	}
+	args := make([]interface{}, numParams)
+	for i := range args {
+		var err error
+		args[i], err = cp.adapter.BindParamValue(paramTypes[2*i], paramTypes[2*i+1]&0x80 != 0, values[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	cp.stmtBinds[stmtid] = &paramBind{types: paramTypes, args: args}
+	return args, paramTypes, nil
+}
+
+// batchSavepoint is the savepoint a batch executed in the transaction of the client rolls back to
+const batchSavepoint = "hera_batch"
+
+// executeBatch answers a COM_STMT_EXECUTE of stmtid with an iteration count above 1, the array binding of
+// the drivers doing bulk inserts. The statement is executed once per parameter set, in a transaction started
+// for the batch or, inside the transaction of the client, after a savepoint. The OK packet has the sum of
+// the rows affected and the last insert id of the first set. The first failure aborts the batch: what the
+// previous sets did is rolled back and the ERR packet of the failure is sent, the failing set being logged.
+// Only statements with parameters and without a result set can be batched.
+func (cp *CmdProcessor) executeBatch(ns *encoding.Packet, stmtid int, iterations uint32) error {
+	numParams := cp.stmtParams[stmtid]
+	if cp.stmtResults[stmtid] || numParams == 0 {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "stmt execute", stmtid, "with iteration count", iterations,
+				"has a result set or no parameters")
+		}
+		np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_NOT_SUPPORTED_YET,
+			fmt.Sprintf("This version of Hera doesn't yet support 'COM_STMT_EXECUTE with iteration count %d for this statement'", iterations)))
+		return cp.respond(np)
+	}
+
+	paramTypes, values, err := mysqlpackets.DecodeExecuteBatch(ns.Payload, numParams)
+	sets := make([][]interface{}, len(values))
+	for i := 0; err == nil && i < len(values); i++ {
+		sets[i] = make([]interface{}, numParams)
+		for j := range sets[i] {
+			sets[i][j], err = cp.adapter.BindParamValue(paramTypes[i][2*j], paramTypes[i][2*j+1]&0x80 != 0, values[i][j])
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "stmt execute", stmtid, "malformed batch:", err.Error())
+		}
+		np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_MALFORMED_PACKET, err.Error()))
+		return cp.respond(np)
+	}
+
+	tx := cp.tx
+	if tx == nil {
+		tx, err = cp.db.BeginTx(cp.ctx, nil)
+	} else {
+		_, err = tx.ExecContext(cp.ctx, "SAVEPOINT "+batchSavepoint)
+	}
+	if err != nil {
+		cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
+		cp.calExecErr("RC", err.Error())
+		return cp.sendExecResult(nil, err)
+	}
+	// the statement may have been prepared outside of the transaction, on another connection
+	stmt := tx.StmtContext(cp.ctx, cp.stmt)
+	defer stmt.Close()
+
+	var rowcnt, liid int64
+	for i, args := range sets {
+		start := time.Now()
+		var res sql.Result
+		var n int64
+		res, err = stmt.ExecContext(cp.ctx, args...)
+		cp.checkSlowQuery(start)
+		if err == nil {
+			n, err = res.RowsAffected()
+		}
+		if err == nil && i == 0 {
+			liid, err = res.LastInsertId()
+		}
+		if err != nil {
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "stmt execute", stmtid, "batch aborted at iteration", i+1,
+					"of", len(sets), ":", err.Error())
+			}
+			cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
+			cp.calExecErr("RC", fmt.Sprintf("iteration %d: %s", i+1, err.Error()))
+			var rerr error
+			if cp.tx == nil {
+				rerr = tx.Rollback()
+			} else {
+				_, rerr = tx.ExecContext(cp.ctx, "ROLLBACK TO SAVEPOINT "+batchSavepoint)
+			}
+			if rerr != nil && logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "Rollback of the batch error:", rerr.Error())
+			}
+			cp.lastErr = err
+			return cp.sendExecResult(nil, err)
+		}
+		rowcnt += n
+	}
+
+	// the warnings of a batch committed here are on a connection back in the pool
+	warnings := 0
+	if cp.tx == nil {
+		err = tx.Commit()
+	} else {
+		_, err = tx.ExecContext(cp.ctx, "RELEASE SAVEPOINT "+batchSavepoint)
+		warnings = cp.warningCount()
+		cp.inTrans = true
+	}
+	if err != nil {
+		cp.adapter.ProcessError(err, &cp.WorkerScope, &cp.queryScope)
+		cp.calExecErr("RC", err.Error())
+		return cp.sendExecResult(nil, err)
+	}
+	if cp.calExecTxn != nil {
+		cp.calExecTxn.AddDataInt("iterations", int64(iterations))
+		cp.calExecTxn.Completed()
+		cp.calExecTxn = nil
+	}
+	if logger.GetLogger().V(logger.Debug) {
+		logger.GetLogger().Log(logger.Debug, "stmt execute", stmtid, "batch of", iterations, "rows", rowcnt)
+	}
+	np := cp.mysqlPacket(mysqlpackets.OKPacket(int(rowcnt), int(liid), cp.statusFlags(), warnings, cp.capabilities, ""))
+	return cp.respond(np)
+}
+
+// openCursor answers a COM_STMT_EXECUTE of stmtid asking for a read-only cursor. Only the column count and
+// definitions are sent, the rows stay open for COM_STMT_FETCH.
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute-response.html
+func (cp *CmdProcessor) openCursor(stmtid int) error {
+	colDefs, err := cp.columnDefinitions(stmtid)
+	if err != nil {
+		cp.rows.Close()
+		cp.rows = nil
+		return cp.sendExecResult(nil, err)
+	}
+	cp.cursorStmt = stmtid
+	resp := cp.appendPacket(nil, mysqlpackets.ColumnCountPacket(len(colDefs)))
+	for _, colDef := range colDefs {
+		resp = cp.appendPacket(resp, colDef)
+	}
+	status := cp.statusFlags() | mysqlpackets.SERVER_STATUS_CURSOR_EXISTS
+	resp = cp.appendPacket(resp, mysqlpackets.TerminatorPacket(status, 0, cp.capabilities))
+	return cp.eorResponse(cp.cursorEOR(), resp)
+}
+
+// columnDefinitions returns the column definition payloads of the rows of stmtid, in the layout of the capabilities
+// of the client. database/sql gives the column types with the rows, not with the prepared statement, so the
+// definitions are built by the first execute and reused by the next ones, until the statement is reset or closed.
+// They are built again if the names or the database types of the columns changed, as for a "select *" after an
+// ALTER TABLE.
+func (cp *CmdProcessor) columnDefinitions(stmtid int) ([][]byte, error) {
+	cts, err := cp.rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if defs, ok := cp.colDefs[stmtid]; ok && defs.describe(cts) {
+		return defs.payloads, nil
+	}
+	payloads, err := cp.describeColumns(cts, cp.stmtColumns[stmtid])
+	if err != nil {
+		return nil, err
+	}
+	cp.colDefs[stmtid] = newColumnDefs(cts, payloads)
+	return payloads, nil
+}
+
+// describeColumns returns the column definition payloads of the columns cts of the open rows. orgNames are the
+// original names of the columns, from common.SelectColumns, a column without one has an empty org_name. Without
+// orgNames, for a "select *" or a CALL, the org_name is the name of the column.
+func (cp *CmdProcessor) describeColumns(cts []*sql.ColumnType, orgNames []string) ([][]byte, error) {
+	if err := cp.checkColumns(len(cts)); err != nil {
+		return nil, err
+	}
+	packager := mysqlpackets.NewPackager(nil, nil)
+	colDefs := make([][]byte, len(cts))
+	for i, ct := range cts {
+		orgName := ct.Name()
+		if orgNames != nil {
+			orgName = ""
+			if i < len(orgNames) {
+				orgName = orgNames[i]
+			}
+		}
+		colDefs[i] = packager.ColumnDefinition(orgName, ct, cp.capabilities)
+	}
+	return colDefs, nil
+}
+
+// sendResultsets answers a COM_STMT_EXECUTE of stmtid without a cursor with its rows in the binary protocol. A CALL
+// can return several result sets, read with rows.NextResultSet if the client has CLIENT_MULTI_RESULTS: each of them
+// then ends with SERVER_MORE_RESULTS_EXISTS, and the last one is followed by an OK packet with the status of the CALL,
+// like with the MySQL server. A client without CLIENT_MULTI_RESULTS can't read them, so a CALL returning a result set
+// gets ER_SP_BADSELECT instead. All the result sets are sent in one EOR, see eorResponse.
+// https://dev.mysql.com/doc/internals/en/multi-resultset.html
+func (cp *CmdProcessor) sendResultsets(stmtid int) error {
+	procedure, call := cp.stmtCalls[stmtid]
+	multiResults := mysqlpackets.Supports(cp.capabilities, mysqlpackets.CLIENT_MULTI_RESULTS)
+	var resp []byte
+	sent := 0
+	for {
+		columns, err := cp.rows.Columns()
+		if err == nil && len(columns) > 0 && call && !multiResults {
+			cp.closeRows()
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "procedure", procedure, "returned a result set, the client doesn't have CLIENT_MULTI_RESULTS")
+			}
+			resp = cp.appendPacket(resp, mysqlpackets.ClientERRPacket(common.ER_SP_BADSELECT, "0A000",
+				fmt.Sprintf("PROCEDURE %s can't return a result set in the given context", procedure), cp.capabilities))
+			return cp.eorResponse(cp.cursorEOR(), resp)
+		}
+		var colDefs, rows [][]byte
+		if err == nil && len(columns) > 0 {
+			colDefs, err = cp.resultsetColumnDefinitions(stmtid, sent == 0)
+		}
+		if err == nil && len(columns) > 0 {
+			rows, err = cp.mysqlResultsetRows(true)
+		}
+		if err != nil {
+			cp.closeRows()
+			if logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "Execute error:", err.Error())
+			}
+			// like with the MySQL server, the result sets already read come before the error
+			resp = cp.appendPacket(resp, mysqlpackets.DriverERRPacket(err, cp.capabilities))
+			return cp.eorResponse(cp.cursorEOR(), resp)
+		}
+		more := multiResults && cp.rows.NextResultSet()
+		if len(columns) > 0 {
+			status := cp.statusFlags()
+			if more || call {
+				status |= mysqlpackets.SERVER_MORE_RESULTS_EXISTS
+			}
+			resp = cp.appendPacket(resp, mysqlpackets.ColumnCountPacket(len(colDefs)))
+			for _, colDef := range colDefs {
+				resp = cp.appendPacket(resp, colDef)
+			}
+			if !mysqlpackets.Supports(cp.capabilities, mysqlpackets.CLIENT_DEPRECATE_EOF) {
+				resp = cp.appendPacket(resp, mysqlpackets.EOFPacket(0, status, cp.capabilities))
+			}
+			for _, row := range rows {
+				resp = cp.appendPacket(resp, row)
+			}
+			resp = cp.appendPacket(resp, mysqlpackets.TerminatorPacket(status, 0, cp.capabilities))
+			sent++
+		}
+		if !more {
+			break
+		}
+	}
+	cp.closeRows()
+	if call || sent == 0 {
+		resp = cp.appendPacket(resp, mysqlpackets.OKPacket(0, 0, cp.statusFlags(), cp.warningCount(), cp.capabilities, ""))
+	}
+	return cp.eorResponse(cp.cursorEOR(), resp)
+}
+
+// sendTextResultset answers a COM_QUERY of sqlQuery returning rows with a text resultset, in one EOR: the column
+// count, the column definitions, the rows in the text protocol and the terminator. The rows are then closed.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html
+func (cp *CmdProcessor) sendTextResultset(sqlQuery string) error {
+	cts, err := cp.rows.ColumnTypes()
+	var colDefs, rows [][]byte
+	if err == nil {
+		colDefs, err = cp.describeColumns(cts, common.SelectColumns(sqlQuery))
+	}
+	if err == nil {
+		rows, err = cp.mysqlResultsetRows(false)
+	}
+	cp.closeRows()
+	if err != nil {
+		return cp.sendExecResult(nil, err)
+	}
+	status := cp.statusFlags()
+	resp := cp.appendPacket(nil, mysqlpackets.ColumnCountPacket(len(colDefs)))
+	for _, colDef := range colDefs {
+		resp = cp.appendPacket(resp, colDef)
+	}
+	if !mysqlpackets.Supports(cp.capabilities, mysqlpackets.CLIENT_DEPRECATE_EOF) {
+		resp = cp.appendPacket(resp, mysqlpackets.EOFPacket(0, status, cp.capabilities))
+	}
+	for _, row := range rows {
+		resp = cp.appendPacket(resp, row)
+	}
+	resp = cp.appendPacket(resp, mysqlpackets.TerminatorPacket(status, 0, cp.capabilities))
+	return cp.eorResponse(cp.cursorEOR(), resp)
+}
+
+// resultsetColumnDefinitions returns the column definition payloads of the current result set of stmtid. Only the
+// ones of the first result set are cached, a CALL can return result sets of different columns.
+func (cp *CmdProcessor) resultsetColumnDefinitions(stmtid int, first bool) ([][]byte, error) {
+	if first {
+		return cp.columnDefinitions(stmtid)
+	}
+	cts, err := cp.rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	return cp.describeColumns(cts, nil)
+}
+
+// fetchCursor answers a COM_STMT_FETCH with the next numRows rows of the cursor of stmtid, in the binary
+// protocol. Once the rows are exhausted the cursor is closed and the status has SERVER_STATUS_LAST_ROW_SENT.
+// https://dev.mysql.com/doc/internals/en/com-stmt-fetch.html
+func (cp *CmdProcessor) fetchCursor(stmtid int, numRows int) error {
+	var rows [][]byte
+	if parked, ok := cp.cursors[stmtid]; ok {
+		rows = parked
+		if len(rows) > numRows {
+			rows = rows[:numRows]
+		}
+		cp.cursors[stmtid] = parked[len(rows):]
+	} else if cp.rows != nil && cp.cursorStmt == stmtid {
+		var err error
+		rows, err = cp.mysqlFetchRows(true, numRows)
+		if err != nil {
+			cp.closeCursor(stmtid)
+			return cp.sendExecResult(nil, err)
+		}
+	} else {
+		np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_STMT_HAS_NO_OPEN_CURSOR,
+			fmt.Sprintf("The statement (%d) has no open cursor.", stmtid)))
+		return cp.respond(np)
+	}
+	status := cp.statusFlags() | mysqlpackets.SERVER_STATUS_CURSOR_EXISTS
+	if len(rows) < numRows {
+		cp.closeCursor(stmtid)
+		status |= mysqlpackets.SERVER_STATUS_LAST_ROW_SENT
+	}
+	var resp []byte
+	for _, row := range rows {
+		resp = cp.appendPacket(resp, row)
+	}
+	resp = cp.appendPacket(resp, mysqlpackets.TerminatorPacket(status, 0, cp.capabilities))
+	return cp.eorResponse(cp.cursorEOR(), resp)
+}
+
+// closeCursor closes the cursor of stmtid, whether its rows are open or parked
+func (cp *CmdProcessor) closeCursor(stmtid int) {
+	if cp.cursorStmt == stmtid {
+		cp.closeRows()
+	}
+	delete(cp.cursors, stmtid)
+}
+
+// closeCursors closes the open cursor and the parked ones
+func (cp *CmdProcessor) closeCursors() {
+	if cp.cursorStmt != 0 {
+		cp.closeRows()
+	}
+	for stmtid := range cp.cursors {
+		delete(cp.cursors, stmtid)
+	}
+}
+
+// closeRows closes the open rows, those of the cursor if any
+func (cp *CmdProcessor) closeRows() {
+	if cp.rows != nil {
+		cp.rows.Close()
+		cp.rows = nil
+	}
+	cp.cursorStmt = 0
+}
+
+// parkCursor reads the rows left in the open cursor, if any, before another statement uses the connection.
+// MySQL keeps several cursors open, materialized in temporary tables, while the database connection only reads
+// one result set at a time: the rows are kept in cursors for the next COM_STMT_FETCH of the statement. If they
+// can't be read the cursor is closed, its next fetch gets ER_STMT_HAS_NO_OPEN_CURSOR.
+func (cp *CmdProcessor) parkCursor() {
+	stmtid := cp.cursorStmt
+	if stmtid == 0 || cp.rows == nil {
+		return
+	}
+	rows, err := cp.mysqlResultsetRows(true)
+	cp.closeRows()
+	if err != nil {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "stmt", stmtid, "cursor closed, failed to read its rows:", err.Error())
+		}
+		evt := cal.NewCalEvent("WARNING", "park_cursor", cal.TransOK, err.Error())
+		evt.Completed()
+		return
+	}
+	cp.cursors[stmtid] = rows
+}
+
+// respond sends ns, the single packet answering the current command, in an EOR keeping the worker with the client
+// while a transaction or a cursor is open
+func (cp *CmdProcessor) respond(ns *encoding.Packet) error {
+	return cp.eor(cp.cursorEOR(), ns)
+}
+
+// cursorEOR returns the end of response code of the packets answering a COM_STMT_EXECUTE or a
+// COM_STMT_FETCH, the worker is not free while a cursor is open or parked
+func (cp *CmdProcessor) cursorEOR() int {
+	if cp.cursorStmt != 0 || len(cp.cursors) > 0 {
+		if cp.inTrans {
+			return common.EORInCursorInTransaction
+		}
+		return common.EORInCursorNotInTransaction
+	}
+	if cp.inTrans {
+		return common.EORInTransaction
+	}
+	return common.EORFree
+}
+
+// statusFlags returns the server status flags sent to MySQL clients in OK and EOF packets
+func (cp *CmdProcessor) statusFlags() int {
+	flags := mysqlpackets.SERVER_STATUS_AUTOCOMMIT
+	if cp.inTrans {
+		flags = mysqlpackets.SERVER_STATUS_IN_TRANS
+		if cp.readOnlyTrans {
+			flags |= mysqlpackets.SERVER_STATUS_IN_TRANS_READONLY
+		}
+	}
+	if cp.querySlow {
+		flags |= mysqlpackets.SERVER_QUERY_WAS_SLOW
+	}
+	return flags
+}
+
+// checkSlowQuery records if the MySQL statement started at start ran longer than the slow query
+// threshold, for statusFlags to set SERVER_QUERY_WAS_SLOW in the response
+func (cp *CmdProcessor) checkSlowQuery(start time.Time) {
+	if cp.slowQueryThreshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	cp.querySlow = elapsed >= cp.slowQueryThreshold
+	if cp.querySlow && logger.GetLogger().V(logger.Info) {
+		logger.GetLogger().Log(logger.Info, "slow query", cp.sqlHash, "took", elapsed)
+	}
+}
+
+// sendExecResult sends the response to a MySQL statement without a result set: an OK packet with the
+// rows affected and the last insert id of res, or an ERR packet if the statement failed with err or
+// res can't tell them. The status flags and the warnings are the ones of the command processor.
+func (cp *CmdProcessor) sendExecResult(res sql.Result, err error) error {
+	var rowcnt, liid int64
+	if err == nil {
+		rowcnt, err = res.RowsAffected()
+		if err == nil {
+			liid, err = res.LastInsertId()
+		}
+	}
+	var np *encoding.Packet
+	if err != nil {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "Execute error:", err.Error())
+		}
+		np = cp.mysqlPacket(mysqlpackets.DriverERRPacket(err, cp.capabilities))
+	} else {
+		if logger.GetLogger().V(logger.Debug) {
+			logger.GetLogger().Log(logger.Debug, "exe row", rowcnt, "LastInsertId", liid)
+		}
+		np = cp.mysqlPacket(mysqlpackets.OKPacket(int(rowcnt), int(liid), cp.statusFlags(), cp.warningCount(), cp.capabilities, ""))
+	}
+	return cp.respond(np)
+}
+
+// warningCountQuery counts the warnings of the last statement, without clearing them
+const warningCountQuery = "SHOW COUNT(*) WARNINGS"
+
+// warningCount returns the number of warnings of the last statement, for the OK packet. database/sql
+// doesn't expose the warnings the server sends, so if enabled the count is queried with an extra
+// round trip to the database, on the same connection, after the statement. Otherwise it is 0. It is
+// not queried while a cursor is open, the connection is busy with the rows.
+func (cp *CmdProcessor) warningCount() int {
+	if !cp.countWarnings || cp.rows != nil {
+		return 0
+	}
+	var row *sql.Row
+	if cp.tx != nil {
+		row = cp.tx.QueryRowContext(cp.ctx, warningCountQuery)
+	} else {
+		row = cp.db.QueryRowContext(cp.ctx, warningCountQuery)
+	}
+	var count int
+	if err := row.Scan(&count); err != nil {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, "warning count:", err.Error())
+		}
+		return 0
+	}
+	return count
+}
+
+// currentSchemaQuery returns the default schema of the connection, NULL for none
+const currentSchemaQuery = "SELECT DATABASE()"
+
+// quoteIdentifier quotes the name of a schema for a statement, doubling the backticks it contains
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+var regexUse = regexp.MustCompile("(?i)^\\s*use\\s+(`(?:[^`]|``)+`|[^\\s;`]+)\\s*;?\\s*$")
+
+// useStatement tells if the SQL sent in a COM_QUERY is a USE, returning the schema in it without its quotes
+func useStatement(sqlQuery string) (string, bool) {
+	m := regexUse.FindStringSubmatch(sqlQuery)
+	if m == nil {
+		return "", false
+	}
+	schema := m[1]
+	if strings.HasPrefix(schema, "`") {
+		schema = strings.Replace(schema[1:len(schema)-1], "``", "`", -1)
+	}
+	return schema, true
+}
+
+// mysqlUseSchema answers a COM_INIT_DB or a USE of schema with an OK packet telling the new schema to the
+// CLIENT_SESSION_TRACK clients, or with the ERR packet of the server
+func (cp *CmdProcessor) mysqlUseSchema(ns *encoding.Packet, schema string) error {
+	var np *encoding.Packet
+	if _, err := cp.useSchema(schema); err != nil {
+		if logger.GetLogger().V(logger.Warning) {
+			logger.GetLogger().Log(logger.Warning, common.SQLcmds[ns.Cmd], ": failed to use", schema, ":", err.Error())
+		}
+		// the errors of the server, like an unknown database, keep their number
+		np = cp.mysqlPacket(mysqlpackets.DriverERRPacket(err, cp.capabilities))
+	} else {
+		np = cp.mysqlPacket(mysqlpackets.SchemaOKPacket(cp.statusFlags(), 0, cp.capabilities, schema))
+	}
+	return cp.respond(np)
+}
+
+// useSchema makes schema the default schema of the connection, for COM_INIT_DB, USE and COM_CHANGE_USER. The
+// connection is shared by the clients of the worker: once changed, the worker stays with the client until
+// restoreSchema puts back the schema the connection was opened with.
+func (cp *CmdProcessor) useSchema(schema string) (sql.Result, error) {
+	var row *sql.Row
+	if cp.schema == "" {
+		if cp.tx != nil {
+			row = cp.tx.QueryRowContext(cp.ctx, currentSchemaQuery)
+		} else {
+			row = cp.db.QueryRowContext(cp.ctx, currentSchemaQuery)
+		}
+		if err := row.Scan(&cp.defaultSchema); err != nil {
+			return nil, err
+		}
+	}
+	var res sql.Result
+	var err error
+	if cp.tx != nil {
+		res, err = cp.tx.ExecContext(cp.ctx, "USE "+quoteIdentifier(schema))
+	} else {
+		res, err = cp.db.ExecContext(cp.ctx, "USE "+quoteIdentifier(schema))
+	}
+	if err == nil {
+		cp.schema = schema
+	}
+	return res, err
+}
+
+// restoreSchema puts back the schema the connection was opened with if the client changed it, before the worker
+// is freed. MySQL can't go back to no schema, the worker then fails and gets a new connection.
+func (cp *CmdProcessor) restoreSchema() error {
+	if cp.schema == "" {
+		return nil
+	}
+	schema := cp.schema
+	cp.schema = ""
+	if !cp.defaultSchema.Valid {
+		return errors.New("the connection had no schema before " + schema)
+	}
+	_, err := cp.db.ExecContext(cp.ctx, "USE "+quoteIdentifier(cp.defaultSchema.String))
+	return err
+}
+
+// mysqlResultsetRows reads the rows in the open cursor and encodes them as MySQL result set rows,
+// in the binary protocol for prepared statements or in the text protocol otherwise. The values
+// are translated with the adapter's ProcessMySQLResult.
+func (cp *CmdProcessor) mysqlResultsetRows(binary bool) ([][]byte, error) {
+	return cp.mysqlFetchRows(binary, -1)
+}
+
+// mysqlFetchRows is mysqlResultsetRows reading at most limit rows, all of them if limit is negative
+func (cp *CmdProcessor) mysqlFetchRows(binary bool, limit int) ([][]byte, error) {
+	cts, err := cp.rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	err = cp.checkColumns(len(cts))
+	if err != nil {
+		return nil, err
+	}
+	colTypes := make([]string, len(cts))
+	for i := range cts {
+		colTypes[i] = mysqlpackets.ColumnTypeName(cts[i])
+	}
+	readCols := make([]interface{}, len(cts))
+	writeCols := make([]sql.NullString, len(cts))
+	for i := range writeCols {
+		readCols[i] = &writeCols[i]
+	}
+	var rows [][]byte
+	for (limit < 0 || len(rows) < limit) && cp.rows.Next() {
+		err = cp.rows.Scan(readCols...)
+		if err != nil {
+			return nil, err
+		}
+		if binary {
+			rows = append(rows, mysqlpackets.BinaryResultsetRow(colTypes, writeCols, cp.adapter.ProcessMySQLResult))
+		} else {
+			rows = append(rows, mysqlpackets.TextResultsetRow(colTypes, writeCols, cp.adapter.ProcessMySQLResult))
+		}
+	}
+	return rows, cp.rows.Err()
+}
+
+// checkColumns guards the result set builders against queries returning a pathological number of columns
+func (cp *CmdProcessor) checkColumns(numColumns int) error {
+	if cp.maxColumns <= 0 || numColumns <= cp.maxColumns {
+		return nil
+	}
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "result set has", numColumns, "columns, more than max", cp.maxColumns)
+	}
+	evt := cal.NewCalEvent("WARNING", "too_many_columns", cal.TransOK, fmt.Sprintf("columns=%d&max=%d", numColumns, cp.maxColumns))
+	evt.Completed()
+	return ErrTooManyColumns
+}
+
+// checkSQLLength returns ErrSQLTooLong if the SQL of a prepare is longer than maxSQLLength, to reject it
+// before it is sent to the database
+func (cp *CmdProcessor) checkSQLLength(length int) error {
+	if cp.maxSQLLength <= 0 || length <= cp.maxSQLLength {
+		return nil
+	}
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "SQL length", length, "more than max", cp.maxSQLLength)
+	}
+	evt := cal.NewCalEvent("WARNING", "sql_too_long", cal.TransOK, fmt.Sprintf("len=%d&max=%d", length, cp.maxSQLLength))
+	evt.Completed()
+	return ErrSQLTooLong
+}
+
+// checkNoRows maps sql.ErrNoRows returned by a query to an empty result set: noRows is set and the
+// error cleared. Any other error is returned as is.
+func (cp *CmdProcessor) checkNoRows(err error) error {
+	if err == sql.ErrNoRows && cp.hasResult {
+		if logger.GetLogger().V(logger.Debug) {
+			logger.GetLogger().Log(logger.Debug, "query returned no rows")
+		}
+		cp.rows = nil
+		cp.noRows = true
+		return nil
+	}
+	return err
+}
+
+// readOnlyViolation checks if the current SQL, which is not a SELECT, is run in a read only transaction.
+// Like the MySQL server, it is rejected with ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION instead of
+// being sent to the database. The transaction is still open.
+func (cp *CmdProcessor) readOnlyViolation(ns *encoding.Packet) (bool, error) {
+	if !cp.readOnlyTrans || cp.tx == nil || cp.hasResult {
+		return false, nil
+	}
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "command", common.SQLcmds[ns.Cmd], "in a read only transaction")
+	}
+	np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION, "Cannot execute statement in a READ ONLY transaction."))
+	return true, cp.respond(np)
+}
+
+// emptyQuery checks if the SQL of a MySQL query or prepare command is empty. Like the MySQL server,
+// the command is rejected with ER_EMPTY_QUERY instead of being sent to the database.
+func (cp *CmdProcessor) emptyQuery(ns *encoding.Packet, sqlQuery string) (bool, error) {
+	if len(strings.TrimSpace(sqlQuery)) > 0 {
+		return false, nil
+	}
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "command", common.SQLcmds[ns.Cmd], "with empty query")
+	}
+	np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_EMPTY_QUERY, "Query was empty"))
+	return true, cp.respond(np)
+}
+
+// calledProcedure returns the name of the stored procedure called by the SQL, or "" if the SQL is not a CALL
+func calledProcedure(sqlQuery string) string {
+	words := strings.Fields(sqlQuery)
+	if len(words) < 2 || !strings.EqualFold(words[0], "call") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.SplitN(words[1], "(", 2)[0], ";")
+}
+
+// loadDataLocalStatement tells if the SQL sent in a COM_QUERY is a LOAD DATA or LOAD XML LOCAL INFILE, reading a
+// file of the client. Without LOCAL the file is read by the database server and the SQL is executed like any other.
+// The comments are stripped first, the database ignores them.
+func loadDataLocalStatement(sqlQuery string) bool {
+	words := strings.Fields(strings.ToLower(common.StripComments(sqlQuery)))
+	if len(words) < 4 || words[0] != "load" || (words[1] != "data" && words[1] != "xml") {
+		return false
+	}
+	words = words[2:]
+	if words[0] == "low_priority" || words[0] == "concurrent" {
+		words = words[1:]
+	}
+	return len(words) >= 2 && words[0] == "local" && words[1] == "infile"
+}
+
+// loadDataLocal rejects a LOAD DATA LOCAL INFILE with ER_NOT_ALLOWED_COMMAND, like a MySQL server with local_infile
+// disabled. The client would stream the file after the request of the server, Hera doesn't relay the file from the
+// mux to the worker, and the database connection of the worker doesn't have it.
+func (cp *CmdProcessor) loadDataLocal(sqlQuery string) (bool, error) {
+	if !loadDataLocalStatement(sqlQuery) {
+		return false, nil
+	}
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "LOAD DATA LOCAL INFILE is not allowed")
+	}
+	np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_NOT_ALLOWED_COMMAND, "The used command is not allowed with this Hera version"))
+	return true, cp.respond(np)
+}
+
+// sqlTooLong checks the length of the SQL of a MySQL prepare command. A SQL longer than maxSQLLength is
+// rejected with ER_NET_PACKET_TOO_LARGE instead of being prepared.
+func (cp *CmdProcessor) sqlTooLong(ns *encoding.Packet, sqlQuery string) (bool, error) {
+	err := cp.checkSQLLength(len(sqlQuery))
+	if err == nil {
+		return false, nil
+	}
+	np := cp.mysqlPacket(mysqlpackets.ERRPacket(common.ER_NET_PACKET_TOO_LARGE, err.Error()))
+	return true, cp.respond(np)
+}
+
+func (cp *CmdProcessor) calExecErr(field string, err string) {
+	// COM_QUERY doesn't start an EXEC transaction
+	if cp.calExecTxn == nil {
+		return
+	}
+	cp.calExecTxn.AddDataStr(field, err)
+	cp.calExecTxn.SetStatus(cal.TransError)
+	cp.calExecTxn.Completed()
+	cp.calExecTxn = nil
+}
+
+/**
+ * extract bindnames and save them in bindVars with their position index.
  * replace bindnames in query with "?"
  */
 func (cp *CmdProcessor) preprocess(packet *encoding.Packet) string {
-	//
-	// @TODO strip comment sections which could have ":".
-	//
-
 	var query string
 
 	if !packet.IsMySQL {
@@ -1154,18 +2549,19 @@ func (cp *CmdProcessor) preprocess(packet *encoding.Packet) string {
 		// WHERE account_number=:account_number
 		// and flags=:flags and return_url=:return_url,
 		//
-		binds := cp.regexBindName.FindAllString(query, -1)
+		locs := cp.bindNameIndexes(query, false)
 		//
 		// just create a new map for each query. the old map if any will be gc out later.
 		//
 		cp.bindVars = make(map[string]*BindValue)
-		cp.bindPos = make([]string, len(binds))
-		for i, val := range binds {
+		cp.bindPos = make([]string, len(locs))
+		for i, loc := range locs {
+			val := query[loc[0]:loc[1]]
 			cp.bindVars[val] = &(BindValue{index: i, name: val, valid: false, btype: btUnknown})
 			cp.bindPos[i] = val
 		}
-		if !(cp.adapter.UseBindNames()) {
-			query = cp.regexBindName.ReplaceAllString(query, "?")
+		if !(cp.adapter.UseBindNames()) && len(locs) > 0 {
+			query = replaceBindNames(query, locs)
 		}
 		return query
 	} else {
@@ -1181,7 +2577,11 @@ func (cp *CmdProcessor) preprocess(packet *encoding.Packet) string {
 		// WHERE account_number=:account_number
 		// and flags=:flags and return_url=:return_url,
 		//
-		binds := cp.regexBindName.FindAllString(query, -1)
+		locs := cp.bindNameIndexes(query, true)
+		binds := make([]string, len(locs))
+		for i, loc := range locs {
+			binds[i] = query[loc[0]:loc[1]]
+		}
 		logger.GetLogger().Log(logger.Debug, "Did some binding")
 		//
 		// just create a new map for each query. the old map if any will be gc out later.
@@ -1192,22 +2592,78 @@ func (cp *CmdProcessor) preprocess(packet *encoding.Packet) string {
 			cp.bindVars[val] = &(BindValue{index: i, name: val, valid: false, btype: btUnknown})
 			cp.bindPos[i] = val
 		}
-
-		// Get the number of columns in the query
-		logger.GetLogger().Log(logger.Debug, "pls")
-		splits := strings.Split(strings.ToLower(query), " as ")
-		logger.GetLogger().Log(logger.Debug, "really?", splits)
-		if len(splits) > 1 {
-			cp.bindOuts = strings.SplitN(splits[1], ",", -1)
-			cp.numColumns = len(cp.bindOuts)
-			cp.numBindOuts = cp.numColumns
+		// MySQL only knows the "?" placeholders, the bind names are replaced by one each, so that a name
+		// bound twice is two parameters. The parameters are the "?" outside of the strings and comments.
+		if len(locs) > 0 {
+			query = replaceBindNames(query, locs)
 		}
+		cp.numParams = strings.Count(common.MaskLiterals(query, true), "?")
+
+		cp.bindOuts = cp.bindOuts[:0]
+		cp.numBindOuts = 0
 		// cp.stmts[cp.currsid] = query
 		logger.GetLogger().Log(logger.Debug, "WHICH PART FAILED")
 		return query
 	}
 }
 
+// bindNameIndexes returns the positions of the bind names in query, in order. The ":" in strings and
+// comments, and in "::" casts, don't start bind names. mysql tells if query is lexed with the MySQL rules
+// or the standard ones.
+func (cp *CmdProcessor) bindNameIndexes(query string, mysql bool) [][]int {
+	masked := common.MaskLiterals(query, mysql)
+	locs := cp.regexBindName.FindAllStringIndex(masked, -1)
+	binds := locs[:0]
+	for _, loc := range locs {
+		if loc[0] > 0 && masked[loc[0]-1] == ':' {
+			continue
+		}
+		binds = append(binds, loc)
+	}
+	return binds
+}
+
+// replaceBindNames returns query with the bind names at locs, from bindNameIndexes, replaced by "?"
+func replaceBindNames(query string, locs [][]int) string {
+	var sb strings.Builder
+	prev := 0
+	for _, loc := range locs {
+		sb.WriteString(query[prev:loc[0]])
+		sb.WriteByte('?')
+		prev = loc[1]
+	}
+	sb.WriteString(query[prev:])
+	return sb.String()
+}
+
+// DumpBindState returns the bind variables extracted from the current statement, in the order they
+// appear in the query
+func (cp *CmdProcessor) DumpBindState() []BindState {
+	state := make([]BindState, 0, len(cp.bindPos))
+	for _, name := range cp.bindPos {
+		bv := cp.bindVars[name]
+		if bv == nil {
+			continue
+		}
+		state = append(state, BindState{Name: bv.name, Position: bv.index, Type: bv.btype.String(), DataType: bv.dataType, Valid: bv.valid,
+			MaxSize: bv.maxSize})
+	}
+	return state
+}
+
+// unknownBindName records that the client bound cp.currentBindName, which is not in the query. The binds
+// don't have a response, so the error is sent to the client by the execute. Only the first unknown bind
+// name is reported.
+func (cp *CmdProcessor) unknownBindName(calField string) {
+	if logger.GetLogger().V(logger.Warning) {
+		logger.GetLogger().Log(logger.Warning, "nonexisting bindname", cp.currentBindName)
+	}
+	if cp.bindErr == nil {
+		cp.bindErr = fmt.Errorf("bindname not found in query: %s", cp.currentBindName)
+		cp.calExecErr(calField, cp.currentBindName)
+	}
+}
+
 func (cp *CmdProcessor) isIdle() bool {
 	return !(cp.inCursor) && !(cp.inTrans)
 }
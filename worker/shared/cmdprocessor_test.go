@@ -0,0 +1,3029 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"github.com/paypal/hera/utility/encoding/netstring"
+)
+
+/* ---- test driver ------------------------------------------------------------
+* A minimal database/sql driver, so that the command processor can be tested
+* without a database. Every SELECT returns the rows in testRows, everything else
+* affects one row.
+ */
+
+var testColumns = []string{"id", "name"}
+var testColTypes = []string{"INT", "VARCHAR"}
+var testRows = [][]driver.Value{{int64(1), "one"}, {int64(2), "two"}}
+
+type testDriver struct{}
+type testConn struct{}
+type testTx struct{}
+type testStmt struct {
+	query string
+}
+type testResult struct {
+	rows int64
+}
+type testRowsType struct {
+	next int
+}
+
+func init() {
+	sql.Register("heratest", &testDriver{})
+}
+
+func (d *testDriver) Open(name string) (driver.Conn, error) {
+	return &testConn{}, nil
+}
+
+// testPrepares counts the statements prepared by the driver
+var testPrepares int
+
+// testBadQuery is a statement the driver fails to prepare
+const testBadQuery = "select nope from test"
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) {
+	testPrepares++
+	if query == testBadQuery {
+		return nil, errors.New("unknown column nope")
+	}
+	return &testStmt{query: query}, nil
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) Begin() (driver.Tx, error) {
+	return &testTx{}, nil
+}
+
+// testTxOptions are the options of the last transaction started
+var testTxOptions driver.TxOptions
+
+func (c *testConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	testTxOptions = opts
+	return &testTx{}, nil
+}
+
+// testCommits and testRollbacks count the transactions committed and rolled back
+var testCommits, testRollbacks int
+
+func (tx *testTx) Commit() error {
+	testCommits++
+	return nil
+}
+
+func (tx *testTx) Rollback() error {
+	testRollbacks++
+	return nil
+}
+
+func (s *testStmt) Close() error {
+	return nil
+}
+
+func (s *testStmt) NumInput() int {
+	return -1
+}
+
+// testExecArgs are the arguments of the last statement executed
+var testExecArgs []driver.Value
+
+// testExecQuery is the last statement executed
+var testExecQuery string
+
+// testSlowQuery is a statement the driver takes testSlowDuration to execute
+const testSlowQuery = "update test set name = 'slow'"
+const testSlowDuration = 20 * time.Millisecond
+
+// testFailValue is a parameter value the driver fails the statement for
+const testFailValue = "fail"
+
+// testUnknownSchemaQuery is a USE of a schema which doesn't exist, the driver fails it
+const testUnknownSchemaQuery = "USE `nope`"
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	testExecArgs = args
+	testExecQuery = s.query
+	if s.query == testUnknownSchemaQuery {
+		return nil, &mysql.MySQLError{Number: uint16(common.ER_BAD_DB_ERROR), Message: "Unknown database 'nope'"}
+	}
+	if s.query == testSlowQuery {
+		time.Sleep(testSlowDuration)
+	}
+	for _, arg := range args {
+		if arg == testFailValue {
+			return nil, errors.New("duplicate entry fail")
+		}
+	}
+	return &testResult{rows: 1}, nil
+}
+
+// testOutProc is a procedure setting its out bind to testOutValue
+const testOutProc = "begin test_proc(:out); end;"
+
+var testOutValue = strings.Repeat("out", 20000)
+
+// testOutDestLen is the length of the out bind destination of the last testOutProc call
+var testOutDestLen int
+
+func (s *testStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if _, ok := nv.Value.(sql.Out); ok {
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+// testBlockingQuery is a statement the driver executes until its context is canceled
+const testBlockingQuery = "update test set name = 'blocking'"
+
+func (s *testStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if s.query == testBlockingQuery {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if out, ok := arg.Value.(sql.Out); ok {
+			dest := out.Dest.(*string)
+			testOutDestLen = len(*dest)
+			if s.query == testOutProc {
+				*dest = testOutValue
+			}
+		}
+		values[i] = arg.Value
+	}
+	return s.Exec(values)
+}
+
+// testNoRowsQuery is a query for which the driver returns sql.ErrNoRows
+const testNoRowsQuery = "select id, name from test where 1 = 0"
+
+// testWarnings is the warning count the driver returns for warningCountQuery
+var testWarnings int64
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query == testNoRowsQuery {
+		return nil, sql.ErrNoRows
+	}
+	if s.query == warningCountQuery {
+		return &testCountRows{count: testWarnings}, nil
+	}
+	if s.query == testProcQuery {
+		return &testProcRows{}, nil
+	}
+	if s.query == currentSchemaQuery {
+		return &testSchemaRows{}, nil
+	}
+	return &testRowsType{}, nil
+}
+
+func (r *testResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (r *testResult) RowsAffected() (int64, error) {
+	return r.rows, nil
+}
+
+func (r *testRowsType) Columns() []string {
+	return testColumns
+}
+
+func (r *testRowsType) ColumnTypeDatabaseTypeName(index int) string {
+	return testColTypes[index]
+}
+
+func (r *testRowsType) Close() error {
+	return nil
+}
+
+func (r *testRowsType) Next(dest []driver.Value) error {
+	if r.next >= len(testRows) {
+		return io.EOF
+	}
+	copy(dest, testRows[r.next])
+	r.next++
+	return nil
+}
+
+// testProcQuery calls a procedure returning two result sets: the rows of testRows, then their names alone
+const testProcQuery = "call test_proc()"
+
+// testProcRows are the result sets of testProcQuery
+type testProcRows struct {
+	testRowsType
+	set int
+}
+
+func (r *testProcRows) Columns() []string {
+	return testColumns[r.set:]
+}
+
+func (r *testProcRows) ColumnTypeDatabaseTypeName(index int) string {
+	return testColTypes[r.set+index]
+}
+
+func (r *testProcRows) Next(dest []driver.Value) error {
+	if r.next >= len(testRows) {
+		return io.EOF
+	}
+	copy(dest, testRows[r.next][r.set:])
+	r.next++
+	return nil
+}
+
+func (r *testProcRows) HasNextResultSet() bool {
+	return r.set == 0
+}
+
+func (r *testProcRows) NextResultSet() error {
+	if r.set > 0 {
+		return io.EOF
+	}
+	r.set++
+	r.next = 0
+	return nil
+}
+
+// testCountRows is the single row result of a count
+type testCountRows struct {
+	count int64
+	done  bool
+}
+
+func (r *testCountRows) Columns() []string {
+	return []string{"count"}
+}
+
+func (r *testCountRows) Close() error {
+	return nil
+}
+
+func (r *testCountRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0] = r.count
+	r.done = true
+	return nil
+}
+
+// testSchema is the schema of the connection before any USE, NULL if nil
+var testSchema driver.Value = "test"
+
+// testSchemaRows is the single row result of currentSchemaQuery
+type testSchemaRows struct {
+	done bool
+}
+
+func (r *testSchemaRows) Columns() []string {
+	return []string{"DATABASE()"}
+}
+
+func (r *testSchemaRows) Close() error {
+	return nil
+}
+
+func (r *testSchemaRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0] = testSchema
+	r.done = true
+	return nil
+}
+
+type testAdapter struct {
+	bindNames bool
+}
+
+func (adapter *testAdapter) GetColTypeMap() map[string]int {
+	return map[string]int{"INT": 3, "VARCHAR": 5}
+}
+
+func (adapter *testAdapter) Heartbeat(db *sql.DB) bool {
+	return true
+}
+
+func (adapter *testAdapter) InitDB() (*sql.DB, error) {
+	return sql.Open("heratest", "")
+}
+
+func (adapter *testAdapter) ProcessError(errToProcess error, workerScope *WorkerScopeType, queryScope *QueryScopeType) {
+}
+
+func (adapter *testAdapter) ProcessResult(colType string, res string) string {
+	return res
+}
+
+func (adapter *testAdapter) ProcessMySQLResult(colType string, res string) string {
+	return res
+}
+
+func (adapter *testAdapter) UseBindNames() bool {
+	return adapter.bindNames
+}
+
+func (adapter *testAdapter) BindParamValue(mysqlType byte, unsigned bool, raw []byte) (interface{}, error) {
+	return mysqlpackets.BinaryParamValue(mysqlType, unsigned, raw)
+}
+
+/* ---- helpers ----------------------------------------------------------------
+ */
+
+// newTestCmdProcessor creates a command processor using the test driver. The responses the
+// processor writes to the mux can be read from the returned reader
+func newTestCmdProcessor(t testing.TB) (*CmdProcessor, *bufio.Reader) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("os.Pipe:", err.Error())
+	}
+	cp := NewCmdProcessor(&testAdapter{}, w)
+	err = cp.InitDB()
+	if err != nil {
+		t.Fatal("InitDB:", err.Error())
+	}
+	cp.moreIncomingRequests = func() bool {
+		return false
+	}
+	return cp, bufio.NewReader(r)
+}
+
+// mysqlCommand creates the packet the mux sends to the worker for a MySQL command
+func mysqlCommand(sqid int, payload []byte) *encoding.Packet {
+	return mysqlpackets.NewMySQLPacketFrom(sqid, payload)
+}
+
+// readEOR reads the next EOR response sent to the mux, returning the EOR code and the embedded
+// MySQL packet
+func readEOR(t *testing.T, reader *bufio.Reader) (int, *encoding.Packet) {
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil {
+		t.Fatal("reading response:", err.Error())
+	}
+	if ns.Cmd != common.CmdEOR {
+		t.Fatal("Expected EOR, instead got", ns.Cmd)
+	}
+	code := int(ns.Payload[0] - '0')
+	packet, err := mysqlpackets.NewMySQLPacket(bytes.NewReader(ns.Payload[3:]))
+	if err != nil {
+		t.Fatal("reading embedded packet:", err.Error())
+	}
+	return code, packet
+}
+
+// readResponse reads the next EOR response sent to the mux, returning the EOR code and all the MySQL packets
+// embedded in it, which the mux writes to the client
+func readResponse(t *testing.T, reader *bufio.Reader) (int, []*encoding.Packet) {
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil {
+		t.Fatal("reading response:", err.Error())
+	}
+	if ns.Cmd != common.CmdEOR {
+		t.Fatal("Expected EOR, instead got", ns.Cmd)
+	}
+	code := int(ns.Payload[0] - '0')
+	r := bytes.NewReader(ns.Payload[3:])
+	packet, err := mysqlpackets.NewMySQLPacket(r)
+	if err != nil {
+		t.Fatal("reading embedded packet:", err.Error())
+	}
+	packets := []*encoding.Packet{packet}
+	for r.Len() > 0 {
+		// the next packets don't have the indicator byte
+		packet, err = mysqlpackets.NewInitSQLPacket(r)
+		if err != nil {
+			t.Fatal("reading embedded packet", len(packets), ":", err.Error())
+		}
+		packets = append(packets, packet)
+	}
+	return code, packets
+}
+
+func TestQueryResultset(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	// the OK of an update is not sent again for the select after it
+	update := append([]byte{byte(common.COM_QUERY)}, "update test set name = 'one' where id = 1"...)
+	if err := cp.ProcessCmd(mysqlCommand(0, update)); err != nil {
+		t.Fatal("update:", err.Error())
+	}
+	if _, packet := readEOR(t, reader); packet.Cmd != 0x00 {
+		t.Fatal("Expected OK for the update, instead got", packet.Payload)
+	}
+
+	// the rows of a select are sent in a text resultset, then the next queries run on the free worker
+	for _, sql := range []string{"select id, name from test", "select id, name from test"} {
+		if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_QUERY)}, sql...))); err != nil {
+			t.Fatal("query:", err.Error())
+		}
+		code, packets := readResponse(t, reader)
+		rows, status, rest := readResultset(t, packets, len(testColumns))
+		if code != common.EORFree || len(rest) != 0 || status&mysqlpackets.SERVER_STATUS_CURSOR_EXISTS != 0 {
+			t.Fatal("Expected the whole resultset freeing the worker, instead got", code, status, len(rest), "packets after it")
+		}
+		if len(rows) != len(testRows) {
+			t.Fatal("Expected", len(testRows), "rows, instead got", len(rows))
+		}
+		for i, row := range rows {
+			// text rows are length encoded strings
+			pos := 0
+			id, _ := mysqlpackets.ReadString(row.Payload, mysqlpackets.LENENCSTR, &pos, 0)
+			name, _ := mysqlpackets.ReadString(row.Payload, mysqlpackets.LENENCSTR, &pos, 0)
+			if string(id) != strconv.FormatInt(testRows[i][0].(int64), 10) || string(name) != testRows[i][1] {
+				t.Log("Unexpected text row", i, row.Payload)
+				t.Fail()
+			}
+		}
+		if cp.rows != nil {
+			t.Fatal("Expected the rows closed after the resultset")
+		}
+	}
+}
+
+// readOKStatus returns the status flags in an OK packet
+func readOKStatus(t *testing.T, packet *encoding.Packet) int {
+	if packet.Cmd != 0x00 {
+		t.Fatal("Expected OK packet, instead got", packet.Payload)
+	}
+	pos := 1
+	mysqlpackets.ReadLenEncInt(packet.Payload, &pos) // affected rows
+	mysqlpackets.ReadLenEncInt(packet.Payload, &pos) // last insert id
+	return mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+}
+
+// readEOFStatus returns the status flags of an EOF packet, sent to a CLIENT_PROTOCOL_41 client
+func readEOFStatus(t *testing.T, packet *encoding.Packet) int {
+	if packet.Cmd != 0xfe || len(packet.Payload) < 5 {
+		t.Fatal("Expected EOF packet, instead got", packet.Payload)
+	}
+	pos := 3
+	return mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+}
+
+func TestCommitOverQuery(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("BEGIN")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("begin:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORInTransaction || readOKStatus(t, packet)&mysqlpackets.SERVER_STATUS_IN_TRANS == 0 {
+		t.Log("Expected OK in transaction after begin, instead got", code, packet.Payload)
+		t.Fail()
+	}
+
+	query = append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	code, packet = readEOR(t, reader)
+	if code != common.EORInTransaction {
+		t.Log("Expected EOR in transaction, instead got", code)
+		t.Fail()
+	}
+	status := readOKStatus(t, packet)
+	if status&mysqlpackets.SERVER_STATUS_IN_TRANS == 0 {
+		t.Log("Expected SERVER_STATUS_IN_TRANS after insert, status", status)
+		t.Fail()
+	}
+
+	query = append([]byte{byte(common.COM_QUERY)}, []byte("COMMIT;")...)
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("commit:", err.Error())
+	}
+	code, packet = readEOR(t, reader)
+	if code != common.EORFree {
+		t.Log("Expected EOR free, instead got", code)
+		t.Fail()
+	}
+	status = readOKStatus(t, packet)
+	if status&mysqlpackets.SERVER_STATUS_IN_TRANS != 0 {
+		t.Log("Expected SERVER_STATUS_IN_TRANS cleared after commit, status", status)
+		t.Fail()
+	}
+	if status&mysqlpackets.SERVER_STATUS_AUTOCOMMIT == 0 {
+		t.Log("Expected SERVER_STATUS_AUTOCOMMIT after commit, status", status)
+		t.Fail()
+	}
+	if cp.tx != nil || cp.inTrans {
+		t.Log("Transaction still open after commit")
+		t.Fail()
+	}
+}
+
+func TestStmtIdRoundTrip(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	// TODO: remove once NewCmdProcessor creates the map
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (1, 'one')")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	if packet.Cmd != 0x00 {
+		t.Fatal("Expected COM_STMT_PREPARE_OK, instead got", packet.Payload)
+	}
+	pos := 1
+	stmtid := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT4, &pos)
+	prepared, ok := cp.stmts[stmtid]
+	if !ok {
+		t.Fatal("Statement id", stmtid, "sent to the client is not a key in stmts", cp.stmts)
+	}
+
+	execute := make([]byte, 10)
+	pos = 0
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT1, common.COM_STMT_EXECUTE, &pos)
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT4, stmtid, &pos)
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT1, 0, &pos) // flags
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT4, 1, &pos) // iteration count
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	if cp.stmt != prepared {
+		t.Log("Execute used a different statement than the one prepared")
+		t.Fail()
+	}
+
+	stmtClose := make([]byte, 5)
+	pos = 0
+	mysqlpackets.WriteFixedLenInt(stmtClose, mysqlpackets.INT1, common.COM_STMT_CLOSE, &pos)
+	mysqlpackets.WriteFixedLenInt(stmtClose, mysqlpackets.INT4, stmtid, &pos)
+	err = cp.ProcessCmd(mysqlCommand(0, stmtClose))
+	if err != nil {
+		t.Fatal("close:", err.Error())
+	}
+	if _, ok = cp.stmts[stmtid]; ok {
+		t.Log("Statement", stmtid, "still in stmts after close")
+		t.Fail()
+	}
+}
+
+func TestStmtExecuteIterationCount(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (2, 'two')")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	pos := 1
+	stmtid := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT4, &pos)
+
+	execute := make([]byte, 10)
+	pos = 0
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT1, common.COM_STMT_EXECUTE, &pos)
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT4, stmtid, &pos)
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT1, 0, &pos) // flags
+	mysqlpackets.WriteFixedLenInt(execute, mysqlpackets.INT4, 2, &pos) // iteration count
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	if packet.Cmd != 0xff {
+		t.Fatal("Expected ERR packet, instead got", packet.Payload)
+	}
+	pos = 1
+	errno := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+	if errno != common.ER_NOT_SUPPORTED_YET {
+		t.Log("Expected error", common.ER_NOT_SUPPORTED_YET, "instead got", errno)
+		t.Fail()
+	}
+	if cp.result != nil {
+		t.Log("Statement without parameters executed with iteration count 2")
+		t.Fail()
+	}
+}
+
+// batchExecute builds a COM_STMT_EXECUTE of stmtid binding the (id, name) parameter sets, the types being
+// sent with the first set only
+func batchExecute(stmtid int, sets [][2]interface{}) []byte {
+	execute := []byte{byte(common.COM_STMT_EXECUTE), byte(stmtid), 0x00, 0x00, 0x00, 0x00, byte(len(sets)), 0x00, 0x00, 0x00}
+	for i, set := range sets {
+		execute = append(execute, 0x00) // null bitmap
+		if i == 0 {
+			execute = append(execute, 0x01, 0x08, 0x00, 0xfe, 0x00)
+		} else {
+			execute = append(execute, 0x00)
+		}
+		id := make([]byte, mysqlpackets.INT8)
+		pos := 0
+		mysqlpackets.WriteFixedLenInt(id, mysqlpackets.INT8, set[0].(int), &pos)
+		name := set[1].(string)
+		execute = append(execute, id...)
+		execute = append(execute, byte(len(name)))
+		execute = append(execute, name...)
+	}
+	return execute
+}
+
+func TestStmtExecuteBatch(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name)")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packet := readPrepareOK(t, reader)[0]
+	pos := 1
+	stmtid := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT4, &pos)
+
+	// every set is executed, in a transaction committed with the batch
+	commits, rollbacks := testCommits, testRollbacks
+	err = cp.ProcessCmd(mysqlCommand(0, batchExecute(stmtid, [][2]interface{}{{1, "one"}, {2, "two"}, {3, "three"}})))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree || packet.Cmd != 0x00 {
+		t.Fatal("Expected OK outside of a transaction, instead got", code, packet.Payload)
+	}
+	pos = 1
+	if rows, _ := mysqlpackets.ReadLenEncInt(packet.Payload, &pos); rows != 3 {
+		t.Log("Expected 3 rows affected, instead got", rows)
+		t.Fail()
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{int64(3), "three"}) {
+		t.Log("Expected the last set to be 3 and three, instead got", testExecArgs)
+		t.Fail()
+	}
+	if testCommits != commits+1 || testRollbacks != rollbacks {
+		t.Log("Expected the batch to be committed, commits", testCommits-commits, "rollbacks", testRollbacks-rollbacks)
+		t.Fail()
+	}
+
+	// a failing set aborts the batch and rolls back the sets before
+	commits, rollbacks = testCommits, testRollbacks
+	err = cp.ProcessCmd(mysqlCommand(0, batchExecute(stmtid, [][2]interface{}{{4, "four"}, {5, testFailValue}, {6, "six"}})))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	code, packet = readEOR(t, reader)
+	if code != common.EORFree || packet.Cmd != 0xff {
+		t.Fatal("Expected ERR outside of a transaction, instead got", code, packet.Payload)
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{int64(5), testFailValue}) {
+		t.Log("Expected the batch to stop at the failing set, instead executed", testExecArgs)
+		t.Fail()
+	}
+	if testCommits != commits || testRollbacks != rollbacks+1 {
+		t.Log("Expected the batch to be rolled back, commits", testCommits-commits, "rollbacks", testRollbacks-rollbacks)
+		t.Fail()
+	}
+
+	// in the transaction of the client only the batch is rolled back
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("BEGIN")...)
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("begin:", err.Error())
+	}
+	readEOR(t, reader)
+	commits, rollbacks = testCommits, testRollbacks
+	err = cp.ProcessCmd(mysqlCommand(0, batchExecute(stmtid, [][2]interface{}{{7, "seven"}, {8, testFailValue}})))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	code, packet = readEOR(t, reader)
+	if code != common.EORInTransaction || packet.Cmd != 0xff {
+		t.Log("Expected ERR in transaction, instead got", code, packet.Payload)
+		t.Fail()
+	}
+	if testExecQuery != "ROLLBACK TO SAVEPOINT "+batchSavepoint || testCommits != commits || testRollbacks != rollbacks || cp.tx == nil {
+		t.Log("Expected a rollback to the savepoint, instead got", testExecQuery, testCommits-commits, testRollbacks-rollbacks)
+		t.Fail()
+	}
+	err = cp.ProcessCmd(mysqlCommand(0, batchExecute(stmtid, [][2]interface{}{{7, "seven"}, {8, "eight"}})))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	code, packet = readEOR(t, reader)
+	if code != common.EORInTransaction || readOKStatus(t, packet)&mysqlpackets.SERVER_STATUS_IN_TRANS == 0 {
+		t.Log("Expected OK in transaction, instead got", code, packet.Payload)
+		t.Fail()
+	}
+	if testExecQuery != "RELEASE SAVEPOINT "+batchSavepoint || testCommits != commits {
+		t.Log("Expected the savepoint released and the transaction open, instead got", testExecQuery, testCommits-commits)
+		t.Fail()
+	}
+
+	// a set past the end of the packet
+	execute := batchExecute(stmtid, [][2]interface{}{{9, "nine"}})
+	execute[6] = 2
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	pos = 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_MALFORMED_PACKET {
+		t.Log("Expected ER_MALFORMED_PACKET, instead got", packet.Payload)
+		t.Fail()
+	}
+}
+
+func TestStmtExecuteReuseParams(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name)")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packet := readPrepareOK(t, reader)[0]
+	pos := 1
+	stmtid := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT4, &pos)
+
+	// executing without the new params flag before any types are bound
+	header := []byte{byte(common.COM_STMT_EXECUTE), byte(stmtid), 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	testExecArgs = nil
+	err = cp.ProcessCmd(mysqlCommand(0, append(header, 0x00, 0x00)))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	pos = 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_MALFORMED_PACKET || testExecArgs != nil {
+		t.Log("Expected ER_MALFORMED_PACKET, instead got", packet.Payload, testExecArgs)
+		t.Fail()
+	}
+
+	// the first execute binds the types
+	err = cp.ProcessCmd(mysqlCommand(0, batchExecute(stmtid, [][2]interface{}{{1, "one"}})))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{int64(1), "one"}) {
+		t.Log("Expected the parameters 1 and one, instead got", testExecArgs)
+		t.Fail()
+	}
+
+	// the next one sends the values only, with the same types
+	execute := append(header, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 't', 'w', 'o')
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{int64(2), "two"}) {
+		t.Log("Expected the parameters 2 and two, instead got", testExecArgs)
+		t.Fail()
+	}
+
+	// without values the last ones are bound again
+	testExecArgs = nil
+	err = cp.ProcessCmd(mysqlCommand(0, append(header, 0x00, 0x00)))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{int64(2), "two"}) {
+		t.Log("Expected the parameters 2 and two again, instead got", testExecArgs)
+		t.Fail()
+	}
+
+	// the parameters are forgotten with the statement
+	closeStmt := []byte{byte(common.COM_STMT_CLOSE), byte(stmtid), 0x00, 0x00, 0x00}
+	err = cp.ProcessCmd(mysqlCommand(0, closeStmt))
+	if err != nil {
+		t.Fatal("close:", err.Error())
+	}
+	if len(cp.stmtBinds) != 0 {
+		t.Log("Expected no parameters kept after the close, instead got", cp.stmtBinds)
+		t.Fail()
+	}
+}
+
+func TestStmtExecuteParams(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name, :note)")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packet := readPrepareOK(t, reader)[0]
+	pos := 1
+	stmtid := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT4, &pos)
+
+	// as sent by go-sql-driver for (-2, "two", nil)
+	execute := []byte{byte(common.COM_STMT_EXECUTE), byte(stmtid), 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x04, 0x01, 0x08, 0x00, 0xfe, 0x00, 0x06, 0x00,
+		0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x03, 't', 'w', 'o'}
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{int64(-2), "two", nil}) {
+		t.Log("Expected the parameters -2, two and NULL, instead got", testExecArgs)
+		t.Fail()
+	}
+	_, packet = readEOR(t, reader)
+	readOKStatus(t, packet)
+
+	// the string value goes past the end of the packet
+	execute[len(execute)-4] = 0x05
+	testExecArgs = nil
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	pos = 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_MALFORMED_PACKET {
+		t.Log("Expected ER_MALFORMED_PACKET, instead got", packet.Payload)
+		t.Fail()
+	}
+	if testExecArgs != nil {
+		t.Log("Statement executed from a malformed packet with", testExecArgs)
+		t.Fail()
+	}
+}
+
+// recordingAdapter records the parameters converted with BindParamValue, which it binds as "p1", "p2"...
+type recordingAdapter struct {
+	testAdapter
+	params []recordedParam
+}
+
+type recordedParam struct {
+	mysqlType byte
+	unsigned  bool
+	raw       []byte
+}
+
+func (adapter *recordingAdapter) BindParamValue(mysqlType byte, unsigned bool, raw []byte) (interface{}, error) {
+	adapter.params = append(adapter.params, recordedParam{mysqlType, unsigned, raw})
+	return fmt.Sprintf("p%d", len(adapter.params)), nil
+}
+
+func TestStmtExecuteBindParamValue(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	adapter := &recordingAdapter{}
+	cp.adapter = adapter
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name, :note)")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packet := readPrepareOK(t, reader)[0]
+	pos := 1
+	stmtid := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT4, &pos)
+
+	// an unsigned BIGINT, a string and NULL
+	execute := []byte{byte(common.COM_STMT_EXECUTE), byte(stmtid), 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x04, 0x01, 0x08, 0x80, 0xfe, 0x00, 0x06, 0x00,
+		0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 't', 'w', 'o'}
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	expected := []recordedParam{
+		{0x08, true, []byte{0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{0xfe, false, []byte("two")},
+		{0x06, false, nil},
+	}
+	if !reflect.DeepEqual(adapter.params, expected) {
+		t.Log("Expected the parameters converted by the adapter", expected, "instead got", adapter.params)
+		t.Fail()
+	}
+	if !reflect.DeepEqual(testExecArgs, []driver.Value{"p1", "p2", "p3"}) {
+		t.Log("Expected the values of the adapter bound, instead got", testExecArgs)
+		t.Fail()
+	}
+}
+
+// upperAdapter translates all the result values to uppercase
+type upperAdapter struct {
+	testAdapter
+}
+
+func (adapter *upperAdapter) ProcessMySQLResult(colType string, res string) string {
+	return strings.ToUpper(res)
+}
+
+func TestResultsetRowsProcessMySQLResult(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		cp, _ := newTestCmdProcessor(t)
+		cp.adapter = &upperAdapter{}
+
+		var err error
+		cp.rows, err = cp.db.Query("select id, name from test")
+		if err != nil {
+			t.Fatal("query:", err.Error())
+		}
+		rows, err := cp.mysqlResultsetRows(binary)
+		if err != nil {
+			t.Fatal("rows:", err.Error())
+		}
+		if len(rows) != len(testRows) {
+			t.Fatal("Expected", len(testRows), "rows, instead got", len(rows))
+		}
+		for i, row := range rows {
+			expected := strings.ToUpper(testRows[i][1].(string))
+			if !bytes.Contains(row, []byte(expected)) {
+				t.Log("binary", binary, "expected", expected, "in row", row)
+				t.Fail()
+			}
+			if bytes.Contains(row, []byte(testRows[i][1].(string))) {
+				t.Log("binary", binary, "value not translated in row", row)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	for _, cmd := range []int{common.COM_QUERY, common.COM_STMT_PREPARE} {
+		for _, sqlQuery := range []string{"", "  "} {
+			cp, reader := newTestCmdProcessor(t)
+			stmts := len(cp.stmts)
+
+			err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(cmd)}, []byte(sqlQuery)...)))
+			if err != nil {
+				t.Fatal(common.SQLcmds[cmd], err.Error())
+			}
+			_, packet := readEOR(t, reader)
+			if packet.Cmd != 0xff {
+				t.Fatal(common.SQLcmds[cmd], "expected ERR packet, instead got", packet.Payload)
+			}
+			pos := 1
+			errno := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+			if errno != common.ER_EMPTY_QUERY {
+				t.Log(common.SQLcmds[cmd], "expected error", common.ER_EMPTY_QUERY, "instead got", errno)
+				t.Fail()
+			}
+			if len(cp.stmts) != stmts {
+				t.Log(common.SQLcmds[cmd], "empty query added to stmts")
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestSocketOutWriter(t *testing.T) {
+	cp, _ := newTestCmdProcessor(t)
+	var out bytes.Buffer
+	cp.SocketOut = &out
+	cp.rqId = 0x0102
+
+	err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_QUERY)}))
+	if err != nil {
+		t.Fatal("empty query:", err.Error())
+	}
+	// the EOR netstring with the code, the request id and the ERR packet with its indicator
+	errPacket := mysqlpackets.NewMySQLPacketFrom(1, mysqlpackets.ERRPacket(common.ER_EMPTY_QUERY, "Query was empty"))
+	eor := append([]byte{byte('0' + common.EORFree), 0x01, 0x02}, errPacket.Serialized...)
+	expected := netstring.NewNetstringFrom(common.CmdEOR, eor).Serialized
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Log("Expected the frame", expected, "instead got", out.Bytes())
+		t.Fail()
+	}
+}
+
+func TestLoadDataLocal(t *testing.T) {
+	for sqlQuery, local := range map[string]bool{
+		"LOAD DATA LOCAL INFILE '/tmp/test.csv' INTO TABLE test":                   true,
+		"load data low_priority local infile 'test.csv' into table test":           true,
+		"  Load Data Concurrent\n Local InFile 'test.csv' REPLACE INTO TABLE test": true,
+		"LOAD XML LOCAL INFILE 'test.xml' INTO TABLE test":                         true,
+		"/* x */ LOAD DATA LOCAL INFILE 'test.csv' INTO TABLE test":                true,
+		"-- x\nload /* y */ data local infile 'test.csv' into table test":          true,
+		"LOAD DATA INFILE '/var/lib/mysql-files/test.csv' INTO TABLE test":         false,
+		"select 'load data local infile'":                                          false,
+		"load data":                                                                false,
+	} {
+		if loadDataLocalStatement(sqlQuery) != local {
+			t.Log("Expected", sqlQuery, "to be LOAD DATA LOCAL", local)
+			t.Fail()
+		}
+	}
+
+	// the query is rejected without reaching the database
+	cp, reader := newTestCmdProcessor(t)
+	testExecQuery = ""
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("LOAD DATA LOCAL INFILE 'test.csv' INTO TABLE test")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("load data:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	pos := 1
+	if code != common.EORFree || packet.Cmd != 0xff ||
+		mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_NOT_ALLOWED_COMMAND {
+		t.Log("Expected ER_NOT_ALLOWED_COMMAND, instead got", code, packet.Payload)
+		t.Fail()
+	}
+	if testExecQuery != "" {
+		t.Log("LOAD DATA LOCAL executed:", testExecQuery)
+		t.Fail()
+	}
+}
+
+// readPrepareOK reads the response to a COM_STMT_PREPARE, the COM_STMT_PREPARE_OK and the parameter definitions
+// ended by EOF, like the MySQL drivers do. The sequence ids must follow each other.
+func readPrepareOK(t *testing.T, reader *bufio.Reader) []*encoding.Packet {
+	_, packets := readResponse(t, reader)
+	if packets[0].Cmd != 0x00 {
+		t.Fatal("Expected COM_STMT_PREPARE_OK, instead got", packets[0].Payload)
+	}
+	for i, packet := range packets[1:] {
+		if packet.Sqid != packets[0].Sqid+1+i {
+			t.Fatal("Expected sequence id", packets[0].Sqid+1+i, "instead got", packet.Sqid)
+		}
+	}
+	if len(packets) > 1 && packets[len(packets)-1].Cmd != 0xfe {
+		t.Fatal("Expected the definitions to end with EOF, instead got", packets[len(packets)-1].Payload)
+	}
+	return packets
+}
+
+func TestStmtPrepareOKEOF(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name as n from test where id = :id")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packets := readPrepareOK(t, reader)
+	if packets[0].Sqid != 1 {
+		t.Fatal("Expected COM_STMT_PREPARE_OK with sequence id 1, instead got", packets[0].Sqid, packets[0].Payload)
+	}
+	// the parameter definition and EOF
+	if len(packets) != 3 {
+		t.Fatal("Expected 3 packets, instead got", len(packets))
+	}
+	def, err := mysqlpackets.ReadColumnDefinition(packets[1].Payload, cp.capabilities)
+	if err != nil || def.Name != "?" {
+		t.Log("Expected the definition of parameter ?, instead got", def, err)
+		t.Fail()
+	}
+	cp.SocketOut.(*os.File).Close()
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Log("Unexpected data after the prepare response")
+		t.Fail()
+	}
+}
+
+func TestStmtPrepareOKDeprecateEOF(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.capabilities |= uint32(mysqlpackets.CLIENT_DEPRECATE_EOF)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name as n from test where id = :id")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	if _, packets := readResponse(t, reader); len(packets) != 2 || packets[1].Cmd == 0xfe {
+		t.Log("Unexpected EOF packet with CLIENT_DEPRECATE_EOF")
+		t.Fail()
+	}
+}
+
+func TestStmtPrepareOKNoDefinitions(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.countWarnings = true
+	testWarnings = 2
+	defer func() { testWarnings = 0 }()
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("update test set name = 'x'")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packets := readPrepareOK(t, reader)
+	expected := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0x00, 2, 0}
+	if !bytes.Equal(packets[0].Payload, expected) {
+		t.Log("Expected COM_STMT_PREPARE_OK", expected, "instead got", packets[0].Payload)
+		t.Fail()
+	}
+	if len(packets) != 1 {
+		t.Log("Unexpected EOF packet without parameters")
+		t.Fail()
+	}
+}
+
+func TestImplicitTransaction(t *testing.T) {
+	// MySQL clients get autocommit by default
+	cp, reader := newTestCmdProcessor(t)
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree || cp.tx != nil || cp.inTrans {
+		t.Log("Expected the MySQL insert to autocommit, instead got EOR code", code)
+		t.Fail()
+	}
+	if readOKStatus(t, packet)&mysqlpackets.SERVER_STATUS_IN_TRANS != 0 {
+		t.Log("Unexpected SERVER_STATUS_IN_TRANS after the MySQL insert")
+		t.Fail()
+	}
+
+	cp, reader = newTestCmdProcessor(t)
+	cp.implicitTransMySQL = true
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	code, _ = readEOR(t, reader)
+	if code != common.EORInTransaction || cp.tx == nil {
+		t.Log("Expected the MySQL insert to start a transaction when configured, instead got EOR code", code)
+		t.Fail()
+	}
+
+	// netstring clients get a transaction by default
+	cp, _ = newTestCmdProcessor(t)
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdPrepare, []byte("insert into test values (1, 'one')")))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	if cp.tx == nil {
+		t.Log("Expected the netstring insert to start a transaction")
+		t.Fail()
+	}
+
+	cp, _ = newTestCmdProcessor(t)
+	cp.implicitTrans = false
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdPrepare, []byte("insert into test values (1, 'one')")))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	if cp.tx != nil {
+		t.Log("Unexpected transaction for the netstring insert when disabled")
+		t.Fail()
+	}
+}
+
+func TestReadOnlyTransaction(t *testing.T) {
+	for stmt, readOnly := range map[string]bool{"START TRANSACTION READ ONLY": true, "start transaction read write": false,
+		"start transaction with consistent snapshot, read only;": true, "begin": false} {
+		gotReadOnly, ok := beginTransStatement(stmt)
+		if !ok || gotReadOnly != readOnly {
+			t.Log("Expected read only", readOnly, "for", stmt, "instead got", gotReadOnly, ok)
+			t.Fail()
+		}
+	}
+	if _, ok := beginTransStatement("start transaction read"); ok {
+		t.Log("Unexpected transaction for an invalid modifier")
+		t.Fail()
+	}
+
+	cp, reader := newTestCmdProcessor(t)
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("START TRANSACTION READ ONLY")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("start transaction:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	status := readOKStatus(t, packet)
+	if code != common.EORInTransaction || status&mysqlpackets.SERVER_STATUS_IN_TRANS_READONLY == 0 || status&mysqlpackets.SERVER_STATUS_IN_TRANS == 0 {
+		t.Log("Expected OK in read only transaction, instead got", code, status)
+		t.Fail()
+	}
+	if !testTxOptions.ReadOnly {
+		t.Log("Transaction not started read only")
+		t.Fail()
+	}
+
+	query = append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	code, packet = readEOR(t, reader)
+	if code != common.EORInTransaction || packet.Cmd != 0xff {
+		t.Fatal("Expected ERR in transaction, instead got", code, packet.Payload)
+	}
+	pos := 1
+	errno := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+	if errno != common.ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION {
+		t.Log("Expected error", common.ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION, "instead got", errno)
+		t.Fail()
+	}
+
+	query = append([]byte{byte(common.COM_QUERY)}, []byte("COMMIT")...)
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("commit:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	if readOKStatus(t, packet)&mysqlpackets.SERVER_STATUS_IN_TRANS_READONLY != 0 || cp.readOnlyTrans {
+		t.Log("Read only status not cleared after commit")
+		t.Fail()
+	}
+}
+
+func TestNoRows(t *testing.T) {
+	// MySQL
+	cp, reader := newTestCmdProcessor(t)
+	query := append([]byte{byte(common.COM_QUERY)}, []byte(testNoRowsQuery)...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("query:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree || packet.Cmd != 0x00 {
+		t.Log("Expected OK for no rows, instead got", code, packet.Payload)
+		t.Fail()
+	}
+
+	// netstring
+	cp, reader = newTestCmdProcessor(t)
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdPrepare, []byte(testNoRowsQuery)))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdExecute, nil))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil {
+		t.Fatal("reading execute response:", err.Error())
+	}
+	if !ns.IsComposite() {
+		t.Fatal("Expected result set header, instead got", string(ns.Serialized))
+	}
+	nss, _ := netstring.SubNetstrings(ns)
+	if len(nss) < 2 || nss[0].Cmd != common.RcValue || string(nss[0].Payload) != "0" || string(nss[1].Payload) != "0" {
+		t.Log("Expected empty result set header, instead got", string(ns.Serialized))
+		t.Fail()
+	}
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdFetch, nil))
+	if err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	ns, err = netstring.NewNetstring(reader)
+	if err != nil {
+		t.Fatal("reading fetch response:", err.Error())
+	}
+	if ns.Cmd != common.CmdEOR || len(ns.Payload) < 3 {
+		t.Fatal("Expected EOR, instead got", string(ns.Serialized))
+	}
+	data, err := netstring.NewNetstring(bytes.NewReader(ns.Payload[3:]))
+	if err != nil || data.Cmd != common.RcNoMoreData {
+		t.Log("Expected no more data, instead got", string(ns.Payload), err)
+		t.Fail()
+	}
+}
+
+func TestMaxColumns(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.maxColumns = len(testColumns) - 1
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("select id, name from test")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("query:", err.Error())
+	}
+	if _, packet := readEOR(t, reader); packet.Cmd != 0xff || !strings.Contains(string(packet.Payload), ErrTooManyColumns.Error()) {
+		t.Log("Expected too many columns error, instead got", packet.Payload)
+		t.Fail()
+	}
+	if cp.rows != nil {
+		t.Log("Result set of the query still open")
+		t.Fail()
+	}
+
+	cp, reader = newTestCmdProcessor(t)
+	cp.maxColumns = len(testColumns) - 1
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdPrepare, []byte("select id, name from test")))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdExecute, nil))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, err = netstring.NewNetstring(reader)
+	if err != nil {
+		t.Fatal("reading execute response:", err.Error())
+	}
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdFetch, nil))
+	if err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR {
+		t.Fatal("Expected EOR, instead got", ns, err)
+	}
+	data, err := netstring.NewNetstring(bytes.NewReader(ns.Payload[3:]))
+	if err != nil || data.Cmd != common.RcSQLError || string(data.Payload) != ErrTooManyColumns.Error() {
+		t.Log("Expected too many columns error, instead got", string(ns.Payload), err)
+		t.Fail()
+	}
+	if cp.rows != nil {
+		t.Log("Result set still open")
+		t.Fail()
+	}
+}
+
+func TestDebug(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_DEBUG)}))
+	if err != nil {
+		t.Fatal("debug:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree {
+		t.Log("Expected EORFree, instead got", code)
+		t.Fail()
+	}
+	if packet.Cmd != 0xfe || packet.Sqid != 1 {
+		t.Fatal("Expected EOF packet with sequence id 1, instead got", packet.Sqid, packet.Payload)
+	}
+	pos := 3 // header, warnings
+	status := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+	if status != mysqlpackets.SERVER_STATUS_AUTOCOMMIT {
+		t.Log("Expected status", mysqlpackets.SERVER_STATUS_AUTOCOMMIT, "instead got", status)
+		t.Fail()
+	}
+}
+
+func TestChangeUser(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("BEGIN")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("begin:", err.Error())
+	}
+	readEOR(t, reader)
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name)")...)
+	err = cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+
+	// user bob, empty auth response, schema other
+	changeUser := []byte{byte(common.COM_CHANGE_USER), 'b', 'o', 'b', 0x00, 0x00, 'o', 't', 'h', 'e', 'r', 0x00}
+	err = cp.ProcessCmd(mysqlCommand(0, changeUser))
+	if err != nil {
+		t.Fatal("change user:", err.Error())
+	}
+	// the worker stays with the client using the schema
+	code, packet := readEOR(t, reader)
+	if code == common.EORFree || packet.Sqid != 1 {
+		t.Log("Expected the worker kept with sequence id 1, instead got", code, packet.Sqid)
+		t.Fail()
+	}
+	status := readOKStatus(t, packet)
+	if status&mysqlpackets.SERVER_STATUS_IN_TRANS != 0 || status&mysqlpackets.SERVER_STATUS_AUTOCOMMIT == 0 {
+		t.Log("Expected autocommit out of transaction after change user, status", status)
+		t.Fail()
+	}
+	if cp.tx != nil || cp.inTrans || len(cp.stmts) != 0 {
+		t.Log("Expected the transaction and statements reset, open statements", len(cp.stmts))
+		t.Fail()
+	}
+	if testExecQuery != "USE `other`" {
+		t.Log("Expected the schema of the change user to be used, instead executed", testExecQuery)
+		t.Fail()
+	}
+
+	// the user is not terminated
+	err = cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_CHANGE_USER), 'b'}))
+	if err != nil {
+		t.Fatal("change user:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_MALFORMED_PACKET {
+		t.Log("Expected malformed packet error, instead got", packet.Payload)
+		t.Fail()
+	}
+
+	// without a schema the new user gets the one of the connection, the worker is freed
+	err = cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_CHANGE_USER), 'b', 'o', 'b', 0x00, 0x00, 0x00}))
+	if err != nil {
+		t.Fatal("change user:", err.Error())
+	}
+	code, _ = readEOR(t, reader)
+	if code != common.EORFree || testExecQuery != "USE `test`" {
+		t.Log("Expected the schema test restored and EORFree, instead got", code, testExecQuery)
+		t.Fail()
+	}
+}
+
+func TestInitDB(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_INIT_DB)}, []byte("sa`les")...)))
+	if err != nil {
+		t.Fatal("init db:", err.Error())
+	}
+	// the schema is the one of the client, the worker is not freed
+	code, packet := readEOR(t, reader)
+	if code != common.EORInSessionNotInTransaction || packet.Cmd != 0x00 {
+		t.Fatal("Expected OK keeping the worker, instead got", code, packet.Payload)
+	}
+	if testExecQuery != "USE `sa``les`" {
+		t.Log("Expected the schema to be used, instead executed", testExecQuery)
+		t.Fail()
+	}
+	err = cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)))
+	if err != nil {
+		t.Fatal("query:", err.Error())
+	}
+	if code, _ = readEOR(t, reader); code != common.EORInSessionNotInTransaction {
+		t.Log("Expected the worker kept after the next command, instead got", code)
+		t.Fail()
+	}
+
+	// the errors of the server keep their number
+	err = cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_INIT_DB)}, []byte("nope")...)))
+	if err != nil {
+		t.Fatal("init db:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	erresp, err := mysqlpackets.ReadERRPacket(packet.Payload, cp.capabilities)
+	if err != nil || erresp.Code != common.ER_BAD_DB_ERROR || erresp.SQLState != "42000" {
+		t.Log("Expected an unknown database error, instead got", erresp, err)
+		t.Fail()
+	}
+
+	// the recovery of the worker puts back the schema of the connection and frees it
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdRollback, nil))
+	if err != nil {
+		t.Fatal("rollback:", err.Error())
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR || int(ns.Payload[0]-'0') != common.EORFree || testExecQuery != "USE `test`" {
+		t.Log("Expected the schema test restored and EORFree, instead got", ns, err, testExecQuery)
+		t.Fail()
+	}
+}
+
+func TestUseStatement(t *testing.T) {
+	for sql, expected := range map[string]string{"use sales": "sales", " USE `sa``les`; ": "sa`les", "Use `my db`": "my db"} {
+		if schema, ok := useStatement(sql); !ok || schema != expected {
+			t.Log("Expected", expected, "for", sql, "got", schema, ok)
+			t.Fail()
+		}
+	}
+	for _, sql := range []string{"select 1", "use", "use a b", "user sales", "use `sales"} {
+		if _, ok := useStatement(sql); ok {
+			t.Log("Unexpected use statement", sql)
+			t.Fail()
+		}
+	}
+}
+
+func TestQueryUse(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.capabilities |= uint32(mysqlpackets.CLIENT_SESSION_TRACK)
+
+	err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_QUERY)}, []byte("use `sa``les`;")...)))
+	if err != nil {
+		t.Fatal("use:", err.Error())
+	}
+	// the schema is recorded like for COM_INIT_DB and the client is told the new one
+	code, packet := readEOR(t, reader)
+	if code == common.EORFree || cp.schema != "sa`les" || testExecQuery != "USE `sa``les`" {
+		t.Fatal("Expected the schema used keeping the worker, instead got", code, cp.schema, testExecQuery)
+	}
+	ok, err := mysqlpackets.ReadOKPacket(packet.Payload, cp.capabilities)
+	if err != nil || ok.Schema != "sa`les" {
+		t.Log("Expected OK with the schema change, instead got", packet.Payload, err)
+		t.Fail()
+	}
+}
+
+func TestInitDBNoDefaultSchema(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	testSchema = nil
+	defer func() { testSchema = "test" }()
+
+	err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_INIT_DB)}, []byte("sales")...)))
+	if err != nil {
+		t.Fatal("init db:", err.Error())
+	}
+	readEOR(t, reader)
+	// the worker can't go back to no schema, it fails instead of serving another client
+	if err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdRollback, nil)); err == nil {
+		t.Log("Expected the recovery to fail")
+		t.Fail()
+	}
+}
+
+func TestProtocol320(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.capabilities = uint32(mysqlpackets.CLIENT_TRANSACTIONS)
+
+	// the OK packet has the status flags but no warnings
+	err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)))
+	if err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	ok, err := mysqlpackets.ReadOKPacket(packet.Payload, cp.capabilities)
+	if err != nil || ok.StatusFlags&mysqlpackets.SERVER_STATUS_AUTOCOMMIT == 0 || len(packet.Payload) != 1+1+1+mysqlpackets.INT2 {
+		t.Log("Unexpected OK packet without CLIENT_PROTOCOL_41", packet.Payload, ok, err)
+		t.Fail()
+	}
+
+	// the ERR packet has no SQL state
+	err = cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_INIT_DB)}, []byte("nope")...)))
+	if err != nil {
+		t.Fatal("init db:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_BAD_DB_ERROR ||
+		packet.Payload[pos] == '#' {
+		t.Log("Unexpected ERR packet without CLIENT_PROTOCOL_41", packet.Payload)
+		t.Fail()
+	}
+}
+
+func TestControlMsgCapabilities(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	// a client without CLIENT_PROTOCOL_41 gets OK packets without the warnings
+	capabilities := uint32(mysqlpackets.CLIENT_TRANSACTIONS)
+	msg := common.ControlMsgCapabilities + strconv.Itoa(int(capabilities))
+	err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdControlMsg, []byte(msg)))
+	if err != nil {
+		t.Fatal("control message:", err.Error())
+	}
+	if cp.capabilities != capabilities {
+		t.Fatal("Expected capabilities", capabilities, "instead got", cp.capabilities)
+	}
+	err = cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_RESET_CONNECTION)}))
+	if err != nil {
+		t.Fatal("reset connection:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	ok, err := mysqlpackets.ReadOKPacket(packet.Payload, capabilities)
+	if err != nil || len(packet.Payload) != 5 || ok.StatusFlags != mysqlpackets.SERVER_STATUS_AUTOCOMMIT {
+		t.Log("Expected OK packet with the status only, instead got", packet.Payload, err)
+		t.Fail()
+	}
+
+	// a malformed message is ignored
+	err = cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdControlMsg, []byte(common.ControlMsgCapabilities+"x")))
+	if err != nil || cp.capabilities != capabilities {
+		t.Log("Expected the capabilities unchanged, instead got", cp.capabilities, err)
+		t.Fail()
+	}
+}
+
+func TestResetConnection(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("BEGIN")...)
+	err := cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("begin:", err.Error())
+	}
+	readEOR(t, reader)
+
+	err = cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_RESET_CONNECTION)}))
+	if err != nil {
+		t.Fatal("reset connection:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree {
+		t.Log("Expected EORFree, instead got", code)
+		t.Fail()
+	}
+	if readOKStatus(t, packet)&mysqlpackets.SERVER_STATUS_IN_TRANS != 0 || cp.tx != nil {
+		t.Log("Expected the transaction rolled back by the reset")
+		t.Fail()
+	}
+}
+
+func TestCommandSequenceIds(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	// the response to COM_STMT_PREPARE takes several sequence ids
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name)")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	if packets := readPrepareOK(t, reader); len(packets) <= 1 {
+		t.Fatal("Expected more than one packet in the prepare response, instead got", len(packets))
+	}
+
+	// the next command starts over with sequence id 0
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)
+	err = cp.ProcessCmd(mysqlCommand(0, query))
+	if err != nil {
+		t.Fatal("query:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	if packet.Sqid != 1 {
+		t.Log("Expected response with sequence id 1, instead got", packet.Sqid)
+		t.Fail()
+	}
+}
+
+func TestResponseSequenceIds(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	// the packets of the response continue from the sequence id of the request
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name from test where id = :id")...)
+	err := cp.ProcessCmd(mysqlCommand(4, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packets := readPrepareOK(t, reader)
+	for i, packet := range packets {
+		if packet.Sqid != 5+i {
+			t.Fatal("Expected sequence id", 5+i, "instead got", packet.Sqid)
+		}
+	}
+}
+
+func TestPreprocessBindsOutsideLiterals(t *testing.T) {
+	cp, _ := newTestCmdProcessor(t)
+	for _, tc := range []struct {
+		query    string
+		expected string
+		binds    []string
+	}{
+		{"select name from test where note = ':not_a_bind' and id = :id",
+			"select name from test where note = ':not_a_bind' and id = ?", []string{":id"}},
+		{"select id::text from test where name = :name and id = :id",
+			"select id::text from test where name = ? and id = ?", []string{":name", ":id"}},
+		{"select 'C:\\' as dir, name from test where id = :id -- :old",
+			"select 'C:\\' as dir, name from test where id = ? -- :old", []string{":id"}},
+	} {
+		query := cp.preprocess(netstring.NewNetstringFrom(common.CmdPrepare, []byte(tc.query)))
+		if query != tc.expected {
+			t.Logf("Expected %q instead got %q", tc.expected, query)
+			t.Fail()
+		}
+		if len(cp.bindPos) != len(tc.binds) || len(cp.bindVars) != len(tc.binds) {
+			t.Log("Expected binds", tc.binds, "instead got", cp.bindPos)
+			t.Fail()
+			continue
+		}
+		for i, name := range tc.binds {
+			if cp.bindPos[i] != name || cp.bindVars[name] == nil || cp.bindVars[name].index != i {
+				t.Log("Expected binds", tc.binds, "instead got", cp.bindPos)
+				t.Fail()
+				break
+			}
+		}
+	}
+}
+
+func TestDumpBindState(t *testing.T) {
+	cp, _ := newTestCmdProcessor(t)
+	err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdPrepare, []byte("select name from test where id = :id and name = :name")))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	for _, cmd := range []*encoding.Packet{
+		netstring.NewNetstringFrom(common.CmdBindName, []byte("name")),
+		netstring.NewNetstringFrom(common.CmdBindValue, []byte("one")),
+	} {
+		if err = cp.ProcessCmd(cmd); err != nil {
+			t.Fatal("bind:", err.Error())
+		}
+	}
+
+	expected := []BindState{
+		{Name: ":id", Position: 0, Type: "unknown"},
+		{Name: ":name", Position: 1, Type: "in", DataType: common.DataTypeString, Valid: true},
+	}
+	state := cp.DumpBindState()
+	if len(state) != len(expected) {
+		t.Fatal("Expected", expected, "instead got", state)
+	}
+	for i := range expected {
+		if state[i] != expected[i] {
+			t.Log("Expected", expected[i], "instead got", state[i])
+			t.Fail()
+		}
+	}
+}
+
+func TestUnknownBindName(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	for _, cmd := range []*encoding.Packet{
+		netstring.NewNetstringFrom(common.CmdPrepare, []byte("select name from test where id = :id")),
+		netstring.NewNetstringFrom(common.CmdBindName, []byte("idd")),
+		netstring.NewNetstringFrom(common.CmdBindType, []byte("1")),
+		netstring.NewNetstringFrom(common.CmdBindValue, []byte("1")),
+		netstring.NewNetstringFrom(common.CmdExecute, nil),
+	} {
+		// the worker must stay up to report the error
+		if err := cp.ProcessCmd(cmd); err != nil {
+			t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+		}
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR {
+		t.Fatal("Expected EOR, instead got", ns, err)
+	}
+	data, err := netstring.NewNetstring(bytes.NewReader(ns.Payload[3:]))
+	if err != nil || data.Cmd != common.RcError || string(data.Payload) != "bindname not found in query: :idd" {
+		t.Fatal("Expected RcError for the unknown bind name, instead got", string(ns.Payload), err)
+	}
+
+	// the next statement runs normally
+	for _, cmd := range []*encoding.Packet{
+		netstring.NewNetstringFrom(common.CmdPrepare, []byte("update test set name = :name")),
+		netstring.NewNetstringFrom(common.CmdBindName, []byte("name")),
+		netstring.NewNetstringFrom(common.CmdBindValue, []byte("one")),
+		netstring.NewNetstringFrom(common.CmdExecute, nil),
+	} {
+		if err := cp.ProcessCmd(cmd); err != nil {
+			t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+		}
+	}
+	ns, err = netstring.NewNetstring(reader)
+	if err != nil {
+		t.Fatal("reading execute response:", err.Error())
+	}
+	if ns.Cmd == common.CmdEOR {
+		if data, _ = netstring.NewNetstring(bytes.NewReader(ns.Payload[3:])); data != nil && data.Cmd == common.RcError {
+			t.Log("Unexpected error after the unknown bind name", string(data.Payload))
+			t.Fail()
+		}
+	}
+}
+
+func TestMaxSQLLength(t *testing.T) {
+	longQuery := "select id from test where name = '" + strings.Repeat("x", 100) + "'"
+
+	// MySQL
+	cp, reader := newTestCmdProcessor(t)
+	cp.maxSQLLength = 100
+	prepares := testPrepares
+	err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, []byte(longQuery)...)))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	if packet.Cmd != 0xff {
+		t.Fatal("Expected ERR packet, instead got", packet.Payload)
+	}
+	pos := 1
+	if errno := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos); errno != common.ER_NET_PACKET_TOO_LARGE {
+		t.Log("Expected error", common.ER_NET_PACKET_TOO_LARGE, "instead got", errno)
+		t.Fail()
+	}
+	if testPrepares != prepares {
+		t.Log("The SQL was prepared")
+		t.Fail()
+	}
+
+	// netstring, the error comes with the execute
+	cp, reader = newTestCmdProcessor(t)
+	cp.maxSQLLength = 100
+	for _, cmd := range []*encoding.Packet{
+		netstring.NewNetstringFrom(common.CmdPrepare, []byte(longQuery)),
+		netstring.NewNetstringFrom(common.CmdExecute, nil),
+	} {
+		if err = cp.ProcessCmd(cmd); err != nil {
+			t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+		}
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR {
+		t.Fatal("Expected EOR, instead got", ns, err)
+	}
+	data, err := netstring.NewNetstring(bytes.NewReader(ns.Payload[3:]))
+	if err != nil || data.Cmd != common.RcSQLError || string(data.Payload) != ErrSQLTooLong.Error() {
+		t.Log("Expected SQL too long error, instead got", string(ns.Payload), err)
+		t.Fail()
+	}
+	if testPrepares != prepares {
+		t.Log("The SQL was prepared")
+		t.Fail()
+	}
+}
+
+func TestWarningCount(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	testWarnings = 3
+	defer func() { testWarnings = 0 }()
+	for _, countWarnings := range []bool{false, true} {
+		cp.countWarnings = countWarnings
+		query := append([]byte{byte(common.COM_QUERY)}, []byte("update test set name = 'x'")...)
+		if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+			t.Fatal("update:", err.Error())
+		}
+		_, packet := readEOR(t, reader)
+		ok, err := mysqlpackets.ReadOKPacket(packet.Payload, uint32(mysqlpackets.CLIENT_PROTOCOL_41))
+		if err != nil {
+			t.Fatal("Expected OK packet, instead got", packet.Payload, err)
+		}
+		expected := 0
+		if countWarnings {
+			expected = int(testWarnings)
+		}
+		if ok.Warnings != expected {
+			t.Log("count warnings", countWarnings, "expected", expected, "warnings, instead got", ok.Warnings)
+			t.Fail()
+		}
+	}
+}
+
+func TestBindValueNUL(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	value := []byte("a\x00b\x00")
+	for _, dataType := range []common.DataType{common.DataTypeString, common.DataTypeBlob} {
+		for _, cmd := range []*encoding.Packet{
+			netstring.NewNetstringFrom(common.CmdPrepare, []byte("update test set name = :name")),
+			netstring.NewNetstringFrom(common.CmdBindName, []byte("name")),
+			netstring.NewNetstringFrom(common.CmdBindType, []byte(strconv.Itoa(int(dataType)))),
+			netstring.NewNetstringFrom(common.CmdBindValue, value),
+			netstring.NewNetstringFrom(common.CmdExecute, nil),
+		} {
+			if err := cp.ProcessCmd(cmd); err != nil {
+				t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+			}
+		}
+		if _, err := netstring.NewNetstring(reader); err != nil {
+			t.Fatal("Expected EOR, instead got", err)
+		}
+		if len(testExecArgs) != 1 {
+			t.Fatal("data type", dataType, "expected one argument, instead got", testExecArgs)
+		}
+		var arg []byte
+		switch v := testExecArgs[0].(type) {
+		case string:
+			arg = []byte(v)
+		case []byte:
+			arg = v
+		}
+		if !bytes.Equal(arg, value) {
+			t.Log("data type", dataType, "expected", value, "instead got", testExecArgs[0])
+			t.Fail()
+		}
+		if err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdCommit, nil)); err != nil {
+			t.Fatal("commit:", err.Error())
+		}
+		if _, err := netstring.NewNetstring(reader); err != nil {
+			t.Fatal("Expected commit EOR, instead got", err)
+		}
+	}
+}
+
+func TestBindValueEmpty(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	for _, tc := range []struct {
+		dataType common.DataType
+		expected driver.Value
+	}{
+		{common.DataTypeString, nil},
+		{common.DataTypeTimestamp, nil},
+		{common.DataTypeTimestampTZ, nil},
+		{common.DataTypeBlob, []byte{}},
+		{common.DataTypeRaw, []byte{}},
+	} {
+		for _, cmd := range []*encoding.Packet{
+			netstring.NewNetstringFrom(common.CmdPrepare, []byte("update test set name = :name")),
+			netstring.NewNetstringFrom(common.CmdBindName, []byte("name")),
+			netstring.NewNetstringFrom(common.CmdBindType, []byte(strconv.Itoa(int(tc.dataType)))),
+			netstring.NewNetstringFrom(common.CmdBindValue, nil),
+			netstring.NewNetstringFrom(common.CmdExecute, nil),
+		} {
+			if err := cp.ProcessCmd(cmd); err != nil {
+				t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+			}
+		}
+		if _, err := netstring.NewNetstring(reader); err != nil {
+			t.Fatal("Expected EOR, instead got", err)
+		}
+		if len(testExecArgs) != 1 {
+			t.Fatal("data type", tc.dataType, "expected one argument, instead got", testExecArgs)
+		}
+		arg := testExecArgs[0]
+		if tc.expected == nil {
+			if arg != nil {
+				t.Log("data type", tc.dataType, "expected NULL, instead got", arg)
+				t.Fail()
+			}
+		} else if v, ok := arg.([]byte); !ok || v == nil || len(v) != 0 {
+			t.Log("data type", tc.dataType, "expected an empty value, instead got", arg)
+			t.Fail()
+		}
+		if err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdCommit, nil)); err != nil {
+			t.Fatal("commit:", err.Error())
+		}
+		if _, err := netstring.NewNetstring(reader); err != nil {
+			t.Fatal("Expected commit EOR, instead got", err)
+		}
+	}
+}
+
+func TestBindValueClob(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	value := strings.Repeat("caf\u00e9 \u00fcber ", 1000)
+	for _, cmd := range []*encoding.Packet{
+		netstring.NewNetstringFrom(common.CmdPrepare, []byte("update test set name = :name")),
+		netstring.NewNetstringFrom(common.CmdBindName, []byte("name")),
+		netstring.NewNetstringFrom(common.CmdBindType, []byte(strconv.Itoa(common.DataTypeClob))),
+		netstring.NewNetstringFrom(common.CmdBindValue, []byte(value)),
+		netstring.NewNetstringFrom(common.CmdExecute, nil),
+	} {
+		if err := cp.ProcessCmd(cmd); err != nil {
+			t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+		}
+	}
+	if _, err := netstring.NewNetstring(reader); err != nil {
+		t.Fatal("Expected EOR, instead got", err)
+	}
+	if len(testExecArgs) != 1 || testExecArgs[0] != value {
+		t.Log("Expected the CLOB of length", len(value), "instead got", len(testExecArgs))
+		t.Fail()
+	}
+	if state := cp.DumpBindState(); len(state) != 1 || state[0].DataType != common.DataTypeClob {
+		t.Log("Expected a CLOB bind, instead got", state)
+		t.Fail()
+	}
+}
+
+func TestBindValueMaxSize(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("os.Pipe:", err.Error())
+	}
+	cp := NewCmdProcessor(&testAdapter{bindNames: true}, w)
+	if err = cp.InitDB(); err != nil {
+		t.Fatal("InitDB:", err.Error())
+	}
+	cp.moreIncomingRequests = func() bool {
+		return false
+	}
+	reader := bufio.NewReader(r)
+	maxSize := len(testOutValue) + 100
+	for _, cmd := range []*encoding.Packet{
+		netstring.NewNetstringFrom(common.CmdPrepare, []byte(testOutProc)),
+		netstring.NewNetstringFrom(common.CmdBindOutName, []byte("out")),
+		netstring.NewNetstringFrom(common.CmdBindValueMaxSize, []byte(strconv.Itoa(maxSize))),
+		netstring.NewNetstringFrom(common.CmdExecute, nil),
+	} {
+		if err = cp.ProcessCmd(cmd); err != nil {
+			t.Fatal("command", cmd.Cmd, "failed:", err.Error())
+		}
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR {
+		t.Fatal("Expected EOR, instead got", ns, err)
+	}
+	// the destination starts empty, an out bind the driver doesn't set comes back empty
+	if testOutDestLen != 0 {
+		t.Log("Expected an empty out bind destination, instead got", testOutDestLen, "bytes")
+		t.Fail()
+	}
+	if state := cp.DumpBindState(); len(state) != 1 || state[0].MaxSize != maxSize {
+		t.Log("Expected the max size", maxSize, "in the bind state, instead got", state)
+		t.Fail()
+	}
+	// row count, out bind flag, then the out bind value
+	data, err := netstring.NewNetstring(bytes.NewReader(ns.Payload[3:]))
+	if err != nil {
+		t.Fatal("Expected the execute response, instead got", err)
+	}
+	nss, err := netstring.SubNetstrings(data)
+	if err != nil || len(nss) != 4 || string(nss[3].Payload) != testOutValue {
+		t.Log("Expected the out bind value of length", len(testOutValue), "instead got", len(nss), err)
+		t.Fail()
+	}
+}
+
+func TestShardCommands(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.numShards = 3
+
+	// the shard key has no response of its own
+	if err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdShardKey, []byte("id=1"))); err != nil {
+		t.Fatal("shard key:", err.Error())
+	}
+	if cp.shardKey != "id=1" {
+		t.Log("Expected shard key id=1, instead got", cp.shardKey)
+		t.Fail()
+	}
+
+	for _, tc := range []struct {
+		cmd     int
+		payload string
+		rc      int
+		result  string
+	}{
+		{common.CmdSetShardID, "2", common.RcOK, ""},
+		{common.CmdSetShardID, "3", common.RcError, ErrBadShardID.Error()},
+		{common.CmdSetShardID, "x", common.RcError, ErrBadShardID.Error()},
+		{common.CmdGetNumShards, "", common.RcOK, "3"},
+		{common.CmdSetShardID, "-1", common.RcOK, ""},
+	} {
+		if err := cp.ProcessCmd(netstring.NewNetstringFrom(tc.cmd, []byte(tc.payload))); err != nil {
+			t.Fatal("command", tc.cmd, "failed:", err.Error())
+		}
+		ns, err := netstring.NewNetstring(reader)
+		if err != nil || ns.Cmd != common.CmdEOR {
+			t.Fatal("Expected EOR, instead got", ns, err)
+		}
+		data, err := netstring.NewNetstring(bytes.NewReader(ns.Payload[3:]))
+		if err != nil || data.Cmd != tc.rc || string(data.Payload) != tc.result {
+			t.Log("command", tc.cmd, tc.payload, "expected", tc.rc, tc.result, "instead got", data, err)
+			t.Fail()
+		}
+		if tc.cmd == common.CmdSetShardID && tc.rc == common.RcOK && strconv.Itoa(cp.shardID) != tc.payload {
+			t.Log("Expected shard id", tc.payload, "instead got", cp.shardID)
+			t.Fail()
+		}
+	}
+}
+
+func TestEORNewCmdProcessor(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("os.Pipe:", err.Error())
+	}
+	reader := bufio.NewReader(r)
+	cp := NewCmdProcessor(&testAdapter{}, w)
+	for _, more := range []func() bool{cp.moreIncomingRequests, nil} {
+		cp.moreIncomingRequests = more
+		if err = cp.eor(common.EORFree, netstring.NewNetstringFrom(common.RcOK, nil)); err != nil {
+			t.Fatal("eor:", err.Error())
+		}
+		ns, err := netstring.NewNetstring(reader)
+		if err != nil || ns.Cmd != common.CmdEOR || int(ns.Payload[0]-'0') != common.EORFree {
+			t.Log("Expected EORFree, instead got", ns, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestStmtParams(t *testing.T) {
+	// the map is allocated by NewCmdProcessor, the first prepare doesn't need any setup
+	cp, reader := newTestCmdProcessor(t)
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("insert into test values (:id, :name)")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+	if len(cp.stmtParams) != 1 || cp.stmtParams[1] != 2 {
+		t.Fatal("Expected 2 parameters for statement 1, instead got", cp.stmtParams)
+	}
+
+	// closing the statement drops its parameter count
+	if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_STMT_CLOSE), 1, 0, 0, 0})); err != nil {
+		t.Fatal("close:", err.Error())
+	}
+	if len(cp.stmtParams) != 0 || len(cp.stmts) != 0 {
+		t.Log("Expected no statement left after the close, instead got", cp.stmtParams, len(cp.stmts))
+		t.Fail()
+	}
+}
+
+func TestStmtCloseMalformed(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name from test")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+
+	// the packet without the whole statement id is ignored, without a response
+	if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_STMT_CLOSE), 1, 0})); err != nil {
+		t.Fatal("close:", err.Error())
+	}
+	if len(cp.stmts) != 1 {
+		t.Fatal("Expected the statement still prepared, instead got", len(cp.stmts), "statements")
+	}
+
+	// the next response is the one of the next command
+	if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_DEBUG)})); err != nil {
+		t.Fatal("debug:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	readEOFStatus(t, packet)
+}
+
+func TestStmtFetchMalformed(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	// the statement id without the number of rows
+	if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_STMT_FETCH), 1, 0, 0, 0})); err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_MALFORMED_PACKET {
+		t.Fatal("Expected a malformed packet error, instead got", packet.Payload)
+	}
+	if code != common.EORFree {
+		t.Log("Expected EOR free, instead got", code)
+		t.Fail()
+	}
+}
+
+func TestStmtExecuteCursor(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name from test")...)
+	err := cp.ProcessCmd(mysqlCommand(0, prepare))
+	if err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+
+	// as sent by the MySQL client library: statement id, CURSOR_TYPE_READ_ONLY, iteration count 1
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00}
+	err = cp.ProcessCmd(mysqlCommand(0, execute))
+	if err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	if cp.cursorType != mysqlpackets.CURSOR_TYPE_READ_ONLY || cp.cursorStmt != 1 || cp.rows == nil {
+		t.Fatal("Expected a read-only cursor open on statement 1, instead got type", cp.cursorType, "statement", cp.cursorStmt)
+	}
+	// the column count and definitions, then the EOF, without the rows, in one response
+	code, packets := readResponse(t, reader)
+	if code != common.EORInCursorNotInTransaction || len(packets) != len(testColumns)+2 {
+		t.Fatal("Expected the column count, the definitions and the EOF, instead got", code, len(packets), "packets")
+	}
+	if packets[0].Cmd != len(testColumns) || packets[0].Sqid != 1 {
+		t.Log("Expected the column count, instead got", packets[0].Sqid, packets[0].Payload)
+		t.Fail()
+	}
+	for i := range testColumns {
+		def, err := mysqlpackets.ReadColumnDefinition(packets[1+i].Payload, cp.capabilities)
+		if err != nil || def.Name != testColumns[i] || packets[1+i].Sqid != 2+i {
+			t.Log("Expected the definition of", testColumns[i], "instead got", def, err)
+			t.Fail()
+		}
+	}
+	status := readEOFStatus(t, packets[len(packets)-1])
+	if status&mysqlpackets.SERVER_STATUS_CURSOR_EXISTS == 0 {
+		t.Log("Expected SERVER_STATUS_CURSOR_EXISTS, status", status)
+		t.Fail()
+	}
+
+	// fetch one row, then the rest
+	remaining := len(testRows)
+	for _, numRows := range []int{1, 10} {
+		fetch := []byte{byte(common.COM_STMT_FETCH), 0x01, 0x00, 0x00, 0x00, byte(numRows), 0x00, 0x00, 0x00}
+		err = cp.ProcessCmd(mysqlCommand(0, fetch))
+		if err != nil {
+			t.Fatal("fetch:", err.Error())
+		}
+		// the rows and the EOF in one response
+		code, packets = readResponse(t, reader)
+		rows := numRows
+		if rows > remaining {
+			rows = remaining
+		}
+		remaining -= rows
+		if len(packets) != rows+1 {
+			t.Fatal("Fetch of", numRows, "rows, expected", rows, "rows and the EOF, instead got", len(packets), "packets")
+		}
+		for i, packet := range packets[:rows] {
+			if packet.Cmd != 0x00 || packet.Sqid != 1+i {
+				t.Fatal("Expected a binary row, instead got", packet.Sqid, packet.Payload)
+			}
+		}
+		status = readEOFStatus(t, packets[rows])
+		lastRow := status&mysqlpackets.SERVER_STATUS_LAST_ROW_SENT != 0
+		if lastRow != (numRows == 10) {
+			t.Log("Fetch of", numRows, "rows, unexpected status", status)
+			t.Fail()
+		}
+	}
+	if code != common.EORFree || cp.rows != nil || cp.cursorStmt != 0 {
+		t.Log("Expected the cursor closed after the last row, EOR", code)
+		t.Fail()
+	}
+
+	// no cursor left
+	err = cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_STMT_FETCH), 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}))
+	if err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_STMT_HAS_NO_OPEN_CURSOR {
+		t.Log("Expected no open cursor error, instead got", packet.Payload)
+		t.Fail()
+	}
+}
+
+func TestStmtExecuteCursorParked(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	for i := 0; i < 2; i++ {
+		prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, "select id, name from test"...)
+		if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+			t.Fatal("prepare:", err.Error())
+		}
+		readPrepareOK(t, reader)
+	}
+
+	// open a cursor on statement 1 and fetch its first row
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00}
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	readResponse(t, reader)
+	fetch := []byte{byte(common.COM_STMT_FETCH), 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	if err := cp.ProcessCmd(mysqlCommand(0, fetch)); err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	if _, packets := readResponse(t, reader); len(packets) != 2 {
+		t.Fatal("Expected one row and the EOF, instead got", len(packets), "packets")
+	}
+
+	// statement 2 and a query run while the cursor is open, its rows are read and kept for the next fetches
+	execute[1] = 0x02
+	execute[5] = 0x00
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute 2:", err.Error())
+	}
+	code, packets := readResponse(t, reader)
+	if rows, _, _ := readResultset(t, packets, len(testColumns)); len(rows) != len(testRows) || code != common.EORInCursorNotInTransaction {
+		t.Fatal("Expected the rows of statement 2 with the cursor open, instead got", code, len(rows), "rows")
+	}
+	if cp.rows != nil || cp.cursorStmt != 0 || len(cp.cursors[1]) != len(testRows)-1 {
+		t.Fatal("Expected the rows left in the cursor parked, instead got", cp.cursorStmt, cp.cursors)
+	}
+	query := append([]byte{byte(common.COM_QUERY)}, "select id, name from test"...)
+	if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+		t.Fatal("query:", err.Error())
+	}
+	code, packets = readResponse(t, reader)
+	if rows, _, _ := readResultset(t, packets, len(testColumns)); len(rows) != len(testRows) || code != common.EORInCursorNotInTransaction {
+		t.Fatal("Expected the rows of the query with the cursor open, instead got", code, len(rows), "rows")
+	}
+
+	// the cursor goes on where it stopped
+	fetch[5] = 10
+	if err := cp.ProcessCmd(mysqlCommand(0, fetch)); err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	code, packets = readResponse(t, reader)
+	if len(packets) != len(testRows) || code != common.EORFree {
+		t.Fatal("Expected the last row and the EOF freeing the worker, instead got", code, len(packets), "packets")
+	}
+	pos := 1 + 1 // header and NULL bitmap
+	id := mysqlpackets.ReadFixedLenInt(packets[0].Payload, mysqlpackets.INT4, &pos)
+	if id != int(testRows[1][0].(int64)) {
+		t.Log("Expected the second row, instead got", packets[0].Payload)
+		t.Fail()
+	}
+	if status := readEOFStatus(t, packets[1]); status&mysqlpackets.SERVER_STATUS_LAST_ROW_SENT == 0 {
+		t.Log("Expected SERVER_STATUS_LAST_ROW_SENT, status", status)
+		t.Fail()
+	}
+	if len(cp.cursors) != 0 {
+		t.Log("Expected no cursor left, instead got", cp.cursors)
+		t.Fail()
+	}
+
+	// executing the statement again closes its parked cursor
+	execute[1] = 0x01
+	execute[5] = 0x01
+	for i := 0; i < 2; i++ {
+		if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+			t.Fatal("execute:", err.Error())
+		}
+		readResponse(t, reader)
+		if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+			t.Fatal("query:", err.Error())
+		}
+		readResponse(t, reader)
+	}
+	if len(cp.cursors) != 1 || len(cp.cursors[1]) != len(testRows) {
+		t.Log("Expected the cursor of the last execute parked, instead got", cp.cursors)
+		t.Fail()
+	}
+}
+
+func TestRecoverCursors(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00}
+	for stmtid := 1; stmtid <= 2; stmtid++ {
+		prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, "select id, name from test"...)
+		if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+			t.Fatal("prepare:", err.Error())
+		}
+		readPrepareOK(t, reader)
+		execute[1] = byte(stmtid)
+		if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+			t.Fatal("execute:", err.Error())
+		}
+		readResponse(t, reader)
+	}
+	if cp.cursorStmt != 2 || len(cp.cursors) != 1 {
+		t.Fatal("Expected the cursor of statement 1 parked and the one of statement 2 open, instead got", cp.cursorStmt, cp.cursors)
+	}
+
+	// the recovery of the worker closes the cursors of the client, the worker is free for the next one
+	if err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdRollback, nil)); err != nil {
+		t.Fatal("rollback:", err.Error())
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR || int(ns.Payload[0]-'0') != common.EORFree {
+		t.Fatal("Expected EORFree, instead got", ns, err)
+	}
+	if cp.rows != nil || cp.cursorStmt != 0 || len(cp.cursors) != 0 {
+		t.Fatal("Expected no cursor left, instead got", cp.cursorStmt, cp.cursors)
+	}
+	query := append([]byte{byte(common.COM_QUERY)}, "insert into test values (1, 'one')"...)
+	if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	if code, _ := readEOR(t, reader); code != common.EORFree {
+		t.Log("Expected EORFree after the recovery, instead got", code)
+		t.Fail()
+	}
+}
+
+// readResultset reads a binary result set of columns columns from the packets of a response, returning its rows,
+// the status ending it and the packets after it
+func readResultset(t *testing.T, packets []*encoding.Packet, columns int) ([]*encoding.Packet, int, []*encoding.Packet) {
+	if len(packets) < columns+2 || packets[0].Cmd != columns {
+		t.Fatal("Expected the column count", columns, "the definitions and the EOF, instead got", len(packets), "packets")
+	}
+	readEOFStatus(t, packets[1+columns])
+	packets = packets[2+columns:]
+	for i, packet := range packets {
+		if packet.Cmd == 0xfe {
+			return packets[:i], readEOFStatus(t, packet), packets[i+1:]
+		}
+	}
+	t.Fatal("Expected the EOF after the rows")
+	return nil, 0, nil
+}
+
+func TestStmtExecuteMultiResults(t *testing.T) {
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+
+	// a select has one result set, without more results
+	cp, reader := newTestCmdProcessor(t)
+	cp.capabilities |= uint32(mysqlpackets.CLIENT_MULTI_RESULTS)
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, "select id, name from test"...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packets := readResponse(t, reader)
+	rows, status, packets := readResultset(t, packets, len(testColumns))
+	if len(rows) != len(testRows) || status&mysqlpackets.SERVER_MORE_RESULTS_EXISTS != 0 || len(packets) != 0 || cp.rows != nil {
+		t.Log("Expected", len(testRows), "rows without more results, instead got", len(rows), "status", status, "then", len(packets), "packets")
+		t.Fail()
+	}
+
+	// the procedure returns two result sets, followed by the OK of the CALL
+	cp, reader = newTestCmdProcessor(t)
+	cp.capabilities |= uint32(mysqlpackets.CLIENT_MULTI_RESULTS)
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, testProcQuery...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readEOR(t, reader)
+	if cp.stmtCalls[1] != "test_proc" {
+		t.Fatal("Expected statement 1 calling test_proc, instead got", cp.stmtCalls)
+	}
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	// the result sets and the OK in one response
+	code, packets := readResponse(t, reader)
+	for _, columns := range []int{len(testColumns), len(testColumns) - 1} {
+		rows, status, packets = readResultset(t, packets, columns)
+		if len(rows) != len(testRows) || status&mysqlpackets.SERVER_MORE_RESULTS_EXISTS == 0 {
+			t.Log("Result set of", columns, "columns, expected", len(testRows), "rows with more results, instead got", len(rows), "status", status)
+			t.Fail()
+		}
+	}
+	if !bytes.Contains(rows[1].Payload, []byte("two")) || bytes.Contains(rows[1].Payload, []byte{2}) {
+		t.Log("Expected the name alone in the second result set, instead got", rows[1].Payload)
+		t.Fail()
+	}
+	if len(packets) != 1 {
+		t.Fatal("Expected the final OK, instead got", len(packets), "packets")
+	}
+	if code != common.EORFree || readOKStatus(t, packets[0])&mysqlpackets.SERVER_MORE_RESULTS_EXISTS != 0 {
+		t.Log("Expected the final OK without more results, instead got", code, packets[0].Payload)
+		t.Fail()
+	}
+	if cp.rows != nil {
+		t.Log("Result sets still open")
+		t.Fail()
+	}
+
+	// a client without CLIENT_MULTI_RESULTS can't read them
+	cp, reader = newTestCmdProcessor(t)
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, testProcQuery...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readEOR(t, reader)
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_SP_BADSELECT ||
+		string(packet.Payload[pos:pos+6]) != "#0A000" {
+		t.Log("Expected ER_SP_BADSELECT with the SQL state, instead got", packet.Payload)
+		t.Fail()
+	}
+	if cp.rows != nil {
+		t.Log("Result sets still open")
+		t.Fail()
+	}
+}
+
+func TestStmtEviction(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.maxStmts = 2
+	prepare := func(query string) {
+		if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, []byte(query)...))); err != nil {
+			t.Fatal("prepare:", err.Error())
+		}
+		readEOR(t, reader)
+	}
+	execute := func(stmtid byte) *encoding.Packet {
+		if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_STMT_EXECUTE), stmtid, 0, 0, 0, 0, 1, 0, 0, 0})); err != nil {
+			t.Fatal("execute:", err.Error())
+		}
+		_, packet := readEOR(t, reader)
+		return packet
+	}
+
+	prepare("update test set name = 'one'")
+	prepare("update test set name = 'two'")
+	// statement 1 is used, so statement 2 is the least recently used when statement 3 is prepared
+	if cp.useStmt(1) == nil {
+		t.Fatal("Expected statement 1")
+	}
+	prepare("update test set name = 'three'")
+	if len(cp.stmts) != 2 || len(cp.stmtParams) != 2 || cp.stmtLRU.Len() != 2 {
+		t.Fatal("Expected 2 statements kept, instead got", len(cp.stmts), len(cp.stmtParams), cp.stmtLRU.Len())
+	}
+	if _, ok := cp.stmts[2]; ok {
+		t.Fatal("Expected statement 2 evicted")
+	}
+
+	packet := execute(2)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_UNKNOWN_STMT_HANDLER {
+		t.Log("Expected unknown statement error executing statement 2, instead got", packet.Payload)
+		t.Fail()
+	}
+	for _, stmtid := range []int{1, 3} {
+		if _, ok := cp.stmts[stmtid]; !ok {
+			t.Log("Expected statement", stmtid, "kept")
+			t.Fail()
+		}
+	}
+}
+
+func TestStmtExecuteHasResult(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, "select id, name from test"...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, "insert into test values (3, 'three')"...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readEOR(t, reader)
+
+	// the select prepared before the insert still returns its rows
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packets := readResponse(t, reader)
+	rows, _, _ := readResultset(t, packets, len(testColumns))
+	if len(rows) != len(testRows) {
+		t.Log("Expected", len(testRows), "rows from statement 1, instead got", len(rows))
+		t.Fail()
+	}
+	execute[1] = 0x02
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	readOKStatus(t, packet)
+	if testExecQuery != "insert into test values (3, 'three')" {
+		t.Log("Expected the insert executed, instead got", testExecQuery)
+		t.Fail()
+	}
+}
+
+func TestSlowQuery(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	cp.slowQueryThreshold = testSlowDuration / 2
+	for _, stmt := range []string{testSlowQuery, "update test set name = 'fast'"} {
+		query := append([]byte{byte(common.COM_QUERY)}, []byte(stmt)...)
+		if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+			t.Fatal(stmt, "failed:", err.Error())
+		}
+		_, packet := readEOR(t, reader)
+		slow := readOKStatus(t, packet)&mysqlpackets.SERVER_QUERY_WAS_SLOW != 0
+		if slow != (stmt == testSlowQuery) {
+			t.Log("Unexpected SERVER_QUERY_WAS_SLOW", slow, "for", stmt)
+			t.Fail()
+		}
+	}
+}
+
+func TestSendExecResult(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	// the database commands get the OK packet of the statement they run
+	drop := append([]byte{byte(common.COM_DROP_DB)}, []byte("test")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, drop)); err != nil {
+		t.Fatal("drop db:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	ok, err := mysqlpackets.ReadOKPacket(packet.Payload, uint32(mysqlpackets.CLIENT_PROTOCOL_41))
+	if err != nil || ok.AffectedRows != 1 || packet.Sqid != 1 {
+		t.Fatal("Expected OK packet, instead got", packet.Payload, err)
+	}
+
+	for _, tc := range []struct {
+		err      error
+		code     int
+		sqlState string
+		msg      string
+	}{
+		{&mysql.MySQLError{Number: 1146, Message: "Table 'test.nope' doesn't exist"}, 1146, "42S02", "Table 'test.nope' doesn't exist"},
+		{errors.New("driver: bad connection"), common.ER_UNKNOWN_ERROR, "HY000", "driver: bad connection"},
+	} {
+		cp.sqid = 3
+		if err := cp.sendExecResult(nil, tc.err); err != nil {
+			t.Fatal("sendExecResult:", err.Error())
+		}
+		_, packet = readEOR(t, reader)
+		if packet.Sqid != 3 {
+			t.Fatal("Expected sequence id 3, instead got", packet.Sqid)
+		}
+		e, err := mysqlpackets.ReadERRPacket(packet.Payload, uint32(mysqlpackets.CLIENT_PROTOCOL_41))
+		if err != nil || *e != (mysqlpackets.ERRResponse{Code: tc.code, SQLState: tc.sqlState, Message: tc.msg}) {
+			t.Log("Expected", tc.code, tc.sqlState, tc.msg, "instead got", e, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestPrepareNumColumns(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	// the column types are only known from the execute, like MySQL does for a CALL the prepare
+	// response has no columns and the client takes them from the result set
+	for _, query := range []string{
+		"select id as i, name as n, id + 1 as next from test",
+		"select * from test",
+		"update test set name = 'x'",
+	} {
+		prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte(query)...)
+		if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+			t.Fatal("prepare:", err.Error())
+		}
+		packets := readPrepareOK(t, reader)
+		pos := 5
+		columns := mysqlpackets.ReadFixedLenInt(packets[0].Payload, mysqlpackets.INT2, &pos)
+		if columns != 0 || len(packets) != 1 {
+			t.Log("Expected no columns for", query, "instead got", columns, len(packets))
+			t.Fail()
+		}
+	}
+}
+
+func TestPrepareError(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, testBadQuery...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	code, packets := readResponse(t, reader)
+	if code != common.EORFree || len(packets) != 1 || packets[0].Cmd != 0xff {
+		t.Fatal("Expected a single ERR packet, instead got", code, len(packets), packets[0].Payload)
+	}
+	// the statement which failed doesn't take an id
+	if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, "select id, name from test"...))); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	pos := 1
+	if stmtid := mysqlpackets.ReadFixedLenInt(readPrepareOK(t, reader)[0].Payload, mysqlpackets.INT4, &pos); stmtid != 1 {
+		t.Log("Expected statement id 1, instead got", stmtid)
+		t.Fail()
+	}
+}
+
+func TestPrepareBindsOutsideLiterals(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	query := "update test set name = ':name' /* :old */ where id = :id -- :x"
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte(query)...)
+	if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	packet := readPrepareOK(t, reader)[0]
+	pos := 7
+	params := mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos)
+	if params != 1 || len(cp.bindPos) != 1 || cp.bindPos[0] != ":id" {
+		t.Log("Expected the only bind :id, instead got", params, cp.bindPos)
+		t.Fail()
+	}
+}
+
+func TestPrepareNumParams(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+	for _, tc := range []struct {
+		query    string
+		expected string
+		params   int
+	}{
+		{"select id, name from test where id = ?", "select id, name from test where id = ?", 1},
+		{"update test set name = '?' /* ? */ where id = ? -- ?", "update test set name = '?' /* ? */ where id = ? -- ?", 1},
+		// each bind name is a parameter, a name bound twice too
+		{"select id from test where name = :name or note = :name and id = ?",
+			"select id from test where name = ? or note = ? and id = ?", 3},
+		{"select id, name from test", "select id, name from test", 0},
+	} {
+		prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte(tc.query)...)
+		if query := cp.preprocess(mysqlCommand(0, prepare)); query != tc.expected {
+			t.Logf("Expected %q instead got %q", tc.expected, query)
+			t.Fail()
+		}
+		if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+			t.Fatal("prepare:", err.Error())
+		}
+		packets := readPrepareOK(t, reader)
+		pos := 7
+		params := mysqlpackets.ReadFixedLenInt(packets[0].Payload, mysqlpackets.INT2, &pos)
+		if params != tc.params || cp.stmtParams[cp.currsid-1] != tc.params {
+			t.Log("Expected", tc.params, "parameters for", tc.query, "instead got", params, cp.stmtParams[cp.currsid-1])
+			t.Fail()
+		}
+		// a definition of each parameter, then EOF
+		expected := 1
+		if tc.params > 0 {
+			expected = tc.params + 2
+		}
+		if len(packets) != expected {
+			t.Log("Expected", expected, "packets for", tc.query, "instead got", len(packets))
+			t.Fail()
+		}
+	}
+}
+
+func TestCancelSession(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("BEGIN")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+		t.Fatal("begin:", err.Error())
+	}
+	readEOR(t, reader)
+
+	// the query runs until the mux recovers the worker, which cancels the session
+	done := make(chan error, 1)
+	go func() {
+		query := append([]byte{byte(common.COM_QUERY)}, []byte(testBlockingQuery)...)
+		done <- cp.ProcessCmd(mysqlCommand(0, query))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cp.cancelSession()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("blocking query:", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The query was not canceled")
+	}
+	_, packet := readEOR(t, reader)
+	if len(packet.Payload) == 0 || packet.Payload[0] != 0xff {
+		t.Log("Expected an error for the canceled query, instead got", packet.Payload)
+		t.Fail()
+	}
+
+	// the recovery starts a new session, the transaction was already rolled back with the canceled one
+	cp.newSession()
+	if err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdRollback, nil)); err != nil {
+		t.Fatal("rollback:", err.Error())
+	}
+	ns, err := netstring.NewNetstring(reader)
+	if err != nil || ns.Cmd != common.CmdEOR || int(ns.Payload[0]-'0') != common.EORFree {
+		t.Log("Expected EORFree after the recovery rollback, instead got", ns, err)
+		t.Fail()
+	}
+	if cp.tx != nil {
+		t.Log("Transaction still open after the recovery rollback")
+		t.Fail()
+	}
+
+	query = append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)
+	if err = cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree || readOKStatus(t, packet)&mysqlpackets.SERVER_STATUS_IN_TRANS != 0 {
+		t.Log("Expected OK in the new session, instead got", code, packet.Payload)
+		t.Fail()
+	}
+}
+
+func TestCmdStats(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	commands := [][]byte{
+		append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...),
+		append([]byte{byte(common.COM_QUERY)}, []byte("  ")...),
+		append([]byte{byte(common.COM_INIT_DB)}, []byte("test")...),
+		{byte(common.COM_DEBUG)},
+		append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (2, 'two')")...),
+	}
+	var bytesIn, bytesOut uint64
+	for _, command := range commands {
+		ns := mysqlCommand(0, command)
+		bytesIn += uint64(len(ns.Serialized))
+		if err := cp.ProcessCmd(ns); err != nil {
+			t.Fatal("command", common.SQLcmds[int(command[0])], ":", err.Error())
+		}
+		_, packet := readEOR(t, reader)
+		bytesOut += uint64(len(packet.Serialized))
+	}
+
+	stats := cp.Stats()
+	expected := map[int]uint64{common.COM_QUERY: 3, common.COM_INIT_DB: 1, common.COM_DEBUG: 1}
+	if !reflect.DeepEqual(stats.Commands, expected) || stats.Total() != 5 {
+		t.Log("Expected commands", expected, "instead got", stats.Commands)
+		t.Fail()
+	}
+	// the empty query is answered with an ERR packet
+	if stats.Errors != 1 {
+		t.Log("Expected 1 error, instead got", stats.Errors)
+		t.Fail()
+	}
+	if stats.BytesIn != bytesIn || stats.BytesOut != bytesOut {
+		t.Log("Expected", bytesIn, "bytes in and", bytesOut, "bytes out, instead got", stats.BytesIn, stats.BytesOut)
+		t.Fail()
+	}
+	if stats.ExecTime <= 0 || stats.AvgLatency() != stats.ExecTime/5 {
+		t.Log("Unexpected exec time", stats.ExecTime, "average", stats.AvgLatency())
+		t.Fail()
+	}
+
+	// the netstring commands are not counted
+	if err := cp.ProcessCmd(netstring.NewNetstringFrom(common.CmdRollback, nil)); err != nil {
+		t.Fatal("rollback:", err.Error())
+	}
+	netstring.NewNetstring(reader)
+	if cp.Stats().Total() != 5 {
+		t.Log("Expected 5 commands after a netstring command, instead got", cp.Stats().Total())
+		t.Fail()
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("insert into test values (1, 'one')")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, query)); err != nil {
+		t.Fatal("insert:", err.Error())
+	}
+	readEOR(t, reader)
+
+	// the ignored sub-commands are acknowledged
+	refresh := []byte{byte(common.COM_REFRESH), byte(mysqlpackets.REFRESH_TABLES | mysqlpackets.REFRESH_LOG)}
+	if err := cp.ProcessCmd(mysqlCommand(0, refresh)); err != nil {
+		t.Fatal("refresh tables:", err.Error())
+	}
+	code, packet := readEOR(t, reader)
+	if code != common.EORFree || packet.Sqid != 1 {
+		t.Log("Expected EOR free, sequence id 1, instead got", code, packet.Sqid)
+		t.Fail()
+	}
+	readOKStatus(t, packet)
+	if cp.Stats().Total() != 2 {
+		t.Log("Expected 2 commands, instead got", cp.Stats().Commands)
+		t.Fail()
+	}
+
+	// REFRESH_STATUS resets the counters, only the refresh itself is counted
+	refresh = []byte{byte(common.COM_REFRESH), byte(mysqlpackets.REFRESH_STATUS)}
+	if err := cp.ProcessCmd(mysqlCommand(0, refresh)); err != nil {
+		t.Fatal("refresh status:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	readOKStatus(t, packet)
+	stats := cp.Stats()
+	if !reflect.DeepEqual(stats.Commands, map[int]uint64{common.COM_REFRESH: 1}) || stats.BytesOut != uint64(len(packet.Serialized)) {
+		t.Log("Expected the counters reset, instead got", stats)
+		t.Fail()
+	}
+
+	// the sub-command is mandatory
+	if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_REFRESH)})); err != nil {
+		t.Fatal("refresh without sub-command:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	if packet.Cmd != 0xff {
+		t.Log("Expected ERR packet, instead got", packet.Payload)
+		t.Fail()
+	}
+}
+
+func TestColumnDefinitionCache(t *testing.T) {
+	cp, reader := newTestCmdProcessor(t)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name from test")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+		t.Fatal("prepare:", err.Error())
+	}
+	readPrepareOK(t, reader)
+	if len(cp.colDefs) != 0 {
+		t.Fatal("Expected no column definitions before the execute, instead got", cp.colDefs)
+	}
+
+	// each execute opens a cursor, closed by fetching all the rows
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00}
+	fetch := []byte{byte(common.COM_STMT_FETCH), 0x01, 0x00, 0x00, 0x00, 100, 0x00, 0x00, 0x00}
+	var cached []byte
+	for i := 0; i < 2; i++ {
+		if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+			t.Fatal("execute:", err.Error())
+		}
+		_, packets := readResponse(t, reader)
+		if len(packets) != len(testColumns)+2 {
+			t.Fatal("Execute", i, "expected the column count, the definitions and the EOF, instead got", len(packets), "packets")
+		}
+		for j := range testColumns {
+			def, err := mysqlpackets.ReadColumnDefinition(packets[1+j].Payload, cp.capabilities)
+			if err != nil || def.Name != testColumns[j] {
+				t.Log("Execute", i, "expected the definition of", testColumns[j], "instead got", def, err)
+				t.Fail()
+			}
+		}
+		if len(cp.colDefs[1].payloads) != len(testColumns) {
+			t.Fatal("Execute", i, "expected the column definitions cached, instead got", cp.colDefs)
+		}
+		// the second execute reuses the definitions of the first one
+		if i == 1 && &cp.colDefs[1].payloads[0][0] != &cached[0] {
+			t.Log("Expected the cached column definitions reused")
+			t.Fail()
+		}
+		cached = cp.colDefs[1].payloads[0]
+		if err := cp.ProcessCmd(mysqlCommand(0, fetch)); err != nil {
+			t.Fatal("fetch:", err.Error())
+		}
+		readResponse(t, reader)
+	}
+
+	// a column of another type, as after an ALTER TABLE, is described again
+	testColTypes[1] = "TEXT"
+	defer func() { testColTypes[1] = "VARCHAR" }()
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	readResponse(t, reader)
+	if &cp.colDefs[1].payloads[0][0] == &cached[0] || cp.colDefs[1].types[1] != "TEXT" {
+		t.Log("Expected the column definitions built again for the new type, instead got", cp.colDefs[1].types)
+		t.Fail()
+	}
+	if err := cp.ProcessCmd(mysqlCommand(0, fetch)); err != nil {
+		t.Fatal("fetch:", err.Error())
+	}
+	readResponse(t, reader)
+
+	// COM_STMT_RESET forgets them
+	reset := []byte{byte(common.COM_STMT_RESET), 0x01, 0x00, 0x00, 0x00}
+	if err := cp.ProcessCmd(mysqlCommand(0, reset)); err != nil {
+		t.Fatal("reset:", err.Error())
+	}
+	_, packet := readEOR(t, reader)
+	readOKStatus(t, packet)
+	if _, ok := cp.colDefs[1]; ok || cp.stmts[1] == nil {
+		t.Log("Expected the column definitions forgotten and the statement kept after the reset")
+		t.Fail()
+	}
+	reset[1] = 0x02
+	if err := cp.ProcessCmd(mysqlCommand(0, reset)); err != nil {
+		t.Fatal("reset:", err.Error())
+	}
+	_, packet = readEOR(t, reader)
+	pos := 1
+	if packet.Cmd != 0xff || mysqlpackets.ReadFixedLenInt(packet.Payload, mysqlpackets.INT2, &pos) != common.ER_UNKNOWN_STMT_HANDLER {
+		t.Log("Expected unknown statement error resetting statement 2, instead got", packet.Payload)
+		t.Fail()
+	}
+
+	// and so does COM_STMT_CLOSE
+	if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+		t.Fatal("execute:", err.Error())
+	}
+	readResponse(t, reader)
+	if _, ok := cp.colDefs[1]; !ok {
+		t.Fatal("Expected the column definitions cached again")
+	}
+	if err := cp.ProcessCmd(mysqlCommand(0, []byte{byte(common.COM_STMT_CLOSE), 0x01, 0x00, 0x00, 0x00})); err != nil {
+		t.Fatal("close:", err.Error())
+	}
+	if len(cp.colDefs) != 0 {
+		t.Log("Expected no column definitions after the close, instead got", cp.colDefs)
+		t.Fail()
+	}
+}
+
+func TestColumnDefinitionOrgName(t *testing.T) {
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	cases := []struct {
+		query    string
+		orgNames []string
+	}{
+		// the driver names the columns id and name whatever their alias
+		{"select name as id, id as name from test", []string{"name", "id"}},
+		{"select id, concat(name, '!') from test", []string{"id", ""}},
+		{"select * from test", testColumns},
+	}
+	for _, c := range cases {
+		cp, reader := newTestCmdProcessor(t)
+		if err := cp.ProcessCmd(mysqlCommand(0, append([]byte{byte(common.COM_STMT_PREPARE)}, c.query...))); err != nil {
+			t.Fatal("prepare:", err.Error())
+		}
+		readPrepareOK(t, reader)
+		if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+			t.Fatal("execute:", err.Error())
+		}
+		_, packets := readResponse(t, reader)
+		readResultset(t, packets, len(testColumns))
+		for i := range testColumns {
+			def, err := mysqlpackets.ReadColumnDefinition(packets[1+i].Payload, cp.capabilities)
+			if err != nil || def.Name != testColumns[i] || def.OrgName != c.orgNames[i] {
+				t.Log(c.query, "expected column", testColumns[i], "with org_name", c.orgNames[i], "instead got", def, err)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// BenchmarkStmtExecuteCursor prepares a statement once, then executes it with a cursor and fetches its rows
+func BenchmarkStmtExecuteCursor(b *testing.B) {
+	cp, reader := newTestCmdProcessor(b)
+	go io.Copy(ioutil.Discard, reader)
+
+	prepare := append([]byte{byte(common.COM_STMT_PREPARE)}, []byte("select id, name from test")...)
+	if err := cp.ProcessCmd(mysqlCommand(0, prepare)); err != nil {
+		b.Fatal("prepare:", err.Error())
+	}
+	execute := []byte{byte(common.COM_STMT_EXECUTE), 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00}
+	fetch := []byte{byte(common.COM_STMT_FETCH), 0x01, 0x00, 0x00, 0x00, 100, 0x00, 0x00, 0x00}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := cp.ProcessCmd(mysqlCommand(0, execute)); err != nil {
+			b.Fatal("execute:", err.Error())
+		}
+		if err := cp.ProcessCmd(mysqlCommand(0, fetch)); err != nil {
+			b.Fatal("fetch:", err.Error())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/paypal/hera/utility/encoding"
+)
+
+// CmdStats are the counters of the MySQL commands processed by a worker since it started. Unlike the CAL
+// transactions, logged for every command, they give the aggregate command mix the worker handled.
+type CmdStats struct {
+	// the number of commands processed, by COM_* command
+	Commands map[int]uint64
+	// the number of commands answered with an ERR packet, or failing to send their response
+	Errors uint64
+	// the bytes of the MySQL packets received from and sent to the client, headers included
+	BytesIn  uint64
+	BytesOut uint64
+	// the total time spent processing the commands
+	ExecTime time.Duration
+}
+
+// Total returns the number of commands processed
+func (s CmdStats) Total() uint64 {
+	var total uint64
+	for _, n := range s.Commands {
+		total += n
+	}
+	return total
+}
+
+// AvgLatency returns the average time spent processing a command, 0 if no command was processed
+func (s CmdStats) AvgLatency() time.Duration {
+	total := s.Total()
+	if total == 0 {
+		return 0
+	}
+	return s.ExecTime / time.Duration(total)
+}
+
+// cmdCounters are updated by the worker while processing the commands. They are atomic so that Stats can
+// be called from another goroutine, like the one waiting for signals. It is allocated on its own to keep the
+// 64 bits counters aligned for the atomic operations.
+type cmdCounters struct {
+	commands [256]uint64
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+	execTime int64
+}
+
+// command counts the MySQL command ns, whose processing started at start and returned err
+func (c *cmdCounters) command(ns *encoding.Packet, start time.Time, err error) {
+	atomic.AddUint64(&c.commands[byte(ns.Cmd)], 1)
+	atomic.AddUint64(&c.bytesIn, uint64(len(ns.Serialized)))
+	atomic.AddInt64(&c.execTime, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&c.errors, 1)
+	}
+}
+
+// sent counts a packet of the response of size bytes, payload being an ERR packet counts the command as failed
+func (c *cmdCounters) sent(size int, payload []byte) {
+	atomic.AddUint64(&c.bytesOut, uint64(size))
+	if len(payload) > 0 && payload[0] == 0xff {
+		atomic.AddUint64(&c.errors, 1)
+	}
+}
+
+// reset zeroes the counters, for a COM_REFRESH with REFRESH_STATUS
+func (c *cmdCounters) reset() {
+	for cmd := range c.commands {
+		atomic.StoreUint64(&c.commands[cmd], 0)
+	}
+	atomic.StoreUint64(&c.errors, 0)
+	atomic.StoreUint64(&c.bytesIn, 0)
+	atomic.StoreUint64(&c.bytesOut, 0)
+	atomic.StoreInt64(&c.execTime, 0)
+}
+
+// Stats returns the counters of the MySQL commands processed so far
+func (cp *CmdProcessor) Stats() CmdStats {
+	c := cp.counters
+	stats := CmdStats{Commands: make(map[int]uint64), Errors: atomic.LoadUint64(&c.errors),
+		BytesIn: atomic.LoadUint64(&c.bytesIn), BytesOut: atomic.LoadUint64(&c.bytesOut),
+		ExecTime: time.Duration(atomic.LoadInt64(&c.execTime))}
+	for cmd := range c.commands {
+		if n := atomic.LoadUint64(&c.commands[cmd]); n > 0 {
+			stats.Commands[cmd] = n
+		}
+	}
+	return stats
+}
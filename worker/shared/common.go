@@ -18,12 +18,14 @@
 package shared
 
 import (
+	"fmt"
 	"github.com/paypal/hera/common"
 	"github.com/paypal/hera/utility/encoding"
 	"github.com/paypal/hera/utility/logger"
 	"io"
 )
 
+// WriteAll writes the packet to the mux, with its indicator byte, until all of it is sent
 func WriteAll(w io.Writer, ns *encoding.Packet) error {
 	if logger.GetLogger().V(logger.Verbose) {
 		if ns.Cmd == common.CmdEOR {
@@ -36,15 +38,48 @@ func WriteAll(w io.Writer, ns *encoding.Packet) error {
 	return writeAll(w, ns.Serialized)
 }
 
-// writeAll blocks until writing all the data
+// maxStalledWrites is the number of consecutive writes accepting no data after which writeAll gives up
+const maxStalledWrites = 100
+
+// PartialWriteError is returned by WriteAll when the writer fails after taking part of the data. The mux
+// is left with a truncated netstring, so the connection to it can't be used anymore.
+type PartialWriteError struct {
+	Written int
+	Total   int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("partial write of %d bytes out of %d: %s", e.Written, e.Total, e.Err.Error())
+}
+
+// writeAll blocks until writing all the data. A write can take only part of the data, with or without
+// io.ErrShortWrite, the rest is written again as long as the writer makes progress. If the writer fails
+// before taking any data the error is returned as is, after that it is a *PartialWriteError.
 func writeAll(w io.Writer, data []byte) error {
 	written := 0
+	stalled := 0
 	for written < len(data) {
 		n, err := w.Write(data[written:])
-		if err != nil {
-			return err
+		if n < 0 || n > len(data)-written {
+			err = fmt.Errorf("invalid write count %d", n)
+			n = 0
 		}
 		written += n
+		if n == 0 && err == nil {
+			stalled++
+			if stalled >= maxStalledWrites {
+				err = io.ErrShortWrite
+			}
+		} else {
+			stalled = 0
+		}
+		if err != nil && (err != io.ErrShortWrite || n == 0) {
+			if written == 0 {
+				return err
+			}
+			return &PartialWriteError{Written: written, Total: len(data), Err: err}
+		}
 	}
 	return nil
 }
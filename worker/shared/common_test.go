@@ -0,0 +1,95 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding/netstring"
+)
+
+// trickleWriter takes at most one byte per Write, reporting the short writes with io.ErrShortWrite if
+// shortWriteErr is set. It fails after taking failAfter bytes, if failAfter is positive.
+type trickleWriter struct {
+	bytes.Buffer
+	shortWriteErr bool
+	failAfter     int
+}
+
+var errTrickleFailed = errors.New("writer failed")
+
+func (w *trickleWriter) Write(p []byte) (int, error) {
+	if w.failAfter > 0 && w.Len() >= w.failAfter {
+		return 0, errTrickleFailed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.Buffer.Write(p[:1])
+	if len(p) > 1 && w.shortWriteErr {
+		return 1, io.ErrShortWrite
+	}
+	return 1, nil
+}
+
+// stalledWriter never takes any data, without an error
+type stalledWriter struct{}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestWriteAllPartialWrites(t *testing.T) {
+	ns := netstring.NewNetstringFrom(common.CmdEOR, bytes.Repeat([]byte("row"), 1000))
+	for _, shortWriteErr := range []bool{false, true} {
+		w := &trickleWriter{shortWriteErr: shortWriteErr}
+		if err := WriteAll(w, ns); err != nil {
+			t.Fatal("io.ErrShortWrite", shortWriteErr, "WriteAll:", err.Error())
+		}
+		if !bytes.Equal(w.Bytes(), ns.Serialized) {
+			t.Log("io.ErrShortWrite", shortWriteErr, "expected", len(ns.Serialized), "bytes written, instead got", w.Len())
+			t.Fail()
+		}
+	}
+
+	// a failure after the first bytes is reported with the number of bytes written
+	w := &trickleWriter{failAfter: 10}
+	err := WriteAll(w, ns)
+	pwerr, ok := err.(*PartialWriteError)
+	if !ok || pwerr.Written != 10 || pwerr.Total != len(ns.Serialized) || pwerr.Err != errTrickleFailed {
+		t.Log("Expected a partial write of 10 bytes, instead got", err)
+		t.Fail()
+	}
+
+	// a writer failing right away returns its error, the buffer is already at failAfter
+	w = &trickleWriter{failAfter: 1}
+	w.WriteByte(0)
+	if err = WriteAll(w, ns); err != errTrickleFailed {
+		t.Log("Expected the error of the writer, instead got", err)
+		t.Fail()
+	}
+
+	if err = WriteAll(stalledWriter{}, ns); err != io.ErrShortWrite {
+		t.Log("Expected io.ErrShortWrite from a stalled writer, instead got", err)
+		t.Fail()
+	}
+}
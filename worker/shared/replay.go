@@ -0,0 +1,87 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/paypal/hera/utility/encoding"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"github.com/paypal/hera/utility/encoding/netstring"
+	"github.com/paypal/hera/utility/logger"
+)
+
+// ReplayStream reads the packets in a stream captured between the mux and the worker, including the
+// indicator bytes, and runs each of them through ProcessCmd. It returns the responses the worker
+// sent back, in order. The packets are all MySQL packets if isMySQL is true, netstrings otherwise.
+// The responses are collected in a buffer, cp.SocketOut is restored before returning.
+func ReplayStream(cp *CmdProcessor, r io.Reader, isMySQL bool) ([]*encoding.Packet, error) {
+	var out bytes.Buffer
+	socketOut := cp.SocketOut
+	moreIncomingRequests := cp.moreIncomingRequests
+	cp.SocketOut = &out
+	cp.moreIncomingRequests = func() bool {
+		return false
+	}
+	defer func() {
+		cp.SocketOut = socketOut
+		cp.moreIncomingRequests = moreIncomingRequests
+	}()
+
+	var err error
+	reader := bufio.NewReader(r)
+	for {
+		var ns *encoding.Packet
+		if isMySQL {
+			ns, err = mysqlpackets.NewMySQLPacket(reader)
+		} else {
+			ns, err = netstring.NewNetstring(reader)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if logger.GetLogger().V(logger.Verbose) {
+			logger.GetLogger().Log(logger.Verbose, "replay: worker read <<<", DebugString(ns.Serialized), ns.IsMySQL)
+		}
+		cp.rqId++
+		err = cp.ProcessCmd(ns)
+		if err != nil {
+			break
+		}
+	}
+
+	// split the responses written in the buffer
+	var responses []*encoding.Packet
+	outReader := bufio.NewReader(&out)
+	for {
+		ns, rerr := netstring.NewNetstring(outReader)
+		if rerr != nil {
+			if rerr != io.EOF && logger.GetLogger().V(logger.Warning) {
+				logger.GetLogger().Log(logger.Warning, "replay: error reading response", rerr.Error())
+			}
+			break
+		}
+		responses = append(responses, ns)
+	}
+	return responses, err
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+)
+
+// a session recorded between the mux and the worker, after the handshake: a begin, an insert,
+// a rollback, a commit and an empty query. Each packet is the indicator byte followed by the MySQL packet
+var recordedSession = []byte("" +
+	"\x00\x06\x00\x00\x00\x03BEGIN" +
+	"\x00\x23\x00\x00\x00\x03insert into test values (1, 'one')" +
+	"\x00\x0a\x00\x00\x00\x03ROLLBACK;" +
+	"\x00\x07\x00\x00\x00\x03COMMIT" +
+	"\x00\x01\x00\x00\x00\x03")
+
+func TestReplayStream(t *testing.T) {
+	cp, _ := newTestCmdProcessor(t)
+	socketOut := cp.SocketOut
+
+	responses, err := ReplayStream(cp, bytes.NewReader(recordedSession), true)
+	if err != nil {
+		t.Fatal("replay:", err.Error())
+	}
+	if cp.SocketOut != socketOut {
+		t.Log("SocketOut not restored after replay")
+		t.Fail()
+	}
+
+	expected := []struct {
+		code   int
+		header byte
+		status int
+	}{
+		{common.EORInTransaction, 0x00, mysqlpackets.SERVER_STATUS_IN_TRANS},
+		{common.EORInTransaction, 0x00, mysqlpackets.SERVER_STATUS_IN_TRANS},
+		{common.EORFree, 0x00, mysqlpackets.SERVER_STATUS_AUTOCOMMIT},
+		{common.EORFree, 0x00, mysqlpackets.SERVER_STATUS_AUTOCOMMIT},
+		{common.EORFree, 0xff, 0},
+	}
+	if len(responses) != len(expected) {
+		t.Fatal("Expected", len(expected), "responses, instead got", len(responses))
+	}
+	for i, ns := range responses {
+		if ns.Cmd != common.CmdEOR {
+			t.Fatal("Expected EOR, instead got", ns.Cmd)
+		}
+		code := int(ns.Payload[0] - '0')
+		if code != expected[i].code {
+			t.Log("response", i, "expected EOR code", expected[i].code, "instead got", code)
+			t.Fail()
+		}
+		rqId := (int(ns.Payload[1]) << 8) + int(ns.Payload[2])
+		if rqId != i+1 {
+			t.Log("response", i, "expected rqId", i+1, "instead got", rqId)
+			t.Fail()
+		}
+		packet, err := mysqlpackets.NewMySQLPacket(bytes.NewReader(ns.Payload[3:]))
+		if err != nil {
+			t.Fatal("response", i, "reading embedded packet:", err.Error())
+		}
+		if byte(packet.Cmd) != expected[i].header {
+			t.Log("response", i, "expected header", expected[i].header, "instead got", packet.Payload)
+			t.Fail()
+			continue
+		}
+		if expected[i].header == 0x00 && readOKStatus(t, packet) != expected[i].status {
+			t.Log("response", i, "expected status", expected[i].status, "instead got", readOKStatus(t, packet))
+			t.Fail()
+		}
+		if expected[i].header == 0xff && !strings.Contains(string(packet.Payload), "Query was empty") {
+			t.Log("response", i, "unexpected error", string(packet.Payload))
+			t.Fail()
+		}
+	}
+}
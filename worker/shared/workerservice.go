@@ -18,6 +18,8 @@
 package shared
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/paypal/hera/utility/encoding"
 	"github.com/paypal/hera/utility/encoding/mysqlpackets"
@@ -112,6 +114,16 @@ func Start(adapter CmdProcessorAdapter) {
 	sockMux := os.NewFile(uintptr(3), fmt.Sprintf("worker_sp%d", 0))
 
 	cmdprocessor := NewCmdProcessor(adapter, sockMux)
+	cmdprocessor.implicitTrans = cfg.GetOrDefaultBool("implicit_transaction", true)
+	cmdprocessor.implicitTransMySQL = cfg.GetOrDefaultBool("mysql_implicit_transaction", false)
+	cmdprocessor.maxColumns = cfg.GetOrDefaultInt("max_result_columns", DefaultMaxColumns)
+	cmdprocessor.maxSQLLength = cfg.GetOrDefaultInt("max_prepared_sql_length", DefaultMaxSQLLength)
+	cmdprocessor.countWarnings = cfg.GetOrDefaultBool("mysql_warning_count", false)
+	cmdprocessor.slowQueryThreshold = time.Duration(cfg.GetOrDefaultInt("mysql_slow_query_ms", 0)) * time.Millisecond
+	cmdprocessor.maxStmts = cfg.GetOrDefaultInt("mysql_max_prepared_statements", DefaultMaxStmts)
+	if cfg.GetOrDefaultBool("enable_sharding", false) && cfg.GetOrDefaultBool("use_shardmap", true) {
+		cmdprocessor.numShards = cfg.GetOrDefaultInt("num_shards", 1)
+	}
 
 	err = cmdprocessor.InitDB()
 	if err != nil {
@@ -144,7 +156,7 @@ func runworker(sockMux *os.File, cmdprocessor *CmdProcessor, cfg *workerConfig)
 	cmdprocessor.moreIncomingRequests = func() bool {
 		return (len(nschannel) > 0)
 	}
-	sigchannel := waitForSignal()
+	sigchannel := waitForSignal(cmdprocessor)
 
 outerloop:
 	for {
@@ -233,7 +245,7 @@ outerloop:
 
 /**
  * reading the next command from socketpair and sending it to commandchannel.
- * block on read. exit only when readnext returns an error.
+ * block on read. exit only when readnext returns an error, after sending nil and closing the channel.
  */
 func readNextNetstring(sockMux *os.File) <-chan *encoding.Packet {
 	//
@@ -243,38 +255,44 @@ func readNextNetstring(sockMux *os.File) <-chan *encoding.Packet {
 
 	logger.GetLogger().Log(logger.Info, "Will pick between mysqlpackets and netstring packager.")
 
-	nsreader := netstring.NewNetstringReader(sockMux)
-	mspreader := mysqlpackets.NewPackager(sockMux, nil)
+	// both readers share the buffer, the stream can switch between the protocols: the control messages of
+	// the proxy are netstrings even in a MySQL session
+	buffered := bufio.NewReader(sockMux)
+	nsreader := netstring.NewNetstringReader(buffered)
+	mspreader := mysqlpackets.NewPackager(buffered, nil)
 	var reader encoding.Reader
 
 	reader = mspreader
 
 	logger.GetLogger().Log(logger.Info, "Using mysql packager reader/writer")
 	go func() {
+		defer close(commandch)
 		for {
 			// Assuming that we're starting out with netstring.
 			ns, err := reader.ReadNext()
 
 			// If it's the wrong packet, then
-			if err != nil && err == encoding.WRONGPACKET {
-				logger.GetLogger().Log(logger.Info, "Using netstring packager reader/writer")
-				reader = nsreader
+			if errors.Is(err, encoding.WRONGPACKET) {
+				if reader == encoding.Reader(mspreader) {
+					logger.GetLogger().Log(logger.Info, "Using netstring packager reader/writer")
+					reader = nsreader
+				} else {
+					logger.GetLogger().Log(logger.Info, "Using mysql packager reader/writer")
+					reader = mspreader
+				}
 				ns, err = reader.ReadNext()
-
-				logger.GetLogger().Log(logger.Info, "Finished using mysql packager reader/writer")
 			}
 
 			if err != nil {
 				if logger.GetLogger().V(logger.Warning) {
 					logger.GetLogger().Log(logger.Warning, sockMux.Name(), ":worker readerr", err.Error())
-					logger.GetLogger().Log(logger.Info, "Serialized: ", ns.Serialized)
 				}
+				// the stream can't be resynchronized after a read error
 				commandch <- nil
-			} else {
-				commandch <- ns
+				return
 			}
+			commandch <- ns
 		}
-		//close(commandch)
 	}()
 
 	return commandch
@@ -282,8 +300,9 @@ func readNextNetstring(sockMux *os.File) <-chan *encoding.Packet {
 
 // waitForSignal runs in its goroutine waiting for signals. When a signal is received, a message is sent to the
 // channel where the main processor listen. There are two signals used: SIGHUP - used when the mux asks the worker to interrups to current work
-// and SIGTERM - used when the workewr is asked to exit
-func waitForSignal() <-chan int {
+// and SIGTERM - used when the workewr is asked to exit. On SIGHUP the session of cmdprocessor is canceled right
+// away, so that a query still running is aborted instead of holding the DB connection until it completes.
+func waitForSignal(cmdprocessor *CmdProcessor) <-chan int {
 	recoverch := make(chan int)
 
 	schannel := make(chan os.Signal, 1)
@@ -295,6 +314,7 @@ func waitForSignal() <-chan int {
 			case signal := <-sigchannel:
 				switch signal {
 				case syscall.SIGHUP:
+					cmdprocessor.cancelSession()
 					recoverch <- signalRecover
 				case syscall.SIGTERM:
 					recoverch <- signalExit
@@ -307,9 +327,10 @@ func waitForSignal() <-chan int {
 	return recoverch
 }
 
-// recoverworker drains the mux channel and rollbacks the current transaction
+// recoverworker drains the mux channel, starts a new session and rollbacks the current transaction
 func recoverworker(cmdprocessor *CmdProcessor, nschannel <-chan *encoding.Packet) error {
 	drainIncomingChannel(cmdprocessor, nschannel)
+	cmdprocessor.newSession()
 	err := cmdprocessor.ProcessCmd(netstring.NewNetstringFrom(common.CmdRollback, []byte("")))
 	// TODO: MySQL rollback. Needs to be implemented separately because ROLLBACK is sent through COM_QUERY
 	//  and not a special rollback opcode
@@ -324,7 +345,7 @@ func drainIncomingChannel(cmdprocessor *CmdProcessor, nschannel <-chan *encoding
 		}
 		select {
 		case ns, ok := <-nschannel:
-			if !ok {
+			if !ok || ns == nil {
 				if logger.GetLogger().V(logger.Debug) {
 					logger.GetLogger().Log(logger.Debug, "draining: nschannel closed")
 				}
@@ -0,0 +1,73 @@
+// Copyright 2019 PayPal Inc.
+//
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/paypal/hera/common"
+	"github.com/paypal/hera/utility/encoding/mysqlpackets"
+	"github.com/paypal/hera/utility/encoding/netstring"
+)
+
+func TestReadNextNetstringSwitch(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("os.Pipe:", err.Error())
+	}
+
+	// a MySQL session, in which the proxy sends a control message
+	query := append([]byte{byte(common.COM_QUERY)}, []byte("select 1")...)
+	control := netstring.NewNetstringFrom(common.CmdControlMsg, []byte(common.ControlMsgCapabilities+"512"))
+	stream := append([]byte{}, mysqlpackets.NewMySQLPacketFrom(0, query).Serialized...)
+	stream = append(stream, control.Serialized...)
+	stream = append(stream, mysqlpackets.NewMySQLPacketFrom(0, query).Serialized...)
+	w.Write(stream)
+
+	ch := readNextNetstring(r)
+	for i, mysql := range []bool{true, false, true} {
+		select {
+		case ns := <-ch:
+			if ns == nil || ns.IsMySQL != mysql {
+				t.Fatal("Message", i, "expected MySQL", mysql, "instead got", ns)
+			}
+			if !mysql && string(ns.Payload) != common.ControlMsgCapabilities+"512" {
+				t.Log("Unexpected control message", string(ns.Payload))
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout reading message", i)
+		}
+	}
+
+	// the reader stops at the end of the stream, sending nil before closing the channel
+	w.Close()
+	for i, expected := range []bool{true, false} {
+		select {
+		case ns, ok := <-ch:
+			if ns != nil || ok != expected {
+				t.Fatal("After the end of the stream", i, "expected nil, open", expected, "instead got", ns, ok)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for the reader to exit")
+		}
+	}
+	r.Close()
+}